@@ -3,8 +3,6 @@ package oidfed
 import (
 	"crypto"
 	"encoding/json"
-	"io"
-	"net/http"
 	"net/url"
 	"time"
 
@@ -12,9 +10,15 @@ import (
 	"github.com/lestrrat-go/jwx/v3/jwa"
 	"github.com/pkg/errors"
 
+	"github.com/go-oidfed/lib/internal"
 	"github.com/go-oidfed/lib/internal/jwx"
+	"github.com/go-oidfed/lib/jwks"
 )
 
+// clientAssertionTypeJWTBearer is the client_assertion_type used for
+// private_key_jwt client authentication
+const clientAssertionTypeJWTBearer = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
 // OIDCErrorResponse is the error response of an oidc provider
 type OIDCErrorResponse struct {
 	Error            string `json:"error"`
@@ -30,6 +34,9 @@ type OIDCTokenResponse struct {
 	Scopes       string `json:"scope"`
 	IDToken      string `json:"id_token"`
 
+	// IDTokenClaims holds the claims of the verified IDToken
+	IDTokenClaims *IDTokenClaims `json:"-"`
+
 	Extra map[string]any `json:"-"`
 }
 
@@ -97,6 +104,27 @@ func (rop RequestObjectProducer) RequestObject(requestValues map[string]any) ([]
 	return jwx.SignPayload(j, rop.alg, rop.key, nil)
 }
 
+// EncryptedRequestObject generates a signed request object jwt from the
+// passed requestValues and encrypts it to one of the passed (OP) keys,
+// resulting in a nested jwt
+func (rop RequestObjectProducer) EncryptedRequestObject(
+	requestValues map[string]any, encryptionKeys jwks.JWKS,
+	alg jwa.KeyEncryptionAlgorithm, enc jwa.ContentEncryptionAlgorithm,
+) ([]byte, error) {
+	signed, err := rop.RequestObject(requestValues)
+	if err != nil {
+		return nil, err
+	}
+	return jwx.EncryptJWT(signed, encryptionKeys, alg, enc)
+}
+
+// clientAssertionAudience returns the audience of client assertions sent to
+// the passed OP; the OP's issuer identifier is used for all endpoints, so PAR
+// and token requests are authenticated in the same way
+func clientAssertionAudience(op *OpenIDProviderMetadata) string {
+	return op.Issuer
+}
+
 // ClientAssertion creates a new signed client assertion jwt for the passed audience
 func (rop RequestObjectProducer) ClientAssertion(aud string) ([]byte, error) {
 	now := time.Now().Unix()
@@ -121,11 +149,18 @@ func (rop RequestObjectProducer) ClientAssertion(aud string) ([]byte, error) {
 	return jwx.SignPayload(j, rop.alg, rop.key, nil)
 }
 
-// GetAuthorizationURL creates an authorization url
+// GetAuthorizationURL creates an authorization url. If the OP has a
+// pushed_authorization_request_endpoint, the request object is pushed to it
+// and the url references it through the request_uri parameter; otherwise
+// the request object is included in the url.
+// If FederationLeaf.IncludeTrustChain is set, the leaf's trust chain to a
+// trust anchor of the OP is included in the request object.
+// If the FederationLeaf explicitly registered at the OP, the client id and
+// metadata of this registration are used.
 func (f FederationLeaf) GetAuthorizationURL(
 	issuer, redirectURI, state, scope string, additionalParams url.Values,
 ) (string, error) {
-	opMetadata, err := f.ResolveOPMetadata(issuer)
+	opMetadata, federationKeys, err := f.resolveOP(issuer)
 	if err != nil {
 		return "", err
 	}
@@ -142,8 +177,17 @@ func (f FederationLeaf) GetAuthorizationURL(
 	requestParams["state"] = state
 	requestParams["response_type"] = "code"
 	requestParams["scope"] = scope
+	if f.IncludeTrustChain {
+		trustChain, err := f.TrustChainForOP(issuer)
+		if err != nil {
+			internal.Logf("not including trust chain in request object: %s", err.Error())
+		} else {
+			requestParams["trust_chain"] = trustChain
+		}
+	}
 
-	requestObject, err := f.oidcROProducer.RequestObject(requestParams)
+	client := f.oidcClient(opMetadata.Issuer)
+	requestObject, err := f.requestObject(opMetadata, federationKeys, client, requestParams)
 	if err != nil {
 		return "", errors.Wrap(err, "could not create request object")
 	}
@@ -151,22 +195,49 @@ func (f FederationLeaf) GetAuthorizationURL(
 	if err != nil {
 		return "", errors.WithStack(err)
 	}
+	// The authorization request parameters that are required by OAuth 2.0
+	// and OpenID Connect are always also passed in the front channel
 	q := url.Values{}
-	q.Set("request", string(requestObject))
-	q.Set("client_id", f.EntityID)
+	q.Set("client_id", client.ID)
 	q.Set("response_type", "code")
 	q.Set("redirect_uri", redirectURI)
 	q.Set("scope", scope)
+	if opMetadata.PushedAuthorizationRequestEndpoint != "" {
+		requestURI, err := f.pushAuthorizationRequest(opMetadata, client, requestObject)
+		if err != nil {
+			return "", err
+		}
+		q.Set("request_uri", requestURI)
+	} else {
+		if opMetadata.RequirePushedAuthorizationRequests {
+			return "", errors.New(
+				"op requires pushed authorization requests, but has no pushed_authorization_request_endpoint",
+			)
+		}
+		q.Set("request", string(requestObject))
+	}
 	u.RawQuery = q.Encode()
 	return u.String(), nil
 }
 
-// CodeExchange performs an oidc code exchange it creates the mytoken and stores it in the database
+// CodeExchange performs an oidc code exchange. If the token response contains
+// an id token, it is verified and its claims are set in
+// OIDCTokenResponse.IDTokenClaims; the nonce is not checked, use
+// CodeExchangeWithNonce for this.
 func (f FederationLeaf) CodeExchange(
 	issuer, code, redirectURI string,
 	additionalParameter url.Values,
 ) (*OIDCTokenResponse, *OIDCErrorResponse, error) {
-	opMetadata, err := f.ResolveOPMetadata(issuer)
+	return f.CodeExchangeWithNonce(issuer, code, redirectURI, "", additionalParameter)
+}
+
+// CodeExchangeWithNonce performs an oidc code exchange like CodeExchange, but
+// also checks that the id token contains the passed nonce
+func (f FederationLeaf) CodeExchangeWithNonce(
+	issuer, code, redirectURI, nonce string,
+	additionalParameter url.Values,
+) (*OIDCTokenResponse, *OIDCErrorResponse, error) {
+	opMetadata, federationKeys, err := f.resolveOP(issuer)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -177,34 +248,5 @@ func (f FederationLeaf) CodeExchange(
 	params.Set("grant_type", "authorization_code")
 	params.Set("code", code)
 	params.Set("redirect_uri", redirectURI)
-	params.Set("client_id", f.EntityID)
-
-	clientAssertion, err := f.oidcROProducer.ClientAssertion(opMetadata.TokenEndpoint)
-	if err != nil {
-		return nil, nil, err
-	}
-	params.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
-	params.Set("client_assertion", string(clientAssertion))
-
-	res, err := http.PostForm(opMetadata.TokenEndpoint, params)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	body, err := io.ReadAll(res.Body)
-	if err != nil {
-		return nil, nil, err
-	}
-	var errRes OIDCErrorResponse
-	var tokenRes OIDCTokenResponse
-	if err = json.Unmarshal(body, &errRes); err != nil {
-		return nil, nil, err
-	}
-	if errRes.Error != "" {
-		return nil, &errRes, nil
-	}
-	if err = json.Unmarshal(body, &tokenRes); err != nil {
-		return nil, nil, err
-	}
-	return &tokenRes, nil, nil
+	return f.tokenRequest(opMetadata, federationKeys, params, nonce)
 }
@@ -1,10 +1,18 @@
 package oidfed
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
 	"encoding/json"
 	"testing"
 
+	"github.com/lestrrat-go/jwx/v3/jwa"
+	"github.com/lestrrat-go/jwx/v3/jwk"
+
 	"github.com/go-oidfed/lib/internal/jwx"
+	"github.com/go-oidfed/lib/jwks"
 )
 
 func TestRequestObjectProducer_RequestObject(t *testing.T) {
@@ -139,3 +147,171 @@ func TestRequestObjectProducer_ClientAssertion(t *testing.T) {
 		)
 	}
 }
+
+func encryptionKeys(t *testing.T) (private, public jwks.JWKS) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	private = jwks.NewJWKS()
+	public = jwks.NewJWKS()
+	for _, k := range []any{rsaKey, ecKey} {
+		sk, err := jwk.Import(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = jwk.AssignKeyID(sk); err != nil {
+			t.Fatal(err)
+		}
+		if err = sk.Set(jwk.KeyUsageKey, jwk.ForEncryption); err != nil {
+			t.Fatal(err)
+		}
+		pk, err := sk.PublicKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = private.AddKey(sk); err != nil {
+			t.Fatal(err)
+		}
+		if err = public.AddKey(pk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return
+}
+
+func TestRequestObjectProducer_EncryptedRequestObject(t *testing.T) {
+	signer := rp1.GeneralJWTSigner
+	rop := NewRequestObjectProducer(rp1.EntityID, signer.key, signer.alg, 60)
+	private, public := encryptionKeys(t)
+	tests := []struct {
+		name string
+		alg  jwa.KeyEncryptionAlgorithm
+		enc  jwa.ContentEncryptionAlgorithm
+	}{
+		{
+			name: "RSA-OAEP-256",
+			alg:  jwa.RSA_OAEP_256(),
+			enc:  jwa.A128CBC_HS256(),
+		},
+		{
+			name: "ECDH-ES+A256KW",
+			alg:  jwa.ECDH_ES_A256KW(),
+			enc:  jwa.A256GCM(),
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				ro, err := rop.EncryptedRequestObject(
+					map[string]any{"aud": "https://op.example.com"}, public, test.alg, test.enc,
+				)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !jwx.IsJWE(ro) {
+					t.Fatal("request object is not encrypted")
+				}
+				if _, err = jwx.Decrypt(ro, private, jwa.RSA1_5()); err == nil {
+					t.Error("expected error for not allowed key encryption algorithm")
+				}
+				decrypted, err := jwx.Decrypt(ro, private, test.alg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				m, err := jwx.Parse(decrypted)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err = m.VerifyWithSet(rp1.jwks); err != nil {
+					t.Error(err)
+				}
+			},
+		)
+	}
+}
+
+func TestFederationLeaf_DecryptIDToken(t *testing.T) {
+	private, public := encryptionKeys(t)
+	idToken := []byte(
+		"eyJhbGciOiJub25lIn0.eyJpc3MiOiJodHRwczovL29wLmV4YW1wbGUuY29tIn0.",
+	)
+	encrypted, err := jwx.EncryptJWT(idToken, public, jwa.RSA_OAEP(), jwa.A128CBC_HS256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherPublic := encryptionKeys(t)
+	encryptedOther, err := jwx.EncryptJWT(idToken, otherPublic, jwa.RSA_OAEP(), jwa.A128CBC_HS256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := func(alg string) FederationLeaf {
+		return FederationLeaf{
+			FederationEntity: FederationEntity{
+				Metadata: &Metadata{
+					RelyingParty: &OpenIDRelyingPartyMetadata{IDTokenEncryptedResponseAlg: alg},
+				},
+			},
+			OIDCDecryptionKeys: private,
+		}
+	}
+	tests := []struct {
+		name      string
+		leaf      FederationLeaf
+		token     []byte
+		expectErr bool
+	}{
+		{
+			name:  "plain, no encryption registered",
+			leaf:  leaf(""),
+			token: idToken,
+		},
+		{
+			name:      "plain, encryption registered",
+			leaf:      leaf("RSA-OAEP"),
+			token:     idToken,
+			expectErr: true,
+		},
+		{
+			name:  "encrypted",
+			leaf:  leaf("RSA-OAEP"),
+			token: encrypted,
+		},
+		{
+			name:      "encrypted with other alg than registered",
+			leaf:      leaf("ECDH-ES"),
+			token:     encrypted,
+			expectErr: true,
+		},
+		{
+			name:      "encrypted to other key",
+			leaf:      leaf("RSA-OAEP"),
+			token:     encryptedOther,
+			expectErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				decrypted, err := test.leaf.DecryptIDToken(test.token)
+				if err != nil {
+					if !test.expectErr {
+						t.Error(err)
+					}
+					return
+				}
+				if test.expectErr {
+					t.Error("expected error, but decryption succeeded")
+					return
+				}
+				if string(decrypted) != string(idToken) {
+					t.Errorf("decrypted id token '%s' does not match '%s'", decrypted, idToken)
+				}
+			},
+		)
+	}
+}
@@ -0,0 +1,203 @@
+package oidfed
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/go-oidfed/lib/cache"
+	"github.com/go-oidfed/lib/unixtime"
+)
+
+// AuthFlowStateLifetime is the time an AuthFlowState is kept, i.e. the time a
+// user has to complete an authorization request started with
+// FederationLeaf.StartAuthFlow
+var AuthFlowStateLifetime = 10 * time.Minute
+
+// codeChallengeMethodS256 is the PKCE code challenge method used
+const codeChallengeMethodS256 = "S256"
+
+// AuthFlowState holds the values of an authorization request that are needed
+// to validate the authorization response and to exchange the code
+type AuthFlowState struct {
+	State        string            `json:"state" msgpack:"state"`
+	Nonce        string            `json:"nonce" msgpack:"nonce"`
+	CodeVerifier string            `json:"code_verifier" msgpack:"code_verifier"`
+	Issuer       string            `json:"issuer" msgpack:"issuer"`
+	RedirectURI  string            `json:"redirect_uri" msgpack:"redirect_uri"`
+	Scope        string            `json:"scope" msgpack:"scope"`
+	ExpiresAt    unixtime.Unixtime `json:"exp" msgpack:"exp"`
+}
+
+// AuthFlowStateStore stores AuthFlowState between the authorization request
+// and the code exchange
+type AuthFlowStateStore interface {
+	// StoreAuthFlowState stores the passed AuthFlowState until it expires
+	StoreAuthFlowState(state AuthFlowState) error
+	// PopAuthFlowState returns the AuthFlowState for the passed state and
+	// removes it, so it cannot be used again; if no valid AuthFlowState
+	// exists, nil is returned
+	PopAuthFlowState(state string) (*AuthFlowState, error)
+}
+
+// CacheAuthFlowStateStore is an AuthFlowStateStore that uses the cache
+type CacheAuthFlowStateStore struct{}
+
+// cachedAuthFlowState wraps an AuthFlowState in the cache; a nil State marks
+// an already used state
+type cachedAuthFlowState struct {
+	State *AuthFlowState `msgpack:"state"`
+}
+
+// StoreAuthFlowState implements the AuthFlowStateStore interface
+func (CacheAuthFlowStateStore) StoreAuthFlowState(state AuthFlowState) error {
+	return cache.Set(
+		cache.Key(cache.KeyAuthFlowState, state.State), cachedAuthFlowState{State: &state},
+		unixtime.Until(state.ExpiresAt),
+	)
+}
+
+// PopAuthFlowState implements the AuthFlowStateStore interface; the pop is
+// atomic if the used cache implements the cache.AtomicCache interface,
+// otherwise only within the process
+func (CacheAuthFlowStateStore) PopAuthFlowState(state string) (*AuthFlowState, error) {
+	key := cache.Key(cache.KeyAuthFlowState, state)
+	var cached cachedAuthFlowState
+	set, err := cache.Get(key, &cached)
+	if err != nil || !set || cached.State == nil {
+		return nil, err
+	}
+	ttl := unixtime.Until(cached.State.ExpiresAt)
+	if ttl <= 0 {
+		return nil, nil
+	}
+	// Claiming the state with a set-if-absent makes the pop atomic, so
+	// concurrent callbacks cannot both consume the same state
+	claimed, err := cache.SetIfAbsent(cache.Key(cache.KeyAuthFlowStateUsed, state), true, ttl)
+	if err != nil || !claimed {
+		return nil, err
+	}
+	if err = cache.Set(key, cachedAuthFlowState{}, ttl); err != nil {
+		return nil, err
+	}
+	return cached.State, nil
+}
+
+func (f FederationLeaf) authFlowStateStore() AuthFlowStateStore {
+	if f.AuthFlowStateStore != nil {
+		return f.AuthFlowStateStore
+	}
+	return CacheAuthFlowStateStore{}
+}
+
+// StartAuthFlow starts an authorization code flow at the OP with the passed
+// issuer. It generates a state, a nonce, and a PKCE code verifier, stores them
+// in the FederationLeaf's AuthFlowStateStore, and returns the authorization
+// url and the state. The authorization response must be passed to
+// CompleteAuthFlow.
+func (f FederationLeaf) StartAuthFlow(
+	issuer, redirectURI, scope string, additionalParams url.Values,
+) (authURL, state string, err error) {
+	flowState := AuthFlowState{
+		Issuer:      issuer,
+		RedirectURI: redirectURI,
+		Scope:       scope,
+		ExpiresAt:   unixtime.Unixtime{Time: time.Now().Add(AuthFlowStateLifetime)},
+	}
+	if flowState.State, err = randomString(); err != nil {
+		return
+	}
+	if flowState.Nonce, err = randomString(); err != nil {
+		return
+	}
+	if flowState.CodeVerifier, err = randomString(); err != nil {
+		return
+	}
+
+	params := url.Values{}
+	for k, v := range additionalParams {
+		params[k] = v
+	}
+	params.Set("nonce", flowState.Nonce)
+	params.Set("code_challenge", codeChallenge(flowState.CodeVerifier))
+	params.Set("code_challenge_method", codeChallengeMethodS256)
+	authURL, err = f.GetAuthorizationURL(issuer, redirectURI, flowState.State, scope, params)
+	if err != nil {
+		return
+	}
+	if err = f.authFlowStateStore().StoreAuthFlowState(flowState); err != nil {
+		return "", "", errors.Wrap(err, "could not store auth flow state")
+	}
+	return authURL, flowState.State, nil
+}
+
+// CompleteAuthFlow completes an authorization code flow started with
+// StartAuthFlow. It takes the query parameters of the authorization response,
+// checks the state and, if present, the iss parameter, and exchanges the code
+// using the stored PKCE code verifier. The id token must contain the stored
+// nonce. If the OP returned an error, it is returned as OIDCErrorResponse.
+func (f FederationLeaf) CompleteAuthFlow(
+	authorizationResponse, additionalParameter url.Values,
+) (*OIDCTokenResponse, *OIDCErrorResponse, error) {
+	state := authorizationResponse.Get("state")
+	if state == "" {
+		return nil, nil, errors.New("authorization response does not contain a state")
+	}
+	flowState, err := f.authFlowStateStore().PopAuthFlowState(state)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not obtain auth flow state")
+	}
+	if flowState == nil {
+		return nil, nil, errors.New("unknown or expired state")
+	}
+	if iss := authorizationResponse.Get("iss"); iss != "" && iss != flowState.Issuer {
+		return nil, nil, errors.Errorf("authorization response issuer '%s' does not match '%s'", iss, flowState.Issuer)
+	}
+	if e := authorizationResponse.Get("error"); e != "" {
+		return nil, &OIDCErrorResponse{
+			Error:            e,
+			ErrorDescription: authorizationResponse.Get("error_description"),
+		}, nil
+	}
+	code := authorizationResponse.Get("code")
+	if code == "" {
+		return nil, nil, errors.New("authorization response does not contain a code")
+	}
+
+	params := url.Values{}
+	for k, v := range additionalParameter {
+		params[k] = v
+	}
+	params.Set("code_verifier", flowState.CodeVerifier)
+	tokenRes, errRes, err := f.CodeExchangeWithNonce(
+		flowState.Issuer, code, flowState.RedirectURI, flowState.Nonce, params,
+	)
+	if err != nil || errRes != nil {
+		return nil, errRes, err
+	}
+	if tokenRes.IDTokenClaims == nil && slices.Contains(strings.Fields(flowState.Scope), "openid") {
+		return nil, nil, errors.New("token response does not contain an id token")
+	}
+	return tokenRes, nil, nil
+}
+
+// codeChallenge returns the S256 PKCE code challenge for the passed verifier
+func codeChallenge(verifier string) string {
+	h := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
+// randomString returns a random url-safe string with 256 bits of entropy
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,273 @@
+package oidfed
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v3/jwa"
+
+	"github.com/go-oidfed/lib/internal/jwx"
+	"github.com/go-oidfed/lib/jwks"
+	"github.com/go-oidfed/lib/unixtime"
+)
+
+// authFlowOP is a mocked OP with a token endpoint for testing authorization
+// code flows
+type authFlowOP struct {
+	*mockOP
+	signer *GeneralJWTSigner
+	// idTokenNonce is the nonce that is put into the next id token; if
+	// empty the nonce from the last request object is used
+	idTokenNonce string
+	challenge    string
+	nonce        string
+	// clientID is the client id the OP expects in token requests; if empty
+	// the client id is not checked
+	clientID string
+}
+
+func newAuthFlowOP(t *testing.T, entityID string) *authFlowOP {
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	op := &authFlowOP{signer: NewGeneralJWTSigner(sk, jwa.ES256())}
+	keys := jwks.KeyToJWKS(sk.Public(), jwa.ES256())
+	op.mockOP = newMockOP(
+		entityID, &OpenIDProviderMetadata{
+			AuthorizationEndpoint:          entityID + "/authorize",
+			TokenEndpoint:                  entityID + "/token",
+			FederationRegistrationEndpoint: entityID + "/register",
+			JWKS:                           &keys,
+		},
+	)
+	mockHandlerEndpoint(http.MethodPost, op.metadata.TokenEndpoint, http.HandlerFunc(op.token))
+	taExplicit.RegisterSubordinate(op.mockOP)
+	return op
+}
+
+// authorize takes an authorization url and remembers the PKCE challenge and
+// nonce from the request object
+func (op *authFlowOP) authorize(t *testing.T, authURL string) url.Values {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := jwx.Parse([]byte(u.Query().Get("request")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ro map[string]any
+	if err = json.Unmarshal(m.Payload(), &ro); err != nil {
+		t.Fatal(err)
+	}
+	if ro["code_challenge_method"] != codeChallengeMethodS256 {
+		t.Errorf("unexpected code_challenge_method '%v'", ro["code_challenge_method"])
+	}
+	op.challenge, _ = ro["code_challenge"].(string)
+	op.nonce, _ = ro["nonce"].(string)
+	state, _ := ro["state"].(string)
+	if op.challenge == "" || op.nonce == "" || state == "" {
+		t.Fatalf("request object is missing state, nonce, or code challenge: %v", ro)
+	}
+	return url.Values{
+		"code":  {"code"},
+		"state": {state},
+		"iss":   {op.EntityID},
+	}
+}
+
+func (op *authFlowOP) token(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := r.ParseForm(); err != nil || codeChallenge(r.PostForm.Get("code_verifier")) != op.challenge {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+	if op.clientID != "" && !op.validClient(r.PostForm) {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(`{"error":"invalid_client"}`))
+		return
+	}
+	nonce := op.idTokenNonce
+	if nonce == "" {
+		nonce = op.nonce
+	}
+	now := time.Now()
+	idToken, err := op.signer.JWT(
+		IDTokenClaims{
+			Issuer:    op.EntityID,
+			Subject:   "user",
+			Audience:  SliceOrSingleValue[string]{r.PostForm.Get("client_id")},
+			ExpiresAt: unixtime.Unixtime{Time: now.Add(time.Hour)},
+			IssuedAt:  unixtime.Unixtime{Time: now},
+			Nonce:     nonce,
+		}, "JWT",
+	)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(
+		map[string]any{
+			"access_token": "access_token",
+			"token_type":   "Bearer",
+			"id_token":     string(idToken),
+		},
+	)
+}
+
+// validClient checks that the client id and the subject of the (unverified)
+// client assertion of a token request match the expected client id and that
+// the OP is its audience
+func (op *authFlowOP) validClient(form url.Values) bool {
+	if form.Get("client_id") != op.clientID {
+		return false
+	}
+	m, err := jwx.Parse([]byte(form.Get("client_assertion")))
+	if err != nil {
+		return false
+	}
+	var assertion struct {
+		Issuer   string                     `json:"iss"`
+		Subject  string                     `json:"sub"`
+		Audience SliceOrSingleValue[string] `json:"aud"`
+	}
+	if err = json.Unmarshal(m.Payload(), &assertion); err != nil {
+		return false
+	}
+	return assertion.Issuer == op.clientID && assertion.Subject == op.clientID &&
+		slices.Contains(assertion.Audience, op.EntityID)
+}
+
+func TestFederationLeaf_AuthFlow(t *testing.T) {
+	op := newAuthFlowOP(t, "https://op-authflow.example.com")
+	leaf := newExplicitRegistrationLeaf(t, "https://rp-authflow.example.com")
+	redirectURI := leaf.EntityID + "/redirect"
+
+	tests := []struct {
+		name         string
+		mutate       func(url.Values)
+		idTokenNonce string
+		replay       bool
+		expectErr    bool
+		expectErrRes bool
+	}{
+		{
+			name: "valid",
+		},
+		{
+			name:      "replayed state",
+			replay:    true,
+			expectErr: true,
+		},
+		{
+			name:      "unknown state",
+			mutate:    func(v url.Values) { v.Set("state", "unknown") },
+			expectErr: true,
+		},
+		{
+			name:      "issuer mismatch",
+			mutate:    func(v url.Values) { v.Set("iss", op1.EntityID) },
+			expectErr: true,
+		},
+		{
+			name:         "wrong nonce",
+			idTokenNonce: "wrong",
+			expectErr:    true,
+		},
+		{
+			name: "error response",
+			mutate: func(v url.Values) {
+				v.Del("code")
+				v.Set("error", "access_denied")
+			},
+			expectErrRes: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				authURL, state, err := leaf.StartAuthFlow(op.EntityID, redirectURI, "openid", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				res := op.authorize(t, authURL)
+				if res.Get("state") != state {
+					t.Fatalf("request object contains wrong state")
+				}
+				if test.mutate != nil {
+					test.mutate(res)
+				}
+				op.idTokenNonce = test.idTokenNonce
+				if test.replay {
+					if _, _, err = leaf.CompleteAuthFlow(res, nil); err != nil {
+						t.Fatal(err)
+					}
+				}
+				tokenRes, errRes, err := leaf.CompleteAuthFlow(res, nil)
+				if err != nil {
+					if !test.expectErr {
+						t.Fatal(err)
+					}
+					return
+				}
+				if test.expectErr {
+					t.Fatal("expected error, but flow succeeded")
+				}
+				if errRes != nil {
+					if !test.expectErrRes {
+						t.Fatalf("unexpected error response: %+v", errRes)
+					}
+					return
+				}
+				if test.expectErrRes {
+					t.Fatal("expected error response")
+				}
+				if tokenRes.IDTokenClaims == nil || tokenRes.IDTokenClaims.Subject != "user" {
+					t.Errorf("unexpected id token claims: %+v", tokenRes.IDTokenClaims)
+				}
+			},
+		)
+	}
+}
+
+func TestCacheAuthFlowStateStore_ConcurrentPop(t *testing.T) {
+	store := CacheAuthFlowStateStore{}
+	flowState := AuthFlowState{
+		State:     "concurrent-pop-state",
+		ExpiresAt: unixtime.Unixtime{Time: time.Now().Add(time.Minute)},
+	}
+	if err := store.StoreAuthFlowState(flowState); err != nil {
+		t.Fatal(err)
+	}
+	var popped atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s, err := store.PopAuthFlowState(flowState.State)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if s != nil {
+				popped.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := popped.Load(); n != 1 {
+		t.Fatalf("expected the state to be popped exactly once, but it was popped %d times", n)
+	}
+}
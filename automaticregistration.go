@@ -0,0 +1,176 @@
+package oidfed
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"slices"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/go-oidfed/lib/cache"
+	"github.com/go-oidfed/lib/internal/jwx"
+	"github.com/go-oidfed/lib/oidfedconst"
+	"github.com/go-oidfed/lib/unixtime"
+)
+
+// AutomaticRegistrationVerifier verifies request objects and private_key_jwt
+// client assertions of RPs that use automatic registration at an OP, i.e.
+// where the client_id is the RP's entity id.
+type AutomaticRegistrationVerifier struct {
+	// EntityID is the OP's entity id; it must be the audience of request objects
+	EntityID     string
+	TrustAnchors TrustAnchors
+	// ClientAssertionAudiences are additional audiences that are accepted
+	// for client assertions, e.g. the OP's token endpoint
+	ClientAssertionAudiences []string
+}
+
+// NewAutomaticRegistrationVerifier creates a new
+// AutomaticRegistrationVerifier for the passed OP
+func NewAutomaticRegistrationVerifier(
+	opEntityID string, trustAnchors TrustAnchors, clientAssertionAudiences ...string,
+) *AutomaticRegistrationVerifier {
+	return &AutomaticRegistrationVerifier{
+		EntityID:                 opEntityID,
+		TrustAnchors:             trustAnchors,
+		ClientAssertionAudiences: clientAssertionAudiences,
+	}
+}
+
+// automaticRegistrationClaims holds the claims of a request object or client
+// assertion that are relevant for verification
+type automaticRegistrationClaims struct {
+	Issuer    string                     `json:"iss"`
+	Subject   string                     `json:"sub"`
+	Audience  SliceOrSingleValue[string] `json:"aud"`
+	ClientID  string                     `json:"client_id"`
+	IssuedAt  *unixtime.Unixtime         `json:"iat"`
+	ExpiresAt *unixtime.Unixtime         `json:"exp"`
+	JTI       string                     `json:"jti"`
+}
+
+// VerifyRequestObject verifies a request object of an automatically
+// registering RP. The RP is resolved through the federation and the request
+// object is verified with the RP's keys. It returns the RP's
+// OpenIDRelyingPartyMetadata with metadata policies applied and the claims of
+// the request object.
+func (v AutomaticRegistrationVerifier) VerifyRequestObject(requestObject []byte) (
+	*OpenIDRelyingPartyMetadata, map[string]any, error,
+) {
+	m, err := jwx.Parse(requestObject)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not parse request object")
+	}
+	var claims automaticRegistrationClaims
+	if err = json.Unmarshal(m.Payload(), &claims); err != nil {
+		return nil, nil, errors.Wrap(err, "could not parse request object")
+	}
+	if claims.ClientID == "" {
+		return nil, nil, errors.New("request object does not contain a client_id")
+	}
+	if claims.Issuer != claims.ClientID {
+		return nil, nil, errors.New("request object issuer does not match client_id")
+	}
+	rp, payload, err := v.verify(m, claims, []string{v.EntityID})
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "request object invalid")
+	}
+	var requestClaims map[string]any
+	if err = json.Unmarshal(payload, &requestClaims); err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	return rp, requestClaims, nil
+}
+
+// VerifyClientAssertion verifies a private_key_jwt client assertion of an
+// automatically registering RP. The RP is resolved through the federation and
+// the client assertion is verified with the RP's keys. It returns the RP's
+// OpenIDRelyingPartyMetadata with metadata policies applied.
+func (v AutomaticRegistrationVerifier) VerifyClientAssertion(clientAssertion []byte) (
+	*OpenIDRelyingPartyMetadata, error,
+) {
+	m, err := jwx.Parse(clientAssertion)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse client assertion")
+	}
+	var claims automaticRegistrationClaims
+	if err = json.Unmarshal(m.Payload(), &claims); err != nil {
+		return nil, errors.Wrap(err, "could not parse client assertion")
+	}
+	if claims.Issuer == "" || claims.Issuer != claims.Subject {
+		return nil, errors.New("client assertion issuer and subject must be the client_id")
+	}
+	claims.ClientID = claims.Issuer
+	audiences := append([]string{v.EntityID}, v.ClientAssertionAudiences...)
+	rp, _, err := v.verify(m, claims, audiences)
+	return rp, errors.Wrap(err, "client assertion invalid")
+}
+
+// verify checks the claims, resolves the RP, verifies the signature, and
+// protects against replay
+func (v AutomaticRegistrationVerifier) verify(
+	m *jwx.ParsedJWT, claims automaticRegistrationClaims, audiences []string,
+) (*OpenIDRelyingPartyMetadata, []byte, error) {
+	if !slices.ContainsFunc(claims.Audience, func(aud string) bool { return slices.Contains(audiences, aud) }) {
+		return nil, nil, errors.New("invalid audience")
+	}
+	if claims.ExpiresAt == nil || claims.ExpiresAt.IsZero() {
+		return nil, nil, errors.New("no expiration")
+	}
+	if err := unixtime.VerifyTime(claims.IssuedAt, claims.ExpiresAt); err != nil {
+		return nil, nil, err
+	}
+	if claims.JTI == "" {
+		return nil, nil, errors.New("no jti")
+	}
+
+	metadata, federationKeys, err := resolveEntity(
+		claims.ClientID, oidfedconst.EntityTypeOpenIDRelyingParty, v.TrustAnchors.EntityIDs(),
+	)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not resolve rp")
+	}
+	if metadata.RelyingParty == nil {
+		return nil, nil, errors.New("rp has no openid_relying_party metadata")
+	}
+	rp := metadata.RelyingParty
+	if len(rp.ClientRegistrationTypes) > 0 &&
+		!slices.Contains(rp.ClientRegistrationTypes, oidfedconst.ClientRegistrationTypeAutomatic) {
+		return nil, nil, errors.New("rp does not support automatic registration")
+	}
+	keys, err := metadata.ProtocolJWKS(claims.ClientID, oidfedconst.EntityTypeOpenIDRelyingParty, federationKeys)
+	if err != nil {
+		return nil, nil, err
+	}
+	payload, err := m.VerifyWithSet(keys)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not verify signature")
+	}
+	if err = checkAndStoreJTI(claims.ClientID, claims.JTI, *claims.ExpiresAt); err != nil {
+		return nil, nil, err
+	}
+	return rp, payload, nil
+}
+
+// checkAndStoreJTI checks that a jti has not been used before by the passed
+// client and remembers it until the passed expiration; check and store are a
+// single atomic operation, so concurrent requests cannot use the same jti
+func checkAndStoreJTI(clientID, jti string, exp unixtime.Unixtime) error {
+	key := cache.Key(
+		cache.KeyJTI,
+		base64.URLEncoding.EncodeToString([]byte(clientID))+":"+base64.URLEncoding.EncodeToString([]byte(jti)),
+	)
+	ttl := unixtime.Until(exp)
+	if ttl <= 0 {
+		ttl = time.Second
+	}
+	stored, err := cache.SetIfAbsent(key, true, ttl)
+	if err != nil {
+		return err
+	}
+	if !stored {
+		return errors.New("jti was already used")
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package oidfed
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/v3/jwa"
+
+	"github.com/go-oidfed/lib/jwks"
+	"github.com/go-oidfed/lib/oidfedconst"
+)
+
+var rpAutomaticKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+var rpAutomatic = newMockRP(
+	"https://rp-automatic.example.com",
+	&OpenIDRelyingPartyMetadata{
+		ClientRegistrationTypes: []string{oidfedconst.ClientRegistrationTypeAutomatic},
+		JWKS: func() *jwks.JWKS {
+			k := jwks.KeyToJWKS(rpAutomaticKey.Public(), jwa.ES256())
+			return &k
+		}(),
+	},
+)
+
+func init() {
+	taExplicit.RegisterSubordinate(rpAutomatic)
+}
+
+func TestAutomaticRegistrationVerifier(t *testing.T) {
+	tokenEndpoint := opExplicit.EntityID + "/token"
+	verifier := NewAutomaticRegistrationVerifier(
+		opExplicit.EntityID,
+		TrustAnchors{{EntityID: taExplicit.EntityID, JWKS: taExplicit.data.JWKS}},
+		tokenEndpoint,
+	)
+	rop := NewRequestObjectProducer(rpAutomatic.EntityID, rpAutomaticKey, jwa.ES256(), 60)
+	expiredROP := NewRequestObjectProducer(rpAutomatic.EntityID, rpAutomaticKey, jwa.ES256(), -60)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongKeyROP := NewRequestObjectProducer(rpAutomatic.EntityID, otherKey, jwa.ES256(), 60)
+	unknownROP := NewRequestObjectProducer("https://unknown-rp.example.com", otherKey, jwa.ES256(), 60)
+
+	requestObject := func(rop *RequestObjectProducer, aud string) []byte {
+		ro, err := rop.RequestObject(map[string]any{"aud": aud, "scope": "openid"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ro
+	}
+	clientAssertion := func(rop *RequestObjectProducer, aud string) []byte {
+		ca, err := rop.ClientAssertion(aud)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ca
+	}
+	replayed := requestObject(rop, opExplicit.EntityID)
+	if _, _, err = verifier.VerifyRequestObject(replayed); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name            string
+		requestObject   []byte
+		clientAssertion []byte
+		expectErr       bool
+	}{
+		{
+			name:          "valid request object",
+			requestObject: requestObject(rop, opExplicit.EntityID),
+		},
+		{
+			name:          "replayed request object",
+			requestObject: replayed,
+			expectErr:     true,
+		},
+		{
+			name:          "wrong audience",
+			requestObject: requestObject(rop, op1.EntityID),
+			expectErr:     true,
+		},
+		{
+			name:          "expired",
+			requestObject: requestObject(expiredROP, opExplicit.EntityID),
+			expectErr:     true,
+		},
+		{
+			name:          "wrong key",
+			requestObject: requestObject(wrongKeyROP, opExplicit.EntityID),
+			expectErr:     true,
+		},
+		{
+			name:          "unknown rp",
+			requestObject: requestObject(unknownROP, opExplicit.EntityID),
+			expectErr:     true,
+		},
+		{
+			name:            "valid client assertion",
+			clientAssertion: clientAssertion(rop, tokenEndpoint),
+		},
+		{
+			name:            "client assertion with wrong audience",
+			clientAssertion: clientAssertion(rop, op1.EntityID+"/token"),
+			expectErr:       true,
+		},
+		{
+			name:            "client assertion with wrong key",
+			clientAssertion: clientAssertion(wrongKeyROP, tokenEndpoint),
+			expectErr:       true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				var rp *OpenIDRelyingPartyMetadata
+				var claims map[string]any
+				var err error
+				if test.requestObject != nil {
+					rp, claims, err = verifier.VerifyRequestObject(test.requestObject)
+				} else {
+					rp, err = verifier.VerifyClientAssertion(test.clientAssertion)
+				}
+				if err != nil {
+					if !test.expectErr {
+						t.Fatal(err)
+					}
+					return
+				}
+				if test.expectErr {
+					t.Fatal("expected error, but verification succeeded")
+				}
+				if rp == nil {
+					t.Fatal("no rp metadata returned")
+				}
+				if test.requestObject != nil && claims["scope"] != "openid" {
+					t.Errorf("unexpected request object claims: %v", claims)
+				}
+			},
+		)
+	}
+}
+
+func TestAutomaticRegistrationVerifier_ConcurrentReplay(t *testing.T) {
+	verifier := NewAutomaticRegistrationVerifier(
+		opExplicit.EntityID,
+		TrustAnchors{{EntityID: taExplicit.EntityID, JWKS: taExplicit.data.JWKS}},
+		opExplicit.EntityID+"/token",
+	)
+	rop := NewRequestObjectProducer(rpAutomatic.EntityID, rpAutomaticKey, jwa.ES256(), 60)
+	requestObject, err := rop.RequestObject(map[string]any{"aud": opExplicit.EntityID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const requests = 20
+	var accepted atomic.Int32
+	var wg sync.WaitGroup
+	for range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := verifier.VerifyRequestObject(requestObject); err == nil {
+				accepted.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("expected request object to be accepted once, but it was accepted %d times", n)
+	}
+}
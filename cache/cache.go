@@ -3,6 +3,7 @@ package cache
 import (
 	"encoding/base64"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/TwiN/gocache/v2"
@@ -18,10 +19,21 @@ type Cache interface {
 	Set(key string, value any, expiration time.Duration) error
 }
 
-// cacheWrapper is a type implementing the Cache interface and providing an
-// internal cache
+// AtomicCache is a Cache that can atomically store a value only if there is
+// no value for the key yet; for caches that do not implement it, SetIfAbsent
+// is only atomic within the process
+type AtomicCache interface {
+	Cache
+	// SetIfAbsent caches the value for the key, if there is no value for the
+	// key yet; it returns false if there already was a value
+	SetIfAbsent(key string, value any, expiration time.Duration) (bool, error)
+}
+
+// cacheWrapper is a type implementing the AtomicCache interface and
+// providing an internal cache
 type cacheWrapper struct {
-	c *gocache.Cache
+	c     *gocache.Cache
+	mutex *sync.Mutex
 }
 
 func newCacheWrapper(defaultExpiration time.Duration) cacheWrapper {
@@ -30,7 +42,8 @@ func newCacheWrapper(defaultExpiration time.Duration) cacheWrapper {
 		log.Fatal(err) // skipcq: RVV-A0003
 	}
 	return cacheWrapper{
-		c,
+		c:     c,
+		mutex: &sync.Mutex{},
 	}
 }
 
@@ -58,8 +71,33 @@ func (c cacheWrapper) Set(key string, value any, expiration time.Duration) error
 	return nil
 }
 
+// SetIfAbsent implements the AtomicCache interface
+func (c cacheWrapper) SetIfAbsent(key string, value any, expiration time.Duration) (bool, error) {
+	return setIfAbsent(c, c.mutex, key, value, expiration)
+}
+
+// setIfAbsent implements SetIfAbsent for a Cache by serializing Get and Set
+// with the passed mutex
+func setIfAbsent(c Cache, mutex *sync.Mutex, key string, value any, expiration time.Duration) (bool, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	var existing any
+	set, err := c.Get(key, &existing)
+	if err != nil {
+		return false, err
+	}
+	if set {
+		return false, nil
+	}
+	return true, c.Set(key, value, expiration)
+}
+
 var cacheCache Cache
 
+// setIfAbsentMutex serializes SetIfAbsent for caches that do not implement
+// the AtomicCache interface
+var setIfAbsentMutex sync.Mutex
+
 func init() {
 	SetCache(newCacheWrapper(time.Hour))
 }
@@ -78,6 +116,19 @@ const (
 	KeyTrustTreeChains            = "trust_tree_chains"
 	KeyTrustChainResolvedMetadata = "trustchain_resolved_metadata"
 	KeySubordinateListing         = "subordinate_listing"
+	KeyHTTPResponse               = "http_response"
+	KeyClientRegistration         = "client_registration"
+	KeyRegisteredClient           = "registered_client"
+	KeyJTI                        = "jti"
+	KeyAuthFlowState              = "auth_flow_state"
+	KeyAuthFlowStateUsed          = "auth_flow_state_used"
+	KeySignedJWKS                 = "signed_jwks"
+	KeyAccessTokenIssuer          = "access_token_issuer"
+	KeyAccessTokenIssuerRefresh   = "access_token_issuer_refresh"
+	KeyAccessTokenIssuerFailure   = "access_token_issuer_failure"
+	KeyTrustMarkEligibility       = "trust_mark_eligibility"
+	KeyTrustMarkStatus            = "trust_mark_status"
+	KeyDelegationStatus           = "delegation_status"
 )
 
 // Key combines a sub system prefix with the key to a cache key
@@ -96,6 +147,17 @@ func Set(key string, value any, duration time.Duration) error {
 	return cacheCache.Set(key, value, duration)
 }
 
+// SetIfAbsent caches a value for the given key and duration, if there is no
+// value for the key yet; it returns false if there already was a value. It is
+// atomic if the used cache implements the AtomicCache interface, otherwise
+// only within the process.
+func SetIfAbsent(key string, value any, duration time.Duration) (bool, error) {
+	if c, ok := cacheCache.(AtomicCache); ok {
+		return c.SetIfAbsent(key, value, duration)
+	}
+	return setIfAbsent(cacheCache, &setIfAbsentMutex, key, value, duration)
+}
+
 // Get obtains a value for the given key from the cache
 func Get(key string, target any) (bool, error) {
 	return cacheCache.Get(key, target)
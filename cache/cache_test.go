@@ -0,0 +1,71 @@
+package cache
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// nonAtomicCache is a Cache that does not implement the AtomicCache
+// interface
+type nonAtomicCache struct {
+	Cache
+}
+
+func TestSetIfAbsent(t *testing.T) {
+	integrityProtected, err := NewIntegrityProtectedCache(newCacheWrapper(time.Minute), bytes.Repeat([]byte{0x42}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		cache Cache
+	}{
+		{
+			name:  "internal cache",
+			cache: newCacheWrapper(time.Minute),
+		},
+		{
+			name:  "integrity protected cache",
+			cache: integrityProtected,
+		},
+		{
+			name:  "non atomic cache",
+			cache: nonAtomicCache{newCacheWrapper(time.Minute)},
+		},
+	}
+	defer SetCache(cacheCache)
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				SetCache(test.cache)
+				const writers = 50
+				var stored atomic.Int32
+				var wg sync.WaitGroup
+				for i := range writers {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						ok, err := SetIfAbsent("key", i, time.Minute)
+						if err != nil {
+							t.Error(err)
+						}
+						if ok {
+							stored.Add(1)
+						}
+					}()
+				}
+				wg.Wait()
+				if n := stored.Load(); n != 1 {
+					t.Errorf("expected exactly one value to be stored, but %d were stored", n)
+				}
+				var value int
+				if set, err := Get("key", &value); err != nil || !set {
+					t.Errorf("expected stored value, but got set=%v, err=%v", set, err)
+				}
+			},
+		)
+	}
+}
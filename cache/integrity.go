@@ -0,0 +1,119 @@
+package cache
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/go-oidfed/lib/internal"
+)
+
+// integrityProtectedCache is a type implementing the Cache interface that
+// authenticates all values with a keyed MAC before they are stored in an
+// underlying Cache; values that cannot be authenticated are treated as cache
+// misses
+type integrityProtectedCache struct {
+	cache Cache
+	key   []byte
+	mutex *sync.Mutex
+}
+
+type authenticatedEntry struct {
+	Data []byte
+	MAC  []byte
+}
+
+// NewIntegrityProtectedCache returns a Cache that stores all values in the
+// passed Cache together with a HMAC-SHA256 computed with the passed key. On
+// load the MAC is verified and entries that were tampered with are treated as
+// cache misses.
+func NewIntegrityProtectedCache(cache Cache, key []byte) (Cache, error) {
+	if cache == nil {
+		return nil, errors.New("no cache passed")
+	}
+	if len(key) < sha256.Size {
+		return nil, errors.Errorf("mac key must be at least %d bytes", sha256.Size)
+	}
+	return integrityProtectedCache{
+		cache: cache,
+		key:   key,
+		mutex: &sync.Mutex{},
+	}, nil
+}
+
+// UseIntegrityProtection wraps the currently used Cache,
+// so that all values are authenticated with the passed key, see also
+// NewIntegrityProtectedCache
+func UseIntegrityProtection(key []byte) error {
+	c, err := NewIntegrityProtectedCache(cacheCache, key)
+	if err != nil {
+		return err
+	}
+	SetCache(c)
+	return nil
+}
+
+func (c integrityProtectedCache) mac(key string, data []byte) []byte {
+	h := hmac.New(sha256.New, c.key)
+	// The cache key is included so that an authenticated value cannot be
+	// moved to a different key
+	_, _ = h.Write([]byte(key))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write(data)
+	return h.Sum(nil)
+}
+
+// Get implements the Cache interface
+func (c integrityProtectedCache) Get(key string, target any) (bool, error) {
+	var entry authenticatedEntry
+	set, err := c.cache.Get(key, &entry)
+	if err != nil {
+		internal.Logf("invalid cache entry for '%s': %s", key, err)
+		return false, nil
+	}
+	if !set {
+		return false, nil
+	}
+	if !hmac.Equal(entry.MAC, c.mac(key, entry.Data)) {
+		internal.Logf("integrity check failed for cache entry '%s'", key)
+		return false, nil
+	}
+	return true, msgpack.Unmarshal(entry.Data, target)
+}
+
+// Set implements the Cache interface
+func (c integrityProtectedCache) Set(key string, value any, expiration time.Duration) error {
+	data, err := msgpack.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return c.cache.Set(
+		key, authenticatedEntry{
+			Data: data,
+			MAC:  c.mac(key, data),
+		}, expiration,
+	)
+}
+
+// SetIfAbsent implements the AtomicCache interface; it is atomic if the
+// underlying Cache is an AtomicCache
+func (c integrityProtectedCache) SetIfAbsent(key string, value any, expiration time.Duration) (bool, error) {
+	atomicCache, ok := c.cache.(AtomicCache)
+	if !ok {
+		return setIfAbsent(c, c.mutex, key, value, expiration)
+	}
+	data, err := msgpack.Marshal(value)
+	if err != nil {
+		return false, err
+	}
+	return atomicCache.SetIfAbsent(
+		key, authenticatedEntry{
+			Data: data,
+			MAC:  c.mac(key, data),
+		}, expiration,
+	)
+}
@@ -0,0 +1,55 @@
+package cache
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestIntegrityProtectedCache(t *testing.T) {
+	underlying := newCacheWrapper(time.Minute)
+	key := bytes.Repeat([]byte{0x42}, 32)
+	c, err := NewIntegrityProtectedCache(underlying, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Set("key", "value", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	var value string
+	set, err := c.Get("key", &value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !set || value != "value" {
+		t.Fatalf("expected cached value 'value', but got '%s' (set: %v)", value, set)
+	}
+
+	var entry authenticatedEntry
+	if _, err = underlying.Get("key", &entry); err != nil {
+		t.Fatal(err)
+	}
+	if err = underlying.Set("moved", entry, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	entry.Data[len(entry.Data)-1] ^= 0xff
+	if err = underlying.Set("key", entry, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err = underlying.Set("plain", "value", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"key", "moved", "plain"} {
+		set, err = c.Get(k, &value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if set {
+			t.Errorf("tampered entry '%s' was not treated as cache miss", k)
+		}
+	}
+
+	if _, err = NewIntegrityProtectedCache(underlying, []byte("short")); err == nil {
+		t.Error("expected error for short key")
+	}
+}
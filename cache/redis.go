@@ -35,6 +35,16 @@ func (c redisCache) Set(key string, value any, expiration time.Duration) error {
 	return c.client.Set(c.ctx, key, data, expiration).Err()
 }
 
+// SetIfAbsent implements the AtomicCache interface
+func (c redisCache) SetIfAbsent(key string, value any, expiration time.Duration) (bool, error) {
+	data, err := msgpack.Marshal(value)
+	if err != nil {
+		return false, err
+	}
+	set, err := c.client.SetNX(c.ctx, key, data, expiration).Result()
+	return set, errors.Wrap(err, "error while setting in cache")
+}
+
 // UseRedisCache creates a new redis cache with the passed options and sets it to be used
 func UseRedisCache(options *redis.Options) error {
 	rdb := redis.NewClient(options)
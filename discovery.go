@@ -17,9 +17,7 @@ import (
 	"github.com/scylladb/go-set/strset"
 
 	"github.com/go-oidfed/lib/apimodel"
-	"github.com/go-oidfed/lib/cache"
 	"github.com/go-oidfed/lib/internal"
-	"github.com/go-oidfed/lib/internal/http"
 	"github.com/go-oidfed/lib/internal/utils"
 	"github.com/go-oidfed/lib/oidfedconst"
 	"github.com/go-oidfed/lib/unixtime"
@@ -44,7 +42,11 @@ type CollectedEntity struct {
 	metadata    *Metadata
 	EntityTypes []string          `json:"entity_types,omitempty"`
 	UIInfos     map[string]UIInfo `json:"ui_infos,omitempty"`
-	Extra       map[string]any    `json:"-"`
+	// TrustMarkFailures holds the verification results of the entity's
+	// trust marks that could not be verified and therefore are not included
+	// in TrustMarks; it is not part of the entity collection response
+	TrustMarkFailures TrustMarkVerificationReport `json:"-"`
+	Extra             map[string]any              `json:"-"`
 }
 
 type UIInfo struct {
@@ -328,7 +330,15 @@ func (d *SimpleEntityCollector) collect(
 										ta, taErr = GetEntityConfiguration(req.TrustAnchor)
 									},
 								)
-								if taErr != nil || trustMarkInfo.VerifyFederation(&ta.EntityStatementPayload) != nil {
+								if taErr != nil {
+									includeEntity = false
+									break
+								}
+								if err = trustMarkInfo.VerifyFederation(&ta.EntityStatementPayload); err != nil {
+									internal.Logf(
+										"Trust mark '%s' of '%s' is not valid (%s): %s -> skipping",
+										trustMarkType, subordinateID, TrustMarkFailureCauseOf(err), err.Error(),
+									)
 									includeEntity = false
 									break
 								}
@@ -426,7 +436,15 @@ func (d *SimpleEntityCollector) collect(
 										},
 									)
 									if taErr == nil {
-										collectedEntity.TrustMarks = entityConfig.TrustMarks.VerifiedFederation(&ta.EntityStatementPayload)
+										report := entityConfig.TrustMarks.VerifyFederationReport(&ta.EntityStatementPayload)
+										collectedEntity.TrustMarks = report.Verified()
+										collectedEntity.TrustMarkFailures = report.Failed()
+										for _, failure := range collectedEntity.TrustMarkFailures {
+											internal.Logf(
+												"Dropping invalid trust mark '%s' of %s: %s",
+												failure.TrustMarkInfo.TrustMarkType, subordinateID, failure.Err.Error(),
+											)
+										}
 									}
 								}
 
@@ -564,32 +582,15 @@ func (f EntityCollectionFilterVerifiedChains) Filter(e *CollectedEntity) bool {
 }
 
 func fetchList(listEndpoint string) ([]string, error) {
-	if ids := subordinateListingCacheGet(listEndpoint); ids != nil {
-		internal.Log("Obtained listing response from cache")
-		return ids, nil
-	}
-	ids, err := httpFetchList(listEndpoint)
+	body, _, err := httpGetCached(listEndpoint, nil, defaultSubordinateListingCacheTime)
 	if err != nil {
 		return nil, err
 	}
-	internal.Log("Obtained listing response from http")
-	subordinateListingCacheSet(listEndpoint, ids)
-	return ids, nil
-}
-
-func httpFetchList(listEndpoint string) ([]string, error) {
-	resp, errRes, err := http.Get(listEndpoint, nil, &[]string{})
-	if err != nil {
-		return nil, err
-	}
-	if errRes != nil {
-		return nil, errRes.Err()
-	}
-	entities, ok := resp.Result().(*[]string)
-	if !ok || entities == nil {
-		return nil, errors.New("unexpected response type")
+	var entities []string
+	if err = json.Unmarshal(body, &entities); err != nil {
+		return nil, errors.Wrap(err, "unexpected response type")
 	}
-	return *entities, nil
+	return entities, nil
 }
 
 func getMetadataForCollectedEntity(e *CollectedEntity, trustAnchors []string) *Metadata {
@@ -701,28 +702,6 @@ func EntityCollectionFilterOPs() EntityCollectionFilter {
 	)
 }
 
-func subordinateListingCacheSet(listingEndpoint string, ids []string) {
-	if err := cache.Set(
-		cache.Key(cache.KeySubordinateListing, listingEndpoint), ids,
-		defaultSubordinateListingCacheTime,
-	); err != nil {
-		internal.Log(err)
-	}
-}
-
-func subordinateListingCacheGet(listingEndpoint string) []string {
-	var ids []string
-	set, err := cache.Get(cache.Key(cache.KeySubordinateListing, listingEndpoint), &ids)
-	if err != nil {
-		internal.Log(err)
-		return nil
-	}
-	if !set {
-		return nil
-	}
-	return ids
-}
-
 // SimpleRemoteEntityCollector is a EntityCollector that utilizes a given
 // EntityCollectionEndpoint
 type SimpleRemoteEntityCollector struct {
@@ -737,17 +716,14 @@ func (c SimpleRemoteEntityCollector) CollectEntities(req apimodel.EntityCollecti
 		internal.Logf("error while creating query parameters for entity collection request: %s", err)
 		return nil
 	}
-	var res EntityCollectionResponse
-	_, errRes, err := http.Get(
-		c.EntityCollectionEndpoint, params,
-		&res,
-	)
+	body, _, err := httpGetCached(c.EntityCollectionEndpoint, params, 0)
 	if err != nil {
 		internal.Logf("error while fetching entity collection endpoint: %s", err)
 		return nil
 	}
-	if errRes != nil {
-		internal.Logf("error while fetching entity collection endpoint: %s", errRes.Err().Error())
+	var res EntityCollectionResponse
+	if err = json.Unmarshal(body, &res); err != nil {
+		internal.Logf("error while parsing entity collection response: %s", err)
 		return nil
 	}
 	return res.FederationEntities
@@ -194,3 +194,54 @@ func TestFilterableVerifiedChainsEntityCollector_CollectEntities(t *testing.T) {
 		)
 	}
 }
+
+var taDiscoveryTrustMarks = newMockAuthority(
+	"https://ta-discovery-tm.example.org", EntityStatementPayload{
+		TrustMarkIssuers: AllowedTrustMarkIssuers{
+			tmTypeStatus: []string{tmiStatus.EntityID},
+		},
+	},
+)
+
+var rpDiscoveryTrustMarks = newMockRP(
+	"https://rp-discovery-tm.example.org", &OpenIDRelyingPartyMetadata{ClientName: "discovery trust marks"},
+)
+
+func init() {
+	valid, err := tmiStatus.IssueTrustMark(tmTypeStatus, rpDiscoveryTrustMarks.EntityID)
+	if err != nil {
+		panic(err)
+	}
+	invalid, err := tmiStatus.IssueTrustMark(tmTypeStatus, rpDiscoveryTrustMarks.EntityID)
+	if err != nil {
+		panic(err)
+	}
+	invalid.TrustMarkType = "https://trustmarks.org/mismatch"
+	rpDiscoveryTrustMarks.trustMarks = TrustMarkInfos{*valid, *invalid}
+	taDiscoveryTrustMarks.RegisterSubordinate(tmiStatus)
+	taDiscoveryTrustMarks.RegisterSubordinate(rpDiscoveryTrustMarks)
+}
+
+func TestSimpleEntityCollector_CollectEntities_InvalidTrustMark(t *testing.T) {
+	entities := (&SimpleEntityCollector{}).CollectEntities(
+		apimodel.EntityCollectionRequest{
+			TrustAnchor: taDiscoveryTrustMarks.EntityID,
+			EntityTypes: []string{"openid_relying_party"},
+			Claims:      []string{"trust_marks"},
+		},
+	)
+	if len(entities) != 1 || entities[0].EntityID != rpDiscoveryTrustMarks.EntityID {
+		t.Fatalf("unexpected collected entities: %+v", entities)
+	}
+	rp := entities[0]
+	if len(rp.TrustMarks) != 1 || rp.TrustMarks[0].TrustMarkType != tmTypeStatus {
+		t.Errorf("expected only the valid trust mark, but got %+v", rp.TrustMarks)
+	}
+	if len(rp.TrustMarkFailures) != 1 {
+		t.Fatalf("expected one trust mark failure, but got %+v", rp.TrustMarkFailures)
+	}
+	if failure := rp.TrustMarkFailures[0]; failure.TrustMarkInfo.TrustMarkType != "https://trustmarks.org/mismatch" ||
+		failure.Cause != TrustMarkFailureTypeMismatch {
+		t.Errorf("unexpected trust mark failure: %+v", failure)
+	}
+}
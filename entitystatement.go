@@ -60,6 +60,18 @@ func (e *EntityStatement) UnmarshalMsgpack(data []byte) error {
 	}
 	e.EntityStatementPayload = ee.Payload
 	e.jwtMsg = &ee.JWTMsg
+	if ResolverCacheReverifySignatures {
+		// Do not trust the cached payload, but use the one from the jwt,
+		// so that the payload is covered by the signature verification
+		if e.jwtMsg.Message == nil {
+			return errors.New("cached entity statement does not contain a jwt")
+		}
+		var payload EntityStatementPayload
+		if err := json.Unmarshal(e.jwtMsg.Payload(), &payload); err != nil {
+			return errors.WithStack(err)
+		}
+		e.EntityStatementPayload = payload
+	}
 	return nil
 }
 
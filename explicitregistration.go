@@ -0,0 +1,243 @@
+package oidfed
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"slices"
+
+	"github.com/pkg/errors"
+
+	"github.com/go-oidfed/lib/cache"
+	"github.com/go-oidfed/lib/internal"
+	"github.com/go-oidfed/lib/internal/http"
+	"github.com/go-oidfed/lib/internal/jwx"
+	"github.com/go-oidfed/lib/oidfedconst"
+	"github.com/go-oidfed/lib/unixtime"
+)
+
+// ExplicitClientRegistration holds the result of an explicit client
+// registration of a FederationLeaf at an OP
+type ExplicitClientRegistration struct {
+	OPEntityID    string                      `json:"op" msgpack:"op"`
+	TrustAnchorID string                      `json:"trust_anchor_id" msgpack:"trust_anchor_id"`
+	Metadata      *OpenIDRelyingPartyMetadata `json:"metadata" msgpack:"metadata"`
+	IssuedAt      unixtime.Unixtime           `json:"iat" msgpack:"iat"`
+	ExpiresAt     unixtime.Unixtime           `json:"exp" msgpack:"exp"`
+}
+
+// ClientID returns the client id assigned by the OP
+func (r ExplicitClientRegistration) ClientID() string {
+	if r.Metadata == nil {
+		return ""
+	}
+	return r.Metadata.ClientID
+}
+
+func clientRegistrationCacheKey(rpID, opID string) string {
+	subkey := base64.URLEncoding.EncodeToString([]byte(rpID)) + ":" + base64.URLEncoding.EncodeToString([]byte(opID))
+	return cache.Key(cache.KeyClientRegistration, subkey)
+}
+
+// ParseExplicitRegistrationResponse parses an explicit registration response
+// jwt; the signature is not verified
+func ParseExplicitRegistrationResponse(data []byte) (*EntityStatement, error) {
+	m, err := jwx.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	if !m.VerifyType(oidfedconst.JWTTypeExplicitRegistrationResponse) {
+		return nil, errors.Errorf(
+			"registration response does not have '%s' JWT type", oidfedconst.JWTTypeExplicitRegistrationResponse,
+		)
+	}
+	res := &EntityStatement{jwtMsg: m}
+	if err = json.Unmarshal(m.Payload(), &res.EntityStatementPayload); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return res, nil
+}
+
+// ExplicitRegistration performs an explicit client registration at the OP
+// with the passed entity id. The FederationLeaf's entity configuration is
+// sent to the OP's federation_registration_endpoint; if a trustChain is
+// passed, it is sent together with the entity configuration. The first
+// element of the trustChain must be the FederationLeaf's entity
+// configuration; it is replaced by a freshly signed entity configuration
+// with the OP as audience, the other elements are sent as passed.
+// The signed registration response is verified against the OP's federation
+// keys and the resulting ExplicitClientRegistration is stored until it expires.
+func (f FederationLeaf) ExplicitRegistration(
+	opEntityID string, trustChain JWSMessages,
+) (*ExplicitClientRegistration, error) {
+	resolver := TrustResolver{
+		TrustAnchors:   f.TrustAnchors,
+		StartingEntity: opEntityID,
+		Types:          []string{oidfedconst.EntityTypeOpenIDProvider},
+	}
+	chains := resolver.ResolveToValidChains()
+	if len(chains) == 0 {
+		return nil, errors.New("no valid trust chain to op found")
+	}
+	chains = chains.SortAsc(TrustChainScoringPathLen)
+	opMetadata, err := chains[0].Metadata()
+	if err != nil {
+		return nil, err
+	}
+	if opMetadata.OpenIDProvider == nil || opMetadata.OpenIDProvider.FederationRegistrationEndpoint == "" {
+		return nil, errors.New("op does not have a federation_registration_endpoint")
+	}
+
+	body, contentType, err := f.explicitRegistrationRequest(opEntityID, trustChain)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.Do().R().
+		SetHeader("Content-Type", contentType).
+		SetBody(body).
+		SetError(&http.HttpError{}).
+		Post(opMetadata.OpenIDProvider.FederationRegistrationEndpoint)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if resp.IsError() {
+		if errRes, ok := resp.Error().(*http.HttpError); ok && errRes != nil && errRes.Error != "" {
+			errRes.Status = resp.StatusCode()
+			return nil, errRes.Err()
+		}
+		return nil, errors.Errorf("explicit registration failed: http status %d", resp.StatusCode())
+	}
+
+	res, err := ParseExplicitRegistrationResponse(resp.Body())
+	if err != nil {
+		return nil, err
+	}
+	registration, err := f.verifyExplicitRegistrationResponse(opEntityID, res, chains)
+	if err != nil {
+		return nil, err
+	}
+	if err = cache.Set(
+		clientRegistrationCacheKey(f.EntityID, opEntityID), registration,
+		unixtime.Until(registration.ExpiresAt),
+	); err != nil {
+		internal.Log(err.Error())
+	}
+	return registration, nil
+}
+
+// explicitRegistrationRequest returns the request body and content type for
+// an explicit registration request
+func (f FederationLeaf) explicitRegistrationRequest(opEntityID string, trustChain JWSMessages) (
+	[]byte, string, error,
+) {
+	payload := f.EntityConfigurationPayload()
+	payload.Audience = opEntityID
+	ec, err := f.EntityStatementSigner.JWT(payload)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(trustChain) == 0 {
+		return ec, oidfedconst.ContentTypeEntityStatement, nil
+	}
+	leafEC, err := ParseEntityStatement(trustChain[0].RawJWT)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "could not parse first element of trust chain")
+	}
+	if leafEC.Issuer != f.EntityID || leafEC.Subject != f.EntityID {
+		return nil, "", errors.New("first element of trust chain is not the entity configuration of this entity")
+	}
+	chain := []string{string(ec)}
+	for _, m := range trustChain[1:] {
+		chain = append(chain, string(m.RawJWT))
+	}
+	body, err := json.Marshal(chain)
+	return body, oidfedconst.ContentTypeTrustChain, errors.WithStack(err)
+}
+
+func (f FederationLeaf) verifyExplicitRegistrationResponse(
+	opEntityID string, res *EntityStatement, opChains TrustChains,
+) (*ExplicitClientRegistration, error) {
+	if !res.Verify(opChains[0][0].JWKS) {
+		return nil, errors.New("registration response could not be verified with op's federation keys")
+	}
+	if res.Issuer != opEntityID {
+		return nil, errors.Errorf("registration response issuer '%s' does not match op", res.Issuer)
+	}
+	if res.Subject != f.EntityID || res.Audience != f.EntityID {
+		return nil, errors.New("registration response was not issued for this entity")
+	}
+	if !res.TimeValid() {
+		return nil, errors.New("registration response is not valid at this time")
+	}
+	if res.TrustAnchorID == "" {
+		return nil, errors.New("registration response does not contain a trust_anchor_id")
+	}
+	if len(opChains.Filter(TrustChainsFilterTrustAnchor(res.TrustAnchorID))) == 0 {
+		return nil, errors.Errorf("trust anchor '%s' of registration response is not trusted", res.TrustAnchorID)
+	}
+	for _, hint := range res.AuthorityHints {
+		if !slices.Contains(f.AuthorityHints, hint) {
+			return nil, errors.Errorf("authority hint '%s' of registration response is not a superior", hint)
+		}
+	}
+	if res.Metadata == nil || res.Metadata.RelyingParty == nil {
+		return nil, errors.New("registration response does not contain openid_relying_party metadata")
+	}
+	return &ExplicitClientRegistration{
+		OPEntityID:    opEntityID,
+		TrustAnchorID: res.TrustAnchorID,
+		Metadata:      res.Metadata.RelyingParty,
+		IssuedAt:      res.IssuedAt,
+		ExpiresAt:     res.ExpiresAt,
+	}, nil
+}
+
+// oidcClient holds the client id and the relying party metadata a
+// FederationLeaf uses at an OP
+type oidcClient struct {
+	ID       string
+	Metadata *OpenIDRelyingPartyMetadata
+	producer *RequestObjectProducer
+}
+
+// oidcClient returns the oidcClient of the FederationLeaf at the OP with the
+// passed entity id; if there is a stored ExplicitClientRegistration at the OP,
+// its client id and metadata are used, otherwise the entity id and the
+// FederationLeaf's own metadata are used (automatic registration)
+func (f FederationLeaf) oidcClient(opEntityID string) oidcClient {
+	client := oidcClient{
+		ID:       f.EntityID,
+		Metadata: f.rpMetadata(),
+		producer: f.oidcROProducer,
+	}
+	registration, err := f.ExplicitClientRegistration(opEntityID)
+	if err != nil {
+		internal.Log(err.Error())
+		return client
+	}
+	if registration == nil || registration.ClientID() == "" {
+		return client
+	}
+	client.ID = registration.ClientID()
+	client.Metadata = registration.Metadata
+	if client.ID != f.EntityID && f.oidcROProducer != nil {
+		producer := *f.oidcROProducer
+		producer.EntityID = client.ID
+		client.producer = &producer
+	}
+	return client
+}
+
+// ExplicitClientRegistration returns the stored ExplicitClientRegistration
+// at the OP with the passed entity id, or nil if there is no (unexpired)
+// registration
+func (f FederationLeaf) ExplicitClientRegistration(opEntityID string) (*ExplicitClientRegistration, error) {
+	var registration ExplicitClientRegistration
+	set, err := cache.Get(clientRegistrationCacheKey(f.EntityID, opEntityID), &registration)
+	if err != nil || !set {
+		return nil, err
+	}
+	if unixtime.Until(registration.ExpiresAt) <= 0 {
+		return nil, nil
+	}
+	return &registration, nil
+}
@@ -0,0 +1,292 @@
+package oidfed
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/go-oidfed/lib/cache"
+	"github.com/go-oidfed/lib/internal"
+	"github.com/go-oidfed/lib/oidfedconst"
+	"github.com/go-oidfed/lib/unixtime"
+)
+
+const defaultExplicitRegistrationLifetime = 24 * time.Hour
+
+// maxExplicitRegistrationRequestSize limits the size of explicit registration
+// requests that are read
+const maxExplicitRegistrationRequestSize = 1 << 20
+
+// RegisteredClient is a client that was registered at an OP through explicit
+// registration
+type RegisteredClient struct {
+	ClientID      string                      `json:"client_id" msgpack:"client_id"`
+	EntityID      string                      `json:"entity_id" msgpack:"entity_id"`
+	TrustAnchorID string                      `json:"trust_anchor_id" msgpack:"trust_anchor_id"`
+	Metadata      *OpenIDRelyingPartyMetadata `json:"metadata" msgpack:"metadata"`
+	IssuedAt      unixtime.Unixtime           `json:"iat" msgpack:"iat"`
+	ExpiresAt     unixtime.Unixtime           `json:"exp" msgpack:"exp"`
+}
+
+// RegisteredClientStorage is an interface for storing RegisteredClients
+type RegisteredClientStorage interface {
+	// StoreClient stores the passed RegisteredClient, replacing an existing
+	// client with the same client id
+	StoreClient(client RegisteredClient) error
+	// Client returns the (unexpired) RegisteredClient for the passed client
+	// id or nil if there is no such client
+	Client(clientID string) (*RegisteredClient, error)
+}
+
+// CacheClientStorage is a RegisteredClientStorage that uses the cache to
+// store clients until their registration expires
+type CacheClientStorage struct{}
+
+// StoreClient implements the RegisteredClientStorage interface
+func (CacheClientStorage) StoreClient(client RegisteredClient) error {
+	return cache.Set(
+		cache.Key(cache.KeyRegisteredClient, client.ClientID), client, unixtime.Until(client.ExpiresAt),
+	)
+}
+
+// Client implements the RegisteredClientStorage interface
+func (CacheClientStorage) Client(clientID string) (*RegisteredClient, error) {
+	var client RegisteredClient
+	set, err := cache.Get(cache.Key(cache.KeyRegisteredClient, clientID), &client)
+	if err != nil || !set {
+		return nil, err
+	}
+	if unixtime.Until(client.ExpiresAt) <= 0 {
+		return nil, nil
+	}
+	return &client, nil
+}
+
+// ExplicitRegistrationHandler is a http.Handler for an OP's
+// federation_registration_endpoint.
+// It accepts explicit registration requests, resolves the RP's trust chains
+// to the configured TrustAnchors, applies the metadata policies, and
+// responds with a signed explicit registration response.
+type ExplicitRegistrationHandler struct {
+	// EntityID is the OP's entity id
+	EntityID     string
+	TrustAnchors TrustAnchors
+	// Storage is used to store the registered clients
+	Storage RegisteredClientStorage
+	// Lifetime is the maximum lifetime of a registration; the registration
+	// never outlives the used trust chain
+	Lifetime time.Duration
+	// ClientMetadataModifier can be used to modify the resolved RP metadata
+	// before the client is registered, e.g. to assign a client id or
+	// reject the registration by returning an error
+	ClientMetadataModifier func(rpEntityID string, metadata *OpenIDRelyingPartyMetadata) error
+	signer                 *GeneralJWTSigner
+}
+
+// NewExplicitRegistrationHandler creates a new ExplicitRegistrationHandler
+// for the passed OP; registration responses are signed with the passed
+// EntityStatementSigner, i.e. the OP's federation key. If no
+// RegisteredClientStorage is passed, CacheClientStorage is used.
+func NewExplicitRegistrationHandler(
+	opEntityID string, trustAnchors TrustAnchors, signer *EntityStatementSigner, storage RegisteredClientStorage,
+) *ExplicitRegistrationHandler {
+	if storage == nil {
+		storage = CacheClientStorage{}
+	}
+	return &ExplicitRegistrationHandler{
+		EntityID:     opEntityID,
+		TrustAnchors: trustAnchors,
+		Storage:      storage,
+		Lifetime:     defaultExplicitRegistrationLifetime,
+		signer:       signer.GeneralJWTSigner,
+	}
+}
+
+// ServeHTTP implements the http.Handler interface
+func (h ExplicitRegistrationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeErrorResponse(w, http.StatusMethodNotAllowed, ErrorInvalidRequest("only POST is supported"))
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxExplicitRegistrationRequestSize))
+	if err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, ErrorInvalidRequest("could not read request body"))
+		return
+	}
+	res, errRes := h.Register(r.Header.Get("Content-Type"), body)
+	if errRes != nil {
+		status := http.StatusBadRequest
+		if errRes.Error == ServerError {
+			status = http.StatusInternalServerError
+		}
+		writeErrorResponse(w, status, *errRes)
+		return
+	}
+	w.Header().Set("Content-Type", oidfedconst.ContentTypeExplicitRegistrationResponse)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(res)
+}
+
+func writeErrorResponse(w http.ResponseWriter, status int, errRes Error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(errRes)
+}
+
+// Register handles an explicit registration request with the passed content
+// type and body and returns the signed registration response or an Error
+func (h ExplicitRegistrationHandler) Register(contentType string, body []byte) ([]byte, *Error) {
+	ec, trustChain, errRes := parseExplicitRegistrationRequest(contentType, body)
+	if errRes != nil {
+		return nil, errRes
+	}
+	if ec.Audience != h.EntityID {
+		return nil, errorPtr(ErrorInvalidRequest("entity configuration has wrong audience"))
+	}
+	if !ec.TimeValid() {
+		return nil, errorPtr(ErrorInvalidRequest("entity configuration is not valid at this time"))
+	}
+	if ec.Metadata == nil || ec.Metadata.RelyingParty == nil {
+		return nil, errorPtr(ErrorInvalidMetadata("entity configuration does not contain openid_relying_party metadata"))
+	}
+
+	chain, errRes := h.resolveRPChain(ec, trustChain)
+	if errRes != nil {
+		return nil, errRes
+	}
+	metadata, err := chain.Metadata()
+	if err != nil {
+		return nil, errorPtr(ErrorInvalidMetadata(err.Error()))
+	}
+	rpMetadata := metadata.RelyingParty
+	if rpMetadata == nil {
+		return nil, errorPtr(ErrorInvalidMetadata("no openid_relying_party metadata after applying policies"))
+	}
+	if rpMetadata.ClientID == "" {
+		rpMetadata.ClientID = ec.Subject
+	}
+	if h.ClientMetadataModifier != nil {
+		if err = h.ClientMetadataModifier(ec.Subject, rpMetadata); err != nil {
+			return nil, errorPtr(ErrorInvalidMetadata(err.Error()))
+		}
+	}
+
+	now := time.Now()
+	lifetime := h.Lifetime
+	if lifetime <= 0 {
+		lifetime = defaultExplicitRegistrationLifetime
+	}
+	exp := now.Add(lifetime)
+	if chainExp := chain.ExpiresAt(); chainExp.Before(exp) {
+		exp = chainExp.Time
+	}
+	taID := chain[len(chain)-1].Issuer
+	client := RegisteredClient{
+		ClientID:      rpMetadata.ClientID,
+		EntityID:      ec.Subject,
+		TrustAnchorID: taID,
+		Metadata:      rpMetadata,
+		IssuedAt:      unixtime.Unixtime{Time: now},
+		ExpiresAt:     unixtime.Unixtime{Time: exp},
+	}
+	payload := EntityStatementPayload{
+		Issuer:         h.EntityID,
+		Subject:        ec.Subject,
+		Audience:       ec.Subject,
+		IssuedAt:       client.IssuedAt,
+		ExpiresAt:      client.ExpiresAt,
+		JWKS:           ec.JWKS,
+		AuthorityHints: []string{chain[1].Issuer},
+		Metadata:       &Metadata{RelyingParty: rpMetadata},
+		TrustAnchorID:  taID,
+	}
+	res, err := h.signer.JWT(payload, oidfedconst.JWTTypeExplicitRegistrationResponse)
+	if err != nil {
+		internal.Log(err.Error())
+		return nil, errorPtr(ErrorServerError("could not sign registration response"))
+	}
+	if err = h.Storage.StoreClient(client); err != nil {
+		internal.Log(err.Error())
+		return nil, errorPtr(ErrorServerError("could not store client registration"))
+	}
+	return res, nil
+}
+
+// parseExplicitRegistrationRequest parses the body of an explicit
+// registration request, which is either an entity configuration or a trust
+// chain starting with the entity configuration
+func parseExplicitRegistrationRequest(contentType string, body []byte) (
+	*EntityStatement, JWSMessages, *Error,
+) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	var ecJWT []byte
+	var trustChain JWSMessages
+	switch mediaType {
+	case oidfedconst.ContentTypeEntityStatement:
+		ecJWT = body
+	case oidfedconst.ContentTypeTrustChain:
+		if err := json.Unmarshal(body, &trustChain); err != nil || len(trustChain) == 0 {
+			return nil, nil, errorPtr(ErrorInvalidRequest("could not parse trust chain"))
+		}
+		ecJWT = trustChain[0].RawJWT
+	default:
+		return nil, nil, errorPtr(ErrorInvalidRequest("unsupported content type"))
+	}
+	ec, err := ParseEntityStatement(ecJWT)
+	if err != nil {
+		return nil, nil, errorPtr(ErrorInvalidRequest("could not parse entity configuration"))
+	}
+	if ec.Issuer != ec.Subject {
+		return nil, nil, errorPtr(ErrorInvalidRequest("not an entity configuration"))
+	}
+	if !ec.Verify(ec.JWKS) {
+		return nil, nil, errorPtr(ErrorInvalidRequest("could not verify entity configuration"))
+	}
+	return ec, trustChain, nil
+}
+
+// resolveRPChain resolves the trust chains of the RP to the configured
+// TrustAnchors and returns the TrustChain with the passed entity
+// configuration as its first element. If the request contained a trust
+// chain, its trust anchor is preferred.
+func (h ExplicitRegistrationHandler) resolveRPChain(ec *EntityStatement, trustChain JWSMessages) (
+	TrustChain, *Error,
+) {
+	resolver := TrustResolver{
+		TrustAnchors:   h.TrustAnchors,
+		StartingEntity: ec.Subject,
+		Types:          []string{oidfedconst.EntityTypeOpenIDRelyingParty},
+	}
+	chains := resolver.ResolveToValidChains()
+	if len(trustChain) > 1 {
+		var taStmt EntityStatementPayload
+		if err := json.Unmarshal(trustChain[len(trustChain)-1].Payload(), &taStmt); err == nil {
+			if preferred := chains.Filter(TrustChainsFilterTrustAnchor(taStmt.Issuer)); len(preferred) > 0 {
+				chains = preferred
+			}
+		}
+	}
+	chains = chains.SortAsc(TrustChainScoringPathLen)
+	for _, c := range chains {
+		if len(c) < 2 {
+			continue
+		}
+		// The entity configuration from the request must be signed with the
+		// keys that are confirmed by the superior
+		if !ec.Verify(c[1].JWKS) {
+			continue
+		}
+		chain := slices.Clone(c)
+		chain[0] = ec
+		return chain, nil
+	}
+	return nil, errorPtr(ErrorInvalidTrustChain("no valid trust chain to a trusted trust anchor found"))
+}
+
+func errorPtr(e Error) *Error {
+	return &e
+}
@@ -0,0 +1,441 @@
+package oidfed
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/lestrrat-go/jwx/v3/jwa"
+
+	"github.com/go-oidfed/lib/internal/jwx"
+	"github.com/go-oidfed/lib/oidfedconst"
+	"github.com/go-oidfed/lib/unixtime"
+)
+
+var taExplicit = newMockAuthority(
+	"https://ta-explicit.example.com",
+	EntityStatementPayload{
+		MetadataPolicy: &MetadataPolicies{
+			RelyingParty: MetadataPolicy{
+				"contacts": MetadataPolicyEntry{
+					PolicyOperatorAdd: "ta@explicit.example.com",
+				},
+			},
+		},
+	},
+)
+
+var opExplicit = newMockOP(
+	"https://op-explicit.example.com",
+	&OpenIDProviderMetadata{
+		ClientRegistrationTypesSupported: []string{oidfedconst.ClientRegistrationTypeExplicit},
+		FederationRegistrationEndpoint:   "https://op-explicit.example.com/register",
+	},
+)
+
+var rpExplicit = newMockRP(
+	"https://rp-explicit.example.com",
+	&OpenIDRelyingPartyMetadata{
+		ClientRegistrationTypes: []string{oidfedconst.ClientRegistrationTypeExplicit},
+		Contacts:                []string{"rp@explicit.example.com"},
+	},
+)
+
+func init() {
+	taExplicit.RegisterSubordinate(opExplicit)
+	taExplicit.RegisterSubordinate(rpExplicit)
+}
+
+func newExplicitRegistrationLeaf(t *testing.T, entityID string) *FederationLeaf {
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := NewFederationLeaf(
+		entityID, []string{taExplicit.EntityID},
+		TrustAnchors{{EntityID: taExplicit.EntityID, JWKS: taExplicit.data.JWKS}},
+		&Metadata{
+			RelyingParty: &OpenIDRelyingPartyMetadata{
+				ClientRegistrationTypes: []string{oidfedconst.ClientRegistrationTypeExplicit},
+				RedirectURIS:            []string{entityID + "/redirect"},
+			},
+		},
+		NewEntityStatementSigner(sk, jwa.ES256()), 0, sk, jwa.ES256(), nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf
+}
+
+// mockExplicitRegistrationEndpoint mocks the registration endpoint of the
+// passed op; the returned slice holds the statements of the last received
+// request, i.e. the entity configuration and, if a trust chain was sent, the
+// rest of the trust chain
+func mockExplicitRegistrationEndpoint(
+	t *testing.T, op *mockOP, mutate func(*EntityStatementPayload),
+) *[]string {
+	received := new([]string)
+	httpmock.RegisterResponder(
+		"POST", op.metadata.FederationRegistrationEndpoint,
+		func(req *http.Request) (*http.Response, error) {
+			body, err := io.ReadAll(req.Body)
+			if err != nil {
+				return nil, err
+			}
+			switch req.Header.Get("Content-Type") {
+			case oidfedconst.ContentTypeEntityStatement:
+				*received = []string{string(body)}
+			case oidfedconst.ContentTypeTrustChain:
+				if err = json.Unmarshal(body, received); err != nil || len(*received) == 0 {
+					return httpmock.NewStringResponse(400, `{"error":"invalid_request"}`), nil
+				}
+			default:
+				return httpmock.NewStringResponse(400, `{"error":"invalid_request"}`), nil
+			}
+			ec, err := ParseEntityStatement([]byte((*received)[0]))
+			if err != nil {
+				t.Error(err)
+				return httpmock.NewStringResponse(400, `{"error":"invalid_request"}`), nil
+			}
+			if ec.Audience != op.EntityID {
+				t.Errorf("entity configuration has wrong audience '%s'", ec.Audience)
+			}
+			rpMetadata := *ec.Metadata.RelyingParty
+			rpMetadata.ClientID = ec.Subject
+			now := time.Now()
+			payload := EntityStatementPayload{
+				Issuer:        op.EntityID,
+				Subject:       ec.Subject,
+				Audience:      ec.Subject,
+				IssuedAt:      unixtime.Unixtime{Time: now},
+				ExpiresAt:     unixtime.Unixtime{Time: now.Add(time.Hour)},
+				TrustAnchorID: taExplicit.EntityID,
+				Metadata:      &Metadata{RelyingParty: &rpMetadata},
+			}
+			if mutate != nil {
+				mutate(&payload)
+			}
+			res, err := op.GeneralJWTSigner.JWT(payload, oidfedconst.JWTTypeExplicitRegistrationResponse)
+			if err != nil {
+				return nil, err
+			}
+			return httpmock.NewBytesResponse(201, res), nil
+		},
+	)
+	return received
+}
+
+func TestFederationLeaf_ExplicitRegistration(t *testing.T) {
+	tests := []struct {
+		name      string
+		mutate    func(*EntityStatementPayload)
+		expectErr bool
+	}{
+		{
+			name: "valid",
+		},
+		{
+			name: "untrusted trust anchor",
+			mutate: func(p *EntityStatementPayload) {
+				p.TrustAnchorID = ta1.EntityID
+			},
+			expectErr: true,
+		},
+		{
+			name: "wrong audience",
+			mutate: func(p *EntityStatementPayload) {
+				p.Audience = rp1.EntityID
+			},
+			expectErr: true,
+		},
+		{
+			name: "expired",
+			mutate: func(p *EntityStatementPayload) {
+				p.ExpiresAt = unixtime.Unixtime{Time: time.Now().Add(-time.Minute)}
+			},
+			expectErr: true,
+		},
+		{
+			name: "no rp metadata",
+			mutate: func(p *EntityStatementPayload) {
+				p.Metadata = nil
+			},
+			expectErr: true,
+		},
+	}
+	for i, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				leaf := newExplicitRegistrationLeaf(t, "https://rp-explicit.example.com/"+string(rune('a'+i)))
+				mockExplicitRegistrationEndpoint(t, opExplicit, test.mutate)
+				registration, err := leaf.ExplicitRegistration(opExplicit.EntityID, nil)
+				stored, getErr := leaf.ExplicitClientRegistration(opExplicit.EntityID)
+				if getErr != nil {
+					t.Fatal(getErr)
+				}
+				if err != nil {
+					if !test.expectErr {
+						t.Fatal(err)
+					}
+					if stored != nil {
+						t.Error("failed registration was stored")
+					}
+					return
+				}
+				if test.expectErr {
+					t.Fatal("expected error, but registration succeeded")
+				}
+				if registration.ClientID() != leaf.EntityID {
+					t.Errorf("unexpected client id '%s'", registration.ClientID())
+				}
+				if registration.TrustAnchorID != taExplicit.EntityID {
+					t.Errorf("unexpected trust anchor id '%s'", registration.TrustAnchorID)
+				}
+				if stored == nil || stored.ClientID() != registration.ClientID() {
+					t.Error("registration was not stored")
+				}
+			},
+		)
+	}
+}
+
+func TestFederationLeaf_ExplicitRegistrationWithTrustChain(t *testing.T) {
+	leaf := newExplicitRegistrationLeaf(t, rpExplicit.EntityID)
+	chain, err := leaf.TrustChainForOP(opExplicit.EntityID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := mockExplicitRegistrationEndpoint(t, opExplicit, nil)
+	if _, err = leaf.ExplicitRegistration(opExplicit.EntityID, chain); err != nil {
+		t.Fatal(err)
+	}
+	if len(*received) != len(chain) {
+		t.Fatalf("expected op to receive %d statements, but got %d", len(chain), len(*received))
+	}
+	ec, err := ParseEntityStatement([]byte((*received)[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ec.Issuer != leaf.EntityID || ec.Subject != leaf.EntityID || ec.Audience != opExplicit.EntityID {
+		t.Errorf("unexpected entity configuration sent: %+v", ec.EntityStatementPayload)
+	}
+	if !ec.Verify(leaf.EntityConfigurationPayload().JWKS) {
+		t.Error("entity configuration sent is not signed by the leaf")
+	}
+	for i, m := range chain[1:] {
+		if (*received)[i+1] != string(m.RawJWT) {
+			t.Errorf("trust chain element %d was not sent as passed", i+1)
+		}
+	}
+
+	*received = nil
+	wrongFirst := append(JWSMessages{chain[1]}, chain[1:]...)
+	if _, err = leaf.ExplicitRegistration(opExplicit.EntityID, wrongFirst); err == nil {
+		t.Error("expected error for trust chain not starting with the leaf's entity configuration")
+	}
+	if *received != nil {
+		t.Error("registration request was sent for invalid trust chain")
+	}
+}
+
+func TestExplicitRegistrationHandler(t *testing.T) {
+	storage := CacheClientStorage{}
+	handler := NewExplicitRegistrationHandler(
+		opExplicit.EntityID,
+		TrustAnchors{{EntityID: taExplicit.EntityID, JWKS: taExplicit.data.JWKS}},
+		opExplicit.EntityStatementSigner, storage,
+	)
+	rpEC := func(aud string) []byte {
+		payload := rpExplicit.EntityStatementPayload()
+		payload.Audience = aud
+		ec, err := rpExplicit.EntityStatementSigner.JWT(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ec
+	}
+	unknownRP := newMockRP("https://unknown-rp.example.com", &OpenIDRelyingPartyMetadata{})
+	unknownPayload := unknownRP.EntityStatementPayload()
+	unknownPayload.Audience = opExplicit.EntityID
+	unknownEC, err := unknownRP.EntityStatementSigner.JWT(unknownPayload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	taEC, err := taExplicit.EntityConfigurationJWT()
+	if err != nil {
+		t.Fatal(err)
+	}
+	subStmt, err := taExplicit.FetchResponse(rpExplicit.EntityID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chainBody := []byte(`["` + string(rpEC(opExplicit.EntityID)) + `","` + string(subStmt) + `","` + string(taEC) + `"]`)
+
+	tests := []struct {
+		name           string
+		method         string
+		contentType    string
+		body           []byte
+		expectedStatus int
+		expectedError  string
+	}{
+		{
+			name:           "entity configuration",
+			method:         http.MethodPost,
+			contentType:    oidfedconst.ContentTypeEntityStatement,
+			body:           rpEC(opExplicit.EntityID),
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "trust chain",
+			method:         http.MethodPost,
+			contentType:    oidfedconst.ContentTypeTrustChain,
+			body:           chainBody,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "wrong method",
+			method:         http.MethodGet,
+			expectedStatus: http.StatusMethodNotAllowed,
+			expectedError:  InvalidRequest,
+		},
+		{
+			name:           "wrong content type",
+			method:         http.MethodPost,
+			contentType:    "application/json",
+			body:           rpEC(opExplicit.EntityID),
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  InvalidRequest,
+		},
+		{
+			name:           "wrong audience",
+			method:         http.MethodPost,
+			contentType:    oidfedconst.ContentTypeEntityStatement,
+			body:           rpEC(op1.EntityID),
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  InvalidRequest,
+		},
+		{
+			name:           "no trust chain",
+			method:         http.MethodPost,
+			contentType:    oidfedconst.ContentTypeEntityStatement,
+			body:           unknownEC,
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  InvalidTrustChain,
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				req := httptest.NewRequest(test.method, opExplicit.metadata.FederationRegistrationEndpoint, bytes.NewReader(test.body))
+				req.Header.Set("Content-Type", test.contentType)
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+				if rec.Code != test.expectedStatus {
+					t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body.String())
+				}
+				if test.expectedError != "" {
+					var errRes Error
+					if err := json.Unmarshal(rec.Body.Bytes(), &errRes); err != nil {
+						t.Fatal(err)
+					}
+					if errRes.Error != test.expectedError {
+						t.Errorf("unexpected error '%s', expected '%s'", errRes.Error, test.expectedError)
+					}
+					return
+				}
+				if ct := rec.Header().Get("Content-Type"); ct != oidfedconst.ContentTypeExplicitRegistrationResponse {
+					t.Errorf("unexpected content type '%s'", ct)
+				}
+				res, err := ParseExplicitRegistrationResponse(rec.Body.Bytes())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !res.Verify(opExplicit.jwks) {
+					t.Fatal("registration response could not be verified")
+				}
+				if res.Subject != rpExplicit.EntityID || res.Audience != rpExplicit.EntityID {
+					t.Errorf("registration response not issued for rp")
+				}
+				if res.TrustAnchorID != taExplicit.EntityID {
+					t.Errorf("unexpected trust anchor id '%s'", res.TrustAnchorID)
+				}
+				if !slices.Contains(res.Metadata.RelyingParty.Contacts, "ta@explicit.example.com") {
+					t.Errorf("metadata policy was not applied: %v", res.Metadata.RelyingParty.Contacts)
+				}
+				client, err := storage.Client(rpExplicit.EntityID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if client == nil || client.EntityID != rpExplicit.EntityID {
+					t.Error("client was not stored")
+				}
+			},
+		)
+	}
+}
+
+func TestFederationLeaf_ExplicitRegistrationAuthFlow(t *testing.T) {
+	op := newAuthFlowOP(t, "https://op-explicit-authflow.example.com")
+	op.clientID = "explicit-client"
+	mockExplicitRegistrationEndpoint(
+		t, op.mockOP, func(p *EntityStatementPayload) {
+			p.Metadata.RelyingParty.ClientID = op.clientID
+		},
+	)
+	leaf := newExplicitRegistrationLeaf(t, "https://rp-explicit-authflow.example.com")
+	redirectURI := leaf.EntityID + "/redirect"
+
+	registration, err := leaf.ExplicitRegistration(op.EntityID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if registration.ClientID() != op.clientID {
+		t.Fatalf("unexpected client id '%s'", registration.ClientID())
+	}
+
+	authURL, _, err := leaf.StartAuthFlow(op.EntityID, redirectURI, "openid", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clientID := u.Query().Get("client_id"); clientID != op.clientID {
+		t.Errorf("authorization url contains client_id '%s'", clientID)
+	}
+	m, err := jwx.Parse([]byte(u.Query().Get("request")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ro map[string]any
+	if err = json.Unmarshal(m.Payload(), &ro); err != nil {
+		t.Fatal(err)
+	}
+	if ro["client_id"] != op.clientID || ro["iss"] != op.clientID {
+		t.Errorf("request object not issued by registered client: %v", ro)
+	}
+	res := op.authorize(t, authURL)
+	tokenRes, errRes, err := leaf.CompleteAuthFlow(res, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errRes != nil {
+		t.Fatalf("unexpected error response: %+v", errRes)
+	}
+	if tokenRes.IDTokenClaims == nil || !slices.Contains(tokenRes.IDTokenClaims.Audience, op.clientID) {
+		t.Errorf("unexpected id token claims: %+v", tokenRes.IDTokenClaims)
+	}
+}
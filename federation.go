@@ -2,6 +2,7 @@ package oidfed
 
 import (
 	"crypto"
+	"sync"
 	"time"
 
 	"github.com/lestrrat-go/jwx/v3/jwa"
@@ -28,6 +29,7 @@ type FederationEntity struct {
 	TrustMarkIssuers AllowedTrustMarkIssuers
 	TrustMarkOwners  TrustMarkOwners
 	Extra            map[string]any
+	refresher        *TrustMarkRefresher
 }
 
 // FederationLeaf is a type for a leaf entity and holds all relevant information about it; it can also be used to
@@ -36,6 +38,17 @@ type FederationLeaf struct {
 	FederationEntity
 	TrustAnchors   TrustAnchors
 	oidcROProducer *RequestObjectProducer
+	// OIDCDecryptionKeys holds the private keys used to decrypt encrypted id
+	// tokens and userinfo responses; the public keys must be published in
+	// the RP's metadata
+	OIDCDecryptionKeys jwks.JWKS
+	// AuthFlowStateStore is used to store the state of authorization requests
+	// started with StartAuthFlow; if not set, CacheAuthFlowStateStore is used
+	AuthFlowStateStore AuthFlowStateStore
+	// IncludeTrustChain indicates that the leaf's trust chain to a trust
+	// anchor of the OP is included in the trust_chain claim of request
+	// objects, so that the OP does not have to resolve it
+	IncludeTrustChain bool
 }
 
 // NewFederationEntity creates a new FederationEntity with the passed properties
@@ -108,6 +121,42 @@ func (f FederationEntity) EntityConfigurationPayload() *EntityStatementPayload {
 	}
 }
 
+// refresherMutex guards the lazy creation of the FederationEntity's
+// TrustMarkRefresher; it is not part of the FederationEntity, since
+// FederationEntity values are copied
+var refresherMutex sync.Mutex
+
+// TrustMarkRefresher returns the TrustMarkRefresher for the
+// FederationEntity's TrustMarks; it is created with default settings on the
+// first call and can be configured before it is started. It is safe for
+// concurrent use.
+func (f *FederationEntity) TrustMarkRefresher() *TrustMarkRefresher {
+	refresherMutex.Lock()
+	defer refresherMutex.Unlock()
+	if f.refresher == nil {
+		f.refresher = NewTrustMarkRefresher(f.TrustMarks, nil)
+	}
+	return f.refresher
+}
+
+// StartTrustMarkRefresher starts refreshing the FederationEntity's
+// TrustMarks in the background ahead of their expiration; failures are
+// reported to the passed TrustMarkRefreshFailureHandler
+func (f *FederationEntity) StartTrustMarkRefresher(onFailure TrustMarkRefreshFailureHandler) {
+	f.TrustMarkRefresher().StartWithFailureHandler(onFailure)
+}
+
+// StopTrustMarkRefresher stops refreshing the FederationEntity's TrustMarks
+// in the background
+func (f *FederationEntity) StopTrustMarkRefresher() {
+	refresherMutex.Lock()
+	refresher := f.refresher
+	refresherMutex.Unlock()
+	if refresher != nil {
+		refresher.Stop()
+	}
+}
+
 // EntityConfigurationJWT creates and returns the signed jwt as a []byte for
 // the entity's entity configuration
 func (f FederationEntity) EntityConfigurationJWT() ([]byte, error) {
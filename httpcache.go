@@ -0,0 +1,164 @@
+package oidfed
+
+import (
+	"encoding/json"
+	"net/url"
+	"time"
+
+	"github.com/go-oidfed/lib/cache"
+	"github.com/go-oidfed/lib/internal"
+	"github.com/go-oidfed/lib/internal/http"
+	"github.com/go-oidfed/lib/internal/jwx"
+	"github.com/go-oidfed/lib/unixtime"
+)
+
+// HTTPCacheRevalidationPeriod is the duration a stale http response that
+// carries an ETag or Last-Modified header is kept, so that it can be
+// revalidated with a conditional request instead of being fetched again.
+var HTTPCacheRevalidationPeriod = 24 * time.Hour
+
+// httpCacheEntry is a cached http response together with its validators
+type httpCacheEntry struct {
+	Body         []byte
+	ETag         string
+	LastModified string
+	FreshUntil   time.Time
+}
+
+func (e httpCacheEntry) validators() http.CacheValidators {
+	return http.CacheValidators{
+		ETag:         e.ETag,
+		LastModified: e.LastModified,
+	}
+}
+
+func httpCacheKey(uri string, params url.Values) string {
+	if len(params) > 0 {
+		uri += "?" + params.Encode()
+	}
+	return cache.Key(cache.KeyHTTPResponse, uri)
+}
+
+// cacheLifetime returns how long a value obtained from a http response
+// should be cached; this is the passed fallback limited by the freshness
+// lifetime of the response, if the response defines one
+func cacheLifetime(cc http.CacheControl, fallback time.Duration) time.Duration {
+	if lifetime, known := cc.Lifetime(); known && lifetime < fallback {
+		return lifetime
+	}
+	return fallback
+}
+
+// jwtExpiration returns the exp claim of the passed body, if it is a jwt with
+// an exp claim; the signature is not verified
+func jwtExpiration(body []byte) (time.Time, bool) {
+	m, err := jwx.Parse(body)
+	if err != nil || m.Message == nil {
+		return time.Time{}, false
+	}
+	var claims struct {
+		ExpiresAt *unixtime.Unixtime `json:"exp"`
+	}
+	if err = json.Unmarshal(m.Payload(), &claims); err != nil || claims.ExpiresAt == nil || claims.ExpiresAt.IsZero() {
+		return time.Time{}, false
+	}
+	return claims.ExpiresAt.Time, true
+}
+
+// clampToExpiration limits the freshness lifetime of a response whose body is
+// a jwt to the expiration of the jwt, so that an expired jwt is never
+// considered fresh
+func clampToExpiration(cc http.CacheControl, body []byte) http.CacheControl {
+	exp, ok := jwtExpiration(body)
+	if !ok {
+		return cc
+	}
+	if remaining := max(time.Until(exp), 0); !cc.HasMaxAge || remaining < cc.MaxAge {
+		cc.MaxAge = remaining
+		cc.HasMaxAge = true
+	}
+	return cc
+}
+
+// httpGetCached performs a http GET request honoring the HTTP caching
+// headers of the server. A response that is still fresh according to its
+// Cache-Control max-age is returned from the cache,
+// a stale response is revalidated with a conditional request if it has an
+// ETag or Last-Modified header. If the server does not define a freshness
+// lifetime, defaultLifetime is used; if defaultLifetime is not positive the
+// lifetime stays unknown, so that the caller can apply its own fallback
+// (e.g. the expiration of an entity statement). If the body is a jwt, the
+// freshness lifetime never exceeds its expiration.
+// The returned http.CacheControl describes the freshness of the returned body.
+func httpGetCached(uri string, params url.Values, defaultLifetime time.Duration) (
+	[]byte, http.CacheControl, error,
+) {
+	key := httpCacheKey(uri, params)
+	var entry httpCacheEntry
+	set, err := cache.Get(key, &entry)
+	if err != nil {
+		internal.Log(err)
+		set = false
+	}
+	if set && time.Now().Before(entry.FreshUntil) {
+		internal.Logf("Obtained fresh http response for %+q from cache", uri)
+		return entry.Body, http.CacheControl{
+			CacheValidators: entry.validators(),
+			MaxAge:          time.Until(entry.FreshUntil),
+			HasMaxAge:       true,
+		}, nil
+	}
+	var validators http.CacheValidators
+	if set {
+		validators = entry.validators()
+	}
+	res, notModified, errRes, err := http.ConditionalGet(uri, params, validators)
+	if err != nil {
+		return nil, http.CacheControl{}, err
+	}
+	if errRes != nil {
+		return nil, http.CacheControl{}, errRes.Err()
+	}
+	cc := http.ParseCacheControl(res.Header())
+	if notModified {
+		internal.Logf("Revalidated cached http response for %+q", uri)
+		if cc.ETag == "" {
+			cc.ETag = entry.ETag
+		}
+		if cc.LastModified == "" {
+			cc.LastModified = entry.LastModified
+		}
+	} else {
+		entry = httpCacheEntry{Body: res.Body()}
+	}
+	if !cc.HasMaxAge && !cc.NoCache && !cc.NoStore && defaultLifetime > 0 {
+		cc.MaxAge = defaultLifetime
+		cc.HasMaxAge = true
+	}
+	cc = clampToExpiration(cc, entry.Body)
+	httpCacheSet(key, entry.Body, cc)
+	return entry.Body, cc, nil
+}
+
+func httpCacheSet(key string, body []byte, cc http.CacheControl) {
+	if cc.NoStore {
+		return
+	}
+	lifetime, _ := cc.Lifetime()
+	ttl := lifetime
+	if cc.HasValidators() && ttl < HTTPCacheRevalidationPeriod {
+		ttl = HTTPCacheRevalidationPeriod
+	}
+	if ttl <= 0 {
+		return
+	}
+	entry := httpCacheEntry{
+		Body:         body,
+		ETag:         cc.ETag,
+		LastModified: cc.LastModified,
+		FreshUntil:   time.Now().Add(lifetime),
+	}
+	if err := cache.Set(key, entry, ttl); err != nil {
+		internal.Log(err)
+	}
+}
@@ -0,0 +1,235 @@
+package oidfed
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/lestrrat-go/jwx/v3/jwa"
+
+	"github.com/go-oidfed/lib/internal/jwx"
+	"github.com/go-oidfed/lib/oidfedconst"
+	"github.com/go-oidfed/lib/unixtime"
+)
+
+func mockCachingEndpoint(uri, etag, cacheControl string, body []byte) (calls, conditionalCalls *int) {
+	calls = new(int)
+	conditionalCalls = new(int)
+	httpmock.RegisterResponder(
+		"GET", uri, func(req *http.Request) (*http.Response, error) {
+			*calls++
+			header := http.Header{}
+			header.Set("ETag", etag)
+			if cacheControl != "" {
+				header.Set("Cache-Control", cacheControl)
+			}
+			if req.Header.Get("If-None-Match") == etag {
+				*conditionalCalls++
+				res := httpmock.NewBytesResponse(http.StatusNotModified, nil)
+				res.Header = header
+				return res, nil
+			}
+			res := httpmock.NewBytesResponse(http.StatusOK, body)
+			res.Header = header
+			return res, nil
+		},
+	)
+	return
+}
+
+func TestHttpGetCached(t *testing.T) {
+	tests := []struct {
+		name                     string
+		uri                      string
+		cacheControl             string
+		defaultLifetime          time.Duration
+		expectedCalls            int
+		expectedConditionalCalls int
+	}{
+		{
+			name:                     "max-age",
+			uri:                      "https://cache.example.org/max-age",
+			cacheControl:             "public, max-age=60",
+			expectedCalls:            1,
+			expectedConditionalCalls: 0,
+		},
+		{
+			name:                     "no-cache",
+			uri:                      "https://cache.example.org/no-cache",
+			cacheControl:             "no-cache",
+			defaultLifetime:          time.Hour,
+			expectedCalls:            3,
+			expectedConditionalCalls: 2,
+		},
+		{
+			name:                     "default lifetime",
+			uri:                      "https://cache.example.org/default",
+			defaultLifetime:          time.Hour,
+			expectedCalls:            1,
+			expectedConditionalCalls: 0,
+		},
+		{
+			name:                     "no lifetime",
+			uri:                      "https://cache.example.org/none",
+			expectedCalls:            3,
+			expectedConditionalCalls: 2,
+		},
+		{
+			name:                     "no-store",
+			uri:                      "https://cache.example.org/no-store",
+			cacheControl:             "no-store",
+			expectedCalls:            3,
+			expectedConditionalCalls: 0,
+		},
+	}
+	body := []byte(`["https://sub.example.org"]`)
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				calls, conditionalCalls := mockCachingEndpoint(test.uri, `"v1"`, test.cacheControl, body)
+				for i := 0; i < 3; i++ {
+					res, _, err := httpGetCached(test.uri, nil, test.defaultLifetime)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if string(res) != string(body) {
+						t.Fatalf("unexpected body: %s", res)
+					}
+				}
+				if *calls != test.expectedCalls {
+					t.Errorf("expected %d requests, but got %d", test.expectedCalls, *calls)
+				}
+				if *conditionalCalls != test.expectedConditionalCalls {
+					t.Errorf(
+						"expected %d conditional requests, but got %d", test.expectedConditionalCalls,
+						*conditionalCalls,
+					)
+				}
+			},
+		)
+	}
+}
+
+func TestHttpGetCached_ClampedToJWTExpiration(t *testing.T) {
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwtWithExp := func(exp time.Time) []byte {
+		payload, err := json.Marshal(map[string]any{"exp": unixtime.Unixtime{Time: exp}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		jwt, err := jwx.SignPayload(payload, jwa.ES256(), sk, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return jwt
+	}
+	tests := []struct {
+		name                     string
+		uri                      string
+		exp                      time.Time
+		maxMaxAge                time.Duration
+		expectedCalls            int
+		expectedConditionalCalls int
+	}{
+		{
+			name:                     "expired jwt",
+			uri:                      "https://cache.example.org/expired-jwt",
+			exp:                      time.Now().Add(-time.Minute),
+			maxMaxAge:                0,
+			expectedCalls:            3,
+			expectedConditionalCalls: 2,
+		},
+		{
+			name:                     "jwt expires before max-age",
+			uri:                      "https://cache.example.org/expiring-jwt",
+			exp:                      time.Now().Add(time.Minute),
+			maxMaxAge:                time.Minute,
+			expectedCalls:            1,
+			expectedConditionalCalls: 0,
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				calls, conditionalCalls := mockCachingEndpoint(
+					test.uri, `"v1"`, "max-age=3600", jwtWithExp(test.exp),
+				)
+				for i := 0; i < 3; i++ {
+					_, cc, err := httpGetCached(test.uri, nil, 0)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if lifetime, known := cc.Lifetime(); !known || lifetime > test.maxMaxAge {
+						t.Errorf("expected freshness lifetime of at most %s, but got %s", test.maxMaxAge, lifetime)
+					}
+				}
+				if *calls != test.expectedCalls {
+					t.Errorf("expected %d requests, but got %d", test.expectedCalls, *calls)
+				}
+				if *conditionalCalls != test.expectedConditionalCalls {
+					t.Errorf(
+						"expected %d conditional requests, but got %d", test.expectedConditionalCalls,
+						*conditionalCalls,
+					)
+				}
+			},
+		)
+	}
+}
+
+func TestHttpGetCached_ErrorStatus(t *testing.T) {
+	uri := "https://cache.example.org/error"
+	calls := 0
+	httpmock.RegisterResponder(
+		"GET", uri, func(_ *http.Request) (*http.Response, error) {
+			calls++
+			res := httpmock.NewStringResponse(http.StatusServiceUnavailable, "unavailable")
+			res.Header.Set("ETag", `"v1"`)
+			res.Header.Set("Cache-Control", "max-age=60")
+			return res, nil
+		},
+	)
+	for i := 0; i < 2; i++ {
+		if _, _, err := httpGetCached(uri, nil, time.Hour); err == nil {
+			t.Fatal("expected error for error status")
+		}
+	}
+	if calls != 2 {
+		t.Errorf("expected error response not to be cached, but got %d requests", calls)
+	}
+}
+
+func TestGetEntityConfiguration_CachedWithoutCacheControl(t *testing.T) {
+	rp := newMockRP("https://no-cache-control.example.org", nil)
+	calls := 0
+	httpmock.RegisterResponder(
+		"GET", rp.EntityID+oidfedconst.FederationSuffix, func(_ *http.Request) (*http.Response, error) {
+			calls++
+			res, err := rp.EntityConfigurationJWT()
+			if err != nil {
+				return nil, err
+			}
+			return httpmock.NewBytesResponse(http.StatusOK, res), nil
+		},
+	)
+	for i := 0; i < 3; i++ {
+		ec, err := GetEntityConfiguration(rp.EntityID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ec.Subject != rp.EntityID {
+			t.Fatalf("unexpected subject: %s", ec.Subject)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("expected entity configuration to be cached until exp, but got %d requests", calls)
+	}
+}
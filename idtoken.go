@@ -0,0 +1,124 @@
+package oidfed
+
+import (
+	"encoding/json"
+	"slices"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/go-oidfed/lib/internal/jwx"
+	"github.com/go-oidfed/lib/jwks"
+	"github.com/go-oidfed/lib/unixtime"
+)
+
+// IDTokenClockSkew is the clock skew that is tolerated when checking the
+// time claims of an id token
+var IDTokenClockSkew = time.Minute
+
+// IDTokenClaims holds the claims of a verified id token;
+// additional claims are set in the Extra field
+type IDTokenClaims struct {
+	Issuer          string                     `json:"iss"`
+	Subject         string                     `json:"sub"`
+	Audience        SliceOrSingleValue[string] `json:"aud"`
+	ExpiresAt       unixtime.Unixtime          `json:"exp"`
+	IssuedAt        unixtime.Unixtime          `json:"iat"`
+	AuthTime        *unixtime.Unixtime         `json:"auth_time,omitempty"`
+	Nonce           string                     `json:"nonce,omitempty"`
+	ACR             string                     `json:"acr,omitempty"`
+	AMR             []string                   `json:"amr,omitempty"`
+	AuthorizedParty string                     `json:"azp,omitempty"`
+
+	Extra map[string]any `json:"-"`
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface
+func (c *IDTokenClaims) UnmarshalJSON(data []byte) error {
+	type idTokenClaims IDTokenClaims
+	cc := idTokenClaims(*c)
+	extra, err := unmarshalWithExtra(data, &cc)
+	if err != nil {
+		return err
+	}
+	cc.Extra = extra
+	*c = IDTokenClaims(cc)
+	return nil
+}
+
+// VerifyIDToken verifies an id token issued by the OP with the passed issuer
+// for this FederationLeaf and returns its claims.
+// The signature is verified with the OP's keys as obtained from its resolved
+// metadata; the iss, aud, azp, exp, and iat claims are checked.
+// If a nonce is passed, the id token must contain the same nonce.
+func (f FederationLeaf) VerifyIDToken(issuer string, idToken []byte, nonce string) (*IDTokenClaims, error) {
+	opMetadata, federationKeys, err := f.resolveOP(issuer)
+	if err != nil {
+		return nil, err
+	}
+	opKeys, err := opJWKS(opMetadata, federationKeys)
+	if err != nil {
+		return nil, err
+	}
+	return f.verifyIDToken(opMetadata.Issuer, opKeys, idToken, nonce)
+}
+
+func (f FederationLeaf) verifyIDToken(
+	issuer string, opKeys jwks.JWKS, idToken []byte, nonce string,
+) (*IDTokenClaims, error) {
+	m, err := jwx.Parse(idToken)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse id token")
+	}
+	client := f.oidcClient(issuer)
+	if rp := client.Metadata; rp != nil && rp.IDTokenSignedResponseAlg != "" {
+		if len(m.Signatures()) == 0 {
+			return nil, errors.New("id token is not signed")
+		}
+		alg, _ := m.Signatures()[0].ProtectedHeaders().Algorithm()
+		if alg.String() != rp.IDTokenSignedResponseAlg {
+			return nil, errors.Errorf("id token is not signed with '%s'", rp.IDTokenSignedResponseAlg)
+		}
+	}
+	payload, err := m.VerifyWithSet(opKeys)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not verify id token signature")
+	}
+	var claims IDTokenClaims
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return nil, errors.Wrap(err, "could not parse id token claims")
+	}
+	if err = claims.verify(issuer, client.ID, nonce); err != nil {
+		return nil, errors.Wrap(err, "id token invalid")
+	}
+	return &claims, nil
+}
+
+func (c IDTokenClaims) verify(issuer, clientID, nonce string) error {
+	if c.Issuer != issuer {
+		return errors.Errorf("issuer '%s' does not match '%s'", c.Issuer, issuer)
+	}
+	if c.Subject == "" {
+		return errors.New("no subject")
+	}
+	if !slices.Contains(c.Audience, clientID) {
+		return errors.New("client is not an audience")
+	}
+	if len(c.Audience) > 1 && c.AuthorizedParty == "" {
+		return errors.New("no authorized party for multiple audiences")
+	}
+	if c.AuthorizedParty != "" && c.AuthorizedParty != clientID {
+		return errors.New("client is not the authorized party")
+	}
+	now := time.Now()
+	if c.ExpiresAt.IsZero() || c.ExpiresAt.Add(IDTokenClockSkew).Before(now) {
+		return errors.New("expired")
+	}
+	if c.IssuedAt.IsZero() || c.IssuedAt.Add(-IDTokenClockSkew).After(now) {
+		return errors.New("not yet valid")
+	}
+	if nonce != "" && c.Nonce != nonce {
+		return errors.New("nonce mismatch")
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package oidfed
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v3/jwa"
+
+	"github.com/go-oidfed/lib/jwks"
+	"github.com/go-oidfed/lib/unixtime"
+)
+
+const (
+	testIDTokenIssuer   = "https://op.example.com"
+	testIDTokenClientID = "https://rp.example.com"
+)
+
+func validIDTokenClaims() IDTokenClaims {
+	now := time.Now()
+	return IDTokenClaims{
+		Issuer:    testIDTokenIssuer,
+		Subject:   "user",
+		Audience:  SliceOrSingleValue[string]{testIDTokenClientID},
+		ExpiresAt: unixtime.Unixtime{Time: now.Add(time.Hour)},
+		IssuedAt:  unixtime.Unixtime{Time: now},
+		Nonce:     "nonce",
+	}
+}
+
+func TestIDTokenClaims_verify(t *testing.T) {
+	tests := []struct {
+		name      string
+		mutate    func(*IDTokenClaims)
+		nonce     string
+		expectErr bool
+	}{
+		{
+			name:  "valid",
+			nonce: "nonce",
+		},
+		{
+			name: "nonce not checked",
+		},
+		{
+			name:      "nonce mismatch",
+			nonce:     "other",
+			expectErr: true,
+		},
+		{
+			name:      "wrong issuer",
+			mutate:    func(c *IDTokenClaims) { c.Issuer = "https://other.example.com" },
+			expectErr: true,
+		},
+		{
+			name:      "no subject",
+			mutate:    func(c *IDTokenClaims) { c.Subject = "" },
+			expectErr: true,
+		},
+		{
+			name:      "wrong audience",
+			mutate:    func(c *IDTokenClaims) { c.Audience = SliceOrSingleValue[string]{"https://other.example.com"} },
+			expectErr: true,
+		},
+		{
+			name: "multiple audiences with azp",
+			mutate: func(c *IDTokenClaims) {
+				c.Audience = append(c.Audience, "https://other.example.com")
+				c.AuthorizedParty = testIDTokenClientID
+			},
+		},
+		{
+			name:      "multiple audiences without azp",
+			mutate:    func(c *IDTokenClaims) { c.Audience = append(c.Audience, "https://other.example.com") },
+			expectErr: true,
+		},
+		{
+			name:      "wrong azp",
+			mutate:    func(c *IDTokenClaims) { c.AuthorizedParty = "https://other.example.com" },
+			expectErr: true,
+		},
+		{
+			name:      "expired",
+			mutate:    func(c *IDTokenClaims) { c.ExpiresAt = unixtime.Unixtime{Time: time.Now().Add(-time.Hour)} },
+			expectErr: true,
+		},
+		{
+			name:      "issued in the future",
+			mutate:    func(c *IDTokenClaims) { c.IssuedAt = unixtime.Unixtime{Time: time.Now().Add(time.Hour)} },
+			expectErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				claims := validIDTokenClaims()
+				if test.mutate != nil {
+					test.mutate(&claims)
+				}
+				err := claims.verify(testIDTokenIssuer, testIDTokenClientID, test.nonce)
+				if err != nil && !test.expectErr {
+					t.Fatal(err)
+				}
+				if err == nil && test.expectErr {
+					t.Fatal("expected error, but verification succeeded")
+				}
+			},
+		)
+	}
+}
+
+func TestFederationLeaf_verifyIDToken(t *testing.T) {
+	opKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opKeys := jwks.KeyToJWKS(opKey.Public(), jwa.ES256())
+	leaf := FederationLeaf{
+		FederationEntity: FederationEntity{
+			EntityID: testIDTokenClientID,
+			Metadata: &Metadata{
+				RelyingParty: &OpenIDRelyingPartyMetadata{IDTokenSignedResponseAlg: "ES256"},
+			},
+		},
+	}
+	idToken := func(signer *GeneralJWTSigner, claims IDTokenClaims) []byte {
+		jwt, err := signer.JWT(claims, "JWT")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return jwt
+	}
+	expired := validIDTokenClaims()
+	expired.ExpiresAt = unixtime.Unixtime{Time: time.Now().Add(-time.Hour)}
+
+	tests := []struct {
+		name      string
+		idToken   []byte
+		expectErr bool
+	}{
+		{
+			name:    "valid",
+			idToken: idToken(NewGeneralJWTSigner(opKey, jwa.ES256()), validIDTokenClaims()),
+		},
+		{
+			name:      "wrong key",
+			idToken:   idToken(NewGeneralJWTSigner(otherKey, jwa.ES256()), validIDTokenClaims()),
+			expectErr: true,
+		},
+		{
+			name:      "unregistered alg",
+			idToken:   idToken(NewGeneralJWTSigner(opKey, jwa.ES512()), validIDTokenClaims()),
+			expectErr: true,
+		},
+		{
+			name:      "expired",
+			idToken:   idToken(NewGeneralJWTSigner(opKey, jwa.ES256()), expired),
+			expectErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				claims, err := leaf.verifyIDToken(testIDTokenIssuer, opKeys, test.idToken, "nonce")
+				if err != nil {
+					if !test.expectErr {
+						t.Fatal(err)
+					}
+					return
+				}
+				if test.expectErr {
+					t.Fatal("expected error, but verification succeeded")
+				}
+				if claims.Subject != "user" {
+					t.Errorf("unexpected subject '%s'", claims.Subject)
+				}
+			},
+		)
+	}
+}
@@ -0,0 +1,98 @@
+package http
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/pkg/errors"
+)
+
+// CacheValidators holds the validators of a previous response that can be
+// used to make a conditional request
+type CacheValidators struct {
+	ETag         string
+	LastModified string
+}
+
+// CacheControl holds the caching relevant information of a http response
+type CacheControl struct {
+	CacheValidators
+	MaxAge    time.Duration
+	HasMaxAge bool
+	NoStore   bool
+	NoCache   bool
+}
+
+// HasValidators checks if the CacheValidators can be used for a conditional
+// request
+func (v CacheValidators) HasValidators() bool {
+	return v.ETag != "" || v.LastModified != ""
+}
+
+// Lifetime returns the duration a response is fresh and whether this is
+// known from the response headers
+func (c CacheControl) Lifetime() (time.Duration, bool) {
+	if c.NoStore || c.NoCache {
+		return 0, true
+	}
+	return c.MaxAge, c.HasMaxAge
+}
+
+// ParseCacheControl parses the caching relevant headers of a http response
+func ParseCacheControl(header http.Header) (c CacheControl) {
+	c.ETag = header.Get("ETag")
+	c.LastModified = header.Get("Last-Modified")
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-store":
+			c.NoStore = true
+		case "no-cache":
+			c.NoCache = true
+		case "max-age":
+			seconds, err := strconv.ParseInt(strings.Trim(value, `"`), 10, 64)
+			if err != nil || seconds < 0 {
+				continue
+			}
+			c.MaxAge = time.Duration(seconds) * time.Second
+			c.HasMaxAge = true
+		}
+	}
+	return
+}
+
+// ConditionalGet performs a http GET request; if CacheValidators are passed
+// the request is made conditional through the If-None-Match and
+// If-Modified-Since headers. The returned bool indicates if the server
+// responded with 304 Not Modified. Any other non-success response results in
+// an error.
+func ConditionalGet(url string, params url.Values, validators CacheValidators) (
+	*resty.Response, bool, *HttpError, error,
+) {
+	req := client.R().SetQueryParamsFromValues(params).SetError(&HttpError{})
+	if validators.ETag != "" {
+		req.SetHeader("If-None-Match", validators.ETag)
+	}
+	if validators.LastModified != "" {
+		req.SetHeader("If-Modified-Since", validators.LastModified)
+	}
+	resp, err := req.Get(url)
+	if err != nil {
+		return nil, false, nil, errors.WithStack(err)
+	}
+	if resp.StatusCode() == http.StatusNotModified {
+		return resp, true, nil, nil
+	}
+	if errRes, ok := resp.Error().(*HttpError); ok && errRes != nil && errRes.Error != "" {
+		errRes.Status = resp.RawResponse.StatusCode
+		return nil, false, errRes, nil
+	}
+	if resp.IsError() {
+		return nil, false, nil, errors.Errorf("http request to '%s' returned status %d", url, resp.StatusCode())
+	}
+	return resp, false, nil, nil
+}
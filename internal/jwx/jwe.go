@@ -0,0 +1,117 @@
+package jwx
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/lestrrat-go/jwx/v3/jwa"
+	"github.com/lestrrat-go/jwx/v3/jwe"
+	"github.com/lestrrat-go/jwx/v3/jwk"
+	"github.com/pkg/errors"
+
+	myjwk "github.com/go-oidfed/lib/jwks"
+)
+
+// IsJWE checks if the passed data is a JWE in compact serialization
+func IsJWE(data []byte) bool {
+	data = bytes.TrimSpace(data)
+	return len(data) > 0 && data[0] != '{' && bytes.Count(data, []byte{'.'}) == 4
+}
+
+// keyUsableForEncryption checks if the passed jwk.Key can be used with the
+// passed jwa.KeyEncryptionAlgorithm
+func keyUsableForEncryption(key jwk.Key, alg jwa.KeyEncryptionAlgorithm) bool {
+	if use, ok := key.KeyUsage(); ok && use != "" && use != jwk.ForEncryption.String() {
+		return false
+	}
+	if keyAlg, ok := key.Algorithm(); ok && keyAlg.String() != alg.String() {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(alg.String(), "RSA"):
+		return key.KeyType() == jwa.RSA()
+	case strings.HasPrefix(alg.String(), "ECDH-ES"):
+		return key.KeyType() == jwa.EC() || key.KeyType() == jwa.OKP()
+	default:
+		return false
+	}
+}
+
+// EncryptJWT encrypts the passed (signed) jwt to a key of the passed
+// myjwk.JWKS, creating a nested jwt. The first key of the set that is
+// usable for encryption with the passed jwa.KeyEncryptionAlgorithm is used.
+func EncryptJWT(
+	jwt []byte, keys myjwk.JWKS, alg jwa.KeyEncryptionAlgorithm, enc jwa.ContentEncryptionAlgorithm,
+) ([]byte, error) {
+	if keys.Set == nil {
+		return nil, errors.New("no encryption keys passed")
+	}
+	for i := 0; i < keys.Len(); i++ {
+		key, _ := keys.Key(i)
+		if !keyUsableForEncryption(key, alg) {
+			continue
+		}
+		headers := jwe.NewHeaders()
+		if err := headers.Set(jwe.ContentTypeKey, "JWT"); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if kid, ok := key.KeyID(); ok {
+			if err := headers.Set(jwe.KeyIDKey, kid); err != nil {
+				return nil, errors.WithStack(err)
+			}
+		}
+		encrypted, err := jwe.Encrypt(
+			jwt,
+			jwe.WithKey(alg, key),
+			jwe.WithContentEncryption(enc),
+			jwe.WithProtectedHeaders(headers),
+		)
+		return encrypted, errors.Wrap(err, "could not encrypt jwt")
+	}
+	return nil, errors.Errorf("no key usable for encryption with '%s' found", alg)
+}
+
+// Decrypt decrypts the passed JWE with one of the (private) keys of the
+// passed myjwk.JWKS. If allowedAlgs are passed, the key encryption algorithm
+// of the JWE must be one of them.
+func Decrypt(data []byte, keys myjwk.JWKS, allowedAlgs ...jwa.KeyEncryptionAlgorithm) ([]byte, error) {
+	if keys.Set == nil || keys.Len() == 0 {
+		return nil, errors.New("jwe decrypt: no keys passed")
+	}
+	data = bytes.TrimSpace(data)
+	msg, err := jwe.Parse(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse jwe")
+	}
+	alg, ok := msg.ProtectedHeaders().Algorithm()
+	if !ok {
+		return nil, errors.New("jwe does not specify a key encryption algorithm")
+	}
+	if len(allowedAlgs) > 0 {
+		allowed := false
+		for _, a := range allowedAlgs {
+			if a.String() == alg.String() {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return nil, errors.Errorf("jwe key encryption algorithm '%s' not allowed", alg)
+		}
+	}
+	kid, _ := msg.ProtectedHeaders().KeyID()
+	for i := 0; i < keys.Len(); i++ {
+		key, _ := keys.Key(i)
+		if keyID, ok := key.KeyID(); kid != "" && ok && keyID != kid {
+			continue
+		}
+		if !keyUsableForEncryption(key, alg) {
+			continue
+		}
+		decrypted, err := jwe.Decrypt(data, jwe.WithKey(alg, key))
+		if err == nil {
+			return decrypted, nil
+		}
+	}
+	return nil, errors.New("jwe decrypt: no key could decrypt the jwe")
+}
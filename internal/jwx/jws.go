@@ -78,28 +78,44 @@ func SignWithType(payload []byte, typ string, signingAlg jwa.SignatureAlgorithm,
 	return SignPayload(payload, signingAlg, key, headers)
 }
 
-// SignPayload signs a payload with the passed properties and adds the kid to the jwt header
+// SignPayload signs a payload with the passed properties and adds the kid to the jwt header.
+// The kid is derived from the public key only and the signature is created
+// through the crypto.Signer interface, so that opaque signers (e.g.
+// HSM or KMS backed keys) that do not expose private key material can be used.
 func SignPayload(payload []byte, signingAlg jwa.SignatureAlgorithm, key crypto.Signer, headers jws.Headers) (
 	[]byte,
 	error,
 ) {
-	k, err := jwk.Import(key)
-	if err != nil {
-		return nil, err
+	if key == nil {
+		return nil, errors.New("no signing key passed")
 	}
-	if err = jwk.AssignKeyID(k); err != nil {
+	keyID, err := KeyID(key.Public())
+	if err != nil {
 		return nil, err
 	}
 	if headers == nil {
 		headers = jws.NewHeaders()
 	}
-	keyID, _ := k.KeyID()
 	if err = headers.Set(jws.KeyIDKey, keyID); err != nil {
 		return nil, err
 	}
 	return jws.Sign(payload, jws.WithKey(signingAlg, key, jws.WithProtectedHeaders(headers)))
 }
 
+// KeyID returns the key id for the passed public key as it is also assigned
+// in jwks.KeyToJWKS, i.e. the jwk thumbprint of the key
+func KeyID(publicKey crypto.PublicKey) (string, error) {
+	k, err := jwk.PublicKeyOf(publicKey)
+	if err != nil {
+		return "", errors.Wrap(err, "could not derive jwk from public key")
+	}
+	if err = jwk.AssignKeyID(k); err != nil {
+		return "", errors.WithStack(err)
+	}
+	keyID, _ := k.KeyID()
+	return keyID, nil
+}
+
 // GetExp returns the expiration of a jwt
 func GetExp(bytes []byte) (exp unixtime.Unixtime, err error) {
 	parsed, err := jwt.Parse(bytes)
@@ -90,22 +90,36 @@ func (jwks *JWKS) UnmarshalMsgpack(data []byte) error {
 	return errors.WithStack(json.Unmarshal(jsonData, jwks))
 }
 
-// KeyToJWKS creates a jwk.Set from the passed publicKey and sets the algorithm key in the jwk.Key to the passed jwa.SignatureAlgorithm
+// KeyToJWKS creates a jwk.Set from the passed publicKey and sets the algorithm key in the jwk.Key to the passed jwa.SignatureAlgorithm.
+// KeyToJWKS panics if the key cannot be converted, see PublicKeyToJWKS for a variant returning an error.
 func KeyToJWKS(publicKey interface{}, alg jwa.SignatureAlgorithm) JWKS {
-	key, err := jwk.PublicKeyOf(publicKey)
+	jwks, err := PublicKeyToJWKS(publicKey, alg)
 	if err != nil {
 		panic(err)
 	}
+	return jwks
+}
+
+// PublicKeyToJWKS creates a JWKS from the passed publicKey and sets the
+// algorithm key in the jwk.Key to the passed jwa.SignatureAlgorithm; the kid
+// is the jwk thumbprint of the key
+func PublicKeyToJWKS(publicKey interface{}, alg jwa.SignatureAlgorithm) (JWKS, error) {
+	key, err := jwk.PublicKeyOf(publicKey)
+	if err != nil {
+		return JWKS{}, errors.Wrap(err, "could not convert public key to jwk")
+	}
 	if err = jwk.AssignKeyID(key); err != nil {
-		panic(err)
+		return JWKS{}, errors.WithStack(err)
 	}
 	if err = key.Set(jwk.KeyUsageKey, string(jwk.ForSignature)); err != nil {
-		panic(err)
+		return JWKS{}, errors.WithStack(err)
 	}
 	if err = key.Set(jwk.AlgorithmKey, alg); err != nil {
-		panic(err)
+		return JWKS{}, errors.WithStack(err)
 	}
 	jwks := jwk.NewSet()
-	jwks.AddKey(key)
-	return JWKS{jwks}
+	if err = jwks.AddKey(key); err != nil {
+		return JWKS{}, errors.WithStack(err)
+	}
+	return JWKS{jwks}, nil
 }
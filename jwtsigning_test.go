@@ -0,0 +1,112 @@
+package oidfed
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"io"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/v3/jwa"
+
+	"github.com/go-oidfed/lib/internal/jwx"
+	"github.com/go-oidfed/lib/oidfedconst"
+)
+
+// opaqueSigner is a crypto.Signer that does not expose the private key,
+// as it is the case for HSM or KMS backed keys
+type opaqueSigner struct {
+	signer crypto.Signer
+}
+
+func (s opaqueSigner) Public() crypto.PublicKey {
+	return s.signer.Public()
+}
+
+func (s opaqueSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return s.signer.Sign(rand, digest, opts)
+}
+
+func TestOpaqueSigner(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		key  crypto.Signer
+		alg  jwa.SignatureAlgorithm
+	}{
+		{
+			name: "ES256",
+			key:  opaqueSigner{ecKey},
+			alg:  jwa.ES256(),
+		},
+		{
+			name: "RS256",
+			key:  opaqueSigner{rsaKey},
+			alg:  jwa.RS256(),
+		},
+		{
+			name: "PS256",
+			key:  opaqueSigner{rsaKey},
+			alg:  jwa.PS256(),
+		},
+		{
+			name: "EdDSA",
+			key:  opaqueSigner{edKey},
+			alg:  jwa.EdDSA(),
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				signer := NewEntityStatementSigner(test.key, test.alg)
+				keys := signer.JWKS()
+				esJWT, err := signer.JWT(EntityStatementPayload{Issuer: "https://op.example.org"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				m, err := jwx.Parse(esJWT)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !m.VerifyType(oidfedconst.JWTTypeEntityStatement) {
+					t.Error("entity statement does not have the correct type")
+				}
+				if _, err = m.VerifyWithSet(keys); err != nil {
+					t.Fatal(err)
+				}
+				kid, _ := m.Signatures()[0].ProtectedHeaders().KeyID()
+				expectedKID, _ := keys.Key(0)
+				if k, _ := expectedKID.KeyID(); k != kid {
+					t.Errorf("kid '%s' in jwt does not match kid '%s' in jwks", kid, k)
+				}
+
+				rop := NewRequestObjectProducer("https://rp.example.org", test.key, test.alg, 60)
+				ro, err := rop.RequestObject(map[string]any{"aud": "https://op.example.org"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				m, err = jwx.Parse(ro)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err = m.VerifyWithSet(keys); err != nil {
+					t.Fatal(err)
+				}
+			},
+		)
+	}
+}
@@ -0,0 +1,226 @@
+package keys
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/lestrrat-go/jwx/v3/jwa"
+	"github.com/lestrrat-go/jwx/v3/jwe"
+	"github.com/lestrrat-go/jwx/v3/jwk"
+	"github.com/pkg/errors"
+
+	"github.com/go-oidfed/lib/internal/jwx"
+)
+
+// Supported file formats for private keys
+const (
+	FormatPEM  = "pem"
+	FormatJWK  = "jwk"
+	FormatJWKS = "jwks"
+)
+
+// formatFromPath guesses the file format that should be used to store a key
+// from the file extension; PEM is the default
+func formatFromPath(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jwk", ".json":
+		return FormatJWK
+	case ".jwks":
+		return FormatJWKS
+	default:
+		return FormatPEM
+	}
+}
+
+// parsedKey is a private key together with the algorithm that is specified
+// in the key file (if any)
+type parsedKey struct {
+	signer crypto.Signer
+	alg    string
+}
+
+// parsePrivateKey parses a private key from PEM, JWK, or JWKS data. If the
+// data is a JWE or an encrypted PKCS #8 PEM, it is decrypted with the passed
+// password.
+func parsePrivateKey(data []byte, password string) (*parsedKey, error) {
+	data = bytes.TrimSpace(data)
+	if jwx.IsJWE(data) {
+		if password == "" {
+			return nil, errors.New("key file is encrypted, but no password given")
+		}
+		decrypted, err := jwe.Decrypt(data, jwe.WithKey(keyEncryptionAlg, []byte(password)))
+		if err != nil {
+			return nil, errors.Wrap(err, "could not decrypt key file")
+		}
+		return parsePrivateKey(decrypted, "")
+	}
+	if bytes.HasPrefix(data, []byte("-----BEGIN")) {
+		return parsePEM(data, password)
+	}
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return nil, errors.New("unknown key file format: must be PEM, JWK, or JWKS")
+	}
+	if _, isSet := probe["keys"]; isSet {
+		return parseJWKS(data)
+	}
+	key, err := jwk.ParseKey(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse jwk")
+	}
+	return parsedKeyFromJWK(key)
+}
+
+// parsePEM parses a PKCS #8, PKCS #1, or SEC 1 private key; encrypted
+// PKCS #8 keys are decrypted with the passed password, legacy Proc-Type
+// encrypted PEM is rejected
+func parsePEM(data []byte, password string) (*parsedKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("could not decode pem")
+	}
+	if strings.Contains(block.Headers["Proc-Type"], "ENCRYPTED") {
+		return nil, errors.New(
+			"legacy encrypted pem private keys are not supported: convert the key to encrypted pkcs8 " +
+				"(e.g. 'openssl pkcs8 -topk8 -in key.pem -out encrypted.pem')",
+		)
+	}
+	var key any
+	var err error
+	switch block.Type {
+	case "ENCRYPTED PRIVATE KEY":
+		if password == "" {
+			return nil, errors.New("key file is encrypted, but no password given")
+		}
+		var der []byte
+		der, err = decryptPKCS8(block.Bytes, password)
+		if err != nil {
+			return nil, err
+		}
+		key, err = x509.ParsePKCS8PrivateKey(der)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, errors.Errorf("unsupported pem block type '%s'", block.Type)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse private key")
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("private key cannot be used for signing")
+	}
+	return &parsedKey{signer: signer}, nil
+}
+
+func parseJWKS(data []byte) (*parsedKey, error) {
+	set, err := jwk.Parse(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse jwks")
+	}
+	for i := 0; i < set.Len(); i++ {
+		key, _ := set.Key(i)
+		if isPrivate(key) {
+			return parsedKeyFromJWK(key)
+		}
+	}
+	return nil, errors.New("jwks does not contain a private key")
+}
+
+func isPrivate(key jwk.Key) bool {
+	private, err := jwk.IsPrivateKey(key)
+	return err == nil && private
+}
+
+func parsedKeyFromJWK(key jwk.Key) (*parsedKey, error) {
+	if !isPrivate(key) {
+		return nil, errors.New("jwk is not a private key")
+	}
+	var raw any
+	if err := jwk.Export(key, &raw); err != nil {
+		return nil, errors.Wrap(err, "could not export jwk")
+	}
+	signer, ok := raw.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("private key cannot be used for signing")
+	}
+	pk := &parsedKey{signer: signer}
+	if alg, ok := key.Algorithm(); ok {
+		pk.alg = alg.String()
+	}
+	return pk, nil
+}
+
+// marshalPrivateKey encodes the private key in the passed format;
+// if a password is given the result is encrypted as a JWE
+func marshalPrivateKey(
+	signer crypto.Signer, alg jwa.SignatureAlgorithm, format, password string,
+) ([]byte, error) {
+	var data []byte
+	switch format {
+	case FormatJWK, FormatJWKS:
+		key, err := jwk.Import(signer)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not convert private key to jwk")
+		}
+		if err = jwk.AssignKeyID(key); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if err = key.Set(jwk.AlgorithmKey, alg); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		var v any = key
+		if format == FormatJWKS {
+			set := jwk.NewSet()
+			if err = set.AddKey(key); err != nil {
+				return nil, errors.WithStack(err)
+			}
+			v = set
+		}
+		data, err = json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	default:
+		der, err := x509.MarshalPKCS8PrivateKey(signer)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not marshal private key")
+		}
+		data = pem.EncodeToMemory(
+			&pem.Block{
+				Type:  "PRIVATE KEY",
+				Bytes: der,
+			},
+		)
+	}
+	if password == "" {
+		return data, nil
+	}
+	encrypted, err := jwe.Encrypt(
+		data,
+		jwe.WithKey(keyEncryptionAlg, []byte(password)),
+		jwe.WithContentEncryption(jwa.A256GCM()),
+	)
+	return encrypted, errors.Wrap(err, "could not encrypt key file")
+}
+
+// keyEncryptionAlg is the jwa.KeyEncryptionAlgorithm used for password
+// protected key files
+var keyEncryptionAlg = jwa.PBES2_HS512_A256KW()
+
+func writeKeyFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.WriteFile(path, data, 0o600))
+}
@@ -0,0 +1,221 @@
+// Package keys provides loading, generation, and persistence of the private
+// keys used by federation entities.
+package keys
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"os"
+
+	"github.com/lestrrat-go/jwx/v3/jwa"
+	"github.com/pkg/errors"
+
+	"github.com/go-oidfed/lib"
+	"github.com/go-oidfed/lib/internal"
+	"github.com/go-oidfed/lib/internal/jwx"
+	"github.com/go-oidfed/lib/jwks"
+)
+
+// Purpose describes for what a key is used
+type Purpose string
+
+// Constants for the different key purposes
+const (
+	PurposeFederation Purpose = "federation"
+	PurposeOIDC       Purpose = "oidc"
+	PurposeTrustMark  Purpose = "trust_mark"
+)
+
+const defaultRSAKeyLen = 2048
+
+// KeyConfig is a type for configuring how the private key for a Purpose is
+// obtained
+type KeyConfig struct {
+	// Path is the path of the key file; the file can hold a PEM encoded
+	// private key, a private JWK, or a JWKS containing a private key.
+	// Supported PEM block types are "PRIVATE KEY" (PKCS #8),
+	// "ENCRYPTED PRIVATE KEY" (PKCS #8 encrypted with PBES2, PBKDF2, and
+	// AES-CBC), "RSA PRIVATE KEY" (PKCS #1), and "EC PRIVATE KEY" (SEC 1);
+	// legacy Proc-Type encrypted PEM is not supported. Alternatively, the
+	// whole file can be encrypted as a JWE with Password.
+	Path string `yaml:"path" json:"path"`
+	// Algorithm is the signing algorithm used with the key; if not set it is
+	// taken from the key file or derived from the key type
+	Algorithm string `yaml:"alg" json:"alg"`
+	// RSAKeyLen is the key length used when generating RSA keys
+	RSAKeyLen int `yaml:"rsa_key_len" json:"rsa_key_len"`
+	// Password is used to decrypt an encrypted key file or an encrypted
+	// PKCS #8 PEM;
+	// generated keys are stored encrypted if it is set
+	Password string `yaml:"password" json:"password"`
+	// GenerateIfMissing enables the generation of a new key that is stored
+	// at Path if no key file exists
+	GenerateIfMissing bool `yaml:"generate_if_missing" json:"generate_if_missing"`
+}
+
+// Key is a private key for a Purpose together with its signing algorithm
+type Key struct {
+	Purpose Purpose
+	Signer  crypto.Signer
+	Alg     jwa.SignatureAlgorithm
+	KeyID   string
+}
+
+// JWKS returns the public jwks.JWKS for this Key
+func (k Key) JWKS() (jwks.JWKS, error) {
+	return jwks.PublicKeyToJWKS(k.Signer.Public(), k.Alg)
+}
+
+// GeneralJWTSigner returns an oidfed.GeneralJWTSigner for this Key
+func (k Key) GeneralJWTSigner() *oidfed.GeneralJWTSigner {
+	return oidfed.NewGeneralJWTSigner(k.Signer, k.Alg)
+}
+
+// LoadKey loads the private key for the passed Purpose as configured;
+// if the key file does not exist and KeyConfig.GenerateIfMissing is set a new key is
+// generated and persisted
+func LoadKey(purpose Purpose, config KeyConfig) (*Key, error) {
+	if config.Path == "" {
+		return nil, errors.Errorf("no key file configured for '%s' key", purpose)
+	}
+	data, err := os.ReadFile(config.Path)
+	if err != nil {
+		if !os.IsNotExist(err) || !config.GenerateIfMissing {
+			return nil, errors.Wrapf(err, "could not read '%s' key", purpose)
+		}
+		internal.Logf("Generating new '%s' key at %s", purpose, config.Path)
+		return generateKey(purpose, config)
+	}
+	parsed, err := parsePrivateKey(data, config.Password)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not load '%s' key from %s", purpose, config.Path)
+	}
+	algName := config.Algorithm
+	if algName == "" {
+		algName = parsed.alg
+	}
+	return newKey(purpose, parsed.signer, algName)
+}
+
+func newKey(purpose Purpose, signer crypto.Signer, algName string) (*Key, error) {
+	alg, err := signingAlg(signer, algName)
+	if err != nil {
+		return nil, err
+	}
+	kid, err := jwx.KeyID(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	return &Key{
+		Purpose: purpose,
+		Signer:  signer,
+		Alg:     alg,
+		KeyID:   kid,
+	}, nil
+}
+
+// signingAlg returns the jwa.SignatureAlgorithm for the passed name or, if no
+// name is given, the default algorithm for the type of the key
+func signingAlg(signer crypto.Signer, name string) (jwa.SignatureAlgorithm, error) {
+	if name != "" {
+		alg, ok := jwa.LookupSignatureAlgorithm(name)
+		if !ok {
+			return jwa.EmptySignatureAlgorithm(), errors.Errorf("unknown signing algorithm '%s'", name)
+		}
+		if !keyMatchesAlg(signer.Public(), alg) {
+			return jwa.EmptySignatureAlgorithm(), errors.Errorf("signing algorithm '%s' cannot be used with key", name)
+		}
+		return alg, nil
+	}
+	switch pk := signer.Public().(type) {
+	case *rsa.PublicKey:
+		return jwa.RS256(), nil
+	case ed25519.PublicKey:
+		return jwa.EdDSA(), nil
+	case *ecdsa.PublicKey:
+		switch pk.Curve {
+		case elliptic.P256():
+			return jwa.ES256(), nil
+		case elliptic.P384():
+			return jwa.ES384(), nil
+		case elliptic.P521():
+			return jwa.ES512(), nil
+		}
+	}
+	return jwa.EmptySignatureAlgorithm(), errors.New("cannot determine signing algorithm for key")
+}
+
+// keyMatchesAlg checks if the passed public key can be used with the passed
+// signing algorithm
+func keyMatchesAlg(pub crypto.PublicKey, alg jwa.SignatureAlgorithm) bool {
+	var curve elliptic.Curve
+	if pk, ok := pub.(*ecdsa.PublicKey); ok {
+		curve = pk.Curve
+	}
+	switch alg.String() {
+	case "RS256", "RS384", "RS512", "PS256", "PS384", "PS512":
+		_, ok := pub.(*rsa.PublicKey)
+		return ok
+	case "ES256":
+		return curve == elliptic.P256()
+	case "ES384":
+		return curve == elliptic.P384()
+	case "ES512":
+		return curve == elliptic.P521()
+	case "EdDSA":
+		_, ok := pub.(ed25519.PublicKey)
+		return ok
+	default:
+		return false
+	}
+}
+
+func generateKey(purpose Purpose, config KeyConfig) (*Key, error) {
+	algName := config.Algorithm
+	if algName == "" {
+		algName = jwa.ES512().String()
+	}
+	alg, ok := jwa.LookupSignatureAlgorithm(algName)
+	if !ok {
+		return nil, errors.Errorf("unknown signing algorithm '%s'", algName)
+	}
+	signer, err := generatePrivateKey(alg, config.RSAKeyLen)
+	if err != nil {
+		return nil, err
+	}
+	data, err := marshalPrivateKey(signer, alg, formatFromPath(config.Path), config.Password)
+	if err != nil {
+		return nil, err
+	}
+	if err = writeKeyFile(config.Path, data); err != nil {
+		return nil, errors.Wrapf(err, "could not store '%s' key", purpose)
+	}
+	return newKey(purpose, signer, alg.String())
+}
+
+func generatePrivateKey(alg jwa.SignatureAlgorithm, rsaKeyLen int) (crypto.Signer, error) {
+	var signer crypto.Signer
+	var err error
+	switch alg {
+	case jwa.ES256():
+		signer, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case jwa.ES384():
+		signer, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case jwa.ES512():
+		signer, err = ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	case jwa.RS256(), jwa.RS384(), jwa.RS512(), jwa.PS256(), jwa.PS384(), jwa.PS512():
+		if rsaKeyLen <= 0 {
+			rsaKeyLen = defaultRSAKeyLen
+		}
+		signer, err = rsa.GenerateKey(rand.Reader, rsaKeyLen)
+	case jwa.EdDSA():
+		_, signer, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, errors.Errorf("cannot generate key for signing algorithm '%s'", alg)
+	}
+	return signer, errors.WithStack(err)
+}
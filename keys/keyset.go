@@ -0,0 +1,143 @@
+package keys
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/go-oidfed/lib"
+	"github.com/go-oidfed/lib/jwks"
+)
+
+// Config configures the keys for the different purposes;
+// the federation key is required, the other keys are optional
+type Config struct {
+	Federation KeyConfig  `yaml:"federation" json:"federation"`
+	OIDC       *KeyConfig `yaml:"oidc" json:"oidc"`
+	// TrustMark configures a separate key for signing trust marks and
+	// delegations; if not set the federation key is used.
+	// Note that a separate trust mark key must also be published in the
+	// entity's federation jwks, see KeySet.JWKS.
+	TrustMark *KeyConfig `yaml:"trust_mark" json:"trust_mark"`
+}
+
+// KeySet holds the keys for the different purposes of an entity
+type KeySet struct {
+	keys map[Purpose]*Key
+}
+
+// Load loads (or generates) all keys configured in the passed Config
+func Load(config Config) (*KeySet, error) {
+	set := &KeySet{keys: make(map[Purpose]*Key)}
+	fedKey, err := LoadKey(PurposeFederation, config.Federation)
+	if err != nil {
+		return nil, err
+	}
+	set.keys[PurposeFederation] = fedKey
+	optional := map[Purpose]*KeyConfig{
+		PurposeOIDC:      config.OIDC,
+		PurposeTrustMark: config.TrustMark,
+	}
+	for purpose, conf := range optional {
+		if conf == nil {
+			continue
+		}
+		k, err := LoadKey(purpose, *conf)
+		if err != nil {
+			return nil, err
+		}
+		set.keys[purpose] = k
+	}
+	return set, nil
+}
+
+// Key returns the Key for the passed Purpose or nil if no such key is loaded;
+// for PurposeTrustMark the federation key is returned if no separate key is
+// configured
+func (s KeySet) Key(purpose Purpose) *Key {
+	if k, ok := s.keys[purpose]; ok {
+		return k
+	}
+	if purpose == PurposeTrustMark {
+		return s.keys[PurposeFederation]
+	}
+	return nil
+}
+
+func (s KeySet) mustKey(purpose Purpose) (*Key, error) {
+	k := s.Key(purpose)
+	if k == nil {
+		return nil, errors.Errorf("no '%s' key loaded", purpose)
+	}
+	return k, nil
+}
+
+// JWKS returns the public jwks.JWKS containing the keys for all passed
+// purposes; keys used for multiple purposes are only included once
+func (s KeySet) JWKS(purposes ...Purpose) (jwks.JWKS, error) {
+	set := jwks.NewJWKS()
+	added := make(map[string]bool)
+	for _, purpose := range purposes {
+		k, err := s.mustKey(purpose)
+		if err != nil {
+			return jwks.JWKS{}, err
+		}
+		if added[k.KeyID] {
+			continue
+		}
+		keyJWKS, err := k.JWKS()
+		if err != nil {
+			return jwks.JWKS{}, err
+		}
+		pk, _ := keyJWKS.Key(0)
+		if err = set.AddKey(pk); err != nil {
+			return jwks.JWKS{}, errors.WithStack(err)
+		}
+		added[k.KeyID] = true
+	}
+	return set, nil
+}
+
+// EntityStatementSigner returns an oidfed.EntityStatementSigner using the federation key
+func (s KeySet) EntityStatementSigner() (*oidfed.EntityStatementSigner, error) {
+	k, err := s.mustKey(PurposeFederation)
+	if err != nil {
+		return nil, err
+	}
+	return k.GeneralJWTSigner().EntityStatementSigner(), nil
+}
+
+// ResolveResponseSigner returns an oidfed.ResolveResponseSigner using the federation key
+func (s KeySet) ResolveResponseSigner() (*oidfed.ResolveResponseSigner, error) {
+	k, err := s.mustKey(PurposeFederation)
+	if err != nil {
+		return nil, err
+	}
+	return k.GeneralJWTSigner().ResolveResponseSigner(), nil
+}
+
+// TrustMarkSigner returns an oidfed.TrustMarkSigner using the trust mark key
+func (s KeySet) TrustMarkSigner() (*oidfed.TrustMarkSigner, error) {
+	k, err := s.mustKey(PurposeTrustMark)
+	if err != nil {
+		return nil, err
+	}
+	return k.GeneralJWTSigner().TrustMarkSigner(), nil
+}
+
+// TrustMarkDelegationSigner returns an oidfed.TrustMarkDelegationSigner using the trust mark key
+func (s KeySet) TrustMarkDelegationSigner() (*oidfed.TrustMarkDelegationSigner, error) {
+	k, err := s.mustKey(PurposeTrustMark)
+	if err != nil {
+		return nil, err
+	}
+	return k.GeneralJWTSigner().TrustMarkDelegationSigner(), nil
+}
+
+// RequestObjectProducer returns an oidfed.RequestObjectProducer for the
+// passed entity id using the oidc key
+func (s KeySet) RequestObjectProducer(entityID string, lifetime int64) (*oidfed.RequestObjectProducer, error) {
+	k, err := s.mustKey(PurposeOIDC)
+	if err != nil {
+		return nil, err
+	}
+	return oidfed.NewRequestObjectProducer(entityID, k.Signer, k.Alg, lifetime), nil
+}
@@ -0,0 +1,53 @@
+package oidfed
+
+import (
+	"slices"
+
+	"github.com/pkg/errors"
+
+	"github.com/go-oidfed/lib/oidfedconst"
+)
+
+// opTrustAnchors returns those of the FederationLeaf's TrustAnchors that the
+// OP with the passed entity id has a valid trust chain to
+func (f FederationLeaf) opTrustAnchors(opEntityID string) TrustAnchors {
+	resolver := TrustResolver{
+		TrustAnchors:   f.TrustAnchors,
+		StartingEntity: opEntityID,
+		Types:          []string{oidfedconst.EntityTypeOpenIDProvider},
+	}
+	var taIDs []string
+	for _, chain := range resolver.ResolveToValidChains() {
+		taIDs = append(taIDs, chain[len(chain)-1].Issuer)
+	}
+	var anchors TrustAnchors
+	for _, ta := range f.TrustAnchors {
+		if slices.Contains(taIDs, ta.EntityID) {
+			anchors = append(anchors, ta)
+		}
+	}
+	return anchors
+}
+
+// TrustChainForOP resolves the FederationLeaf's own trust chain to a trust
+// anchor that the OP with the passed entity id also has a trust chain to.
+// The trust anchors of the OP are determined from its resolved trust chains.
+// If there are multiple possible trust chains, the shortest one is returned.
+// The returned chain can be used in the trust_chain claim of request
+// objects or for ExplicitRegistration.
+func (f FederationLeaf) TrustChainForOP(opEntityID string) (JWSMessages, error) {
+	anchors := f.opTrustAnchors(opEntityID)
+	if len(anchors) == 0 {
+		return nil, errors.Errorf("no valid trust chain from op '%s' to a trust anchor found", opEntityID)
+	}
+	resolver := TrustResolver{
+		TrustAnchors:   anchors,
+		StartingEntity: f.EntityID,
+		Types:          []string{oidfedconst.EntityTypeOpenIDRelyingParty},
+	}
+	chains := resolver.ResolveToValidChains()
+	if len(chains) == 0 {
+		return nil, errors.Errorf("no valid trust chain to a trust anchor of op '%s' found", opEntityID)
+	}
+	return chains.SortAsc(TrustChainScoringPathLen)[0].Messages(), nil
+}
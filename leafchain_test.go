@@ -0,0 +1,101 @@
+package oidfed
+
+import (
+	"encoding/json"
+	"net/url"
+	"testing"
+
+	"github.com/go-oidfed/lib/internal/jwx"
+)
+
+func TestFederationLeaf_TrustChainForOP(t *testing.T) {
+	leaf := newExplicitRegistrationLeaf(t, rpExplicit.EntityID)
+	leaf.TrustAnchors = append(leaf.TrustAnchors, TrustAnchor{EntityID: ta1.EntityID, JWKS: ta1.data.JWKS})
+
+	tests := []struct {
+		name       string
+		op         string
+		expectedTA string
+		expectErr  bool
+	}{
+		{
+			name:       "common trust anchor",
+			op:         opExplicit.EntityID,
+			expectedTA: taExplicit.EntityID,
+		},
+		{
+			name:      "rp not under op's trust anchor",
+			op:        op1.EntityID,
+			expectErr: true,
+		},
+		{
+			name:      "unknown op",
+			op:        "https://unknown-op.example.com",
+			expectErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				chain, err := leaf.TrustChainForOP(test.op)
+				if err != nil {
+					if !test.expectErr {
+						t.Fatal(err)
+					}
+					return
+				}
+				if test.expectErr {
+					t.Fatal("expected error, but got trust chain")
+				}
+				if len(chain) != 3 {
+					t.Fatalf("unexpected trust chain length %d", len(chain))
+				}
+				var first, last EntityStatementPayload
+				if err = json.Unmarshal(chain[0].Payload(), &first); err != nil {
+					t.Fatal(err)
+				}
+				if err = json.Unmarshal(chain[len(chain)-1].Payload(), &last); err != nil {
+					t.Fatal(err)
+				}
+				if first.Subject != leaf.EntityID {
+					t.Errorf("trust chain starts at '%s'", first.Subject)
+				}
+				if last.Issuer != test.expectedTA {
+					t.Errorf("trust chain ends at '%s'", last.Issuer)
+				}
+			},
+		)
+	}
+}
+
+func TestFederationLeaf_GetAuthorizationURL_TrustChain(t *testing.T) {
+	leaf := newExplicitRegistrationLeaf(t, rpExplicit.EntityID)
+
+	for _, include := range []bool{false, true} {
+		leaf.IncludeTrustChain = include
+		authURL, err := leaf.GetAuthorizationURL(opNoPAR.EntityID, leaf.EntityID+"/redirect", "state", "openid", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := url.Parse(authURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := jwx.Parse([]byte(u.Query().Get("request")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ro struct {
+			TrustChain JWSMessages `json:"trust_chain"`
+		}
+		if err = json.Unmarshal(m.Payload(), &ro); err != nil {
+			t.Fatal(err)
+		}
+		if include && len(ro.TrustChain) != 3 {
+			t.Errorf("request object does not contain trust chain")
+		}
+		if !include && ro.TrustChain != nil {
+			t.Errorf("request object contains trust chain although not enabled")
+		}
+	}
+}
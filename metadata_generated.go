@@ -180,6 +180,9 @@ type OpenIDRelyingPartyMetadata struct {
 	RequestSignedResponseAlg              string         `json:"request_signed_response_alg,omitempty"`
 	RequestEncryptedResponseAlg           string         `json:"request_encrypted_response_alg,omitempty"`
 	RequestEncryptedResponseEnc           string         `json:"request_encrypted_response_enc,omitempty"`
+	RequestObjectSigningAlg               string         `json:"request_object_signing_alg,omitempty"`
+	RequestObjectEncryptionAlg            string         `json:"request_object_encryption_alg,omitempty"`
+	RequestObjectEncryptionEnc            string         `json:"request_object_encryption_enc,omitempty"`
 	TokenEndpointAuthMethod               string         `json:"token_endpoint_auth_method,omitempty"`
 	TokenEndpointAuthSigningAlg           string         `json:"token_endpoint_auth_signing_alg,omitempty"`
 	DefaultMaxAge                         int64          `json:"default_max_age,omitempty"`
@@ -252,6 +255,9 @@ type openIDRelyingPartyMetadataWithPtrs struct {
 	RequestSignedResponseAlg              *string        `json:"request_signed_response_alg,omitempty"`
 	RequestEncryptedResponseAlg           *string        `json:"request_encrypted_response_alg,omitempty"`
 	RequestEncryptedResponseEnc           *string        `json:"request_encrypted_response_enc,omitempty"`
+	RequestObjectSigningAlg               *string        `json:"request_object_signing_alg,omitempty"`
+	RequestObjectEncryptionAlg            *string        `json:"request_object_encryption_alg,omitempty"`
+	RequestObjectEncryptionEnc            *string        `json:"request_object_encryption_enc,omitempty"`
 	TokenEndpointAuthMethod               *string        `json:"token_endpoint_auth_method,omitempty"`
 	TokenEndpointAuthSigningAlg           *string        `json:"token_endpoint_auth_signing_alg,omitempty"`
 	DefaultMaxAge                         *int64         `json:"default_max_age,omitempty"`
@@ -427,6 +433,9 @@ type OpenIDProviderMetadata struct {
 	RequestSignedResponseAlgValuesSupported                   []string            `json:"request_signed_response_alg_values_supported,omitempty"`
 	RequestEncryptedResponseAlgValuesSupported                []string            `json:"request_encrypted_response_alg_values_supported,omitempty"`
 	RequestEncryptedResponseEncValuesSupported                []string            `json:"request_encrypted_response_enc_values_supported,omitempty"`
+	RequestObjectSigningAlgValuesSupported                    []string            `json:"request_object_signing_alg_values_supported,omitempty"`
+	RequestObjectEncryptionAlgValuesSupported                 []string            `json:"request_object_encryption_alg_values_supported,omitempty"`
+	RequestObjectEncryptionEncValuesSupported                 []string            `json:"request_object_encryption_enc_values_supported,omitempty"`
 	TokenEndpointAuthMethodsSupported                         []string            `json:"token_endpoint_auth_methods_supported,omitempty"`
 	TokenEndpointAuthSigningAlgValuesSupported                []string            `json:"token_endpoint_auth_signing_alg_values_supported,omitempty"`
 	DisplayValuesSupported                                    []string            `json:"display_values_supported,omitempty"`
@@ -460,6 +469,7 @@ type OpenIDProviderMetadata struct {
 	RequireSignedRequestObject                                bool                `json:"require_signed_request_object,omitempty"`
 	PushedAuthorizationRequestEndpoint                        string              `json:"pushed_authorization_request_endpoint,omitempty"`
 	RequirePushedAuthorizationRequests                        bool                `json:"require_pushed_authorization_requests,omitempty"`
+	ProtectedResources                                        []string            `json:"protected_resources,omitempty"`
 	AuthorizationResponseIssParameterSupported                bool                `json:"authorization_response_iss_parameter_supported,omitempty"`
 	CheckSessionIFrame                                        string              `json:"check_session_iframe,omitempty"`
 	FrontchannelLogoutSupported                               bool                `json:"frontchannel_logout_supported,omitempty"`
@@ -511,6 +521,9 @@ type openIDProviderMetadataWithPtrs struct {
 	RequestSignedResponseAlgValuesSupported                   []string            `json:"request_signed_response_alg_values_supported,omitempty"`
 	RequestEncryptedResponseAlgValuesSupported                []string            `json:"request_encrypted_response_alg_values_supported,omitempty"`
 	RequestEncryptedResponseEncValuesSupported                []string            `json:"request_encrypted_response_enc_values_supported,omitempty"`
+	RequestObjectSigningAlgValuesSupported                    []string            `json:"request_object_signing_alg_values_supported,omitempty"`
+	RequestObjectEncryptionAlgValuesSupported                 []string            `json:"request_object_encryption_alg_values_supported,omitempty"`
+	RequestObjectEncryptionEncValuesSupported                 []string            `json:"request_object_encryption_enc_values_supported,omitempty"`
 	TokenEndpointAuthMethodsSupported                         []string            `json:"token_endpoint_auth_methods_supported,omitempty"`
 	TokenEndpointAuthSigningAlgValuesSupported                []string            `json:"token_endpoint_auth_signing_alg_values_supported,omitempty"`
 	DisplayValuesSupported                                    []string            `json:"display_values_supported,omitempty"`
@@ -544,6 +557,7 @@ type openIDProviderMetadataWithPtrs struct {
 	RequireSignedRequestObject                                *bool               `json:"require_signed_request_object,omitempty"`
 	PushedAuthorizationRequestEndpoint                        *string             `json:"pushed_authorization_request_endpoint,omitempty"`
 	RequirePushedAuthorizationRequests                        *bool               `json:"require_pushed_authorization_requests,omitempty"`
+	ProtectedResources                                        []string            `json:"protected_resources,omitempty"`
 	AuthorizationResponseIssParameterSupported                *bool               `json:"authorization_response_iss_parameter_supported,omitempty"`
 	CheckSessionIFrame                                        *string             `json:"check_session_iframe,omitempty"`
 	FrontchannelLogoutSupported                               *bool               `json:"frontchannel_logout_supported,omitempty"`
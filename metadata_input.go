@@ -45,6 +45,9 @@ type openIDRelyingPartyMetadata struct {
 	RequestSignedResponseAlg              string   `json:"request_signed_response_alg,omitempty"`
 	RequestEncryptedResponseAlg           string   `json:"request_encrypted_response_alg,omitempty"`
 	RequestEncryptedResponseEnc           string   `json:"request_encrypted_response_enc,omitempty"`
+	RequestObjectSigningAlg               string   `json:"request_object_signing_alg,omitempty"`
+	RequestObjectEncryptionAlg            string   `json:"request_object_encryption_alg,omitempty"`
+	RequestObjectEncryptionEnc            string   `json:"request_object_encryption_enc,omitempty"`
 	TokenEndpointAuthMethod               string   `json:"token_endpoint_auth_method,omitempty"`
 	TokenEndpointAuthSigningAlg           string   `json:"token_endpoint_auth_signing_alg,omitempty"`
 	DefaultMaxAge                         int64    `json:"default_max_age,omitempty"`
@@ -107,6 +110,9 @@ type openIDProviderMetadata struct {
 	RequestSignedResponseAlgValuesSupported                   []string          `json:"request_signed_response_alg_values_supported,omitempty"`
 	RequestEncryptedResponseAlgValuesSupported                []string          `json:"request_encrypted_response_alg_values_supported,omitempty"`
 	RequestEncryptedResponseEncValuesSupported                []string          `json:"request_encrypted_response_enc_values_supported,omitempty"`
+	RequestObjectSigningAlgValuesSupported                    []string          `json:"request_object_signing_alg_values_supported,omitempty"`
+	RequestObjectEncryptionAlgValuesSupported                 []string          `json:"request_object_encryption_alg_values_supported,omitempty"`
+	RequestObjectEncryptionEncValuesSupported                 []string          `json:"request_object_encryption_enc_values_supported,omitempty"`
 	TokenEndpointAuthMethodsSupported                         []string          `json:"token_endpoint_auth_methods_supported,omitempty"`
 	TokenEndpointAuthSigningAlgValuesSupported                []string          `json:"token_endpoint_auth_signing_alg_values_supported,omitempty"`
 	DisplayValuesSupported                                    []string          `json:"display_values_supported,omitempty"`
@@ -140,6 +146,7 @@ type openIDProviderMetadata struct {
 	RequireSignedRequestObject                                bool              `json:"require_signed_request_object,omitempty"`
 	PushedAuthorizationRequestEndpoint                        string            `json:"pushed_authorization_request_endpoint,omitempty"`
 	RequirePushedAuthorizationRequests                        bool              `json:"require_pushed_authorization_requests,omitempty"`
+	ProtectedResources                                        []string          `json:"protected_resources,omitempty"`
 	AuthorizationResponseIssParameterSupported                bool              `json:"authorization_response_iss_parameter_supported,omitempty"`
 	CheckSessionIFrame                                        string            `json:"check_session_iframe,omitempty"`
 	FrontchannelLogoutSupported                               bool              `json:"frontchannel_logout_supported,omitempty"`
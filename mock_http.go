@@ -2,6 +2,7 @@ package oidfed
 
 import (
 	"net/http"
+	"net/http/httptest"
 	"strings"
 
 	"github.com/jarcoal/httpmock"
@@ -57,3 +58,13 @@ func mockListEndpoint(listEndpoint string, mocker mockedSubordinateLister) {
 		},
 	)
 }
+
+func mockHandlerEndpoint(method, endpoint string, handler http.Handler) {
+	httpmock.RegisterResponder(
+		method, endpoint, func(request *http.Request) (*http.Response, error) {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, request)
+			return rec.Result(), nil
+		},
+	)
+}
@@ -19,7 +19,8 @@ type mockRP struct {
 	authorities []string
 	jwks        jwks.JWKS
 	*EntityStatementSigner
-	metadata *OpenIDRelyingPartyMetadata
+	metadata   *OpenIDRelyingPartyMetadata
+	trustMarks TrustMarkInfos
 }
 
 func newMockRP(entityID string, metadata *OpenIDRelyingPartyMetadata) *mockRP {
@@ -52,6 +53,7 @@ func (rp mockRP) EntityStatementPayload() EntityStatementPayload {
 		JWKS:           rp.jwks,
 		Audience:       "",
 		AuthorityHints: rp.authorities,
+		TrustMarks:     rp.trustMarks,
 		Metadata: &Metadata{
 			FederationEntity: &FederationEntityMetadata{
 				OrganizationName: fmt.Sprintf("Organization: %s", orgID[:8]),
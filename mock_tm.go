@@ -16,8 +16,9 @@ import (
 
 type mockTMI struct {
 	TrustMarkIssuer
-	authorities []string
-	jwks        jwks.JWKS
+	authorities  []string
+	jwks         jwks.JWKS
+	entitlements *InMemoryTrustMarkEntitlementStore
 }
 
 func (tmi mockTMI) EntityConfigurationJWT() ([]byte, error) {
@@ -36,7 +37,9 @@ func (tmi mockTMI) EntityStatementPayload() EntityStatementPayload {
 		JWKS:           tmi.jwks,
 		Metadata: &Metadata{
 			FederationEntity: &FederationEntityMetadata{
-				FederationTrustMarkStatusEndpoint: "TODO", //TODO
+				FederationTrustMarkStatusEndpoint: tmi.EntityID + "/status",
+				FederationTrustMarkEndpoint:       tmi.EntityID + "/trustmark",
+				FederationTrustMarkListEndpoint:   tmi.EntityID + "/trustmarked",
 				OrganizationName:                  fmt.Sprintf("Organization: %s", orgID[:8]),
 			},
 		},
@@ -53,7 +56,9 @@ func newMockTrustMarkOwner(entityID string, ownedTrustMarks []OwnedTrustMark) *T
 	if err != nil {
 		panic(err)
 	}
-	return NewTrustMarkOwner(entityID, NewTrustMarkDelegationSigner(sk, jwa.ES512()), ownedTrustMarks)
+	tmo := NewTrustMarkOwner(entityID, NewTrustMarkDelegationSigner(sk, jwa.ES512()), ownedTrustMarks)
+	tmo.Delegations = NewInMemoryDelegationStore()
+	return tmo
 }
 
 func newMockTrustMarkIssuer(entityID string, trustMarkSpecs []TrustMarkSpec) *mockTMI {
@@ -62,11 +67,18 @@ func newMockTrustMarkIssuer(entityID string, trustMarkSpecs []TrustMarkSpec) *mo
 		panic(err)
 	}
 	tmi := NewTrustMarkIssuer(entityID, NewTrustMarkSigner(sk, jwa.ES512()), trustMarkSpecs)
+	tmi.IssuedTrustMarks = NewInMemoryIssuedTrustMarkStore()
 	mock := &mockTMI{
 		TrustMarkIssuer: *tmi,
 		jwks:            jwks.KeyToJWKS(tmi.key.Public(), tmi.alg),
+		entitlements:    NewInMemoryTrustMarkEntitlementStore(),
 	}
 	mockEntityConfiguration(mock.EntityID, mock)
+	mockHandlerEndpoint(
+		"GET", mock.EntityID+"/trustmark", NewTrustMarkHandler(&mock.TrustMarkIssuer, mock.entitlements),
+	)
+	mockHandlerEndpoint("GET", mock.EntityID+"/trustmarked", NewTrustMarkListHandler(&mock.TrustMarkIssuer))
+	mockHandlerEndpoint("POST", mock.EntityID+"/status", NewTrustMarkStatusHandler(&mock.TrustMarkIssuer))
 	return mock
 }
 
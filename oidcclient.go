@@ -0,0 +1,293 @@
+package oidfed
+
+import (
+	"bytes"
+	"encoding/json"
+	nethttp "net/http"
+	"net/url"
+	"slices"
+
+	"github.com/pkg/errors"
+
+	"github.com/go-oidfed/lib/internal/http"
+	"github.com/go-oidfed/lib/internal/jwx"
+	"github.com/go-oidfed/lib/jwks"
+	"github.com/go-oidfed/lib/unixtime"
+)
+
+// TokenIntrospectionResponse is the response of an OP's introspection
+// endpoint as defined in RFC 7662
+type TokenIntrospectionResponse struct {
+	Active    bool                       `json:"active"`
+	Scope     string                     `json:"scope,omitempty"`
+	ClientID  string                     `json:"client_id,omitempty"`
+	Username  string                     `json:"username,omitempty"`
+	TokenType string                     `json:"token_type,omitempty"`
+	ExpiresAt *unixtime.Unixtime         `json:"exp,omitempty"`
+	IssuedAt  *unixtime.Unixtime         `json:"iat,omitempty"`
+	NotBefore *unixtime.Unixtime         `json:"nbf,omitempty"`
+	Subject   string                     `json:"sub,omitempty"`
+	Audience  SliceOrSingleValue[string] `json:"aud,omitempty"`
+	Issuer    string                     `json:"iss,omitempty"`
+	JWTID     string                     `json:"jti,omitempty"`
+
+	Extra map[string]any `json:"-"`
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface
+func (res *TokenIntrospectionResponse) UnmarshalJSON(data []byte) error {
+	type tokenIntrospectionResponse TokenIntrospectionResponse
+	r := tokenIntrospectionResponse(*res)
+	extra, err := unmarshalWithExtra(data, &r)
+	if err != nil {
+		return err
+	}
+	r.Extra = extra
+	*res = TokenIntrospectionResponse(r)
+	return nil
+}
+
+// postWithClientAssertion posts the passed parameters to an endpoint of the
+// passed OP using private_key_jwt client authentication and returns the http
+// status and the response body; the audience of the client assertion is the
+// OP's issuer identifier, whichever endpoint is used
+func (f FederationLeaf) postWithClientAssertion(
+	op *OpenIDProviderMetadata, endpoint string, params url.Values,
+) (int, []byte, error) {
+	client := f.oidcClient(op.Issuer)
+	clientAssertion, err := client.producer.ClientAssertion(clientAssertionAudience(op))
+	if err != nil {
+		return 0, nil, err
+	}
+	params.Set("client_id", client.ID)
+	params.Set("client_assertion_type", clientAssertionTypeJWTBearer)
+	params.Set("client_assertion", string(clientAssertion))
+
+	res, err := http.Do().R().SetFormDataFromValues(params).Post(endpoint)
+	if err != nil {
+		return 0, nil, errors.WithStack(err)
+	}
+	return res.StatusCode(), res.Body(), nil
+}
+
+// oidcErrorResponse parses an OIDCErrorResponse from a response body; nil is
+// returned if the body does not contain one
+func oidcErrorResponse(body []byte) *OIDCErrorResponse {
+	var errRes OIDCErrorResponse
+	if err := json.Unmarshal(body, &errRes); err != nil || errRes.Error == "" {
+		return nil
+	}
+	return &errRes
+}
+
+// tokenRequest sends a token request to the OP's token endpoint; if the token
+// response contains an id token, it is decrypted and verified
+func (f FederationLeaf) tokenRequest(
+	op *OpenIDProviderMetadata, federationKeys jwks.JWKS, params url.Values, nonce string,
+) (*OIDCTokenResponse, *OIDCErrorResponse, error) {
+	_, body, err := f.postWithClientAssertion(op, op.TokenEndpoint, params)
+	if err != nil {
+		return nil, nil, err
+	}
+	var errRes OIDCErrorResponse
+	var tokenRes OIDCTokenResponse
+	if err = json.Unmarshal(body, &errRes); err != nil {
+		return nil, nil, err
+	}
+	if errRes.Error != "" {
+		return nil, &errRes, nil
+	}
+	if err = json.Unmarshal(body, &tokenRes); err != nil {
+		return nil, nil, err
+	}
+	if tokenRes.IDToken != "" {
+		idToken, err := f.decryptIDToken(f.oidcClient(op.Issuer).Metadata, []byte(tokenRes.IDToken))
+		if err != nil {
+			return nil, nil, err
+		}
+		tokenRes.IDToken = string(idToken)
+		opKeys, err := opJWKS(op, federationKeys)
+		if err != nil {
+			return nil, nil, err
+		}
+		tokenRes.IDTokenClaims, err = f.verifyIDToken(op.Issuer, opKeys, idToken, nonce)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return &tokenRes, nil, nil
+}
+
+// RefreshTokens uses the passed refresh token to obtain new tokens from the
+// OP with the passed issuer. If the token response contains an id token, it
+// is verified and its claims are set in OIDCTokenResponse.IDTokenClaims.
+func (f FederationLeaf) RefreshTokens(
+	issuer, refreshToken string, additionalParameter url.Values,
+) (*OIDCTokenResponse, *OIDCErrorResponse, error) {
+	opMetadata, federationKeys, err := f.resolveOP(issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	params := url.Values{}
+	for k, v := range additionalParameter {
+		params[k] = v
+	}
+	params.Set("grant_type", "refresh_token")
+	params.Set("refresh_token", refreshToken)
+	return f.tokenRequest(opMetadata, federationKeys, params, "")
+}
+
+// Userinfo obtains the userinfo claims for the passed access token from the
+// OP with the passed issuer. Encrypted userinfo responses are decrypted with
+// the FederationLeaf.OIDCDecryptionKeys; signed userinfo responses are
+// verified with the OP's keys.
+func (f FederationLeaf) Userinfo(issuer, accessToken string) (map[string]any, error) {
+	opMetadata, federationKeys, err := f.resolveOP(issuer)
+	if err != nil {
+		return nil, err
+	}
+	if opMetadata.UserinfoEndpoint == "" {
+		return nil, errors.New("op does not have a userinfo_endpoint")
+	}
+	res, err := http.Do().R().SetAuthToken(accessToken).Get(opMetadata.UserinfoEndpoint)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	body := res.Body()
+	if res.StatusCode() != nethttp.StatusOK {
+		if errRes := oidcErrorResponse(body); errRes != nil {
+			return nil, errors.Errorf("userinfo request failed: %s: %s", errRes.Error, errRes.ErrorDescription)
+		}
+		if wwwAuth := res.Header().Get("WWW-Authenticate"); wwwAuth != "" {
+			return nil, errors.Errorf("userinfo request failed: %s", wwwAuth)
+		}
+		return nil, errors.Errorf("userinfo request failed: http status %d", res.StatusCode())
+	}
+
+	client := f.oidcClient(opMetadata.Issuer)
+	userinfo, err := f.decryptUserinfo(client.Metadata, body)
+	if err != nil {
+		return nil, err
+	}
+	var signedAlg string
+	if rp := client.Metadata; rp != nil {
+		signedAlg = rp.UserinfoSignedResponseAlg
+	}
+	if signedAlg != "" || !bytes.HasPrefix(bytes.TrimSpace(userinfo), []byte("{")) {
+		opKeys, err := opJWKS(opMetadata, federationKeys)
+		if err != nil {
+			return nil, err
+		}
+		if userinfo, err = f.verifySignedUserinfo(opMetadata.Issuer, client.ID, opKeys, userinfo, signedAlg); err != nil {
+			return nil, err
+		}
+	}
+	var claims map[string]any
+	if err = json.Unmarshal(userinfo, &claims); err != nil {
+		return nil, errors.Wrap(err, "could not parse userinfo response")
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, errors.New("userinfo response does not contain a sub claim")
+	}
+	return claims, nil
+}
+
+// verifySignedUserinfo verifies a signed userinfo response and returns its
+// payload
+func (f FederationLeaf) verifySignedUserinfo(
+	issuer, clientID string, opKeys jwks.JWKS, userinfo []byte, signedAlg string,
+) ([]byte, error) {
+	m, err := jwx.Parse(userinfo)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse signed userinfo response")
+	}
+	if signedAlg != "" {
+		if len(m.Signatures()) == 0 {
+			return nil, errors.New("userinfo response is not signed")
+		}
+		alg, _ := m.Signatures()[0].ProtectedHeaders().Algorithm()
+		if alg.String() != signedAlg {
+			return nil, errors.Errorf("userinfo response is not signed with '%s'", signedAlg)
+		}
+	}
+	payload, err := m.VerifyWithSet(opKeys)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not verify userinfo response signature")
+	}
+	var claims struct {
+		Issuer   string                     `json:"iss"`
+		Audience SliceOrSingleValue[string] `json:"aud"`
+	}
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return nil, errors.Wrap(err, "could not parse userinfo response")
+	}
+	if claims.Issuer != issuer {
+		return nil, errors.Errorf("userinfo issuer '%s' does not match '%s'", claims.Issuer, issuer)
+	}
+	if !slices.Contains(claims.Audience, clientID) {
+		return nil, errors.New("client is not an audience of the userinfo response")
+	}
+	return payload, nil
+}
+
+// RevokeToken revokes the passed token at the OP with the passed issuer as
+// defined in RFC 7009; tokenTypeHint is optional
+func (f FederationLeaf) RevokeToken(issuer, token, tokenTypeHint string) (*OIDCErrorResponse, error) {
+	opMetadata, _, err := f.resolveOP(issuer)
+	if err != nil {
+		return nil, err
+	}
+	if opMetadata.RevocationEndpoint == "" {
+		return nil, errors.New("op does not have a revocation_endpoint")
+	}
+	params := url.Values{}
+	params.Set("token", token)
+	if tokenTypeHint != "" {
+		params.Set("token_type_hint", tokenTypeHint)
+	}
+	status, body, err := f.postWithClientAssertion(opMetadata, opMetadata.RevocationEndpoint, params)
+	if err != nil {
+		return nil, err
+	}
+	if status == nethttp.StatusOK {
+		return nil, nil
+	}
+	if errRes := oidcErrorResponse(body); errRes != nil {
+		return errRes, nil
+	}
+	return nil, errors.Errorf("token revocation failed: http status %d", status)
+}
+
+// IntrospectToken introspects the passed token at the OP with the passed
+// issuer as defined in RFC 7662; tokenTypeHint is optional
+func (f FederationLeaf) IntrospectToken(issuer, token, tokenTypeHint string) (
+	*TokenIntrospectionResponse, *OIDCErrorResponse, error,
+) {
+	opMetadata, _, err := f.resolveOP(issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if opMetadata.IntrospectionEndpoint == "" {
+		return nil, nil, errors.New("op does not have an introspection_endpoint")
+	}
+	params := url.Values{}
+	params.Set("token", token)
+	if tokenTypeHint != "" {
+		params.Set("token_type_hint", tokenTypeHint)
+	}
+	status, body, err := f.postWithClientAssertion(opMetadata, opMetadata.IntrospectionEndpoint, params)
+	if err != nil {
+		return nil, nil, err
+	}
+	if status != nethttp.StatusOK {
+		if errRes := oidcErrorResponse(body); errRes != nil {
+			return nil, errRes, nil
+		}
+		return nil, nil, errors.Errorf("token introspection failed: http status %d", status)
+	}
+	var res TokenIntrospectionResponse
+	if err = json.Unmarshal(body, &res); err != nil {
+		return nil, nil, errors.Wrap(err, "could not parse introspection response")
+	}
+	return &res, nil, nil
+}
@@ -0,0 +1,400 @@
+package oidfed
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v3/jwa"
+
+	"github.com/go-oidfed/lib/internal/jwx"
+	"github.com/go-oidfed/lib/jwks"
+	"github.com/go-oidfed/lib/unixtime"
+)
+
+// oidcClientOP is a mocked OP with token, userinfo, revocation, and
+// introspection endpoints
+type oidcClientOP struct {
+	*mockOP
+	signer *GeneralJWTSigner
+	// userinfo is the response of the userinfo endpoint
+	userinfo []byte
+}
+
+func newOIDCClientOP(t *testing.T, entityID string) *oidcClientOP {
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	op := &oidcClientOP{signer: NewGeneralJWTSigner(sk, jwa.ES256())}
+	keys := jwks.KeyToJWKS(sk.Public(), jwa.ES256())
+	op.mockOP = newMockOP(
+		entityID, &OpenIDProviderMetadata{
+			TokenEndpoint:         entityID + "/token",
+			UserinfoEndpoint:      entityID + "/userinfo",
+			RevocationEndpoint:    entityID + "/revoke",
+			IntrospectionEndpoint: entityID + "/introspect",
+			JWKS:                  &keys,
+		},
+	)
+	mockHandlerEndpoint(http.MethodPost, op.metadata.TokenEndpoint, http.HandlerFunc(op.token))
+	mockHandlerEndpoint(http.MethodGet, op.metadata.UserinfoEndpoint, http.HandlerFunc(op.userinfoEndpoint))
+	mockHandlerEndpoint(http.MethodPost, op.metadata.RevocationEndpoint, http.HandlerFunc(op.revoke))
+	mockHandlerEndpoint(http.MethodPost, op.metadata.IntrospectionEndpoint, http.HandlerFunc(op.introspect))
+	taExplicit.RegisterSubordinate(op.mockOP)
+	return op
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// authenticated parses the form and checks that the request contains a
+// client assertion with the OP's issuer as audience
+func (op *oidcClientOP) authenticated(w http.ResponseWriter, r *http.Request) bool {
+	if err := r.ParseForm(); err != nil ||
+		r.PostForm.Get("client_assertion_type") != clientAssertionTypeJWTBearer ||
+		!op.validAudience(r.PostForm.Get("client_assertion")) {
+		writeJSON(w, http.StatusUnauthorized, OIDCErrorResponse{Error: "invalid_client"})
+		return false
+	}
+	return true
+}
+
+// validAudience checks that the OP's issuer is an audience of the (unverified)
+// client assertion
+func (op *oidcClientOP) validAudience(clientAssertion string) bool {
+	m, err := jwx.Parse([]byte(clientAssertion))
+	if err != nil {
+		return false
+	}
+	var claims struct {
+		Audience SliceOrSingleValue[string] `json:"aud"`
+	}
+	if err = json.Unmarshal(m.Payload(), &claims); err != nil {
+		return false
+	}
+	return slices.Contains(claims.Audience, op.EntityID)
+}
+
+func (op *oidcClientOP) token(w http.ResponseWriter, r *http.Request) {
+	if !op.authenticated(w, r) {
+		return
+	}
+	if r.PostForm.Get("grant_type") != "refresh_token" || r.PostForm.Get("refresh_token") != "refresh_token" {
+		writeJSON(w, http.StatusBadRequest, OIDCErrorResponse{Error: "invalid_grant"})
+		return
+	}
+	now := time.Now()
+	idToken, err := op.signer.JWT(
+		IDTokenClaims{
+			Issuer:    op.EntityID,
+			Subject:   "user",
+			Audience:  SliceOrSingleValue[string]{r.PostForm.Get("client_id")},
+			ExpiresAt: unixtime.Unixtime{Time: now.Add(time.Hour)},
+			IssuedAt:  unixtime.Unixtime{Time: now},
+		}, "JWT",
+	)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(
+		w, http.StatusOK, map[string]any{
+			"access_token":  "new_access_token",
+			"token_type":    "Bearer",
+			"refresh_token": "new_refresh_token",
+			"id_token":      string(idToken),
+		},
+	)
+}
+
+func (op *oidcClientOP) userinfoEndpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer access_token" {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	_, _ = w.Write(op.userinfo)
+}
+
+func (op *oidcClientOP) revoke(w http.ResponseWriter, r *http.Request) {
+	if !op.authenticated(w, r) {
+		return
+	}
+	if r.PostForm.Get("token_type_hint") == "unsupported" {
+		writeJSON(w, http.StatusBadRequest, OIDCErrorResponse{Error: "unsupported_token_type"})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (op *oidcClientOP) introspect(w http.ResponseWriter, r *http.Request) {
+	if !op.authenticated(w, r) {
+		return
+	}
+	if r.PostForm.Get("token") != "access_token" {
+		writeJSON(w, http.StatusOK, map[string]any{"active": false})
+		return
+	}
+	writeJSON(
+		w, http.StatusOK, map[string]any{
+			"active": true,
+			"sub":    "user",
+			"scope":  "openid",
+			"exp":    time.Now().Add(time.Hour).Unix(),
+			"custom": "value",
+		},
+	)
+}
+
+func TestFederationLeaf_RefreshTokens(t *testing.T) {
+	op := newOIDCClientOP(t, "https://op-refresh.example.com")
+	leaf := newExplicitRegistrationLeaf(t, "https://rp-refresh.example.com")
+
+	tests := []struct {
+		name         string
+		refreshToken string
+		expectErrRes bool
+	}{
+		{
+			name:         "valid",
+			refreshToken: "refresh_token",
+		},
+		{
+			name:         "invalid refresh token",
+			refreshToken: "invalid",
+			expectErrRes: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				res, errRes, err := leaf.RefreshTokens(op.EntityID, test.refreshToken, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if errRes != nil {
+					if !test.expectErrRes {
+						t.Fatalf("unexpected error response: %+v", errRes)
+					}
+					return
+				}
+				if test.expectErrRes {
+					t.Fatal("expected error response")
+				}
+				if res.AccessToken != "new_access_token" || res.RefreshToken != "new_refresh_token" {
+					t.Errorf("unexpected token response: %+v", res)
+				}
+				if res.IDTokenClaims == nil || res.IDTokenClaims.Subject != "user" {
+					t.Errorf("unexpected id token claims: %+v", res.IDTokenClaims)
+				}
+			},
+		)
+	}
+}
+
+func TestFederationLeaf_Userinfo(t *testing.T) {
+	op := newOIDCClientOP(t, "https://op-userinfo.example.com")
+	plainLeaf := newExplicitRegistrationLeaf(t, "https://rp-userinfo.example.com/plain")
+	private, public := encryptionKeys(t)
+	encryptingLeaf := newExplicitRegistrationLeaf(t, "https://rp-userinfo.example.com/encrypted")
+	encryptingLeaf.Metadata.RelyingParty.UserinfoEncryptedResponseAlg = "RSA-OAEP"
+	encryptingLeaf.OIDCDecryptionKeys = private
+
+	signed := func(iss, aud string) []byte {
+		jwt, err := op.signer.JWT(map[string]any{"iss": iss, "aud": aud, "sub": "user"}, "JWT")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return jwt
+	}
+	encrypted := func(data []byte) []byte {
+		jwe, err := jwx.EncryptJWT(data, public, jwa.RSA_OAEP(), jwa.A128CBC_HS256())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return jwe
+	}
+	otherSigner := NewGeneralJWTSigner(func() *ecdsa.PrivateKey {
+		sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sk
+	}(), jwa.ES256())
+	wrongKey, err := otherSigner.JWT(
+		map[string]any{"iss": op.EntityID, "aud": plainLeaf.EntityID, "sub": "user"}, "JWT",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		leaf        *FederationLeaf
+		accessToken string
+		userinfo    []byte
+		expectErr   bool
+	}{
+		{
+			name:        "json",
+			leaf:        plainLeaf,
+			accessToken: "access_token",
+			userinfo:    []byte(`{"sub":"user"}`),
+		},
+		{
+			name:        "invalid access token",
+			leaf:        plainLeaf,
+			accessToken: "invalid",
+			userinfo:    []byte(`{"sub":"user"}`),
+			expectErr:   true,
+		},
+		{
+			name:        "no sub",
+			leaf:        plainLeaf,
+			accessToken: "access_token",
+			userinfo:    []byte(`{"name":"user"}`),
+			expectErr:   true,
+		},
+		{
+			name:        "signed",
+			leaf:        plainLeaf,
+			accessToken: "access_token",
+			userinfo:    signed(op.EntityID, plainLeaf.EntityID),
+		},
+		{
+			name:        "signed for other audience",
+			leaf:        plainLeaf,
+			accessToken: "access_token",
+			userinfo:    signed(op.EntityID, encryptingLeaf.EntityID),
+			expectErr:   true,
+		},
+		{
+			name:        "signed by other issuer",
+			leaf:        plainLeaf,
+			accessToken: "access_token",
+			userinfo:    signed(op1.EntityID, plainLeaf.EntityID),
+			expectErr:   true,
+		},
+		{
+			name:        "signed with wrong key",
+			leaf:        plainLeaf,
+			accessToken: "access_token",
+			userinfo:    wrongKey,
+			expectErr:   true,
+		},
+		{
+			name:        "encrypted and signed",
+			leaf:        encryptingLeaf,
+			accessToken: "access_token",
+			userinfo:    encrypted(signed(op.EntityID, encryptingLeaf.EntityID)),
+		},
+		{
+			name:        "encrypted json",
+			leaf:        encryptingLeaf,
+			accessToken: "access_token",
+			userinfo:    encrypted([]byte(`{"sub":"user"}`)),
+		},
+		{
+			name:        "not encrypted although registered",
+			leaf:        encryptingLeaf,
+			accessToken: "access_token",
+			userinfo:    []byte(`{"sub":"user"}`),
+			expectErr:   true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				op.userinfo = test.userinfo
+				claims, err := test.leaf.Userinfo(op.EntityID, test.accessToken)
+				if err != nil {
+					if !test.expectErr {
+						t.Fatal(err)
+					}
+					return
+				}
+				if test.expectErr {
+					t.Fatalf("expected error, but got userinfo: %v", claims)
+				}
+				if claims["sub"] != "user" {
+					t.Errorf("unexpected userinfo claims: %v", claims)
+				}
+			},
+		)
+	}
+}
+
+func TestFederationLeaf_RevokeToken(t *testing.T) {
+	op := newOIDCClientOP(t, "https://op-revoke.example.com")
+	leaf := newExplicitRegistrationLeaf(t, "https://rp-revoke.example.com")
+
+	errRes, err := leaf.RevokeToken(op.EntityID, "access_token", "access_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errRes != nil {
+		t.Fatalf("unexpected error response: %+v", errRes)
+	}
+	errRes, err = leaf.RevokeToken(op.EntityID, "access_token", "unsupported")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errRes == nil || errRes.Error != "unsupported_token_type" {
+		t.Fatalf("unexpected error response: %+v", errRes)
+	}
+}
+
+func TestFederationLeaf_IntrospectToken(t *testing.T) {
+	op := newOIDCClientOP(t, "https://op-introspect.example.com")
+	leaf := newExplicitRegistrationLeaf(t, "https://rp-introspect.example.com")
+
+	tests := []struct {
+		name           string
+		token          string
+		expectedActive bool
+	}{
+		{
+			name:           "active",
+			token:          "access_token",
+			expectedActive: true,
+		},
+		{
+			name:  "inactive",
+			token: "other",
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				res, errRes, err := leaf.IntrospectToken(op.EntityID, test.token, "")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if errRes != nil {
+					t.Fatalf("unexpected error response: %+v", errRes)
+				}
+				if res.Active != test.expectedActive {
+					t.Fatalf("unexpected active state %v", res.Active)
+				}
+				if !test.expectedActive {
+					return
+				}
+				if res.Subject != "user" || res.ExpiresAt == nil {
+					t.Errorf("unexpected introspection response: %+v", res)
+				}
+				if res.Extra["custom"] != "value" || len(res.Extra) != 1 {
+					t.Errorf("unexpected extra claims: %v", res.Extra)
+				}
+			},
+		)
+	}
+}
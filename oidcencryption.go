@@ -0,0 +1,115 @@
+package oidfed
+
+import (
+	"github.com/lestrrat-go/jwx/v3/jwa"
+	"github.com/pkg/errors"
+
+	"github.com/go-oidfed/lib/internal/jwx"
+	"github.com/go-oidfed/lib/jwks"
+)
+
+// defaultContentEncryptionAlg is the content encryption algorithm used if only
+// a key encryption algorithm is registered, as defined by OpenID Connect
+// Dynamic Client Registration
+var defaultContentEncryptionAlg = jwa.A128CBC_HS256()
+
+func (f FederationLeaf) rpMetadata() *OpenIDRelyingPartyMetadata {
+	if f.Metadata == nil {
+		return nil
+	}
+	return f.Metadata.RelyingParty
+}
+
+// requestObject creates the request object of the passed oidcClient for the
+// passed OP; if the client's metadata contains a
+// request_object_encryption_alg the request object is encrypted to the OP's
+// keys
+func (f FederationLeaf) requestObject(
+	op *OpenIDProviderMetadata, federationKeys jwks.JWKS, client oidcClient, requestParams map[string]any,
+) ([]byte, error) {
+	rp := client.Metadata
+	if rp == nil || rp.RequestObjectEncryptionAlg == "" {
+		return client.producer.RequestObject(requestParams)
+	}
+	alg, enc, err := encryptionAlgs(rp.RequestObjectEncryptionAlg, rp.RequestObjectEncryptionEnc)
+	if err != nil {
+		return nil, err
+	}
+	opKeys, err := opJWKS(op, federationKeys)
+	if err != nil {
+		return nil, err
+	}
+	return client.producer.EncryptedRequestObject(requestParams, opKeys, alg, enc)
+}
+
+func encryptionAlgs(algName, encName string) (jwa.KeyEncryptionAlgorithm, jwa.ContentEncryptionAlgorithm, error) {
+	alg, ok := jwa.LookupKeyEncryptionAlgorithm(algName)
+	if !ok {
+		return jwa.EmptyKeyEncryptionAlgorithm(), jwa.EmptyContentEncryptionAlgorithm(),
+			errors.Errorf("unknown key encryption algorithm '%s'", algName)
+	}
+	if encName == "" {
+		return alg, defaultContentEncryptionAlg, nil
+	}
+	enc, ok := jwa.LookupContentEncryptionAlgorithm(encName)
+	if !ok {
+		return jwa.EmptyKeyEncryptionAlgorithm(), jwa.EmptyContentEncryptionAlgorithm(),
+			errors.Errorf("unknown content encryption algorithm '%s'", encName)
+	}
+	return alg, enc, nil
+}
+
+// decryptResponse decrypts an encrypted response with the
+// FederationLeaf.OIDCDecryptionKeys. If registeredAlg is set, the response
+// must be encrypted with it; otherwise unencrypted responses are returned
+// unchanged.
+func (f FederationLeaf) decryptResponse(data []byte, registeredAlg string) ([]byte, error) {
+	if !jwx.IsJWE(data) {
+		if registeredAlg != "" {
+			return nil, errors.Errorf("expected response encrypted with '%s'", registeredAlg)
+		}
+		return data, nil
+	}
+	var allowed []jwa.KeyEncryptionAlgorithm
+	if registeredAlg != "" {
+		alg, ok := jwa.LookupKeyEncryptionAlgorithm(registeredAlg)
+		if !ok {
+			return nil, errors.Errorf("unknown key encryption algorithm '%s'", registeredAlg)
+		}
+		allowed = append(allowed, alg)
+	}
+	return jwx.Decrypt(data, f.OIDCDecryptionKeys, allowed...)
+}
+
+// DecryptIDToken decrypts an encrypted (nested) id token and returns the
+// signed id token jwt; unencrypted id tokens are returned unchanged, unless
+// the RP's metadata contains an id_token_encrypted_response_alg
+func (f FederationLeaf) DecryptIDToken(idToken []byte) ([]byte, error) {
+	return f.decryptIDToken(f.rpMetadata(), idToken)
+}
+
+func (f FederationLeaf) decryptIDToken(rp *OpenIDRelyingPartyMetadata, idToken []byte) ([]byte, error) {
+	var alg string
+	if rp != nil {
+		alg = rp.IDTokenEncryptedResponseAlg
+	}
+	decrypted, err := f.decryptResponse(idToken, alg)
+	return decrypted, errors.Wrap(err, "could not decrypt id token")
+}
+
+// DecryptUserinfo decrypts an encrypted userinfo response; the result is
+// either a signed jwt or a json object. Unencrypted responses are returned
+// unchanged, unless the RP's metadata contains an
+// userinfo_encrypted_response_alg
+func (f FederationLeaf) DecryptUserinfo(userinfo []byte) ([]byte, error) {
+	return f.decryptUserinfo(f.rpMetadata(), userinfo)
+}
+
+func (f FederationLeaf) decryptUserinfo(rp *OpenIDRelyingPartyMetadata, userinfo []byte) ([]byte, error) {
+	var alg string
+	if rp != nil {
+		alg = rp.UserinfoEncryptedResponseAlg
+	}
+	decrypted, err := f.decryptResponse(userinfo, alg)
+	return decrypted, errors.Wrap(err, "could not decrypt userinfo response")
+}
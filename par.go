@@ -0,0 +1,58 @@
+package oidfed
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+
+	"github.com/go-oidfed/lib/internal/http"
+)
+
+// pushedAuthorizationResponse is the response of an OP's
+// pushed_authorization_request_endpoint
+type pushedAuthorizationResponse struct {
+	RequestURI string `json:"request_uri"`
+	ExpiresIn  int64  `json:"expires_in"`
+}
+
+// pushAuthorizationRequest pushes the passed request object to the OP's
+// pushed_authorization_request_endpoint using private_key_jwt client
+// authentication and returns the obtained request_uri
+func (f FederationLeaf) pushAuthorizationRequest(
+	op *OpenIDProviderMetadata, client oidcClient, requestObject []byte,
+) (string, error) {
+	clientAssertion, err := client.producer.ClientAssertion(clientAssertionAudience(op))
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.Do().R().
+		SetFormData(
+			map[string]string{
+				"client_id":             client.ID,
+				"request":               string(requestObject),
+				"client_assertion_type": clientAssertionTypeJWTBearer,
+				"client_assertion":      string(clientAssertion),
+			},
+		).
+		Post(op.PushedAuthorizationRequestEndpoint)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if resp.IsError() {
+		var errRes OIDCErrorResponse
+		if err = json.Unmarshal(resp.Body(), &errRes); err == nil && errRes.Error != "" {
+			return "", errors.Errorf(
+				"pushed authorization request failed: %s: %s", errRes.Error, errRes.ErrorDescription,
+			)
+		}
+		return "", errors.Errorf("pushed authorization request failed: http status %d", resp.StatusCode())
+	}
+	var res pushedAuthorizationResponse
+	if err = json.Unmarshal(resp.Body(), &res); err != nil {
+		return "", errors.Wrap(err, "could not parse pushed authorization response")
+	}
+	if res.RequestURI == "" {
+		return "", errors.New("pushed authorization response does not contain a request_uri")
+	}
+	return res.RequestURI, nil
+}
@@ -0,0 +1,155 @@
+package oidfed
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"testing"
+
+	"github.com/jarcoal/httpmock"
+
+	"github.com/go-oidfed/lib/internal/jwx"
+)
+
+var opPAR = newMockOP(
+	"https://op-par.example.com",
+	&OpenIDProviderMetadata{
+		AuthorizationEndpoint:              "https://op-par.example.com/authorize",
+		PushedAuthorizationRequestEndpoint: "https://op-par.example.com/par",
+		RequirePushedAuthorizationRequests: true,
+	},
+)
+
+var opPARRequiredWithoutEndpoint = newMockOP(
+	"https://op-par-required.example.com",
+	&OpenIDProviderMetadata{
+		AuthorizationEndpoint:              "https://op-par-required.example.com/authorize",
+		RequirePushedAuthorizationRequests: true,
+	},
+)
+
+var opNoPAR = newMockOP(
+	"https://op-no-par.example.com",
+	&OpenIDProviderMetadata{
+		AuthorizationEndpoint: "https://op-no-par.example.com/authorize",
+	},
+)
+
+func init() {
+	taExplicit.RegisterSubordinate(opPAR)
+	taExplicit.RegisterSubordinate(opPARRequiredWithoutEndpoint)
+	taExplicit.RegisterSubordinate(opNoPAR)
+}
+
+func mockPAREndpoint(t *testing.T, status int, body string) {
+	httpmock.RegisterResponder(
+		"POST", opPAR.metadata.PushedAuthorizationRequestEndpoint,
+		func(req *http.Request) (*http.Response, error) {
+			if err := req.ParseForm(); err != nil {
+				return nil, err
+			}
+			if req.PostForm.Get("client_assertion_type") != clientAssertionTypeJWTBearer {
+				t.Error("pushed authorization request without client assertion")
+			}
+			assertion, err := jwx.Parse([]byte(req.PostForm.Get("client_assertion")))
+			if err != nil {
+				t.Errorf("pushed authorization request without valid client assertion: %v", err)
+			} else {
+				var claims struct {
+					Audience SliceOrSingleValue[string] `json:"aud"`
+				}
+				if err = json.Unmarshal(assertion.Payload(), &claims); err != nil ||
+					!slices.Contains(claims.Audience, opPAR.EntityID) {
+					t.Errorf("client assertion does not have the op's issuer as audience")
+				}
+			}
+			if _, err := jwx.Parse([]byte(req.PostForm.Get("request"))); err != nil {
+				t.Errorf("pushed authorization request without valid request object: %v", err)
+			}
+			return httpmock.NewStringResponse(status, body), nil
+		},
+	)
+}
+
+func TestFederationLeaf_GetAuthorizationURL_PAR(t *testing.T) {
+	leaf := newExplicitRegistrationLeaf(t, "https://rp-par.example.com")
+	redirectURI := leaf.EntityID + "/redirect"
+
+	tests := []struct {
+		name               string
+		op                 string
+		parStatus          int
+		parBody            string
+		expectedRequestURI string
+		expectErr          bool
+	}{
+		{
+			name:               "par",
+			op:                 opPAR.EntityID,
+			parStatus:          http.StatusCreated,
+			parBody:            `{"request_uri":"urn:example:request","expires_in":60}`,
+			expectedRequestURI: "urn:example:request",
+		},
+		{
+			name:      "par error",
+			op:        opPAR.EntityID,
+			parStatus: http.StatusBadRequest,
+			parBody:   `{"error":"invalid_request_object"}`,
+			expectErr: true,
+		},
+		{
+			name:      "par without request_uri",
+			op:        opPAR.EntityID,
+			parStatus: http.StatusCreated,
+			parBody:   `{"expires_in":60}`,
+			expectErr: true,
+		},
+		{
+			name:      "par required without endpoint",
+			op:        opPARRequiredWithoutEndpoint.EntityID,
+			expectErr: true,
+		},
+		{
+			name: "no par",
+			op:   opNoPAR.EntityID,
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				if test.parStatus != 0 {
+					mockPAREndpoint(t, test.parStatus, test.parBody)
+				}
+				authURL, err := leaf.GetAuthorizationURL(test.op, redirectURI, "state", "openid", nil)
+				if err != nil {
+					if !test.expectErr {
+						t.Fatal(err)
+					}
+					return
+				}
+				if test.expectErr {
+					t.Fatal("expected error, but got authorization url")
+				}
+				u, err := url.Parse(authURL)
+				if err != nil {
+					t.Fatal(err)
+				}
+				q := u.Query()
+				if q.Get("client_id") != leaf.EntityID {
+					t.Errorf("unexpected client_id '%s'", q.Get("client_id"))
+				}
+				if q.Get("response_type") != "code" || q.Get("scope") != "openid" ||
+					q.Get("redirect_uri") != redirectURI {
+					t.Errorf("authorization url lacks required parameters: %s", authURL)
+				}
+				if q.Get("request_uri") != test.expectedRequestURI {
+					t.Errorf("unexpected request_uri '%s'", q.Get("request_uri"))
+				}
+				if (q.Get("request") == "") == (test.expectedRequestURI == "") {
+					t.Errorf("authorization url must contain either request or request_uri: %s", authURL)
+				}
+			},
+		)
+	}
+}
@@ -0,0 +1,249 @@
+package oidfed
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/go-oidfed/lib/apimodel"
+	"github.com/go-oidfed/lib/cache"
+	"github.com/go-oidfed/lib/internal"
+	"github.com/go-oidfed/lib/internal/jwx"
+	"github.com/go-oidfed/lib/jwks"
+	"github.com/go-oidfed/lib/oidfedconst"
+	"github.com/go-oidfed/lib/unixtime"
+)
+
+// SignedJWKSCacheLifetime is the maximum time a verified signed jwks obtained
+// from a signed_jwks_uri is cached; it is never cached beyond its expiration
+var SignedJWKSCacheLifetime = time.Hour
+
+// entityTypeOAuthAuthorizationServer is the entity type of
+// OAuthAuthorizationServerMetadata
+const entityTypeOAuthAuthorizationServer = "oauth_authorization_server"
+
+// protocolKeyClaims returns the key related claims of the metadata for the
+// passed entity type
+func (m Metadata) protocolKeyClaims(entityType string) (signedJWKSURI, jwksURI string, set *jwks.JWKS, err error) {
+	switch entityType {
+	case oidfedconst.EntityTypeOpenIDProvider:
+		if op := m.OpenIDProvider; op != nil {
+			return op.SignedJWKSURI, op.JWKSURI, op.JWKS, nil
+		}
+	case oidfedconst.EntityTypeOpenIDRelyingParty:
+		if rp := m.RelyingParty; rp != nil {
+			return rp.SignedJWKSURI, rp.JWKSURI, rp.JWKS, nil
+		}
+	case entityTypeOAuthAuthorizationServer:
+		if as := m.OAuthAuthorizationServer; as != nil {
+			return as.SignedJWKSURI, as.JWKSURI, as.JWKS, nil
+		}
+	case oidfedconst.EntityTypeOAuthClient:
+		if c := m.OAuthClient; c != nil {
+			return c.SignedJWKSURI, c.JWKSURI, c.JWKS, nil
+		}
+	case oidfedconst.EntityTypeOAuthProtectedResource:
+		if rs := m.OAuthProtectedResource; rs != nil {
+			return rs.SignedJWKSURI, rs.JWKSURI, rs.JWKS, nil
+		}
+	default:
+		return "", "", nil, errors.Errorf("entity type '%s' does not have protocol keys", entityType)
+	}
+	return "", "", nil, errors.Errorf("no %s metadata", entityType)
+}
+
+// ProtocolJWKS returns the jwks.JWKS the entity with the passed entity id
+// uses for the protocol of the passed entity type, as published in its
+// (resolved) Metadata.
+// The keys are obtained from the signed_jwks_uri, the jwks_uri, or the jwks
+// claim, in this order of preference; if the keys cannot be obtained from a
+// source, e.g. because the signed jwks cannot be fetched or verified, the
+// next one is used. A signed jwks is verified with the passed federation
+// keys of the entity, i.e. the keys of its entity configuration; if no
+// federation keys are passed, the signed_jwks_uri is not used. Verified
+// signed jwks are cached.
+func (m Metadata) ProtocolJWKS(entityID, entityType string, federationKeys jwks.JWKS) (jwks.JWKS, error) {
+	signedJWKSURI, jwksURI, set, err := m.protocolKeyClaims(entityType)
+	if err != nil {
+		return jwks.JWKS{}, err
+	}
+	err = errors.New("no keys published")
+	if signedJWKSURI != "" && federationKeys.Set != nil {
+		keys, signedErr := signedJWKS(signedJWKSURI, entityID, federationKeys)
+		if signedErr == nil {
+			return keys, nil
+		}
+		internal.Logf("Could not obtain signed jwks of '%s': %s", entityID, signedErr.Error())
+		err = signedErr
+	}
+	if jwksURI != "" {
+		keys, uriErr := fetchJWKS(jwksURI)
+		if uriErr == nil {
+			return keys, nil
+		}
+		internal.Logf("Could not obtain jwks of '%s' from jwks_uri: %s", entityID, uriErr.Error())
+		err = uriErr
+	}
+	if set != nil && set.Set != nil && set.Len() > 0 {
+		return *set, nil
+	}
+	return jwks.JWKS{}, errors.Wrapf(err, "could not obtain %s keys of '%s'", entityType, entityID)
+}
+
+// ResolveProtocolJWKS resolves the entity with the passed entity id for the
+// passed entity type through the passed trust anchors and returns its
+// protocol keys as described in Metadata.ProtocolJWKS
+func ResolveProtocolJWKS(entityID, entityType string, trustAnchorIDs []string) (jwks.JWKS, error) {
+	metadata, federationKeys, err := resolveEntity(entityID, entityType, trustAnchorIDs)
+	if err != nil {
+		return jwks.JWKS{}, err
+	}
+	return metadata.ProtocolJWKS(entityID, entityType, federationKeys)
+}
+
+// resolveEntity resolves the Metadata of the entity with the passed entity id
+// and returns it together with the entity's federation keys
+func resolveEntity(entityID, entityType string, trustAnchorIDs []string) (*Metadata, jwks.JWKS, error) {
+	res, err := DefaultMetadataResolver.ResolveResponsePayload(
+		apimodel.ResolveRequest{
+			Subject:     entityID,
+			TrustAnchor: trustAnchorIDs,
+			EntityTypes: []string{entityType},
+		},
+	)
+	if err != nil {
+		return nil, jwks.JWKS{}, errors.Wrap(err, "no trust chain with valid metadata found")
+	}
+	if res.Metadata == nil {
+		return nil, jwks.JWKS{}, errors.Errorf("no %s metadata found", entityType)
+	}
+	var federationKeys jwks.JWKS
+	if len(res.TrustChain) > 0 {
+		var ec EntityStatementPayload
+		if err = json.Unmarshal(res.TrustChain[0].Payload(), &ec); err == nil && ec.Subject == entityID {
+			federationKeys = ec.JWKS
+		}
+	}
+	return res.Metadata, federationKeys, nil
+}
+
+// resolveOP resolves the OpenIDProviderMetadata and the federation keys of
+// the OP with the passed issuer through the FederationLeaf's TrustAnchors
+func (f FederationLeaf) resolveOP(issuer string) (*OpenIDProviderMetadata, jwks.JWKS, error) {
+	metadata, federationKeys, err := resolveEntity(
+		issuer, oidfedconst.EntityTypeOpenIDProvider, f.TrustAnchors.EntityIDs(),
+	)
+	if err != nil {
+		return nil, jwks.JWKS{}, err
+	}
+	if metadata.OpenIDProvider == nil {
+		return nil, jwks.JWKS{}, errors.New("no openid_provider metadata found")
+	}
+	return metadata.OpenIDProvider, federationKeys, nil
+}
+
+// opJWKS returns the protocol keys of an OP
+func opJWKS(op *OpenIDProviderMetadata, federationKeys jwks.JWKS) (jwks.JWKS, error) {
+	if op == nil {
+		return jwks.JWKS{}, errors.New("no op metadata")
+	}
+	return Metadata{OpenIDProvider: op}.ProtocolJWKS(op.Issuer, oidfedconst.EntityTypeOpenIDProvider, federationKeys)
+}
+
+func fetchJWKS(jwksURI string) (jwks.JWKS, error) {
+	body, _, err := httpGetCached(jwksURI, nil, 0)
+	if err != nil {
+		return jwks.JWKS{}, errors.Wrap(err, "could not obtain jwks from jwks_uri")
+	}
+	var keys jwks.JWKS
+	if err = json.Unmarshal(body, &keys); err != nil {
+		return jwks.JWKS{}, errors.Wrap(err, "could not parse jwks from jwks_uri")
+	}
+	return keys, nil
+}
+
+// signedJWKSClaims holds the claims of a signed jwks as obtained from a
+// signed_jwks_uri in addition to the keys
+type signedJWKSClaims struct {
+	Issuer    string             `json:"iss"`
+	Subject   string             `json:"sub"`
+	IssuedAt  *unixtime.Unixtime `json:"iat"`
+	ExpiresAt *unixtime.Unixtime `json:"exp"`
+}
+
+func signedJWKSCacheKey(entityID, signedJWKSURI string) string {
+	return cache.Key(
+		cache.KeySignedJWKS,
+		base64.URLEncoding.EncodeToString([]byte(entityID))+":"+base64.URLEncoding.EncodeToString([]byte(signedJWKSURI)),
+	)
+}
+
+// signedJWKS returns the verified signed jwks of an entity from the cache or
+// obtains it from the signed_jwks_uri
+func signedJWKS(signedJWKSURI, entityID string, federationKeys jwks.JWKS) (jwks.JWKS, error) {
+	key := signedJWKSCacheKey(entityID, signedJWKSURI)
+	var keys jwks.JWKS
+	set, err := cache.Get(key, &keys)
+	if err != nil {
+		internal.Log(err)
+	} else if set {
+		return keys, nil
+	}
+	keys, exp, err := fetchSignedJWKS(signedJWKSURI, entityID, federationKeys)
+	if err != nil {
+		return jwks.JWKS{}, err
+	}
+	ttl := SignedJWKSCacheLifetime
+	if exp != nil && !exp.IsZero() {
+		ttl = min(ttl, unixtime.Until(*exp))
+	}
+	if ttl > 0 {
+		if err = cache.Set(key, keys, ttl); err != nil {
+			internal.Log(err)
+		}
+	}
+	return keys, nil
+}
+
+// fetchSignedJWKS obtains the signed jwks from the passed signed_jwks_uri
+// and verifies it with the entity's federation keys; it returns the keys and
+// the expiration of the signed jwks
+func fetchSignedJWKS(signedJWKSURI, entityID string, federationKeys jwks.JWKS) (
+	jwks.JWKS, *unixtime.Unixtime, error,
+) {
+	body, _, err := httpGetCached(signedJWKSURI, nil, 0)
+	if err != nil {
+		return jwks.JWKS{}, nil, errors.Wrap(err, "could not obtain signed jwks")
+	}
+	m, err := jwx.Parse(body)
+	if err != nil {
+		return jwks.JWKS{}, nil, errors.Wrap(err, "could not parse signed jwks")
+	}
+	if !m.VerifyType(oidfedconst.JWTTypeJWKS) {
+		return jwks.JWKS{}, nil, errors.Errorf("signed jwks does not have '%s' JWT type", oidfedconst.JWTTypeJWKS)
+	}
+	payload, err := m.VerifyWithSet(federationKeys)
+	if err != nil {
+		return jwks.JWKS{}, nil, errors.Wrap(err, "could not verify signed jwks")
+	}
+	var keys jwks.JWKS
+	if err = json.Unmarshal(payload, &keys); err != nil {
+		return jwks.JWKS{}, nil, errors.Wrap(err, "could not parse signed jwks")
+	}
+	var signed signedJWKSClaims
+	if err = json.Unmarshal(payload, &signed); err != nil {
+		return jwks.JWKS{}, nil, errors.Wrap(err, "could not parse signed jwks")
+	}
+	if signed.Issuer != entityID {
+		return jwks.JWKS{}, nil, errors.New("signed jwks was not issued by the entity")
+	}
+	if signed.Subject != "" && signed.Subject != entityID {
+		return jwks.JWKS{}, nil, errors.New("signed jwks is not about the entity")
+	}
+	if err = unixtime.VerifyTime(signed.IssuedAt, signed.ExpiresAt); err != nil {
+		return jwks.JWKS{}, nil, errors.Wrap(err, "signed jwks is not valid")
+	}
+	return keys, signed.ExpiresAt, nil
+}
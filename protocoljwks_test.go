@@ -0,0 +1,317 @@
+package oidfed
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/lestrrat-go/jwx/v3/jwa"
+
+	"github.com/go-oidfed/lib/jwks"
+	"github.com/go-oidfed/lib/oidfedconst"
+)
+
+// signJWKS creates a signed jwks with the passed keys and additional claims
+func signJWKS(t *testing.T, signer crypto.Signer, typ string, keys jwks.JWKS, claims map[string]any) []byte {
+	keysJSON, err := json.Marshal(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payload map[string]any
+	if err = json.Unmarshal(keysJSON, &payload); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range claims {
+		payload[k] = v
+	}
+	jwt, err := NewGeneralJWTSigner(signer, jwa.ES256()).JWT(payload, typ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jwt
+}
+
+func TestFetchSignedJWKS(t *testing.T) {
+	const entityID = "https://op-signed-jwks.example.com"
+	federationKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	federationKeys := jwks.KeyToJWKS(federationKey.Public(), jwa.ES256())
+	opKeys := jwks.KeyToJWKS(opKey.Public(), jwa.ES256())
+	signedJWKS := func(signer crypto.Signer, typ string, claims map[string]any) []byte {
+		return signJWKS(t, signer, typ, opKeys, claims)
+	}
+	now := time.Now()
+	validClaims := map[string]any{
+		"iss": entityID,
+		"sub": entityID,
+		"iat": now.Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+	}
+
+	tests := []struct {
+		name      string
+		jwt       []byte
+		expectErr bool
+	}{
+		{
+			name: "valid",
+			jwt:  signedJWKS(federationKey, oidfedconst.JWTTypeJWKS, validClaims),
+		},
+		{
+			name:      "wrong type",
+			jwt:       signedJWKS(federationKey, "JWT", validClaims),
+			expectErr: true,
+		},
+		{
+			name:      "not signed with federation key",
+			jwt:       signedJWKS(opKey, oidfedconst.JWTTypeJWKS, validClaims),
+			expectErr: true,
+		},
+		{
+			name: "wrong issuer",
+			jwt: signedJWKS(
+				federationKey, oidfedconst.JWTTypeJWKS, map[string]any{
+					"iss": "https://other.example.com",
+					"iat": now.Unix(),
+				},
+			),
+			expectErr: true,
+		},
+		{
+			name: "expired",
+			jwt: signedJWKS(
+				federationKey, oidfedconst.JWTTypeJWKS, map[string]any{
+					"iss": entityID,
+					"iat": now.Add(-2 * time.Hour).Unix(),
+					"exp": now.Add(-time.Hour).Unix(),
+				},
+			),
+			expectErr: true,
+		},
+	}
+	for i, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				uri := entityID + "/jwks/" + string(rune('a'+i))
+				httpmock.RegisterResponder(
+					"GET", uri,
+					httpmock.NewBytesResponder(200, test.jwt).HeaderSet(
+						map[string][]string{"Content-Type": {oidfedconst.ContentTypeJWKS}},
+					),
+				)
+				keys, _, err := fetchSignedJWKS(uri, entityID, federationKeys)
+				if err != nil {
+					if !test.expectErr {
+						t.Fatal(err)
+					}
+					return
+				}
+				if test.expectErr {
+					t.Fatal("expected error, but verification succeeded")
+				}
+				if keys.Len() != 1 {
+					t.Errorf("unexpected number of keys: %d", keys.Len())
+				}
+			},
+		)
+	}
+}
+
+func TestMetadata_ProtocolJWKS(t *testing.T) {
+	const entityID = "https://rp-protocol-jwks.example.com"
+	federationKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	federationKeys := jwks.KeyToJWKS(federationKey.Public(), jwa.ES256())
+	newKeys := func() jwks.JWKS {
+		sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return jwks.KeyToJWKS(sk.Public(), jwa.ES256())
+	}
+	signedKeys, uriKeys, inlineKeys := newKeys(), newKeys(), newKeys()
+	signedURI := entityID + "/signed-jwks"
+	jwksURI := entityID + "/jwks"
+	now := time.Now()
+	httpmock.RegisterResponder(
+		"GET", signedURI,
+		httpmock.NewBytesResponder(
+			200, signJWKS(
+				t, federationKey, oidfedconst.JWTTypeJWKS, signedKeys, map[string]any{
+					"iss": entityID,
+					"iat": now.Unix(),
+					"exp": now.Add(time.Hour).Unix(),
+				},
+			),
+		),
+	)
+	httpmock.RegisterResponder("GET", jwksURI, httpmock.NewJsonResponderOrPanic(200, uriKeys))
+	unavailableURI := entityID + "/unavailable"
+	httpmock.RegisterResponder("GET", unavailableURI, httpmock.NewStringResponder(404, ""))
+
+	tests := []struct {
+		name           string
+		metadata       Metadata
+		entityType     string
+		federationKeys jwks.JWKS
+		expectedKeys   jwks.JWKS
+		expectErr      bool
+	}{
+		{
+			name: "signed_jwks_uri with wrong federation keys",
+			metadata: Metadata{
+				OAuthProtectedResource: &OAuthProtectedResourceMetadata{SignedJWKSURI: signedURI},
+			},
+			entityType:     oidfedconst.EntityTypeOAuthProtectedResource,
+			federationKeys: newKeys(),
+			expectErr:      true,
+		},
+		{
+			name: "signed_jwks_uri with wrong federation keys falls back to jwks_uri",
+			metadata: Metadata{
+				RelyingParty: &OpenIDRelyingPartyMetadata{
+					SignedJWKSURI: signedURI,
+					JWKSURI:       jwksURI,
+					JWKS:          &inlineKeys,
+				},
+			},
+			entityType:     oidfedconst.EntityTypeOpenIDRelyingParty,
+			federationKeys: newKeys(),
+			expectedKeys:   uriKeys,
+		},
+		{
+			name: "unavailable signed_jwks_uri and jwks_uri fall back to jwks",
+			metadata: Metadata{
+				RelyingParty: &OpenIDRelyingPartyMetadata{
+					SignedJWKSURI: unavailableURI,
+					JWKSURI:       unavailableURI,
+					JWKS:          &inlineKeys,
+				},
+			},
+			entityType:     oidfedconst.EntityTypeOpenIDRelyingParty,
+			federationKeys: federationKeys,
+			expectedKeys:   inlineKeys,
+		},
+		{
+			name: "unavailable jwks_uri without fallback",
+			metadata: Metadata{
+				RelyingParty: &OpenIDRelyingPartyMetadata{JWKSURI: unavailableURI},
+			},
+			entityType: oidfedconst.EntityTypeOpenIDRelyingParty,
+			expectErr:  true,
+		},
+		{
+			name: "signed_jwks_uri preferred",
+			metadata: Metadata{
+				RelyingParty: &OpenIDRelyingPartyMetadata{
+					SignedJWKSURI: signedURI,
+					JWKSURI:       jwksURI,
+					JWKS:          &inlineKeys,
+				},
+			},
+			entityType:     oidfedconst.EntityTypeOpenIDRelyingParty,
+			federationKeys: federationKeys,
+			expectedKeys:   signedKeys,
+		},
+		{
+			name: "signed_jwks_uri without federation keys",
+			metadata: Metadata{
+				RelyingParty: &OpenIDRelyingPartyMetadata{
+					SignedJWKSURI: signedURI,
+					JWKSURI:       jwksURI,
+					JWKS:          &inlineKeys,
+				},
+			},
+			entityType:   oidfedconst.EntityTypeOpenIDRelyingParty,
+			expectedKeys: uriKeys,
+		},
+		{
+			name: "jwks_uri preferred over jwks",
+			metadata: Metadata{
+				RelyingParty: &OpenIDRelyingPartyMetadata{
+					JWKSURI: jwksURI,
+					JWKS:    &inlineKeys,
+				},
+			},
+			entityType:     oidfedconst.EntityTypeOpenIDRelyingParty,
+			federationKeys: federationKeys,
+			expectedKeys:   uriKeys,
+		},
+		{
+			name: "jwks",
+			metadata: Metadata{
+				RelyingParty: &OpenIDRelyingPartyMetadata{JWKS: &inlineKeys},
+			},
+			entityType:   oidfedconst.EntityTypeOpenIDRelyingParty,
+			expectedKeys: inlineKeys,
+		},
+		{
+			name: "no keys",
+			metadata: Metadata{
+				RelyingParty: &OpenIDRelyingPartyMetadata{},
+			},
+			entityType: oidfedconst.EntityTypeOpenIDRelyingParty,
+			expectErr:  true,
+		},
+		{
+			name: "no metadata for entity type",
+			metadata: Metadata{
+				RelyingParty: &OpenIDRelyingPartyMetadata{JWKS: &inlineKeys},
+			},
+			entityType: oidfedconst.EntityTypeOpenIDProvider,
+			expectErr:  true,
+		},
+		{
+			name:       "entity type without keys",
+			metadata:   Metadata{FederationEntity: &FederationEntityMetadata{}},
+			entityType: oidfedconst.EntityTypeFederationEntity,
+			expectErr:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				keys, err := test.metadata.ProtocolJWKS(entityID, test.entityType, test.federationKeys)
+				if err != nil {
+					if !test.expectErr {
+						t.Fatal(err)
+					}
+					return
+				}
+				if test.expectErr {
+					t.Fatal("expected error, but got keys")
+				}
+				expectedKey, _ := test.expectedKeys.Key(0)
+				kid, _ := expectedKey.KeyID()
+				if _, found := keys.LookupKeyID(kid); !found || keys.Len() != 1 {
+					t.Errorf("unexpected keys returned")
+				}
+			},
+		)
+	}
+
+	t.Run(
+		"signed jwks is cached", func(t *testing.T) {
+			httpmock.RegisterResponder("GET", signedURI, httpmock.NewStringResponder(500, ""))
+			metadata := Metadata{RelyingParty: &OpenIDRelyingPartyMetadata{SignedJWKSURI: signedURI}}
+			if _, err := metadata.ProtocolJWKS(
+				entityID, oidfedconst.EntityTypeOpenIDRelyingParty, federationKeys,
+			); err != nil {
+				t.Fatal(err)
+			}
+		},
+	)
+}
@@ -0,0 +1,269 @@
+package oidfed
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"slices"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/go-oidfed/lib/cache"
+	"github.com/go-oidfed/lib/internal"
+	"github.com/go-oidfed/lib/internal/jwx"
+	"github.com/go-oidfed/lib/jwks"
+	"github.com/go-oidfed/lib/oidfedconst"
+	"github.com/go-oidfed/lib/unixtime"
+)
+
+// AccessTokenIssuerCacheLifetime is the maximum time the keys of a resolved
+// access token issuer are cached; they are never cached beyond the
+// expiration of the used trust chain
+var AccessTokenIssuerCacheLifetime = time.Hour
+
+// AccessTokenIssuerRefreshInterval is the minimum time between two forced
+// refreshes of the cached keys of an access token issuer; a refresh is forced
+// if an access token is signed with a key that is not in the cached keys
+var AccessTokenIssuerRefreshInterval = time.Minute
+
+// AccessTokenIssuerFailureCacheLifetime is the time a failed resolution of an
+// access token issuer is cached; during this time access tokens of the issuer
+// are rejected without resolving it again
+var AccessTokenIssuerFailureCacheLifetime = time.Minute
+
+// JWT types of JWT access tokens as defined in RFC 9068
+const (
+	jwtTypeAccessToken            = "at+jwt"
+	jwtTypeAccessTokenApplication = "application/at+jwt"
+)
+
+// AccessTokenClaims holds the claims of a validated JWT access token as
+// defined in RFC 9068; additional claims are set in the Extra field
+type AccessTokenClaims struct {
+	Issuer    string                     `json:"iss"`
+	Subject   string                     `json:"sub"`
+	Audience  SliceOrSingleValue[string] `json:"aud"`
+	ExpiresAt *unixtime.Unixtime         `json:"exp"`
+	IssuedAt  *unixtime.Unixtime         `json:"iat,omitempty"`
+	NotBefore *unixtime.Unixtime         `json:"nbf,omitempty"`
+	ClientID  string                     `json:"client_id,omitempty"`
+	Scope     string                     `json:"scope,omitempty"`
+	JWTID     string                     `json:"jti,omitempty"`
+
+	Extra map[string]any `json:"-"`
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface
+func (c *AccessTokenClaims) UnmarshalJSON(data []byte) error {
+	type accessTokenClaims AccessTokenClaims
+	cc := accessTokenClaims(*c)
+	extra, err := unmarshalWithExtra(data, &cc)
+	if err != nil {
+		return err
+	}
+	cc.Extra = extra
+	*c = AccessTokenClaims(cc)
+	return nil
+}
+
+// AccessTokenValidator validates JWT access tokens for a protected resource.
+// The issuer of an access token is resolved through the federation; it must
+// be an oauth_authorization_server or openid_provider that lists the
+// resource in its protected_resources.
+type AccessTokenValidator struct {
+	// ResourceID is the resource identifier of the protected resource; it
+	// must be an audience of access tokens
+	ResourceID   string
+	TrustAnchors TrustAnchors
+	// AllowedIssuers optionally restricts the accepted access token issuers;
+	// if set, access tokens of other issuers are rejected without resolving
+	// the issuer
+	AllowedIssuers []string
+}
+
+// NewAccessTokenValidator creates a new AccessTokenValidator for the passed
+// resource
+func NewAccessTokenValidator(resourceID string, trustAnchors TrustAnchors) *AccessTokenValidator {
+	return &AccessTokenValidator{
+		ResourceID:   resourceID,
+		TrustAnchors: trustAnchors,
+	}
+}
+
+// Validate validates the passed JWT access token and returns its claims
+func (v AccessTokenValidator) Validate(token []byte) (*AccessTokenClaims, error) {
+	m, err := jwx.Parse(token)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse access token")
+	}
+	if !m.VerifyType(jwtTypeAccessToken) && !m.VerifyType(jwtTypeAccessTokenApplication) {
+		return nil, errors.Errorf("access token does not have '%s' JWT type", jwtTypeAccessToken)
+	}
+	var claims AccessTokenClaims
+	if err = json.Unmarshal(m.Payload(), &claims); err != nil {
+		return nil, errors.Wrap(err, "could not parse access token claims")
+	}
+	if claims.Issuer == "" {
+		return nil, errors.New("access token does not contain an issuer")
+	}
+	if len(v.AllowedIssuers) > 0 && !slices.Contains(v.AllowedIssuers, claims.Issuer) {
+		return nil, errors.Errorf("access token issuer '%s' is not allowed", claims.Issuer)
+	}
+
+	keys, cached, err := v.issuerKeys(claims.Issuer, false)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = m.VerifyWithSet(keys); err != nil {
+		if !cached || !v.issuerKeysRefreshAllowed(claims.Issuer, m, keys) {
+			return nil, errors.Wrap(err, "could not verify access token signature")
+		}
+		// the issuer might have rotated its keys
+		if keys, _, err = v.issuerKeys(claims.Issuer, true); err != nil {
+			return nil, err
+		}
+		if _, err = m.VerifyWithSet(keys); err != nil {
+			return nil, errors.Wrap(err, "could not verify access token signature")
+		}
+	}
+	if err = claims.verify(v.ResourceID); err != nil {
+		return nil, errors.Wrap(err, "access token invalid")
+	}
+	return &claims, nil
+}
+
+func (c AccessTokenClaims) verify(resourceID string) error {
+	if c.Subject == "" {
+		return errors.New("no subject")
+	}
+	if !slices.Contains(c.Audience, resourceID) {
+		return errors.New("resource is not an audience")
+	}
+	if c.ExpiresAt == nil || c.ExpiresAt.IsZero() {
+		return errors.New("no expiration")
+	}
+	if err := unixtime.VerifyTime(c.IssuedAt, c.ExpiresAt); err != nil {
+		return err
+	}
+	if c.NotBefore != nil && c.NotBefore.After(time.Now()) {
+		return errors.New("not yet valid")
+	}
+	return nil
+}
+
+func (v AccessTokenValidator) issuerCacheKey(subsystem, issuer string) string {
+	return cache.Key(
+		subsystem,
+		base64.URLEncoding.EncodeToString([]byte(v.ResourceID))+":"+base64.URLEncoding.EncodeToString([]byte(issuer)),
+	)
+}
+
+// issuerKeys returns the keys of the access token issuer, either from the
+// cache or by resolving the issuer; the returned bool indicates if the keys
+// were obtained from the cache. Failed resolutions are cached for
+// AccessTokenIssuerFailureCacheLifetime, so that access tokens with arbitrary
+// issuers cannot be used to trigger outgoing requests.
+func (v AccessTokenValidator) issuerKeys(issuer string, forceRefresh bool) (jwks.JWKS, bool, error) {
+	key := v.issuerCacheKey(cache.KeyAccessTokenIssuer, issuer)
+	if !forceRefresh {
+		var keys jwks.JWKS
+		set, err := cache.Get(key, &keys)
+		if err != nil {
+			internal.Log(err)
+		} else if set {
+			return keys, true, nil
+		}
+	}
+	failureKey := v.issuerCacheKey(cache.KeyAccessTokenIssuerFailure, issuer)
+	var failure string
+	set, err := cache.Get(failureKey, &failure)
+	if err != nil {
+		internal.Log(err)
+	} else if set {
+		return jwks.JWKS{}, false, errors.New(failure)
+	}
+	keys, exp, err := v.resolveIssuer(issuer)
+	if err != nil {
+		if cacheErr := cache.Set(failureKey, err.Error(), AccessTokenIssuerFailureCacheLifetime); cacheErr != nil {
+			internal.Log(cacheErr)
+		}
+		return jwks.JWKS{}, false, err
+	}
+	if ttl := min(AccessTokenIssuerCacheLifetime, unixtime.Until(exp)); ttl > 0 {
+		if err = cache.Set(key, keys, ttl); err != nil {
+			internal.Log(err)
+		}
+	}
+	return keys, false, nil
+}
+
+// issuerKeysRefreshAllowed checks if the cached keys of the access token
+// issuer should be refreshed because the passed token could not be verified
+// with them. This is only the case if the token's kid is not one of the
+// cached keys and the keys were not already refreshed within the
+// AccessTokenIssuerRefreshInterval.
+func (v AccessTokenValidator) issuerKeysRefreshAllowed(issuer string, token *jwx.ParsedJWT, keys jwks.JWKS) bool {
+	if sigs := token.Signatures(); len(sigs) > 0 {
+		if kid, ok := sigs[0].ProtectedHeaders().KeyID(); ok && kid != "" {
+			if _, known := keys.LookupKeyID(kid); known {
+				return false
+			}
+		}
+	}
+	key := v.issuerCacheKey(cache.KeyAccessTokenIssuerRefresh, issuer)
+	var refreshed bool
+	set, err := cache.Get(key, &refreshed)
+	if err != nil {
+		internal.Log(err)
+	} else if set {
+		return false
+	}
+	if err = cache.Set(key, true, AccessTokenIssuerRefreshInterval); err != nil {
+		internal.Log(err)
+	}
+	return true
+}
+
+// resolveIssuer resolves the access token issuer through the federation,
+// checks that it lists the resource, and returns its keys together with the
+// expiration of the used trust chain
+func (v AccessTokenValidator) resolveIssuer(issuer string) (jwks.JWKS, unixtime.Unixtime, error) {
+	resolver := TrustResolver{
+		TrustAnchors:   v.TrustAnchors,
+		StartingEntity: issuer,
+		Types: []string{
+			entityTypeOAuthAuthorizationServer,
+			oidfedconst.EntityTypeOpenIDProvider,
+		},
+	}
+	chains := resolver.ResolveToValidChains()
+	if len(chains) == 0 {
+		return jwks.JWKS{}, unixtime.Unixtime{}, errors.Errorf("no valid trust chain for issuer '%s' found", issuer)
+	}
+	chain := chains.SortAsc(TrustChainScoringPathLen)[0]
+	metadata, err := chain.Metadata()
+	if err != nil {
+		return jwks.JWKS{}, unixtime.Unixtime{}, err
+	}
+	for _, entityType := range resolver.Types {
+		var protectedResources []string
+		switch entityType {
+		case entityTypeOAuthAuthorizationServer:
+			if metadata.OAuthAuthorizationServer != nil {
+				protectedResources = metadata.OAuthAuthorizationServer.ProtectedResources
+			}
+		case oidfedconst.EntityTypeOpenIDProvider:
+			if metadata.OpenIDProvider != nil {
+				protectedResources = metadata.OpenIDProvider.ProtectedResources
+			}
+		}
+		if !slices.Contains(protectedResources, v.ResourceID) {
+			continue
+		}
+		keys, err := metadata.ProtocolJWKS(issuer, entityType, chain[0].JWKS)
+		return keys, chain.ExpiresAt(), err
+	}
+	return jwks.JWKS{}, unixtime.Unixtime{}, errors.Errorf(
+		"issuer '%s' is not an authorization server for resource '%s'", issuer, v.ResourceID,
+	)
+}
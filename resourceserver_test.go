@@ -0,0 +1,279 @@
+package oidfed
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/lestrrat-go/jwx/v3/jwa"
+
+	"github.com/go-oidfed/lib/internal/jwx"
+	"github.com/go-oidfed/lib/jwks"
+)
+
+const testResourceID = "https://rs.example.com"
+
+var asKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+var asListingResource = newMockOP(
+	"https://as-listing.example.com",
+	&OpenIDProviderMetadata{
+		ProtectedResources: []string{testResourceID},
+		JWKS: func() *jwks.JWKS {
+			k := jwks.KeyToJWKS(asKey.Public(), jwa.ES256())
+			return &k
+		}(),
+	},
+)
+
+var asNotListingResource = newMockOP(
+	"https://as-not-listing.example.com",
+	&OpenIDProviderMetadata{
+		ProtectedResources: []string{"https://other-rs.example.com"},
+		JWKS: func() *jwks.JWKS {
+			k := jwks.KeyToJWKS(asKey.Public(), jwa.ES256())
+			return &k
+		}(),
+	},
+)
+
+func init() {
+	taExplicit.RegisterSubordinate(asListingResource)
+	taExplicit.RegisterSubordinate(asNotListingResource)
+}
+
+func TestAccessTokenValidator_Validate(t *testing.T) {
+	validator := NewAccessTokenValidator(
+		testResourceID, TrustAnchors{{EntityID: taExplicit.EntityID, JWKS: taExplicit.data.JWKS}},
+	)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	accessToken := func(key *ecdsa.PrivateKey, typ string, mutate func(map[string]any)) []byte {
+		claims := map[string]any{
+			"iss":       asListingResource.EntityID,
+			"sub":       "user",
+			"aud":       testResourceID,
+			"client_id": "https://rp.example.com",
+			"iat":       now.Unix(),
+			"exp":       now.Add(time.Hour).Unix(),
+			"scope":     "read",
+		}
+		if mutate != nil {
+			mutate(claims)
+		}
+		jwt, err := NewGeneralJWTSigner(key, jwa.ES256()).JWT(claims, typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return jwt
+	}
+
+	tests := []struct {
+		name      string
+		token     []byte
+		expectErr bool
+	}{
+		{
+			name:  "valid",
+			token: accessToken(asKey, jwtTypeAccessToken, nil),
+		},
+		{
+			name:  "valid with application type",
+			token: accessToken(asKey, jwtTypeAccessTokenApplication, nil),
+		},
+		{
+			name:      "wrong type",
+			token:     accessToken(asKey, "JWT", nil),
+			expectErr: true,
+		},
+		{
+			name:      "wrong key",
+			token:     accessToken(otherKey, jwtTypeAccessToken, nil),
+			expectErr: true,
+		},
+		{
+			name:      "wrong audience",
+			token:     accessToken(asKey, jwtTypeAccessToken, func(c map[string]any) { c["aud"] = "https://other-rs.example.com" }),
+			expectErr: true,
+		},
+		{
+			name:      "expired",
+			token:     accessToken(asKey, jwtTypeAccessToken, func(c map[string]any) { c["exp"] = now.Add(-time.Minute).Unix() }),
+			expectErr: true,
+		},
+		{
+			name:      "no expiration",
+			token:     accessToken(asKey, jwtTypeAccessToken, func(c map[string]any) { delete(c, "exp") }),
+			expectErr: true,
+		},
+		{
+			name:      "not yet valid",
+			token:     accessToken(asKey, jwtTypeAccessToken, func(c map[string]any) { c["nbf"] = now.Add(time.Hour).Unix() }),
+			expectErr: true,
+		},
+		{
+			name: "issuer not listing resource",
+			token: accessToken(
+				asKey, jwtTypeAccessToken, func(c map[string]any) { c["iss"] = asNotListingResource.EntityID },
+			),
+			expectErr: true,
+		},
+		{
+			name: "issuer not in federation",
+			token: accessToken(
+				asKey, jwtTypeAccessToken, func(c map[string]any) { c["iss"] = "https://unknown-as.example.com" },
+			),
+			expectErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				claims, err := validator.Validate(test.token)
+				if err != nil {
+					if !test.expectErr {
+						t.Fatal(err)
+					}
+					return
+				}
+				if test.expectErr {
+					t.Fatal("expected error, but validation succeeded")
+				}
+				if claims.Subject != "user" || claims.Scope != "read" {
+					t.Errorf("unexpected claims: %+v", claims)
+				}
+			},
+		)
+	}
+}
+
+func TestAccessTokenValidator_issuerKeysRefreshAllowed(t *testing.T) {
+	validator := NewAccessTokenValidator(
+		"https://rs-refresh.example.com", TrustAnchors{{EntityID: taExplicit.EntityID, JWKS: taExplicit.data.JWKS}},
+	)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	knownKeys := jwks.KeyToJWKS(asKey.Public(), jwa.ES256())
+	token := func(key *ecdsa.PrivateKey) *jwx.ParsedJWT {
+		jwt, err := NewGeneralJWTSigner(key, jwa.ES256()).JWT(map[string]any{"iss": "issuer"}, jwtTypeAccessToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := jwx.Parse(jwt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	tests := []struct {
+		name     string
+		issuer   string
+		token    *jwx.ParsedJWT
+		expected bool
+	}{
+		{
+			name:     "known kid",
+			issuer:   "https://as-known-kid.example.com",
+			token:    token(asKey),
+			expected: false,
+		},
+		{
+			name:     "unknown kid",
+			issuer:   "https://as-unknown-kid.example.com",
+			token:    token(otherKey),
+			expected: true,
+		},
+		{
+			name:     "unknown kid within refresh interval",
+			issuer:   "https://as-unknown-kid.example.com",
+			token:    token(otherKey),
+			expected: false,
+		},
+		{
+			name:     "unknown kid of other issuer",
+			issuer:   "https://as-other-unknown-kid.example.com",
+			token:    token(otherKey),
+			expected: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				if allowed := validator.issuerKeysRefreshAllowed(test.issuer, test.token, knownKeys); allowed != test.expected {
+					t.Errorf("expected refresh allowed to be %v, but got %v", test.expected, allowed)
+				}
+			},
+		)
+	}
+}
+
+func TestAccessTokenValidator_Validate_NoRepeatedResolution(t *testing.T) {
+	unknownIssuer := "https://unknown-as-cached.example.com"
+	var calls int
+	httpmock.RegisterResponder(
+		http.MethodGet, unknownIssuer+"/.well-known/openid-federation",
+		func(*http.Request) (*http.Response, error) {
+			calls++
+			return httpmock.NewStringResponse(http.StatusNotFound, ""), nil
+		},
+	)
+	now := time.Now()
+	accessToken := func(issuer string) []byte {
+		jwt, err := NewGeneralJWTSigner(asKey, jwa.ES256()).JWT(
+			map[string]any{
+				"iss": issuer,
+				"sub": "user",
+				"aud": "https://rs-negative.example.com",
+				"iat": now.Unix(),
+				"exp": now.Add(time.Hour).Unix(),
+			}, jwtTypeAccessToken,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return jwt
+	}
+
+	t.Run(
+		"failed resolution cached", func(t *testing.T) {
+			validator := NewAccessTokenValidator(
+				"https://rs-negative.example.com",
+				TrustAnchors{{EntityID: taExplicit.EntityID, JWKS: taExplicit.data.JWKS}},
+			)
+			for i := 0; i < 3; i++ {
+				if _, err := validator.Validate(accessToken(unknownIssuer)); err == nil {
+					t.Fatal("expected error, but validation succeeded")
+				}
+			}
+			if calls != 1 {
+				t.Errorf("expected the issuer to be resolved once, but it was fetched %d times", calls)
+			}
+		},
+	)
+	t.Run(
+		"issuer not allowed", func(t *testing.T) {
+			calls = 0
+			validator := NewAccessTokenValidator(
+				"https://rs-allowed.example.com",
+				TrustAnchors{{EntityID: taExplicit.EntityID, JWKS: taExplicit.data.JWKS}},
+			)
+			validator.AllowedIssuers = []string{asListingResource.EntityID}
+			if _, err := validator.Validate(accessToken(unknownIssuer)); err == nil {
+				t.Fatal("expected error, but validation succeeded")
+			}
+			if calls != 0 {
+				t.Errorf("expected the issuer not to be resolved, but it was fetched %d times", calls)
+			}
+		},
+	)
+}
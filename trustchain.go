@@ -9,6 +9,7 @@ import (
 	"github.com/go-oidfed/lib/cache"
 	"github.com/go-oidfed/lib/internal"
 	"github.com/go-oidfed/lib/internal/utils"
+	"github.com/go-oidfed/lib/jwks"
 	"github.com/go-oidfed/lib/unixtime"
 )
 
@@ -111,9 +112,51 @@ func (c TrustChain) Messages() (msgs JWSMessages) {
 	return
 }
 
+// verifySignatures verifies the signatures of all statements in the
+// TrustChain, starting at the TrustAnchor, which must be one of the passed
+// TrustAnchors
+func (c TrustChain) verifySignatures(anchors TrustAnchors) bool {
+	if len(c) == 0 {
+		return false
+	}
+	taStmt := c[len(c)-1]
+	var taJWKS jwks.JWKS
+	var taFound bool
+	for _, ta := range anchors {
+		if utils.Equal(ta.EntityID, taStmt.Issuer, taStmt.Subject) {
+			taJWKS = ta.JWKS
+			taFound = true
+			break
+		}
+	}
+	if !taFound {
+		return false
+	}
+	if taJWKS.Set == nil {
+		taJWKS = taStmt.JWKS
+	}
+	if !taStmt.Verify(taJWKS) {
+		return false
+	}
+	for i := len(c) - 2; i >= 0; i-- {
+		keys := c[i+1].JWKS
+		if i+1 == len(c)-1 {
+			keys = taJWKS
+		}
+		if !c[i].Verify(keys) {
+			return false
+		}
+	}
+	return true
+}
+
 func (c TrustChain) cacheGetMetadata() (
 	metadata *Metadata, set bool, err error,
 ) {
+	if ResolverCacheReverifySignatures {
+		// resolved metadata cannot be verified, so it is always computed
+		return nil, false, nil
+	}
 	hash, err := c.hash()
 	if err != nil {
 		return nil, false, err
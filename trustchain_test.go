@@ -230,3 +230,39 @@ func TestTrustChain_MetaDataPolicyCrit(t *testing.T) {
 		)
 	}
 }
+
+func TestTrustChain_verifySignatures(t *testing.T) {
+	anchors := TrustAnchors{
+		{
+			EntityID: ta1.EntityID,
+			JWKS:     ta1.data.JWKS,
+		},
+	}
+	resolver := TrustResolver{
+		TrustAnchors:   anchors,
+		StartingEntity: rp1.EntityID,
+	}
+	chains := resolver.ResolveToValidChains()
+	if len(chains) == 0 {
+		t.Fatal("no trust chains resolved")
+	}
+	ta2Config, err := GetEntityConfiguration(ta2.EntityID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, chain := range chains {
+		if !chain.verifySignatures(anchors) {
+			t.Errorf("valid trust chain %+v could not be verified", chain)
+		}
+		if chain.verifySignatures(NewTrustAnchorsFromEntityIDs(ta2.EntityID)) {
+			t.Error("trust chain verified for wrong trust anchor")
+		}
+		tampered := append(TrustChain{}, chain...)
+		forged := *tampered[len(tampered)-1]
+		forged.jwtMsg = ta2Config.jwtMsg
+		tampered[len(tampered)-1] = &forged
+		if tampered.verifySignatures(anchors) {
+			t.Error("tampered trust chain was verified")
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"slices"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v3"
 
@@ -18,28 +19,20 @@ import (
 // TrustMarkInfos is a slice of TrustMarkInfo
 type TrustMarkInfos []TrustMarkInfo
 
-// VerifiedFederation verifies all TrustMarkInfos by using the passed trust anchor and returns only the valid TrustMarkInfos
-func (tms TrustMarkInfos) VerifiedFederation(ta *EntityStatementPayload) (verified TrustMarkInfos) {
-	for _, tm := range tms {
-		if err := tm.VerifyFederation(ta); err == nil {
-			verified = append(verified, tm)
-		}
-	}
-	return
+// VerifiedFederation verifies all TrustMarkInfos by using the passed trust anchor and returns only the valid TrustMarkInfos.
+// Use VerifyFederationReport to also obtain the reasons for invalid TrustMarkInfos.
+func (tms TrustMarkInfos) VerifiedFederation(ta *EntityStatementPayload) TrustMarkInfos {
+	return tms.VerifyFederationReport(ta).Verified()
 }
 
 // VerifiedExternal verifies all TrustMarkInfos by using the passed trust mark issuer jwks and optionally the passed
-// trust mark owner jwks and returns only the valid TrustMarkInfos
+// trust mark owner jwks and returns only the valid TrustMarkInfos.
+// Use VerifyExternalReport to also obtain the reasons for invalid TrustMarkInfos.
 func (tms TrustMarkInfos) VerifiedExternal(
 	jwks jwks.JWKS,
 	tmo ...TrustMarkOwnerSpec,
-) (verified TrustMarkInfos) {
-	for _, tm := range tms {
-		if err := tm.VerifyExternal(jwks, tmo...); err == nil {
-			verified = append(verified, tm)
-		}
-	}
-	return
+) TrustMarkInfos {
+	return tms.VerifyExternalReport(jwks, tmo...).Verified()
 }
 
 // Find uses the passed function to find the first matching TrustMarkInfo
@@ -122,10 +115,13 @@ func (tm *TrustMarkInfo) TrustMark() (*TrustMark, error) {
 func (tm *TrustMarkInfo) VerifyFederation(ta *EntityStatementPayload) error {
 	mark, err := tm.TrustMark()
 	if err != nil {
-		return err
+		return trustMarkVerificationError(TrustMarkFailureMalformed, err)
 	}
 	if mark.TrustMarkType != tm.TrustMarkType {
-		return errors.Errorf("trust mark object claim 'trust_mark_type' does not match JWT claim")
+		return trustMarkVerificationError(
+			TrustMarkFailureTypeMismatch,
+			errors.Errorf("trust mark object claim 'trust_mark_type' does not match JWT claim"),
+		)
 	}
 	return mark.VerifyFederation(ta)
 }
@@ -138,10 +134,13 @@ func (tm *TrustMarkInfo) VerifyExternal(
 ) error {
 	mark, err := tm.TrustMark()
 	if err != nil {
-		return err
+		return trustMarkVerificationError(TrustMarkFailureMalformed, err)
 	}
 	if mark.TrustMarkType != tm.TrustMarkType {
-		return errors.Errorf("trust mark object claim 'trust_mark_type' does not match JWT claim")
+		return trustMarkVerificationError(
+			TrustMarkFailureTypeMismatch,
+			errors.Errorf("trust mark object claim 'trust_mark_type' does not match JWT claim"),
+		)
 	}
 	return mark.VerifyExternal(jwks, tmo...)
 }
@@ -156,6 +155,7 @@ type TrustMark struct {
 	ExpiresAt     *unixtime.Unixtime     `json:"exp,omitempty"`
 	Ref           string                 `json:"ref,omitempty"`
 	DelegationJWT string                 `json:"delegation,omitempty"`
+	JTI           string                 `json:"jti,omitempty"`
 	Extra         map[string]interface{} `json:"-"`
 	jwtMsg        *jwx.ParsedJWT
 	delegation    *DelegationJWT
@@ -219,8 +219,19 @@ func getTrustMarkIssuerJWKS(
 	trustMarkIssuer string,
 	ta *EntityStatementPayload,
 ) (jwks jwks.JWKS, err error) {
+	jwks, _, err = resolveTrustMarkIssuer(trustMarkIssuer, ta)
+	return
+}
+
+// resolveTrustMarkIssuer resolves the passed trust mark issuer with the passed
+// trust anchor and returns its jwks and its metadata
+func resolveTrustMarkIssuer(
+	trustMarkIssuer string,
+	ta *EntityStatementPayload,
+) (jwks jwks.JWKS, metadata *Metadata, err error) {
 	if trustMarkIssuer == ta.Subject {
 		jwks = ta.JWKS
+		metadata = ta.Metadata
 		return
 	}
 
@@ -254,6 +265,10 @@ func getTrustMarkIssuerJWKS(
 		return
 	}
 	jwks = tmi.JWKS
+	metadata = res.Metadata
+	if metadata == nil {
+		metadata = tmi.Metadata
+	}
 	return
 }
 
@@ -262,53 +277,83 @@ func (tm *TrustMark) VerifyFederation(ta *EntityStatementPayload) error {
 	if ta.TrustMarkIssuers != nil {
 		if tmis, found := ta.TrustMarkIssuers[tm.TrustMarkType]; found {
 			if !slices.Contains(tmis, tm.Issuer) {
-				return errors.New("verify trustmark: trust mark issuer is not allowed by trust anchor")
+				return trustMarkVerificationError(
+					TrustMarkFailureIssuerNotAllowed,
+					errors.New("verify trustmark: trust mark issuer is not allowed by trust anchor"),
+				)
 			}
 		}
 	}
 	jwks, err := getTrustMarkIssuerJWKS(tm.Issuer, ta)
 	if err != nil {
-		return err
+		return trustMarkVerificationError(TrustMarkFailureIssuerUnresolvable, err)
 	}
 	tmo, tmoFound := ta.TrustMarkOwners[tm.TrustMarkType]
 	if !tmoFound {
 		// no delegation
-		return tm.VerifyExternal(jwks)
+		return tm.verifyExternal(ta, jwks)
 	}
-	return tm.VerifyExternal(jwks, tmo)
+	return tm.verifyExternal(ta, jwks, tmo)
 }
 
 // VerifyExternal verifies the TrustMark by using the passed trust mark issuer jwks and optionally the passed
 // trust mark owner jwks
 func (tm *TrustMark) VerifyExternal(jwks jwks.JWKS, tmo ...TrustMarkOwnerSpec) error {
-	if err := unixtime.VerifyTime(&tm.IssuedAt, tm.ExpiresAt); err != nil {
+	return tm.verifyExternal(nil, jwks, tmo...)
+}
+
+// verifyExternal verifies the TrustMark like VerifyExternal; ta is the trust
+// anchor the TrustMark is verified with and might be nil
+func (tm *TrustMark) verifyExternal(ta *EntityStatementPayload, jwks jwks.JWKS, tmo ...TrustMarkOwnerSpec) error {
+	if err := verifyTrustMarkTime(tm.IssuedAt, tm.ExpiresAt); err != nil {
 		return err
 	}
 	if _, err := tm.jwtMsg.VerifyWithSet(jwks); err != nil {
-		return errors.Wrap(err, "verify trustmark")
+		return trustMarkVerificationError(TrustMarkFailureInvalidSignature, errors.Wrap(err, "verify trustmark"))
 	}
-	if len(tmo) == 0 {
-		// no delegation
-		return nil
+	if len(tmo) > 0 {
+		if err := tm.verifyDelegation(tmo[0]); err != nil {
+			return err
+		}
 	}
-	// delegation
+	return checkTrustMarkRevocation(tm, ta)
+}
+
+// verifyDelegation verifies that the TrustMark contains a valid delegation
+// from the passed trust mark owner
+func (tm *TrustMark) verifyDelegation(tmo TrustMarkOwnerSpec) error {
 	delegation, err := tm.Delegation()
 	if err != nil {
-		return errors.Wrap(err, "verify trustmark: parsing delegation jwt")
+		return trustMarkVerificationError(
+			TrustMarkFailureInvalidDelegation, errors.Wrap(err, "verify trustmark: parsing delegation jwt"),
+		)
 	}
 	if delegation == nil {
-		return errors.New("verify trustmark: no delegation jwt in trust mark")
+		return trustMarkVerificationError(
+			TrustMarkFailureMissingDelegation, errors.New("verify trustmark: no delegation jwt in trust mark"),
+		)
 	}
 	if delegation.TrustMarkType != tm.TrustMarkType {
-		return errors.New("verify trustmark: delegation jwt not for this trust mark")
+		return trustMarkVerificationError(
+			TrustMarkFailureInvalidDelegation, errors.New("verify trustmark: delegation jwt not for this trust mark"),
+		)
 	}
 	if delegation.Subject != tm.Issuer {
-		return errors.New("verify trustmark: delegation jwt not for this trust mark issuer")
+		return trustMarkVerificationError(
+			TrustMarkFailureInvalidDelegation,
+			errors.New("verify trustmark: delegation jwt not for this trust mark issuer"),
+		)
+	}
+	if delegation.Issuer != tmo.ID {
+		return trustMarkVerificationError(
+			TrustMarkFailureInvalidDelegation,
+			errors.New("verify trustmark: delegation jwt not issued by trust mark owner"),
+		)
 	}
-	if delegation.Issuer != tmo[0].ID {
-		return errors.New("verify trustmark: delegation jwt not issued by trust mark owner")
+	if err = delegation.VerifyExternal(tmo.JWKS); err != nil {
+		return trustMarkVerificationError(TrustMarkFailureInvalidDelegation, err)
 	}
-	return delegation.VerifyExternal(tmo[0].JWKS)
+	return checkDelegationRevocation(delegation)
 }
 
 // DelegationJWT is a type for holding information about a delegation jwt
@@ -319,6 +364,7 @@ type DelegationJWT struct {
 	IssuedAt      unixtime.Unixtime      `json:"iat"`
 	ExpiresAt     *unixtime.Unixtime     `json:"exp,omitempty"`
 	Ref           string                 `json:"ref,omitempty"`
+	JTI           string                 `json:"jti,omitempty"`
 	Extra         map[string]interface{} `json:"-"`
 	jwtMsg        *jwx.ParsedJWT
 }
@@ -374,7 +420,13 @@ func (djwt DelegationJWT) VerifyExternal(jwks jwks.JWKS) error {
 type TrustMarkIssuer struct {
 	EntityID string
 	*TrustMarkSigner
-	trustMarks map[string]TrustMarkSpec
+	// IssuedTrustMarks optionally records the issued trust marks; it is
+	// needed to serve the trust mark list and status endpoints, to revoke
+	// trust marks, and to hand out still valid trust marks again. If nil,
+	// issued trust marks are not recorded.
+	IssuedTrustMarks IssuedTrustMarkStore
+	trustMarks       map[string]TrustMarkSpec
+	delegations      *trustMarkDelegations
 }
 
 // TrustMarkSpec describes a TrustMark for a TrustMarkIssuer
@@ -386,6 +438,20 @@ type TrustMarkSpec struct {
 	Extra                    map[string]any             `json:"-" yaml:"-"`
 	IncludeExtraClaimsInInfo bool                       `json:"include_extra_claims_in_info" yaml:"include_extra_claims_in_info"`
 	DelegationJWT            string                     `json:"delegation_jwt" yaml:"delegation_jwt"`
+	// DelegationEndpoint is the trust mark owner's endpoint where a fresh
+	// DelegationJWT is obtained before the current one expires; it requires
+	// the TrustMarkOwner to be set
+	DelegationEndpoint string `json:"delegation_endpoint,omitempty" yaml:"delegation_endpoint,omitempty"`
+	// TrustMarkOwner is the owner of the trust mark; if set, delegation jwts
+	// obtained from the DelegationEndpoint or passed to SetDelegationJWT
+	// must be issued by it and are verified with its keys
+	TrustMarkOwner *TrustMarkOwnerSpec `json:"trust_mark_owner,omitempty" yaml:"trust_mark_owner,omitempty"`
+	// EligibilityChecker optionally checks if a subject is eligible for
+	// the trust mark before it is issued
+	EligibilityChecker EligibilityChecker `json:"-" yaml:"-"`
+	// ClaimsProvider optionally provides additional subject-specific claims;
+	// they take precedence over the Extra claims
+	ClaimsProvider TrustMarkClaimsProvider `json:"-" yaml:"-"`
 }
 
 // MarshalJSON implements the json.Marshaler interface
@@ -448,6 +514,7 @@ func NewTrustMarkIssuer(
 		EntityID:        entityID,
 		TrustMarkSigner: signer,
 		trustMarks:      trustMarks,
+		delegations:     newTrustMarkDelegations(),
 	}
 }
 
@@ -466,24 +533,38 @@ func (tmi *TrustMarkIssuer) TrustMarkTypes() []string {
 }
 
 // IssueTrustMark issues a TrustMarkInfo for the passed trust mark id and subject; optionally  a custom lifetime can
-// be passed
+// be passed. If the TrustMarkSpec has an EligibilityChecker, the subject must be eligible.
 func (tmi TrustMarkIssuer) IssueTrustMark(trustMarkType, sub string, lifetime ...time.Duration) (
 	*TrustMarkInfo, error,
 ) {
-	spec, ok := tmi.trustMarks[trustMarkType]
-	if !ok {
-		return nil, errors.Errorf("unknown trustmark '%s'", trustMarkType)
+	return tmi.IssueTrustMarkWithClaims(trustMarkType, sub, nil, lifetime...)
+}
+
+func (tmi TrustMarkIssuer) issueTrustMark(
+	spec TrustMarkSpec, sub string, claims map[string]any, lifetime ...time.Duration,
+) (*TrustMarkInfo, error) {
+	extra, err := spec.trustMarkClaims(sub, claims)
+	if err != nil {
+		return nil, err
+	}
+	delegation, err := tmi.delegationJWT(spec)
+	if err != nil {
+		return nil, err
+	}
+	jti, err := uuid.NewRandom()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create jti")
 	}
 	now := time.Now()
 	tm := &TrustMark{
+		JTI:           jti.String(),
 		Issuer:        tmi.EntityID,
 		Subject:       sub,
 		TrustMarkType: spec.TrustMarkType,
 		IssuedAt:      unixtime.Unixtime{Time: now},
 		LogoURI:       spec.LogoURI,
 		Ref:           spec.Ref,
-		DelegationJWT: spec.DelegationJWT,
-		Extra:         spec.Extra,
+		Extra:         extra,
 	}
 	lf := spec.Lifetime.Duration
 	if len(lifetime) > 0 {
@@ -492,27 +573,67 @@ func (tmi TrustMarkIssuer) IssueTrustMark(trustMarkType, sub string, lifetime ..
 	if lf != 0 {
 		tm.ExpiresAt = &unixtime.Unixtime{Time: now.Add(lf)}
 	}
+	if delegation != nil {
+		tm.DelegationJWT = string(delegation.jwtMsg.RawJWT)
+		tm.delegation = delegation
+		// the trust mark must not outlive its delegation
+		if exp := delegation.ExpiresAt; exp != nil && !exp.IsZero() &&
+			(tm.ExpiresAt == nil || exp.Before(tm.ExpiresAt.Time)) {
+			tm.ExpiresAt = &unixtime.Unixtime{Time: exp.Time}
+		}
+	}
 	jwt, err := tmi.TrustMarkSigner.JWT(tm)
 	if err != nil {
 		return nil, err
 	}
-	var extra map[string]any
+	if tmi.IssuedTrustMarks != nil {
+		if err = tmi.IssuedTrustMarks.StoreIssuedTrustMark(
+			IssuedTrustMark{
+				JTI:           tm.JTI,
+				TrustMarkType: tm.TrustMarkType,
+				Subject:       tm.Subject,
+				IssuedAt:      tm.IssuedAt,
+				ExpiresAt:     tm.ExpiresAt,
+				TrustMarkJWT:  string(jwt),
+			},
+		); err != nil {
+			return nil, err
+		}
+	}
+	var infoExtra map[string]any
 	if spec.IncludeExtraClaimsInInfo {
-		extra = spec.Extra
+		infoExtra = extra
 	}
 	return &TrustMarkInfo{
 		TrustMarkType: spec.TrustMarkType,
 		TrustMarkJWT:  string(jwt),
-		Extra:         extra,
+		Extra:         infoExtra,
 		trustmark:     tm,
 	}, nil
 }
 
+// reusableTrustMark returns the jwt of an active trust mark of the passed
+// type that was issued to the passed subject and can be handed out again
+// instead of issuing a new one (see reusableIssuedTrustMark); if there is no
+// such trust mark, nil is returned
+func (tmi TrustMarkIssuer) reusableTrustMark(trustMarkType, sub string, notAfter *unixtime.Unixtime) ([]byte, error) {
+	if tmi.IssuedTrustMarks == nil {
+		return nil, nil
+	}
+	return reusableIssuedTrustMark(tmi.IssuedTrustMarks, trustMarkType, sub, notAfter, 0)
+}
+
 // TrustMarkOwner is a type describing the owning entity of a trust mark; it can be used to issue DelegationJWT
 type TrustMarkOwner struct {
 	EntityID string
 	*TrustMarkDelegationSigner
+	// Delegations optionally records the issued delegation jwts; it is
+	// needed to revoke delegations, to serve the delegation status endpoint,
+	// and to hand out still valid delegation jwts again. If nil, issued
+	// delegations are not recorded.
+	Delegations     DelegationStore
 	ownedTrustMarks map[string]OwnedTrustMark
+	delegates       *trustMarkDelegates
 }
 
 // OwnedTrustMark is a type describing the trust marks owned by a TrustMarkOwner
@@ -535,6 +656,7 @@ func NewTrustMarkOwner(
 		EntityID:                  entityID,
 		TrustMarkDelegationSigner: signer,
 		ownedTrustMarks:           trustMarks,
+		delegates:                 newTrustMarkDelegates(),
 	}
 }
 
@@ -550,8 +672,13 @@ func (tmo TrustMarkOwner) DelegationJWT(trustMarkType, sub string, lifetime ...t
 	if !ok {
 		return nil, errors.Errorf("unknown trustmark '%s'", trustMarkType)
 	}
+	jti, err := uuid.NewRandom()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create jti")
+	}
 	now := time.Now()
 	delegation := &DelegationJWT{
+		JTI:           jti.String(),
 		Issuer:        tmo.EntityID,
 		Subject:       sub,
 		TrustMarkType: spec.ID,
@@ -566,5 +693,23 @@ func (tmo TrustMarkOwner) DelegationJWT(trustMarkType, sub string, lifetime ...t
 	if spec.DelegationLifetime != 0 {
 		delegation.ExpiresAt = &unixtime.Unixtime{Time: now.Add(lf)}
 	}
-	return tmo.TrustMarkDelegationSigner.JWT(delegation)
+	jwt, err := tmo.TrustMarkDelegationSigner.JWT(delegation)
+	if err != nil {
+		return nil, err
+	}
+	if tmo.Delegations != nil {
+		if err = tmo.Delegations.StoreDelegation(
+			IssuedDelegation{
+				JTI:             delegation.JTI,
+				TrustMarkType:   delegation.TrustMarkType,
+				TrustMarkIssuer: delegation.Subject,
+				IssuedAt:        delegation.IssuedAt,
+				ExpiresAt:       delegation.ExpiresAt,
+				DelegationJWT:   string(jwt),
+			},
+		); err != nil {
+			return nil, err
+		}
+	}
+	return jwt, nil
 }
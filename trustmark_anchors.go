@@ -0,0 +1,100 @@
+package oidfed
+
+import (
+	"github.com/pkg/errors"
+)
+
+// TrustMarkAnchorVerification holds the outcome of the verification of a
+// trust mark within the federation of a single TrustAnchor
+type TrustMarkAnchorVerification struct {
+	TrustAnchor TrustAnchor
+	// Cause is empty if the trust anchor accepts the trust mark
+	Cause TrustMarkFailureCause
+	// Err is nil if the trust anchor accepts the trust mark
+	Err error
+}
+
+// Accepted returns true if the TrustAnchor accepts the trust mark
+func (v TrustMarkAnchorVerification) Accepted() bool {
+	return v.Err == nil
+}
+
+// TrustMarkAnchorVerifications holds a TrustMarkAnchorVerification for each
+// TrustAnchor a trust mark was verified against
+type TrustMarkAnchorVerifications []TrustMarkAnchorVerification
+
+// Accepting returns the TrustAnchors that accept the trust mark
+func (vs TrustMarkAnchorVerifications) Accepting() (anchors TrustAnchors) {
+	for _, v := range vs {
+		if v.Accepted() {
+			anchors = append(anchors, v.TrustAnchor)
+		}
+	}
+	return
+}
+
+// trustAnchorConfiguration obtains the entity configuration of the passed
+// TrustAnchor and verifies it with the TrustAnchor's jwks; if no jwks are
+// configured, the entity configuration must be validly self-signed
+func trustAnchorConfiguration(ta TrustAnchor) (*EntityStatementPayload, error) {
+	stmt, err := GetEntityConfiguration(ta.EntityID)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not obtain trust anchor entity configuration")
+	}
+	if stmt.Issuer != ta.EntityID || stmt.Subject != ta.EntityID {
+		return nil, errors.New("trust anchor entity configuration is not about the trust anchor")
+	}
+	keys := ta.JWKS
+	if keys.Set == nil {
+		keys = stmt.JWKS
+	}
+	if !stmt.Verify(keys) {
+		return nil, errors.New("could not verify trust anchor entity configuration")
+	}
+	return &stmt.EntityStatementPayload, nil
+}
+
+// VerifyTrustAnchors verifies the TrustMark within the federation of each of
+// the passed TrustAnchors, i.e. according to their trust_mark_issuers and
+// trust_mark_owners, and returns the outcome for each TrustAnchor
+func (tm *TrustMark) VerifyTrustAnchors(anchors TrustAnchors) TrustMarkAnchorVerifications {
+	return verifyTrustAnchors(anchors, tm.VerifyFederation)
+}
+
+// AcceptingTrustAnchors returns the TrustAnchors of the passed ones that
+// accept the TrustMark
+func (tm *TrustMark) AcceptingTrustAnchors(anchors TrustAnchors) TrustAnchors {
+	return tm.VerifyTrustAnchors(anchors).Accepting()
+}
+
+// VerifyTrustAnchors verifies the TrustMarkInfo within the federation of each
+// of the passed TrustAnchors and returns the outcome for each TrustAnchor
+func (tm *TrustMarkInfo) VerifyTrustAnchors(anchors TrustAnchors) TrustMarkAnchorVerifications {
+	return verifyTrustAnchors(anchors, tm.VerifyFederation)
+}
+
+// AcceptingTrustAnchors returns the TrustAnchors of the passed ones that
+// accept the TrustMarkInfo
+func (tm *TrustMarkInfo) AcceptingTrustAnchors(anchors TrustAnchors) TrustAnchors {
+	return tm.VerifyTrustAnchors(anchors).Accepting()
+}
+
+func verifyTrustAnchors(
+	anchors TrustAnchors, verify func(ta *EntityStatementPayload) error,
+) TrustMarkAnchorVerifications {
+	verifications := make(TrustMarkAnchorVerifications, len(anchors))
+	for i, anchor := range anchors {
+		ta, err := trustAnchorConfiguration(anchor)
+		if err != nil {
+			err = trustMarkVerificationError(TrustMarkFailureTrustAnchorUnavailable, err)
+		} else {
+			err = verify(ta)
+		}
+		verifications[i] = TrustMarkAnchorVerification{
+			TrustAnchor: anchor,
+			Cause:       TrustMarkFailureCauseOf(err),
+			Err:         err,
+		}
+	}
+	return verifications
+}
@@ -0,0 +1,98 @@
+package oidfed
+
+import (
+	"testing"
+)
+
+func TestTrustMark_VerifyTrustAnchors(t *testing.T) {
+	withTmo := TrustAnchor{
+		EntityID: taWithTmo.EntityID,
+		JWKS:     taWithTmo.data.JWKS,
+	}
+	explicit := TrustAnchor{EntityID: taExplicit.EntityID}
+	unknown := TrustAnchor{EntityID: "https://unknown-ta.example.org"}
+	wrongKeys := TrustAnchor{
+		EntityID: taWithTmo.EntityID,
+		JWKS:     taExplicit.data.JWKS,
+	}
+	anchors := TrustAnchors{withTmo, explicit, unknown, wrongKeys}
+
+	tests := []struct {
+		name           string
+		trustMarkType  string
+		expectedCauses []TrustMarkFailureCause
+	}{
+		{
+			name:          "accepted by one trust anchor",
+			trustMarkType: "https://trustmarks.org/tm1",
+			expectedCauses: []TrustMarkFailureCause{
+				"",
+				TrustMarkFailureIssuerUnresolvable,
+				TrustMarkFailureTrustAnchorUnavailable,
+				TrustMarkFailureTrustAnchorUnavailable,
+			},
+		},
+		{
+			name:          "delegated trust mark",
+			trustMarkType: "https://trustmarks.org/test",
+			expectedCauses: []TrustMarkFailureCause{
+				"",
+				TrustMarkFailureIssuerUnresolvable,
+				TrustMarkFailureTrustAnchorUnavailable,
+				TrustMarkFailureTrustAnchorUnavailable,
+			},
+		},
+		{
+			name:          "issuer not allowed",
+			trustMarkType: "https://trustmarks.org/tm4",
+			expectedCauses: []TrustMarkFailureCause{
+				TrustMarkFailureIssuerNotAllowed,
+				TrustMarkFailureIssuerUnresolvable,
+				TrustMarkFailureTrustAnchorUnavailable,
+				TrustMarkFailureTrustAnchorUnavailable,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				info, err := tmi1.IssueTrustMark(test.trustMarkType, "https://sub.example.org")
+				if err != nil {
+					t.Fatal(err)
+				}
+				verifications := info.VerifyTrustAnchors(anchors)
+				if len(verifications) != len(anchors) {
+					t.Fatalf("expected %d verifications, but got %d", len(anchors), len(verifications))
+				}
+				var expectedAccepting []string
+				for i, v := range verifications {
+					if v.TrustAnchor.EntityID != anchors[i].EntityID {
+						t.Errorf("unexpected trust anchor '%s'", v.TrustAnchor.EntityID)
+					}
+					if v.Cause != test.expectedCauses[i] {
+						t.Errorf(
+							"trust anchor '%s': expected cause '%s', but got '%s': %v",
+							v.TrustAnchor.EntityID, test.expectedCauses[i], v.Cause, v.Err,
+						)
+					}
+					if test.expectedCauses[i] == "" {
+						expectedAccepting = append(expectedAccepting, anchors[i].EntityID)
+					}
+				}
+				tm, err := info.TrustMark()
+				if err != nil {
+					t.Fatal(err)
+				}
+				accepting := tm.AcceptingTrustAnchors(anchors).EntityIDs()
+				if len(accepting) != len(expectedAccepting) {
+					t.Fatalf("expected accepting trust anchors %v, but got %v", expectedAccepting, accepting)
+				}
+				for i := range accepting {
+					if accepting[i] != expectedAccepting[i] {
+						t.Errorf("expected accepting trust anchors %v, but got %v", expectedAccepting, accepting)
+					}
+				}
+			},
+		)
+	}
+}
@@ -0,0 +1,165 @@
+package oidfed
+
+import (
+	"encoding/json"
+	"maps"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// protectedTrustMarkClaims are the trust mark claims that cannot be set
+// through additional claims, since they are set by the TrustMarkIssuer
+var protectedTrustMarkClaims = []string{
+	"iss",
+	"sub",
+	"trust_mark_type",
+	"iat",
+	"exp",
+	"jti",
+	"logo_uri",
+	"ref",
+	"delegation",
+}
+
+// TrustMarkClaimsProvider provides additional subject-specific claims for a
+// trust mark
+type TrustMarkClaimsProvider interface {
+	// TrustMarkClaims returns the additional claims that should be included
+	// in the trust mark of the passed type for the passed subject
+	TrustMarkClaims(trustMarkType, sub string) (map[string]any, error)
+}
+
+// TrustMarkClaimsProviderFunc is a function that implements the
+// TrustMarkClaimsProvider interface
+type TrustMarkClaimsProviderFunc func(trustMarkType, sub string) (map[string]any, error)
+
+// TrustMarkClaims implements the TrustMarkClaimsProvider interface
+func (f TrustMarkClaimsProviderFunc) TrustMarkClaims(trustMarkType, sub string) (map[string]any, error) {
+	return f(trustMarkType, sub)
+}
+
+// TrustMarkClaimsProviders is a TrustMarkClaimsProvider that merges the
+// claims of multiple TrustMarkClaimsProviders; if multiple providers set the
+// same claim, later providers take precedence
+type TrustMarkClaimsProviders []TrustMarkClaimsProvider
+
+// TrustMarkClaims implements the TrustMarkClaimsProvider interface
+func (p TrustMarkClaimsProviders) TrustMarkClaims(trustMarkType, sub string) (map[string]any, error) {
+	claims := make(map[string]any)
+	for _, provider := range p {
+		c, err := provider.TrustMarkClaims(trustMarkType, sub)
+		if err != nil {
+			return nil, err
+		}
+		maps.Copy(claims, c)
+	}
+	return claims, nil
+}
+
+// SubjectTrustMarkClaims is a TrustMarkClaimsProvider that holds static
+// claims per subject
+type SubjectTrustMarkClaims map[string]map[string]any
+
+// TrustMarkClaims implements the TrustMarkClaimsProvider interface
+func (c SubjectTrustMarkClaims) TrustMarkClaims(_, sub string) (map[string]any, error) {
+	return c[sub], nil
+}
+
+// MetadataTrustMarkClaims is a TrustMarkClaimsProvider that copies claims
+// from the subject's Metadata as resolved through a trust chain to one of the
+// TrustAnchors
+type MetadataTrustMarkClaims struct {
+	TrustAnchors TrustAnchors
+	// EntityTypes are the entity types for which the subject's metadata
+	// is resolved
+	EntityTypes []string
+	// Claims maps the name of the trust mark claim to the metadata claim
+	// that is copied; metadata claims are given as
+	// '<entity_type>.<claim>', e.g. 'federation_entity.organization_name'.
+	// Metadata claims that are not present are omitted.
+	Claims map[string]string
+}
+
+// TrustMarkClaims implements the TrustMarkClaimsProvider interface
+func (c MetadataTrustMarkClaims) TrustMarkClaims(_, sub string) (map[string]any, error) {
+	chains := resolveSubjectChains(sub, c.TrustAnchors, c.EntityTypes)
+	if len(chains) == 0 {
+		return nil, errors.Errorf("no valid trust chain for subject '%s' found", sub)
+	}
+	metadata, err := chains.SortAsc(TrustChainScoringPathLen)[0].Metadata()
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var metadataClaims map[string]map[string]any
+	if err = json.Unmarshal(data, &metadataClaims); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	claims := make(map[string]any, len(c.Claims))
+	for claim, metadataClaim := range c.Claims {
+		entityType, name, found := strings.Cut(metadataClaim, ".")
+		if !found {
+			return nil, errors.Errorf("invalid metadata claim '%s'", metadataClaim)
+		}
+		if v, ok := metadataClaims[entityType][name]; ok {
+			claims[claim] = v
+		}
+	}
+	return claims, nil
+}
+
+// IssueTrustMarkWithClaims issues a TrustMarkInfo for the passed trust mark
+// id and subject like IssueTrustMark, but additionally includes the passed
+// claims in the trust mark. The passed claims take precedence over the claims
+// of the TrustMarkSpec's ClaimsProvider, which take precedence over the
+// TrustMarkSpec's Extra claims.
+func (tmi TrustMarkIssuer) IssueTrustMarkWithClaims(
+	trustMarkType, sub string, claims map[string]any, lifetime ...time.Duration,
+) (*TrustMarkInfo, error) {
+	eligible, reason, err := tmi.CheckEligibility(trustMarkType, sub)
+	if err != nil {
+		return nil, err
+	}
+	if !eligible {
+		return nil, errors.Errorf("subject '%s' is not eligible for trustmark '%s': %s", sub, trustMarkType, reason)
+	}
+	return tmi.issueTrustMark(tmi.trustMarks[trustMarkType], sub, claims, lifetime...)
+}
+
+// trustMarkClaims returns the additional claims of a trust mark for the
+// passed subject
+func (spec TrustMarkSpec) trustMarkClaims(sub string, claims map[string]any) (map[string]any, error) {
+	if spec.ClaimsProvider == nil && len(claims) == 0 {
+		return spec.Extra, checkProtectedTrustMarkClaims(spec.Extra)
+	}
+	extra := maps.Clone(spec.Extra)
+	if extra == nil {
+		extra = make(map[string]any)
+	}
+	if spec.ClaimsProvider != nil {
+		provided, err := spec.ClaimsProvider.TrustMarkClaims(spec.TrustMarkType, sub)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not obtain trust mark claims")
+		}
+		maps.Copy(extra, provided)
+	}
+	maps.Copy(extra, claims)
+	if err := checkProtectedTrustMarkClaims(extra); err != nil {
+		return nil, err
+	}
+	return extra, nil
+}
+
+func checkProtectedTrustMarkClaims(extra map[string]any) error {
+	for _, claim := range protectedTrustMarkClaims {
+		if _, set := extra[claim]; set {
+			return errors.Errorf("claim '%s' cannot be set as additional trust mark claim", claim)
+		}
+	}
+	return nil
+}
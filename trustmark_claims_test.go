@@ -0,0 +1,154 @@
+package oidfed
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/go-oidfed/lib/unixtime"
+)
+
+func TestTrustMarkIssuer_IssueTrustMarkWithClaims(t *testing.T) {
+	const tmType = "https://trustmarks.org/claims"
+	var failingProviderCalled bool
+	tmi := newMockTrustMarkIssuer(
+		"https://tmi-claims.example.org", []TrustMarkSpec{
+			{
+				TrustMarkType: tmType,
+				Lifetime:      unixtime.DurationInSeconds{Duration: time.Hour},
+				Extra: map[string]any{
+					"static": "value",
+					"level":  "basic",
+				},
+				ClaimsProvider: TrustMarkClaimsProviders{
+					SubjectTrustMarkClaims{
+						rpExplicit.EntityID: {"level": "high"},
+					},
+					MetadataTrustMarkClaims{
+						TrustAnchors: TrustAnchors{{EntityID: taExplicit.EntityID, JWKS: taExplicit.data.JWKS}},
+						Claims: map[string]string{
+							"contacts": "openid_relying_party.contacts",
+							"missing":  "openid_relying_party.client_name",
+						},
+					},
+				},
+			},
+			{
+				TrustMarkType: "https://trustmarks.org/jti-claims",
+				ClaimsProvider: SubjectTrustMarkClaims{
+					rpExplicit.EntityID: {"jti": "fixed"},
+				},
+			},
+			{
+				TrustMarkType: "https://trustmarks.org/failing-claims",
+				ClaimsProvider: TrustMarkClaimsProviderFunc(
+					func(_, _ string) (map[string]any, error) {
+						failingProviderCalled = true
+						return nil, errors.New("provider failed")
+					},
+				),
+			},
+		},
+	)
+
+	tests := []struct {
+		name           string
+		trustMarkType  string
+		sub            string
+		claims         map[string]any
+		expectedClaims map[string]any
+		expectErr      bool
+	}{
+		{
+			name:          "provider claims",
+			trustMarkType: tmType,
+			sub:           rpExplicit.EntityID,
+			expectedClaims: map[string]any{
+				"static":   "value",
+				"level":    "high",
+				"contacts": []any{"rp@explicit.example.com", "ta@explicit.example.com"},
+			},
+		},
+		{
+			name:          "overlay takes precedence",
+			trustMarkType: tmType,
+			sub:           rpExplicit.EntityID,
+			claims: map[string]any{
+				"level":    "highest",
+				"assessed": "2026-01-01",
+			},
+			expectedClaims: map[string]any{
+				"static":   "value",
+				"level":    "highest",
+				"assessed": "2026-01-01",
+				"contacts": []any{"rp@explicit.example.com", "ta@explicit.example.com"},
+			},
+		},
+		{
+			name:          "subject not resolvable for metadata",
+			trustMarkType: tmType,
+			sub:           "https://unknown.example.org",
+			expectErr:     true,
+		},
+		{
+			name:          "protected claim",
+			trustMarkType: tmType,
+			sub:           rpExplicit.EntityID,
+			claims:        map[string]any{"sub": "https://other.example.org"},
+			expectErr:     true,
+		},
+		{
+			name:          "protected logo_uri",
+			trustMarkType: tmType,
+			sub:           rpExplicit.EntityID,
+			claims:        map[string]any{"logo_uri": "https://other.example.org/logo.png"},
+			expectErr:     true,
+		},
+		{
+			name:          "provider cannot override jti",
+			trustMarkType: "https://trustmarks.org/jti-claims",
+			sub:           rpExplicit.EntityID,
+			expectErr:     true,
+		},
+		{
+			name:          "provider error",
+			trustMarkType: "https://trustmarks.org/failing-claims",
+			sub:           rpExplicit.EntityID,
+			expectErr:     true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				info, err := tmi.IssueTrustMarkWithClaims(test.trustMarkType, test.sub, test.claims)
+				if err != nil {
+					if !test.expectErr {
+						t.Fatal(err)
+					}
+					return
+				}
+				if test.expectErr {
+					t.Fatal("expected error, but trust mark was issued")
+				}
+				tm, err := ParseTrustMark([]byte(info.TrustMarkJWT))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tm.Subject != test.sub {
+					t.Errorf("unexpected subject '%s'", tm.Subject)
+				}
+				if !reflect.DeepEqual(tm.Extra, test.expectedClaims) {
+					t.Errorf("expected claims %v, but got %v", test.expectedClaims, tm.Extra)
+				}
+			},
+		)
+	}
+	if !failingProviderCalled {
+		t.Error("claims provider was not called")
+	}
+	if _, ok := tmi.trustMarks[tmType].Extra["contacts"]; ok {
+		t.Error("spec extra claims were modified")
+	}
+}
@@ -0,0 +1,170 @@
+package oidfed
+
+import (
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/go-oidfed/lib/internal"
+	"github.com/go-oidfed/lib/internal/http"
+	"github.com/go-oidfed/lib/unixtime"
+)
+
+// DelegationRenewalPeriod is the remaining lifetime below which a
+// TrustMarkIssuer renews a delegation jwt at the trust mark owner's
+// delegation endpoint
+var DelegationRenewalPeriod = time.Hour
+
+// trustMarkDelegations holds the delegation jwts a TrustMarkIssuer obtained
+// after its creation; they take precedence over the TrustMarkSpec's
+// DelegationJWT
+type trustMarkDelegations struct {
+	mutex sync.RWMutex
+	jwts  map[string]*DelegationJWT
+}
+
+func newTrustMarkDelegations() *trustMarkDelegations {
+	return &trustMarkDelegations{jwts: make(map[string]*DelegationJWT)}
+}
+
+func (d *trustMarkDelegations) get(trustMarkType string) *DelegationJWT {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.jwts[trustMarkType]
+}
+
+func (d *trustMarkDelegations) set(delegation *DelegationJWT) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.jwts[delegation.TrustMarkType] = delegation
+}
+
+func delegationExpired(delegation *DelegationJWT) bool {
+	return delegation.ExpiresAt != nil && !delegation.ExpiresAt.IsZero() && delegation.ExpiresAt.Before(time.Now())
+}
+
+func delegationNeedsRenewal(delegation *DelegationJWT) bool {
+	return delegation == nil || delegation.ExpiresAt != nil && !delegation.ExpiresAt.IsZero() &&
+		unixtime.Until(*delegation.ExpiresAt) < DelegationRenewalPeriod
+}
+
+// checkDelegationJWT parses the delegation jwt and checks that it delegates
+// the trust mark type of the passed TrustMarkSpec to the TrustMarkIssuer and
+// is not expired; if the TrustMarkSpec has a TrustMarkOwner, the delegation
+// jwt must be issued and signed by it
+func (tmi TrustMarkIssuer) checkDelegationJWT(spec TrustMarkSpec, delegationJWT []byte) (*DelegationJWT, error) {
+	delegation, err := parseDelegationJWT(delegationJWT)
+	if err != nil {
+		return nil, err
+	}
+	if delegation.TrustMarkType != spec.TrustMarkType {
+		return nil, errors.New("delegation jwt is not for this trust mark")
+	}
+	if delegation.Subject != tmi.EntityID {
+		return nil, errors.New("delegation jwt is not for this trust mark issuer")
+	}
+	if delegationExpired(delegation) {
+		return nil, errors.New("delegation jwt is expired")
+	}
+	if owner := spec.TrustMarkOwner; owner != nil {
+		if delegation.Issuer != owner.ID {
+			return nil, errors.Errorf("delegation jwt was not issued by trust mark owner '%s'", owner.ID)
+		}
+		if err = delegation.VerifyExternal(owner.JWKS); err != nil {
+			return nil, err
+		}
+	}
+	return delegation, nil
+}
+
+// SetDelegationJWT sets a fresh delegation jwt for the passed trust mark
+// type; it is embedded in subsequently issued trust marks instead of the
+// TrustMarkSpec's DelegationJWT
+func (tmi TrustMarkIssuer) SetDelegationJWT(trustMarkType string, delegationJWT []byte) error {
+	spec, ok := tmi.trustMarks[trustMarkType]
+	if !ok {
+		return errors.Errorf("unknown trustmark '%s'", trustMarkType)
+	}
+	if tmi.delegations == nil {
+		return errors.New("trust mark issuer cannot store delegation jwts")
+	}
+	delegation, err := tmi.checkDelegationJWT(spec, delegationJWT)
+	if err != nil {
+		return err
+	}
+	tmi.delegations.set(delegation)
+	return nil
+}
+
+// RenewDelegationJWT obtains a fresh delegation jwt for the passed trust mark
+// type from the TrustMarkSpec's DelegationEndpoint; it is verified with the
+// keys of the TrustMarkSpec's TrustMarkOwner
+func (tmi TrustMarkIssuer) RenewDelegationJWT(trustMarkType string) error {
+	spec, ok := tmi.trustMarks[trustMarkType]
+	if !ok {
+		return errors.Errorf("unknown trustmark '%s'", trustMarkType)
+	}
+	if spec.DelegationEndpoint == "" {
+		return errors.Errorf("no delegation endpoint for trustmark '%s'", trustMarkType)
+	}
+	if spec.TrustMarkOwner == nil {
+		return errors.Errorf("no trust mark owner to verify delegation jwts for trustmark '%s'", trustMarkType)
+	}
+	delegationJWT, err := fetchDelegationJWT(spec.DelegationEndpoint, trustMarkType, tmi.EntityID)
+	if err != nil {
+		return err
+	}
+	return tmi.SetDelegationJWT(trustMarkType, delegationJWT)
+}
+
+func fetchDelegationJWT(endpoint, trustMarkType, sub string) ([]byte, error) {
+	params := url.Values{}
+	params.Set("trust_mark_type", trustMarkType)
+	params.Set("sub", sub)
+	res, errRes, err := http.Get(endpoint, params, nil)
+	if err != nil {
+		return nil, err
+	}
+	if errRes != nil {
+		return nil, errRes.Err()
+	}
+	if res.IsError() {
+		return nil, errors.Errorf("delegation endpoint returned status %d", res.StatusCode())
+	}
+	return res.Body(), nil
+}
+
+// delegationJWT returns the delegation jwt that should be embedded in a trust
+// mark for the passed TrustMarkSpec; if the delegation expires soon and the
+// TrustMarkSpec has a DelegationEndpoint, it is renewed first. An error is
+// returned if the delegation jwt is expired or if no delegation jwt could be
+// obtained from the DelegationEndpoint.
+func (tmi TrustMarkIssuer) delegationJWT(spec TrustMarkSpec) (*DelegationJWT, error) {
+	var delegation *DelegationJWT
+	if tmi.delegations != nil {
+		delegation = tmi.delegations.get(spec.TrustMarkType)
+	}
+	if delegation == nil && spec.DelegationJWT != "" {
+		var err error
+		delegation, err = parseDelegationJWT([]byte(spec.DelegationJWT))
+		if err != nil {
+			return nil, errors.Wrap(err, "could not parse delegation jwt")
+		}
+	}
+	if spec.DelegationEndpoint != "" && delegationNeedsRenewal(delegation) {
+		if err := tmi.RenewDelegationJWT(spec.TrustMarkType); err != nil {
+			internal.Logf("could not renew delegation jwt for '%s': %s", spec.TrustMarkType, err.Error())
+		} else {
+			delegation = tmi.delegations.get(spec.TrustMarkType)
+		}
+	}
+	if delegation == nil && spec.DelegationEndpoint != "" {
+		return nil, errors.Errorf("no delegation jwt for trustmark '%s'", spec.TrustMarkType)
+	}
+	if delegation != nil && delegationExpired(delegation) {
+		return nil, errors.Errorf("delegation jwt for trustmark '%s' is expired", spec.TrustMarkType)
+	}
+	return delegation, nil
+}
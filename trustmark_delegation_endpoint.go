@@ -0,0 +1,140 @@
+package oidfed
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-oidfed/lib/internal"
+	"github.com/go-oidfed/lib/oidfedconst"
+)
+
+// TrustMarkDelegationHandler is a http.Handler for a TrustMarkOwner's
+// delegation endpoint.
+// It issues delegation jwts of the requested trust_mark_type to the trust
+// mark issuer given as sub, if the TrustMarkOwner delegated this trust mark
+// type to the issuer.
+type TrustMarkDelegationHandler struct {
+	Owner *TrustMarkOwner
+}
+
+// NewTrustMarkDelegationHandler creates a new TrustMarkDelegationHandler for
+// the passed TrustMarkOwner; the passed issuers map trust mark types to the
+// entity ids of trust mark issuers and are delegated the trust mark type
+// (see TrustMarkOwner.Delegate)
+func NewTrustMarkDelegationHandler(
+	owner *TrustMarkOwner, issuers map[string][]string,
+) *TrustMarkDelegationHandler {
+	for trustMarkType, tmis := range issuers {
+		for _, tmi := range tmis {
+			if err := owner.Delegate(trustMarkType, tmi); err != nil {
+				internal.Log(err.Error())
+			}
+		}
+	}
+	return &TrustMarkDelegationHandler{Owner: owner}
+}
+
+// ServeHTTP implements the http.Handler interface
+func (h TrustMarkDelegationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeErrorResponse(w, http.StatusMethodNotAllowed, ErrorInvalidRequest("only GET is supported"))
+		return
+	}
+	query := r.URL.Query()
+	jwt, errRes := h.Delegation(query.Get("trust_mark_type"), query.Get("sub"))
+	if errRes != nil {
+		status := http.StatusBadRequest
+		switch errRes.Error {
+		case NotFound:
+			status = http.StatusNotFound
+		case ServerError:
+			status = http.StatusInternalServerError
+		}
+		writeErrorResponse(w, status, *errRes)
+		return
+	}
+	w.Header().Set("Content-Type", oidfedconst.ContentTypeTrustMarkDelegation)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(jwt)
+}
+
+// Delegation issues a delegation jwt of the passed trust mark type to the
+// passed trust mark issuer and returns it or an Error, if the trust mark type
+// is unknown or the issuer is not allowed to issue it; if the issuer still
+// holds a delegation jwt of this type that is valid for at least half of its
+// lifetime and does not need to be renewed (see DelegationRenewalPeriod), it
+// is returned instead of issuing a new one
+func (h TrustMarkDelegationHandler) Delegation(trustMarkType, sub string) ([]byte, *Error) {
+	if trustMarkType == "" {
+		errRes := ErrorInvalidRequest("trust_mark_type parameter is required")
+		return nil, &errRes
+	}
+	if sub == "" {
+		errRes := ErrorInvalidRequest("sub parameter is required")
+		return nil, &errRes
+	}
+	if _, ok := h.Owner.ownedTrustMarks[trustMarkType]; !ok {
+		errRes := ErrorNotFound("unknown trust_mark_type")
+		return nil, &errRes
+	}
+	if !h.Owner.IsDelegated(trustMarkType, sub) {
+		errRes := ErrorNotFound("subject is not a trust mark issuer for this trust mark")
+		return nil, &errRes
+	}
+	if h.Owner.Delegations != nil {
+		reusable, err := reusableDelegation(h.Owner.Delegations, trustMarkType, sub, DelegationRenewalPeriod)
+		if err != nil {
+			internal.Log(err.Error())
+			errRes := ErrorServerError("could not issue delegation jwt")
+			return nil, &errRes
+		}
+		if reusable != nil {
+			return reusable, nil
+		}
+	}
+	jwt, err := h.Owner.DelegationJWT(trustMarkType, sub)
+	if err != nil {
+		internal.Log(err.Error())
+		errRes := ErrorServerError("could not issue delegation jwt")
+		return nil, &errRes
+	}
+	return jwt, nil
+}
+
+// TrustMarkDelegationStatusHandler is a http.Handler for a TrustMarkOwner's
+// delegation status endpoint.
+// It returns the status of the delegation jwt passed in the delegation form
+// parameter as TrustMarkDelegationStatus.
+type TrustMarkDelegationStatusHandler struct {
+	Owner *TrustMarkOwner
+}
+
+// NewTrustMarkDelegationStatusHandler creates a new
+// TrustMarkDelegationStatusHandler for the passed TrustMarkOwner
+func NewTrustMarkDelegationStatusHandler(owner *TrustMarkOwner) *TrustMarkDelegationStatusHandler {
+	return &TrustMarkDelegationStatusHandler{Owner: owner}
+}
+
+// ServeHTTP implements the http.Handler interface
+func (h TrustMarkDelegationStatusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeErrorResponse(w, http.StatusMethodNotAllowed, ErrorInvalidRequest("only POST is supported"))
+		return
+	}
+	delegation := r.PostFormValue("delegation")
+	if delegation == "" {
+		writeErrorResponse(w, http.StatusBadRequest, ErrorInvalidRequest("delegation parameter is required"))
+		return
+	}
+	status, err := h.Owner.DelegationStatus([]byte(delegation))
+	if err != nil {
+		internal.Log(err.Error())
+		writeErrorResponse(w, http.StatusInternalServerError, ErrorServerError("could not determine delegation status"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(TrustMarkDelegationStatus{Status: status})
+}
@@ -0,0 +1,433 @@
+package oidfed
+
+import (
+	"encoding/json"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/go-oidfed/lib/cache"
+	"github.com/go-oidfed/lib/internal/http"
+	"github.com/go-oidfed/lib/unixtime"
+)
+
+// IssuedDelegation is a record of a delegation jwt that was issued by a
+// TrustMarkOwner
+type IssuedDelegation struct {
+	JTI           string `json:"jti"`
+	TrustMarkType string `json:"trust_mark_type"`
+	// TrustMarkIssuer is the trust mark issuer the delegation jwt was issued
+	// to, i.e. its subject
+	TrustMarkIssuer  string             `json:"trust_mark_issuer"`
+	IssuedAt         unixtime.Unixtime  `json:"iat"`
+	ExpiresAt        *unixtime.Unixtime `json:"exp,omitempty"`
+	Revoked          bool               `json:"revoked,omitempty"`
+	RevokedAt        *unixtime.Unixtime `json:"revoked_at,omitempty"`
+	RevocationReason string             `json:"revocation_reason,omitempty"`
+	// DelegationJWT is the issued delegation jwt; it is used to hand out the
+	// same delegation jwt again instead of issuing a new one
+	DelegationJWT string `json:"delegation,omitempty"`
+}
+
+// DelegationAuditEvent is an entry in the audit log of a DelegationStore;
+// the events are the same as for trust marks, e.g. TrustMarkEventIssued
+type DelegationAuditEvent struct {
+	Event           string             `json:"event"`
+	Time            unixtime.Unixtime  `json:"time"`
+	JTI             string             `json:"jti"`
+	TrustMarkType   string             `json:"trust_mark_type"`
+	TrustMarkIssuer string             `json:"trust_mark_issuer"`
+	IssuedAt        *unixtime.Unixtime `json:"iat,omitempty"`
+	ExpiresAt       *unixtime.Unixtime `json:"exp,omitempty"`
+	Reason          string             `json:"reason,omitempty"`
+	DelegationJWT   string             `json:"delegation,omitempty"`
+}
+
+// DelegationStore is a registry of the delegation jwts issued by a
+// TrustMarkOwner; it keeps an append-only audit log of issuance, refresh,
+// and revocation events
+type DelegationStore interface {
+	// StoreDelegation records an issued delegation jwt
+	StoreDelegation(d IssuedDelegation) error
+	// Delegations returns the active IssuedDelegations of the passed trust
+	// mark type; if trustMarkIssuer is not empty, only the delegations of
+	// this trust mark issuer are returned
+	Delegations(trustMarkType, trustMarkIssuer string) ([]IssuedDelegation, error)
+	// Delegation returns the IssuedDelegation with the passed jti
+	// regardless of its state; if there is no such delegation, nil is
+	// returned; expired delegations might have been pruned from the store
+	Delegation(jti string) (*IssuedDelegation, error)
+	// RevokeDelegations revokes all active delegations of the passed trust
+	// mark type to the passed trust mark issuer and returns them
+	RevokeDelegations(trustMarkType, trustMarkIssuer, reason string) ([]IssuedDelegation, error)
+	// AuditLog returns the recorded events in chronological order; if
+	// trustMarkType or trustMarkIssuer are not empty, the events are
+	// filtered accordingly
+	AuditLog(trustMarkType, trustMarkIssuer string) ([]DelegationAuditEvent, error)
+}
+
+// NewDelegationStore creates a DelegationStore that records the delegations
+// in the passed IssuedTrustMarkStore, e.g. a FileIssuedTrustMarkStore; the
+// IssuedTrustMarkStore must not be used for anything else
+func NewDelegationStore(backend IssuedTrustMarkStore) DelegationStore {
+	return issuedTrustMarkDelegationStore{backend: backend}
+}
+
+// NewInMemoryDelegationStore creates a DelegationStore that keeps the
+// delegations in an InMemoryIssuedTrustMarkStore
+func NewInMemoryDelegationStore() DelegationStore {
+	return NewDelegationStore(NewInMemoryIssuedTrustMarkStore())
+}
+
+// issuedTrustMarkDelegationStore is a DelegationStore that records
+// delegations as IssuedTrustMarks in an IssuedTrustMarkStore
+type issuedTrustMarkDelegationStore struct {
+	backend IssuedTrustMarkStore
+}
+
+func issuedDelegation(tm IssuedTrustMark) IssuedDelegation {
+	return IssuedDelegation{
+		JTI:              tm.JTI,
+		TrustMarkType:    tm.TrustMarkType,
+		TrustMarkIssuer:  tm.Subject,
+		IssuedAt:         tm.IssuedAt,
+		ExpiresAt:        tm.ExpiresAt,
+		Revoked:          tm.Revoked,
+		RevokedAt:        tm.RevokedAt,
+		RevocationReason: tm.RevocationReason,
+		DelegationJWT:    tm.TrustMarkJWT,
+	}
+}
+
+func issuedDelegations(tms []IssuedTrustMark) []IssuedDelegation {
+	if tms == nil {
+		return nil
+	}
+	delegations := make([]IssuedDelegation, len(tms))
+	for i, tm := range tms {
+		delegations[i] = issuedDelegation(tm)
+	}
+	return delegations
+}
+
+// StoreDelegation implements the DelegationStore interface
+func (s issuedTrustMarkDelegationStore) StoreDelegation(d IssuedDelegation) error {
+	return s.backend.StoreIssuedTrustMark(
+		IssuedTrustMark{
+			JTI:           d.JTI,
+			TrustMarkType: d.TrustMarkType,
+			Subject:       d.TrustMarkIssuer,
+			IssuedAt:      d.IssuedAt,
+			ExpiresAt:     d.ExpiresAt,
+			TrustMarkJWT:  d.DelegationJWT,
+		},
+	)
+}
+
+// Delegations implements the DelegationStore interface
+func (s issuedTrustMarkDelegationStore) Delegations(trustMarkType, trustMarkIssuer string) (
+	[]IssuedDelegation, error,
+) {
+	tms, err := s.backend.IssuedTrustMarks(trustMarkType, trustMarkIssuer)
+	return issuedDelegations(tms), err
+}
+
+// Delegation implements the DelegationStore interface
+func (s issuedTrustMarkDelegationStore) Delegation(jti string) (*IssuedDelegation, error) {
+	tm, err := s.backend.IssuedTrustMark(jti)
+	if err != nil || tm == nil {
+		return nil, err
+	}
+	d := issuedDelegation(*tm)
+	return &d, nil
+}
+
+// RevokeDelegations implements the DelegationStore interface
+func (s issuedTrustMarkDelegationStore) RevokeDelegations(trustMarkType, trustMarkIssuer, reason string) (
+	[]IssuedDelegation, error,
+) {
+	tms, err := s.backend.RevokeTrustMarks(trustMarkType, trustMarkIssuer, reason)
+	return issuedDelegations(tms), err
+}
+
+// AuditLog implements the DelegationStore interface
+func (s issuedTrustMarkDelegationStore) AuditLog(trustMarkType, trustMarkIssuer string) (
+	[]DelegationAuditEvent, error,
+) {
+	events, err := s.backend.AuditLog(trustMarkType, trustMarkIssuer)
+	if err != nil || events == nil {
+		return nil, err
+	}
+	delegationEvents := make([]DelegationAuditEvent, len(events))
+	for i, e := range events {
+		delegationEvents[i] = DelegationAuditEvent{
+			Event:           e.Event,
+			Time:            e.Time,
+			JTI:             e.JTI,
+			TrustMarkType:   e.TrustMarkType,
+			TrustMarkIssuer: e.Subject,
+			IssuedAt:        e.IssuedAt,
+			ExpiresAt:       e.ExpiresAt,
+			Reason:          e.Reason,
+			DelegationJWT:   e.TrustMarkJWT,
+		}
+	}
+	return delegationEvents, nil
+}
+
+// reusableDelegation returns the jwt of an active IssuedDelegation of the
+// passed type to the passed trust mark issuer from the passed store, so it
+// can be handed out again instead of issuing a new one (see reusableJWT);
+// if there is no such delegation, nil is returned
+func reusableDelegation(
+	store DelegationStore, trustMarkType, trustMarkIssuer string, minRemaining time.Duration,
+) ([]byte, error) {
+	delegations, err := store.Delegations(trustMarkType, trustMarkIssuer)
+	if err != nil {
+		return nil, err
+	}
+	jwts := make([]issuedJWT, len(delegations))
+	for i, d := range delegations {
+		jwts[i] = issuedJWT{
+			jwt:       d.DelegationJWT,
+			issuedAt:  d.IssuedAt,
+			expiresAt: d.ExpiresAt,
+		}
+	}
+	return reusableJWT(jwts, nil, minRemaining), nil
+}
+
+// trustMarkDelegates holds the trust mark issuers a TrustMarkOwner delegated
+// its trust marks to
+type trustMarkDelegates struct {
+	mutex   sync.RWMutex
+	issuers map[string][]string
+}
+
+func newTrustMarkDelegates() *trustMarkDelegates {
+	return &trustMarkDelegates{issuers: make(map[string][]string)}
+}
+
+// Delegate allows the passed trust mark issuer to obtain delegation jwts for
+// the passed trust mark type
+func (tmo TrustMarkOwner) Delegate(trustMarkType, trustMarkIssuer string) error {
+	if _, ok := tmo.ownedTrustMarks[trustMarkType]; !ok {
+		return errors.Errorf("unknown trustmark '%s'", trustMarkType)
+	}
+	if tmo.delegates == nil {
+		return errors.New("trust mark owner cannot record delegations")
+	}
+	tmo.delegates.mutex.Lock()
+	defer tmo.delegates.mutex.Unlock()
+	if !slices.Contains(tmo.delegates.issuers[trustMarkType], trustMarkIssuer) {
+		tmo.delegates.issuers[trustMarkType] = append(tmo.delegates.issuers[trustMarkType], trustMarkIssuer)
+	}
+	return nil
+}
+
+// DelegatedIssuers returns the entity ids of the trust mark issuers the
+// passed trust mark type is delegated to
+func (tmo TrustMarkOwner) DelegatedIssuers(trustMarkType string) []string {
+	if tmo.delegates == nil {
+		return nil
+	}
+	tmo.delegates.mutex.RLock()
+	defer tmo.delegates.mutex.RUnlock()
+	return slices.Clone(tmo.delegates.issuers[trustMarkType])
+}
+
+// IsDelegated checks if the passed trust mark type is delegated to the passed
+// trust mark issuer
+func (tmo TrustMarkOwner) IsDelegated(trustMarkType, trustMarkIssuer string) bool {
+	return slices.Contains(tmo.DelegatedIssuers(trustMarkType), trustMarkIssuer)
+}
+
+// RevokeDelegation revokes the delegation of the passed trust mark type to
+// the passed trust mark issuer; the issuer can no longer obtain delegation
+// jwts and all active delegation jwts issued to it are revoked
+func (tmo TrustMarkOwner) RevokeDelegation(trustMarkType, trustMarkIssuer, reason string) error {
+	if _, ok := tmo.ownedTrustMarks[trustMarkType]; !ok {
+		return errors.Errorf("unknown trustmark '%s'", trustMarkType)
+	}
+	delegated := false
+	if tmo.delegates != nil {
+		tmo.delegates.mutex.Lock()
+		issuers := tmo.delegates.issuers[trustMarkType]
+		delegated = slices.Contains(issuers, trustMarkIssuer)
+		tmo.delegates.issuers[trustMarkType] = slices.DeleteFunc(
+			issuers, func(iss string) bool {
+				return iss == trustMarkIssuer
+			},
+		)
+		tmo.delegates.mutex.Unlock()
+	}
+	var revoked []IssuedDelegation
+	if tmo.Delegations != nil {
+		var err error
+		revoked, err = tmo.Delegations.RevokeDelegations(trustMarkType, trustMarkIssuer, reason)
+		if err != nil {
+			return err
+		}
+	}
+	if !delegated && len(revoked) == 0 {
+		return errors.Errorf("trustmark '%s' is not delegated to '%s'", trustMarkType, trustMarkIssuer)
+	}
+	return nil
+}
+
+// DelegationStatus returns the status of the passed delegation jwt; it is
+// TrustMarkStatusInvalid if the delegation jwt was not issued by this
+// TrustMarkOwner
+func (tmo TrustMarkOwner) DelegationStatus(delegationJWT []byte) (string, error) {
+	delegation, err := parseDelegationJWT(delegationJWT)
+	if err != nil || delegation.Issuer != tmo.EntityID || delegation.JTI == "" {
+		return TrustMarkStatusInvalid, nil
+	}
+	if _, err = delegation.jwtMsg.VerifyWithSet(tmo.TrustMarkDelegationSigner.JWKS()); err != nil {
+		return TrustMarkStatusInvalid, nil
+	}
+	if tmo.Delegations == nil {
+		return "", errors.New("trust mark owner does not record delegations")
+	}
+	issued, err := tmo.Delegations.Delegation(delegation.JTI)
+	if err != nil {
+		return "", err
+	}
+	if issued == nil && delegationExpired(delegation) {
+		// expired delegations are pruned from the DelegationStore
+		return TrustMarkStatusExpired, nil
+	}
+	if issued == nil || issued.TrustMarkType != delegation.TrustMarkType ||
+		issued.TrustMarkIssuer != delegation.Subject {
+		return TrustMarkStatusInvalid, nil
+	}
+	if issued.Revoked {
+		return TrustMarkStatusRevoked, nil
+	}
+	if delegationExpired(delegation) {
+		return TrustMarkStatusExpired, nil
+	}
+	return TrustMarkStatusActive, nil
+}
+
+// DelegationRevoked implements the DelegationRevocationChecker interface;
+// it allows a TrustMarkOwner to be used as DefaultDelegationRevocationChecker
+// if owner and verifier are the same entity
+func (tmo TrustMarkOwner) DelegationRevoked(delegation *DelegationJWT) (bool, error) {
+	if delegation.Issuer != tmo.EntityID {
+		return false, errors.New("delegation jwt not issued by this trust mark owner")
+	}
+	status, err := tmo.DelegationStatus(delegation.jwtMsg.RawJWT)
+	if err != nil {
+		return false, err
+	}
+	return delegationStatusRevoked(status)
+}
+
+func delegationStatusRevoked(status string) (bool, error) {
+	switch status {
+	case TrustMarkStatusRevoked:
+		return true, nil
+	case TrustMarkStatusActive, TrustMarkStatusExpired:
+		return false, nil
+	default:
+		return false, errors.Errorf("delegation status is '%s'", status)
+	}
+}
+
+// DelegationRevocationChecker checks if a DelegationJWT was revoked by its
+// trust mark owner
+type DelegationRevocationChecker interface {
+	DelegationRevoked(delegation *DelegationJWT) (bool, error)
+}
+
+// DelegationRevocationCheckerFunc is a function implementing the
+// DelegationRevocationChecker interface
+type DelegationRevocationCheckerFunc func(delegation *DelegationJWT) (bool, error)
+
+// DelegationRevoked implements the DelegationRevocationChecker interface
+func (f DelegationRevocationCheckerFunc) DelegationRevoked(delegation *DelegationJWT) (bool, error) {
+	return f(delegation)
+}
+
+// DefaultDelegationRevocationChecker is used during trust mark verification
+// to check if the otherwise valid delegation of a TrustMark was revoked; if
+// nil, delegation revocation is not checked
+var DefaultDelegationRevocationChecker DelegationRevocationChecker
+
+func checkDelegationRevocation(delegation *DelegationJWT) error {
+	if DefaultDelegationRevocationChecker == nil {
+		return nil
+	}
+	revoked, err := DefaultDelegationRevocationChecker.DelegationRevoked(delegation)
+	if err != nil {
+		return trustMarkVerificationError(
+			TrustMarkFailureStatusUnknown, errors.Wrap(err, "verify trustmark: checking delegation revocation"),
+		)
+	}
+	if revoked {
+		return trustMarkVerificationError(
+			TrustMarkFailureDelegationRevoked, errors.New("verify trustmark: delegation jwt was revoked"),
+		)
+	}
+	return nil
+}
+
+// TrustMarkDelegationStatus is the response of a trust mark owner's
+// delegation status endpoint
+type TrustMarkDelegationStatus struct {
+	Status string `json:"status"`
+}
+
+// DelegationStatusCacheLifetime is the time a delegation status obtained by
+// the DelegationStatusRevocationChecker is cached
+var DelegationStatusCacheLifetime = time.Minute
+
+// DelegationStatusRevocationChecker is a DelegationRevocationChecker that
+// queries the delegation status endpoint (see
+// TrustMarkDelegationStatusHandler) of the trust mark owner; obtained
+// statuses are cached for the DelegationStatusCacheLifetime
+type DelegationStatusRevocationChecker struct {
+	// StatusEndpoints maps the entity ids of trust mark owners to their
+	// delegation status endpoint; delegations of other owners are not
+	// checked
+	StatusEndpoints map[string]string
+}
+
+// DelegationRevoked implements the DelegationRevocationChecker interface
+func (c DelegationStatusRevocationChecker) DelegationRevoked(delegation *DelegationJWT) (bool, error) {
+	endpoint, ok := c.StatusEndpoints[delegation.Issuer]
+	if !ok {
+		return false, nil
+	}
+	status, err := cachedJWTStatus(
+		cache.KeyDelegationStatus, delegation.jwtMsg.RawJWT, DelegationStatusCacheLifetime,
+		func() (string, error) {
+			return fetchDelegationStatus(endpoint, delegation)
+		},
+	)
+	if err != nil {
+		return false, err
+	}
+	return delegationStatusRevoked(status)
+}
+
+// fetchDelegationStatus queries the passed delegation status endpoint for
+// the status of the passed delegation jwt
+func fetchDelegationStatus(endpoint string, delegation *DelegationJWT) (string, error) {
+	res, err := http.Do().R().SetFormData(map[string]string{"delegation": string(delegation.jwtMsg.RawJWT)}).
+		Post(endpoint)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if res.IsError() {
+		return "", errors.Errorf("delegation status endpoint returned status %d", res.StatusCode())
+	}
+	var status TrustMarkDelegationStatus
+	if err = json.Unmarshal(res.Body(), &status); err != nil {
+		return "", errors.Wrap(err, "unexpected response type")
+	}
+	return status.Status, nil
+}
@@ -0,0 +1,607 @@
+package oidfed
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-oidfed/lib/jwks"
+	"github.com/go-oidfed/lib/oidfedconst"
+	"github.com/go-oidfed/lib/unixtime"
+)
+
+const (
+	tmTypeRenewed       = "https://trustmarks.org/renewed"
+	tmTypeNotDelegated  = "https://trustmarks.org/not-delegated"
+	tmoRenewEntityID    = "https://tmo-renew.example.org"
+	tmoRenewEndpoint    = tmoRenewEntityID + "/delegation"
+	tmoSpoofedEndpoint  = "https://tmo-spoofed.example.org/delegation"
+	tmiRenewEntityID    = "https://tmi-renew.example.org"
+	tmiNotAllowedEntity = "https://tmi-not-allowed.example.org"
+)
+
+var tmoRenew = newMockTrustMarkOwner(
+	tmoRenewEntityID, []OwnedTrustMark{
+		{
+			ID:                 tmTypeRenewed,
+			DelegationLifetime: 24 * time.Hour,
+		},
+		{
+			ID:                 tmTypeNotDelegated,
+			DelegationLifetime: 24 * time.Hour,
+		},
+	},
+)
+
+// tmoSpoofed claims to be tmoRenew, but signs with a different key
+var tmoSpoofed = newMockTrustMarkOwner(
+	tmoRenewEntityID, []OwnedTrustMark{
+		{
+			ID:                 tmTypeRenewed,
+			DelegationLifetime: 24 * time.Hour,
+		},
+	},
+)
+
+func init() {
+	mockHandlerEndpoint(
+		"GET", tmoRenewEndpoint, NewTrustMarkDelegationHandler(
+			tmoRenew, map[string][]string{
+				tmTypeRenewed: {tmiRenewEntityID},
+			},
+		),
+	)
+	mockHandlerEndpoint(
+		"GET", tmoSpoofedEndpoint, NewTrustMarkDelegationHandler(
+			tmoSpoofed, map[string][]string{
+				tmTypeRenewed: {tmiRenewEntityID},
+			},
+		),
+	)
+}
+
+func tmoRenewSpec() *TrustMarkOwnerSpec {
+	return &TrustMarkOwnerSpec{
+		ID:   tmoRenewEntityID,
+		JWKS: jwks.KeyToJWKS(tmoRenew.key.Public(), tmoRenew.alg),
+	}
+}
+
+func TestTrustMarkDelegationHandler(t *testing.T) {
+	handler := NewTrustMarkDelegationHandler(
+		tmoRenew, map[string][]string{
+			tmTypeRenewed: {tmiRenewEntityID},
+		},
+	)
+	tests := []struct {
+		name           string
+		params         url.Values
+		expectedStatus int
+		expectedError  string
+	}{
+		{
+			name: "allowed issuer",
+			params: url.Values{
+				"trust_mark_type": {tmTypeRenewed},
+				"sub":             {tmiRenewEntityID},
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "issuer not allowed",
+			params: url.Values{
+				"trust_mark_type": {tmTypeRenewed},
+				"sub":             {tmiNotAllowedEntity},
+			},
+			expectedStatus: http.StatusNotFound,
+			expectedError:  NotFound,
+		},
+		{
+			name: "no issuers for trust mark",
+			params: url.Values{
+				"trust_mark_type": {tmTypeNotDelegated},
+				"sub":             {tmiRenewEntityID},
+			},
+			expectedStatus: http.StatusNotFound,
+			expectedError:  NotFound,
+		},
+		{
+			name: "unknown trust mark",
+			params: url.Values{
+				"trust_mark_type": {"https://trustmarks.org/unknown"},
+				"sub":             {tmiRenewEntityID},
+			},
+			expectedStatus: http.StatusNotFound,
+			expectedError:  NotFound,
+		},
+		{
+			name:           "missing sub",
+			params:         url.Values{"trust_mark_type": {tmTypeRenewed}},
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  InvalidRequest,
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				req := httptest.NewRequest(http.MethodGet, "/delegation?"+test.params.Encode(), nil)
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+				if rec.Code != test.expectedStatus {
+					t.Fatalf("expected status %d, but got %d", test.expectedStatus, rec.Code)
+				}
+				if test.expectedError != "" {
+					var errRes Error
+					if err := json.Unmarshal(rec.Body.Bytes(), &errRes); err != nil {
+						t.Fatal(err)
+					}
+					if errRes.Error != test.expectedError {
+						t.Errorf("expected error '%s', but got '%s'", test.expectedError, errRes.Error)
+					}
+					return
+				}
+				if ct := rec.Header().Get("Content-Type"); ct != oidfedconst.ContentTypeTrustMarkDelegation {
+					t.Errorf("unexpected content type '%s'", ct)
+				}
+				delegation, err := parseDelegationJWT(rec.Body.Bytes())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if delegation.Subject != tmiRenewEntityID || delegation.Issuer != tmoRenewEntityID {
+					t.Errorf("unexpected delegation: %+v", delegation)
+				}
+			},
+		)
+	}
+}
+
+func TestTrustMarkDelegationHandler_RepeatedRequests(t *testing.T) {
+	tmo := newMockTrustMarkOwner(
+		"https://tmo-repeated.example.org", []OwnedTrustMark{
+			{
+				ID:                 tmTypeRenewed,
+				DelegationLifetime: 24 * time.Hour,
+			},
+		},
+	)
+	handler := NewTrustMarkDelegationHandler(
+		tmo, map[string][]string{
+			tmTypeRenewed: {tmiRenewEntityID, tmiNotAllowedEntity},
+		},
+	)
+
+	first, errRes := handler.Delegation(tmTypeRenewed, tmiRenewEntityID)
+	if errRes != nil {
+		t.Fatal(errRes.ErrorDescription)
+	}
+	for range 3 {
+		jwt, errRes := handler.Delegation(tmTypeRenewed, tmiRenewEntityID)
+		if errRes != nil {
+			t.Fatal(errRes.ErrorDescription)
+		}
+		if string(jwt) != string(first) {
+			t.Error("expected the active delegation jwt to be returned again")
+		}
+	}
+	issued, err := tmo.Delegations.Delegations(tmTypeRenewed, tmiRenewEntityID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issued) != 1 {
+		t.Errorf("expected 1 issued delegation jwt, but got %d", len(issued))
+	}
+
+	// a delegation jwt that needs to be renewed is not handed out again
+	expiring, err := tmo.DelegationJWT(tmTypeRenewed, tmiNotAllowedEntity, DelegationRenewalPeriod/2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwt, errRes := handler.Delegation(tmTypeRenewed, tmiNotAllowedEntity)
+	if errRes != nil {
+		t.Fatal(errRes.ErrorDescription)
+	}
+	if string(jwt) == string(expiring) {
+		t.Error("expected a new delegation jwt instead of the expiring one")
+	}
+
+	// expired delegation jwts are pruned, but their status is still expired
+	expired, err := tmo.DelegationJWT(tmTypeRenewed, tmiRenewEntityID, -time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tmo.DelegationJWT(tmTypeRenewed, tmiNotAllowedEntity); err != nil {
+		t.Fatal(err)
+	}
+	d, err := parseDelegationJWT(expired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := tmo.Delegations.Delegation(d.JTI); err != nil || stored != nil {
+		t.Errorf("expected expired delegation jwt to be pruned, but got %+v, %v", stored, err)
+	}
+	status, err := tmo.DelegationStatus(expired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != TrustMarkStatusExpired {
+		t.Errorf("expected status '%s', but got '%s'", TrustMarkStatusExpired, status)
+	}
+}
+
+func TestTrustMarkIssuer_DelegationRenewal(t *testing.T) {
+	delegation := func(sub string, lifetime time.Duration) string {
+		jwt, err := tmoRenew.DelegationJWT(tmTypeRenewed, sub, lifetime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(jwt)
+	}
+	expired := delegation(tmiRenewEntityID, -time.Hour)
+	expiringSoon := delegation(tmiRenewEntityID, time.Minute)
+
+	tests := []struct {
+		name      string
+		entityID  string
+		spec      TrustMarkSpec
+		noOwner   bool
+		renewed   bool
+		expectErr bool
+	}{
+		{
+			name:     "expired delegation is renewed",
+			entityID: tmiRenewEntityID,
+			spec: TrustMarkSpec{
+				DelegationJWT:      expired,
+				DelegationEndpoint: tmoRenewEndpoint,
+			},
+			renewed: true,
+		},
+		{
+			name:     "expiring delegation is renewed",
+			entityID: tmiRenewEntityID,
+			spec: TrustMarkSpec{
+				DelegationJWT:      expiringSoon,
+				DelegationEndpoint: tmoRenewEndpoint,
+			},
+			renewed: true,
+		},
+		{
+			name:     "delegation is obtained",
+			entityID: tmiRenewEntityID,
+			spec: TrustMarkSpec{
+				DelegationEndpoint: tmoRenewEndpoint,
+			},
+			renewed: true,
+		},
+		{
+			name:     "delegation from spoofed endpoint",
+			entityID: tmiRenewEntityID,
+			spec: TrustMarkSpec{
+				DelegationEndpoint: tmoSpoofedEndpoint,
+			},
+			expectErr: true,
+		},
+		{
+			name:     "endpoint without trust mark owner",
+			entityID: tmiRenewEntityID,
+			spec: TrustMarkSpec{
+				DelegationEndpoint: tmoRenewEndpoint,
+			},
+			noOwner:   true,
+			expectErr: true,
+		},
+		{
+			name:     "expiring delegation without endpoint",
+			entityID: tmiRenewEntityID,
+			spec: TrustMarkSpec{
+				DelegationJWT: expiringSoon,
+			},
+		},
+		{
+			name:     "expired delegation without endpoint",
+			entityID: tmiRenewEntityID,
+			spec: TrustMarkSpec{
+				DelegationJWT: expired,
+			},
+			expectErr: true,
+		},
+		{
+			name:     "expired delegation and renewal refused",
+			entityID: tmiNotAllowedEntity,
+			spec: TrustMarkSpec{
+				DelegationJWT:      delegation(tmiNotAllowedEntity, -time.Hour),
+				DelegationEndpoint: tmoRenewEndpoint,
+			},
+			expectErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				test.spec.TrustMarkType = tmTypeRenewed
+				test.spec.Lifetime = unixtime.DurationInSeconds{Duration: 48 * time.Hour}
+				if !test.noOwner {
+					test.spec.TrustMarkOwner = tmoRenewSpec()
+				}
+				tmi := newMockTrustMarkIssuer(test.entityID, []TrustMarkSpec{test.spec})
+				info, err := tmi.IssueTrustMark(tmTypeRenewed, "https://sub.example.org")
+				if err != nil {
+					if !test.expectErr {
+						t.Fatal(err)
+					}
+					return
+				}
+				if test.expectErr {
+					t.Fatal("expected error, but trust mark was issued")
+				}
+				tm, err := ParseTrustMark([]byte(info.TrustMarkJWT))
+				if err != nil {
+					t.Fatal(err)
+				}
+				d, err := tm.Delegation()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if d == nil {
+					t.Fatal("trust mark does not contain delegation")
+				}
+				if err = d.VerifyExternal(jwks.KeyToJWKS(tmoRenew.key.Public(), tmoRenew.alg)); err != nil {
+					t.Error(err)
+				}
+				if renewed := d.ExpiresAt.After(time.Now().Add(time.Hour)); renewed != test.renewed {
+					t.Errorf("expected renewed %v, but got %v", test.renewed, renewed)
+				}
+				if tm.ExpiresAt == nil || tm.ExpiresAt.After(d.ExpiresAt.Time) {
+					t.Error("trust mark outlives its delegation")
+				}
+			},
+		)
+	}
+}
+
+func TestTrustMarkIssuer_SetDelegationJWT(t *testing.T) {
+	tmi := newMockTrustMarkIssuer(
+		"https://tmi-set-delegation.example.org", []TrustMarkSpec{{TrustMarkType: tmTypeRenewed}},
+	)
+	otherSub, err := tmoRenew.DelegationJWT(tmTypeRenewed, "https://other.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tmi.SetDelegationJWT(tmTypeRenewed, otherSub); err == nil {
+		t.Error("expected error for delegation of other trust mark issuer")
+	}
+	expired, err := tmoRenew.DelegationJWT(tmTypeRenewed, tmi.EntityID, -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tmi.SetDelegationJWT(tmTypeRenewed, expired); err == nil {
+		t.Error("expected error for expired delegation")
+	}
+	valid, err := tmoRenew.DelegationJWT(tmTypeRenewed, tmi.EntityID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tmi.SetDelegationJWT(tmTypeRenewed, valid); err != nil {
+		t.Fatal(err)
+	}
+	info, err := tmi.IssueTrustMark(tmTypeRenewed, "https://sub.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm, err := ParseTrustMark([]byte(info.TrustMarkJWT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tm.DelegationJWT != string(valid) {
+		t.Error("trust mark does not contain the set delegation")
+	}
+
+	verifying := newMockTrustMarkIssuer(
+		"https://tmi-set-verified-delegation.example.org", []TrustMarkSpec{
+			{
+				TrustMarkType:  tmTypeRenewed,
+				TrustMarkOwner: tmoRenewSpec(),
+			},
+		},
+	)
+	spoofed, err := tmoSpoofed.DelegationJWT(tmTypeRenewed, verifying.EntityID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = verifying.SetDelegationJWT(tmTypeRenewed, spoofed); err == nil {
+		t.Error("expected error for delegation signed by wrong key")
+	}
+	otherOwner, err := newMockTrustMarkOwner(
+		"https://tmo-other.example.org", []OwnedTrustMark{{ID: tmTypeRenewed}},
+	).DelegationJWT(tmTypeRenewed, verifying.EntityID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = verifying.SetDelegationJWT(tmTypeRenewed, otherOwner); err == nil {
+		t.Error("expected error for delegation of other trust mark owner")
+	}
+	valid, err = tmoRenew.DelegationJWT(tmTypeRenewed, verifying.EntityID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = verifying.SetDelegationJWT(tmTypeRenewed, valid); err != nil {
+		t.Fatal(err)
+	}
+}
+
+const (
+	tmTypeRevocable      = "https://trustmarks.org/revocable"
+	tmoRevokeEntityID    = "https://tmo-revoke.example.org"
+	tmoRevokeStatus      = tmoRevokeEntityID + "/delegation-status"
+	tmiRevokedEntityID   = "https://tmi-revoked.example.org"
+	tmiDelegatedEntityID = "https://tmi-still-delegated.example.org"
+)
+
+var tmoRevoke = newMockTrustMarkOwner(
+	tmoRevokeEntityID, []OwnedTrustMark{
+		{
+			ID:                 tmTypeRevocable,
+			DelegationLifetime: 24 * time.Hour,
+		},
+	},
+)
+
+func init() {
+	mockHandlerEndpoint("POST", tmoRevokeStatus, NewTrustMarkDelegationStatusHandler(tmoRevoke))
+}
+
+func TestTrustMarkOwner_RevokeDelegation(t *testing.T) {
+	handler := NewTrustMarkDelegationHandler(
+		tmoRevoke, map[string][]string{
+			tmTypeRevocable: {tmiRevokedEntityID, tmiDelegatedEntityID},
+		},
+	)
+	statusHandler := NewTrustMarkDelegationStatusHandler(tmoRevoke)
+	tmoSpec := TrustMarkOwnerSpec{
+		ID:   tmoRevokeEntityID,
+		JWKS: jwks.KeyToJWKS(tmoRevoke.key.Public(), tmoRevoke.alg),
+	}
+	delegate := func(sub string) (string, int) {
+		req := httptest.NewRequest(
+			http.MethodGet, "/delegation?"+url.Values{
+				"trust_mark_type": {tmTypeRevocable},
+				"sub":             {sub},
+			}.Encode(), nil,
+		)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Body.String(), rec.Code
+	}
+	status := func(delegation string) string {
+		req := httptest.NewRequest(
+			http.MethodPost, "/delegation-status", strings.NewReader(url.Values{"delegation": {delegation}}.Encode()),
+		)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		statusHandler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("unexpected status code %d", rec.Code)
+		}
+		var res TrustMarkDelegationStatus
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		return res.Status
+	}
+	trustMark := func(entityID, delegation string) (TrustMarkInfos, jwks.JWKS) {
+		tmi := newMockTrustMarkIssuer(
+			entityID, []TrustMarkSpec{
+				{
+					TrustMarkType: tmTypeRevocable,
+					DelegationJWT: delegation,
+				},
+			},
+		)
+		info, err := tmi.IssueTrustMark(tmTypeRevocable, "https://sub.example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return TrustMarkInfos{*info}, tmi.jwks
+	}
+
+	revokedDelegation, code := delegate(tmiRevokedEntityID)
+	if code != http.StatusOK {
+		t.Fatalf("expected delegation, but got status %d", code)
+	}
+	otherDelegation, code := delegate(tmiDelegatedEntityID)
+	if code != http.StatusOK {
+		t.Fatalf("expected delegation, but got status %d", code)
+	}
+	foreignDelegation, err := tmoRenew.DelegationJWT(tmTypeRenewed, tmiRevokedEntityID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := status(revokedDelegation); s != TrustMarkStatusActive {
+		t.Errorf("expected status '%s', but got '%s'", TrustMarkStatusActive, s)
+	}
+	revokedTM, revokedTMIKeys := trustMark(tmiRevokedEntityID, revokedDelegation)
+	otherTM, otherTMIKeys := trustMark(tmiDelegatedEntityID, otherDelegation)
+
+	if err = tmoRevoke.RevokeDelegation(tmTypeRevocable, tmiRevokedEntityID, "misuse"); err != nil {
+		t.Fatal(err)
+	}
+	if err = tmoRevoke.RevokeDelegation(tmTypeRevocable, tmiRevokedEntityID, "misuse"); err == nil {
+		t.Error("expected error when revoking a delegation again")
+	}
+	if _, code = delegate(tmiRevokedEntityID); code != http.StatusNotFound {
+		t.Errorf("expected status %d for revoked issuer, but got %d", http.StatusNotFound, code)
+	}
+	if s := status(revokedDelegation); s != TrustMarkStatusRevoked {
+		t.Errorf("expected status '%s', but got '%s'", TrustMarkStatusRevoked, s)
+	}
+	if s := status(otherDelegation); s != TrustMarkStatusActive {
+		t.Errorf("expected status '%s', but got '%s'", TrustMarkStatusActive, s)
+	}
+	if s := status(string(foreignDelegation)); s != TrustMarkStatusInvalid {
+		t.Errorf("expected status '%s', but got '%s'", TrustMarkStatusInvalid, s)
+	}
+	events, err := tmoRevoke.Delegations.AuditLog(tmTypeRevocable, tmiRevokedEntityID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[1].Event != TrustMarkEventRevoked || events[1].Reason != "misuse" {
+		t.Errorf("unexpected audit log: %+v", events)
+	}
+
+	checkers := map[string]DelegationRevocationChecker{
+		"status endpoint": DelegationStatusRevocationChecker{
+			StatusEndpoints: map[string]string{tmoRevokeEntityID: tmoRevokeStatus},
+		},
+		"owner": tmoRevoke,
+	}
+	for name, checker := range checkers {
+		t.Run(
+			name, func(t *testing.T) {
+				DefaultDelegationRevocationChecker = checker
+				defer func() { DefaultDelegationRevocationChecker = nil }()
+				report := revokedTM.VerifyExternalReport(revokedTMIKeys, tmoSpec)
+				if report[0].Cause != TrustMarkFailureDelegationRevoked {
+					t.Errorf(
+						"expected cause '%s', but got '%s': %v", TrustMarkFailureDelegationRevoked,
+						report[0].Cause, report[0].Err,
+					)
+				}
+				report = otherTM.VerifyExternalReport(otherTMIKeys, tmoSpec)
+				if !report[0].Valid() {
+					t.Errorf("expected valid trust mark, but got: %v", report[0].Err)
+				}
+			},
+		)
+	}
+}
+
+func TestDelegationStatusRevocationChecker_Cached(t *testing.T) {
+	sub := "https://tmi-cached.example.org"
+	jwt, err := tmoRevoke.DelegationJWT(tmTypeRevocable, sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delegation, err := parseDelegationJWT(jwt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checker := DelegationStatusRevocationChecker{
+		StatusEndpoints: map[string]string{tmoRevokeEntityID: tmoRevokeStatus},
+	}
+	if revoked, err := checker.DelegationRevoked(delegation); err != nil || revoked {
+		t.Fatalf("expected delegation to not be revoked, but got %v, %v", revoked, err)
+	}
+	if err = tmoRevoke.RevokeDelegation(tmTypeRevocable, sub, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if revoked, err := tmoRevoke.DelegationRevoked(delegation); err != nil || !revoked {
+		t.Fatalf("expected delegation to be revoked, but got %v, %v", revoked, err)
+	}
+	if revoked, err := checker.DelegationRevoked(delegation); err != nil || revoked {
+		t.Errorf("expected the cached status to be used, but got %v, %v", revoked, err)
+	}
+}
@@ -0,0 +1,243 @@
+package oidfed
+
+import (
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/go-oidfed/lib/cache"
+	"github.com/go-oidfed/lib/internal"
+)
+
+// EligibilityChecker checks if an entity is eligible to receive a trust mark
+type EligibilityChecker interface {
+	// Check checks if the subject is eligible for a trust mark of the
+	// passed type; if it is not, a reason is returned. An error is only
+	// returned if the eligibility could not be determined.
+	Check(sub, trustMarkType string) (eligible bool, reason string, err error)
+}
+
+// EligibilityCheckerFunc is a function that implements the
+// EligibilityChecker interface
+type EligibilityCheckerFunc func(sub, trustMarkType string) (bool, string, error)
+
+// Check implements the EligibilityChecker interface
+func (f EligibilityCheckerFunc) Check(sub, trustMarkType string) (bool, string, error) {
+	return f(sub, trustMarkType)
+}
+
+// EligibilityCheckAnd is an EligibilityChecker that requires all its
+// EligibilityCheckers to succeed
+type EligibilityCheckAnd []EligibilityChecker
+
+// Check implements the EligibilityChecker interface
+func (c EligibilityCheckAnd) Check(sub, trustMarkType string) (bool, string, error) {
+	for _, checker := range c {
+		eligible, reason, err := checker.Check(sub, trustMarkType)
+		if err != nil || !eligible {
+			return false, reason, err
+		}
+	}
+	return true, "", nil
+}
+
+// EligibilityCheckOr is an EligibilityChecker that requires at least one of
+// its EligibilityCheckers to succeed
+type EligibilityCheckOr []EligibilityChecker
+
+// Check implements the EligibilityChecker interface
+func (c EligibilityCheckOr) Check(sub, trustMarkType string) (bool, string, error) {
+	var reasons []string
+	var firstErr error
+	for _, checker := range c {
+		eligible, reason, err := checker.Check(sub, trustMarkType)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if eligible {
+			return true, "", nil
+		}
+		reasons = append(reasons, reason)
+	}
+	if len(reasons) == 0 && firstErr != nil {
+		return false, "", firstErr
+	}
+	return false, strings.Join(reasons, "; "), nil
+}
+
+// resolveSubjectChains resolves the valid trust chains of the subject to
+// the passed TrustAnchors
+func resolveSubjectChains(sub string, anchors TrustAnchors, entityTypes []string) TrustChains {
+	resolver := TrustResolver{
+		TrustAnchors:   anchors,
+		StartingEntity: sub,
+		Types:          entityTypes,
+	}
+	return resolver.ResolveToValidChains()
+}
+
+// TrustAnchorEligibilityChecker is an EligibilityChecker that requires the
+// subject to have a valid trust chain to one of the TrustAnchors
+type TrustAnchorEligibilityChecker struct {
+	TrustAnchors TrustAnchors
+	// EntityTypes are the entity types for which the subject's metadata
+	// is resolved
+	EntityTypes []string
+}
+
+// Check implements the EligibilityChecker interface
+func (c TrustAnchorEligibilityChecker) Check(sub, _ string) (bool, string, error) {
+	if len(resolveSubjectChains(sub, c.TrustAnchors, c.EntityTypes)) == 0 {
+		return false, "no valid trust chain to a trust anchor", nil
+	}
+	return true, "", nil
+}
+
+// MetadataEligibilityChecker is an EligibilityChecker that checks the
+// subject's Metadata as resolved through a trust chain to one of the
+// TrustAnchors; the subject is eligible if the MetadataCheck succeeds for
+// the resolved Metadata of any of its trust chains
+type MetadataEligibilityChecker struct {
+	TrustAnchors TrustAnchors
+	// EntityTypes are the entity types for which the subject's metadata
+	// is resolved
+	EntityTypes []string
+	// MetadataCheck checks the resolved Metadata; if the subject is not
+	// eligible a reason is returned
+	MetadataCheck func(metadata *Metadata) (eligible bool, reason string)
+}
+
+// Check implements the EligibilityChecker interface
+func (c MetadataEligibilityChecker) Check(sub, _ string) (bool, string, error) {
+	if c.MetadataCheck == nil {
+		return false, "", errors.New("no metadata check defined")
+	}
+	chains := resolveSubjectChains(sub, c.TrustAnchors, c.EntityTypes)
+	if len(chains) == 0 {
+		return false, "no valid trust chain to a trust anchor", nil
+	}
+	var reason string
+	for _, chain := range chains.SortAsc(TrustChainScoringPathLen) {
+		metadata, err := chain.Metadata()
+		if err != nil {
+			reason = err.Error()
+			continue
+		}
+		var eligible bool
+		if eligible, reason = c.MetadataCheck(metadata); eligible {
+			return true, "", nil
+		}
+	}
+	return false, reason, nil
+}
+
+// TrustMarkEligibilityChecker is an EligibilityChecker that requires the
+// subject to already hold a valid trust mark of the PrerequisiteTrustMarkType
+// in its entity configuration; the trust mark is verified within the
+// federation of the trust anchor of one of the subject's trust chains
+type TrustMarkEligibilityChecker struct {
+	TrustAnchors              TrustAnchors
+	PrerequisiteTrustMarkType string
+	// EntityTypes are the entity types for which the subject's metadata
+	// is resolved
+	EntityTypes []string
+}
+
+// Check implements the EligibilityChecker interface
+func (c TrustMarkEligibilityChecker) Check(sub, _ string) (bool, string, error) {
+	chains := resolveSubjectChains(sub, c.TrustAnchors, c.EntityTypes)
+	if len(chains) == 0 {
+		return false, "no valid trust chain to a trust anchor", nil
+	}
+	for _, chain := range chains {
+		ta := chain[len(chain)-1]
+		tm := chain[0].TrustMarks.FindByID(c.PrerequisiteTrustMarkType)
+		if tm == nil {
+			return false, "missing trust mark '" + c.PrerequisiteTrustMarkType + "'", nil
+		}
+		if err := tm.VerifyFederation(&ta.EntityStatementPayload); err == nil {
+			return true, "", nil
+		}
+	}
+	return false, "trust mark '" + c.PrerequisiteTrustMarkType + "' is not valid", nil
+}
+
+// CachedEligibilityChecker is an EligibilityChecker that caches the results
+// of another EligibilityChecker; errors are not cached
+type CachedEligibilityChecker struct {
+	// Name distinguishes the cache entries of different
+	// CachedEligibilityCheckers
+	Name     string
+	Checker  EligibilityChecker
+	Lifetime time.Duration
+}
+
+// NewCachedEligibilityChecker creates a new CachedEligibilityChecker that
+// caches the results of the passed EligibilityChecker for the passed lifetime
+func NewCachedEligibilityChecker(
+	name string, checker EligibilityChecker, lifetime time.Duration,
+) *CachedEligibilityChecker {
+	return &CachedEligibilityChecker{
+		Name:     name,
+		Checker:  checker,
+		Lifetime: lifetime,
+	}
+}
+
+type cachedEligibility struct {
+	Eligible bool   `msgpack:"eligible"`
+	Reason   string `msgpack:"reason"`
+}
+
+func (c CachedEligibilityChecker) cacheKey(sub, trustMarkType string) string {
+	return cache.Key(
+		cache.KeyTrustMarkEligibility,
+		base64.URLEncoding.EncodeToString([]byte(c.Name))+":"+
+			base64.URLEncoding.EncodeToString([]byte(trustMarkType))+":"+
+			base64.URLEncoding.EncodeToString([]byte(sub)),
+	)
+}
+
+// Check implements the EligibilityChecker interface
+func (c CachedEligibilityChecker) Check(sub, trustMarkType string) (bool, string, error) {
+	key := c.cacheKey(sub, trustMarkType)
+	var cached cachedEligibility
+	set, err := cache.Get(key, &cached)
+	if err != nil {
+		internal.Log(err)
+	} else if set {
+		return cached.Eligible, cached.Reason, nil
+	}
+	eligible, reason, err := c.Checker.Check(sub, trustMarkType)
+	if err != nil {
+		return false, reason, err
+	}
+	if err = cache.Set(
+		key, cachedEligibility{
+			Eligible: eligible,
+			Reason:   reason,
+		}, c.Lifetime,
+	); err != nil {
+		internal.Log(err)
+	}
+	return eligible, reason, nil
+}
+
+// CheckEligibility checks if the subject is eligible for a trust mark of the
+// passed type, using the EligibilityChecker of the TrustMarkSpec; if no
+// EligibilityChecker is set, every subject is eligible
+func (tmi TrustMarkIssuer) CheckEligibility(trustMarkType, sub string) (bool, string, error) {
+	spec, ok := tmi.trustMarks[trustMarkType]
+	if !ok {
+		return false, "", errors.Errorf("unknown trustmark '%s'", trustMarkType)
+	}
+	if spec.EligibilityChecker == nil {
+		return true, "", nil
+	}
+	return spec.EligibilityChecker.Check(sub, trustMarkType)
+}
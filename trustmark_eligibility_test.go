@@ -0,0 +1,211 @@
+package oidfed
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-oidfed/lib/unixtime"
+)
+
+var rpWithTrustMark = newMockRP(
+	"https://rp-trustmarked.example.com",
+	&OpenIDRelyingPartyMetadata{
+		Contacts: []string{"rp@trustmarked.example.com"},
+	},
+)
+
+func init() {
+	tm, err := tmi1.IssueTrustMark("https://trustmarks.org/tm1", rpWithTrustMark.EntityID)
+	if err != nil {
+		panic(err)
+	}
+	rpWithTrustMark.trustMarks = TrustMarkInfos{*tm}
+	taWithTmo.RegisterSubordinate(rpWithTrustMark)
+}
+
+func staticEligibility(eligible bool) EligibilityChecker {
+	return EligibilityCheckerFunc(
+		func(_, _ string) (bool, string, error) {
+			if eligible {
+				return true, "", nil
+			}
+			return false, "static", nil
+		},
+	)
+}
+
+func TestEligibilityCheckers(t *testing.T) {
+	taExplicitAnchors := TrustAnchors{{EntityID: taExplicit.EntityID, JWKS: taExplicit.data.JWKS}}
+	taWithTmoAnchors := TrustAnchors{{EntityID: taWithTmo.EntityID, JWKS: taWithTmo.data.JWKS}}
+	hasContacts := func(metadata *Metadata) (bool, string) {
+		if metadata.RelyingParty == nil || len(metadata.RelyingParty.Contacts) == 0 {
+			return false, "no contacts"
+		}
+		return true, ""
+	}
+
+	tests := []struct {
+		name             string
+		checker          EligibilityChecker
+		sub              string
+		expectedEligible bool
+	}{
+		{
+			name:             "and all eligible",
+			checker:          EligibilityCheckAnd{staticEligibility(true), staticEligibility(true)},
+			expectedEligible: true,
+		},
+		{
+			name:             "and one not eligible",
+			checker:          EligibilityCheckAnd{staticEligibility(true), staticEligibility(false)},
+			expectedEligible: false,
+		},
+		{
+			name:             "or one eligible",
+			checker:          EligibilityCheckOr{staticEligibility(false), staticEligibility(true)},
+			expectedEligible: true,
+		},
+		{
+			name:             "or none eligible",
+			checker:          EligibilityCheckOr{staticEligibility(false), staticEligibility(false)},
+			expectedEligible: false,
+		},
+		{
+			name: "nested",
+			checker: EligibilityCheckAnd{
+				staticEligibility(true),
+				EligibilityCheckOr{staticEligibility(false), staticEligibility(true)},
+			},
+			expectedEligible: true,
+		},
+		{
+			name:             "trust anchor",
+			checker:          TrustAnchorEligibilityChecker{TrustAnchors: taExplicitAnchors},
+			sub:              rpExplicit.EntityID,
+			expectedEligible: true,
+		},
+		{
+			name:             "trust anchor wrong federation",
+			checker:          TrustAnchorEligibilityChecker{TrustAnchors: taWithTmoAnchors},
+			sub:              rpExplicit.EntityID,
+			expectedEligible: false,
+		},
+		{
+			name: "metadata",
+			checker: MetadataEligibilityChecker{
+				TrustAnchors:  taExplicitAnchors,
+				MetadataCheck: hasContacts,
+			},
+			sub:              rpExplicit.EntityID,
+			expectedEligible: true,
+		},
+		{
+			name: "metadata not matching",
+			checker: MetadataEligibilityChecker{
+				TrustAnchors:  taExplicitAnchors,
+				MetadataCheck: hasContacts,
+			},
+			sub:              opExplicit.EntityID,
+			expectedEligible: false,
+		},
+		{
+			name: "prerequisite trust mark",
+			checker: TrustMarkEligibilityChecker{
+				TrustAnchors:              taWithTmoAnchors,
+				PrerequisiteTrustMarkType: "https://trustmarks.org/tm1",
+			},
+			sub:              rpWithTrustMark.EntityID,
+			expectedEligible: true,
+		},
+		{
+			name: "prerequisite trust mark missing",
+			checker: TrustMarkEligibilityChecker{
+				TrustAnchors:              taWithTmoAnchors,
+				PrerequisiteTrustMarkType: "https://trustmarks.org/tm2",
+			},
+			sub:              rpWithTrustMark.EntityID,
+			expectedEligible: false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				eligible, reason, err := test.checker.Check(test.sub, "https://trustmarks.org/eligibility")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if eligible != test.expectedEligible {
+					t.Errorf("expected eligibility %v, but got %v (%s)", test.expectedEligible, eligible, reason)
+				}
+				if !eligible && reason == "" {
+					t.Error("no reason given for ineligibility")
+				}
+			},
+		)
+	}
+}
+
+func TestCachedEligibilityChecker(t *testing.T) {
+	var calls int
+	checker := NewCachedEligibilityChecker(
+		"counting", EligibilityCheckerFunc(
+			func(sub, _ string) (bool, string, error) {
+				calls++
+				return sub == "https://eligible.example.org", "not the eligible entity", nil
+			},
+		), time.Minute,
+	)
+	for range 3 {
+		for _, sub := range []string{"https://eligible.example.org", "https://other.example.org"} {
+			eligible, _, err := checker.Check(sub, "https://trustmarks.org/cached")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if eligible != (sub == "https://eligible.example.org") {
+				t.Errorf("unexpected eligibility %v for '%s'", eligible, sub)
+			}
+		}
+	}
+	if calls != 2 {
+		t.Errorf("expected 2 calls of the wrapped checker, but got %d", calls)
+	}
+}
+
+func TestTrustMarkIssuer_IssueTrustMark_Eligibility(t *testing.T) {
+	tmi := newMockTrustMarkIssuer(
+		"https://tmi-eligibility.example.org", []TrustMarkSpec{
+			{
+				TrustMarkType: "https://trustmarks.org/eligibility",
+				Lifetime:      unixtime.DurationInSeconds{Duration: time.Hour},
+				EligibilityChecker: EligibilityCheckerFunc(
+					func(sub, _ string) (bool, string, error) {
+						return sub == "https://eligible.example.org", "not the eligible entity", nil
+					},
+				),
+			},
+		},
+	)
+	if _, err := tmi.IssueTrustMark("https://trustmarks.org/eligibility", "https://eligible.example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tmi.IssueTrustMark(
+		"https://trustmarks.org/eligibility", "https://other.example.org",
+	); err == nil {
+		t.Error("expected error for ineligible subject")
+	}
+
+	if err := tmi.entitlements.CreateEntitlement(
+		TrustMarkEntitlement{
+			TrustMarkType: "https://trustmarks.org/eligibility",
+			Subject:       "https://other.example.org",
+		},
+	); err != nil {
+		t.Fatal(err)
+	}
+	_, errRes := NewTrustMarkHandler(&tmi.TrustMarkIssuer, tmi.entitlements).TrustMark(
+		"https://trustmarks.org/eligibility", "https://other.example.org",
+	)
+	if errRes == nil || errRes.Error != NotFound {
+		t.Errorf("expected not_found error for entitled but ineligible subject, got %+v", errRes)
+	}
+}
@@ -0,0 +1,256 @@
+package oidfed
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/go-oidfed/lib/internal"
+	"github.com/go-oidfed/lib/oidfedconst"
+	"github.com/go-oidfed/lib/unixtime"
+)
+
+// TrustMarkEntitlement records that a subject is entitled to receive trust
+// marks of a trust mark type from a TrustMarkIssuer
+type TrustMarkEntitlement struct {
+	TrustMarkType string `json:"trust_mark_type" msgpack:"trust_mark_type" yaml:"trust_mark_type"`
+	Subject       string `json:"sub" msgpack:"sub" yaml:"sub"`
+	// ExpiresAt optionally limits the entitlement; trust marks issued on
+	// the basis of the entitlement never outlive it
+	ExpiresAt *unixtime.Unixtime `json:"exp,omitempty" msgpack:"exp,omitempty" yaml:"exp,omitempty"`
+}
+
+// Expired checks if the TrustMarkEntitlement is expired
+func (e TrustMarkEntitlement) Expired() bool {
+	return e.ExpiresAt != nil && !e.ExpiresAt.IsZero() && e.ExpiresAt.Before(time.Now())
+}
+
+// TrustMarkEntitlementStore is an interface for managing
+// TrustMarkEntitlements
+type TrustMarkEntitlementStore interface {
+	// CreateEntitlement stores a new TrustMarkEntitlement; it returns an
+	// error if the subject already has an entitlement for the trust mark
+	// type
+	CreateEntitlement(entitlement TrustMarkEntitlement) error
+	// Entitlement returns the (unexpired) TrustMarkEntitlement of the
+	// subject for the trust mark type or nil if there is no such
+	// entitlement
+	Entitlement(trustMarkType, sub string) (*TrustMarkEntitlement, error)
+	// Entitlements returns all unexpired TrustMarkEntitlements for the trust
+	// mark type
+	Entitlements(trustMarkType string) ([]TrustMarkEntitlement, error)
+	// UpdateEntitlement replaces an existing TrustMarkEntitlement; it
+	// returns an error if there is no such entitlement
+	UpdateEntitlement(entitlement TrustMarkEntitlement) error
+	// DeleteEntitlement deletes the TrustMarkEntitlement of the subject for
+	// the trust mark type; deleting a non-existing entitlement is not an
+	// error
+	DeleteEntitlement(trustMarkType, sub string) error
+}
+
+// InMemoryTrustMarkEntitlementStore is a TrustMarkEntitlementStore that
+// keeps the TrustMarkEntitlements in memory
+type InMemoryTrustMarkEntitlementStore struct {
+	mutex        sync.RWMutex
+	entitlements map[string]map[string]TrustMarkEntitlement
+}
+
+// NewInMemoryTrustMarkEntitlementStore creates a new
+// InMemoryTrustMarkEntitlementStore holding the passed TrustMarkEntitlements
+func NewInMemoryTrustMarkEntitlementStore(entitlements ...TrustMarkEntitlement) *InMemoryTrustMarkEntitlementStore {
+	s := &InMemoryTrustMarkEntitlementStore{
+		entitlements: make(map[string]map[string]TrustMarkEntitlement),
+	}
+	for _, e := range entitlements {
+		s.set(e)
+	}
+	return s
+}
+
+func (s *InMemoryTrustMarkEntitlementStore) get(trustMarkType, sub string) (TrustMarkEntitlement, bool) {
+	e, ok := s.entitlements[trustMarkType][sub]
+	return e, ok
+}
+
+func (s *InMemoryTrustMarkEntitlementStore) set(entitlement TrustMarkEntitlement) {
+	subjects, ok := s.entitlements[entitlement.TrustMarkType]
+	if !ok {
+		subjects = make(map[string]TrustMarkEntitlement)
+		s.entitlements[entitlement.TrustMarkType] = subjects
+	}
+	subjects[entitlement.Subject] = entitlement
+}
+
+// CreateEntitlement implements the TrustMarkEntitlementStore interface
+func (s *InMemoryTrustMarkEntitlementStore) CreateEntitlement(entitlement TrustMarkEntitlement) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.get(entitlement.TrustMarkType, entitlement.Subject); ok {
+		return errors.Errorf(
+			"entitlement of '%s' for trust mark type '%s' already exists", entitlement.Subject,
+			entitlement.TrustMarkType,
+		)
+	}
+	s.set(entitlement)
+	return nil
+}
+
+// Entitlement implements the TrustMarkEntitlementStore interface
+func (s *InMemoryTrustMarkEntitlementStore) Entitlement(trustMarkType, sub string) (*TrustMarkEntitlement, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	e, ok := s.get(trustMarkType, sub)
+	if !ok || e.Expired() {
+		return nil, nil
+	}
+	return &e, nil
+}
+
+// Entitlements implements the TrustMarkEntitlementStore interface
+func (s *InMemoryTrustMarkEntitlementStore) Entitlements(trustMarkType string) ([]TrustMarkEntitlement, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var entitlements []TrustMarkEntitlement
+	for _, e := range s.entitlements[trustMarkType] {
+		if !e.Expired() {
+			entitlements = append(entitlements, e)
+		}
+	}
+	return entitlements, nil
+}
+
+// UpdateEntitlement implements the TrustMarkEntitlementStore interface
+func (s *InMemoryTrustMarkEntitlementStore) UpdateEntitlement(entitlement TrustMarkEntitlement) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.get(entitlement.TrustMarkType, entitlement.Subject); !ok {
+		return errors.Errorf(
+			"no entitlement of '%s' for trust mark type '%s'", entitlement.Subject, entitlement.TrustMarkType,
+		)
+	}
+	s.set(entitlement)
+	return nil
+}
+
+// DeleteEntitlement implements the TrustMarkEntitlementStore interface
+func (s *InMemoryTrustMarkEntitlementStore) DeleteEntitlement(trustMarkType, sub string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.entitlements[trustMarkType], sub)
+	return nil
+}
+
+// TrustMarkHandler is a http.Handler for a TrustMarkIssuer's
+// federation_trust_mark_endpoint.
+// It issues trust marks of the requested trust_mark_type to the requested
+// sub, if the subject is entitled to it according to the
+// TrustMarkEntitlementStore and eligible according to the
+// EligibilityChecker of the TrustMarkSpec.
+type TrustMarkHandler struct {
+	Issuer       *TrustMarkIssuer
+	Entitlements TrustMarkEntitlementStore
+}
+
+// NewTrustMarkHandler creates a new TrustMarkHandler for the passed
+// TrustMarkIssuer. If no TrustMarkEntitlementStore is passed, an empty
+// InMemoryTrustMarkEntitlementStore is used.
+func NewTrustMarkHandler(issuer *TrustMarkIssuer, entitlements TrustMarkEntitlementStore) *TrustMarkHandler {
+	if entitlements == nil {
+		entitlements = NewInMemoryTrustMarkEntitlementStore()
+	}
+	return &TrustMarkHandler{
+		Issuer:       issuer,
+		Entitlements: entitlements,
+	}
+}
+
+// ServeHTTP implements the http.Handler interface
+func (h TrustMarkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeErrorResponse(w, http.StatusMethodNotAllowed, ErrorInvalidRequest("only GET is supported"))
+		return
+	}
+	query := r.URL.Query()
+	jwt, errRes := h.TrustMark(query.Get("trust_mark_type"), query.Get("sub"))
+	if errRes != nil {
+		status := http.StatusBadRequest
+		switch errRes.Error {
+		case NotFound:
+			status = http.StatusNotFound
+		case ServerError:
+			status = http.StatusInternalServerError
+		}
+		writeErrorResponse(w, status, *errRes)
+		return
+	}
+	w.Header().Set("Content-Type", oidfedconst.ContentTypeTrustMark)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(jwt)
+}
+
+// TrustMark issues a trust mark of the passed type to the passed subject and
+// returns the trust mark jwt or an Error, if the trust mark type is unknown
+// or the subject is not entitled to it; if the subject still holds a trust
+// mark of this type that is valid for at least half of its lifetime, it is
+// returned instead of issuing a new one
+func (h TrustMarkHandler) TrustMark(trustMarkType, sub string) ([]byte, *Error) {
+	if trustMarkType == "" {
+		errRes := ErrorInvalidRequest("trust_mark_type parameter is required")
+		return nil, &errRes
+	}
+	if sub == "" {
+		errRes := ErrorInvalidRequest("sub parameter is required")
+		return nil, &errRes
+	}
+	spec, ok := h.Issuer.trustMarks[trustMarkType]
+	if !ok {
+		errRes := ErrorNotFound("unknown trust_mark_type")
+		return nil, &errRes
+	}
+	entitlement, err := h.Entitlements.Entitlement(trustMarkType, sub)
+	if err != nil {
+		internal.Log(err.Error())
+		errRes := ErrorServerError("could not check entitlement")
+		return nil, &errRes
+	}
+	if entitlement == nil {
+		errRes := ErrorNotFound("subject is not entitled to this trust mark")
+		return nil, &errRes
+	}
+	eligible, reason, err := h.Issuer.CheckEligibility(trustMarkType, sub)
+	if err != nil {
+		internal.Log(err.Error())
+		errRes := ErrorServerError("could not check eligibility")
+		return nil, &errRes
+	}
+	if !eligible {
+		errRes := ErrorNotFound("subject is not eligible for this trust mark: " + reason)
+		return nil, &errRes
+	}
+	reusable, err := h.Issuer.reusableTrustMark(trustMarkType, sub, entitlement.ExpiresAt)
+	if err != nil {
+		internal.Log(err.Error())
+		errRes := ErrorServerError("could not issue trust mark")
+		return nil, &errRes
+	}
+	if reusable != nil {
+		return reusable, nil
+	}
+	var lifetime []time.Duration
+	if entitlement.ExpiresAt != nil && !entitlement.ExpiresAt.IsZero() {
+		untilEntitlementExpires := unixtime.Until(*entitlement.ExpiresAt)
+		if spec.Lifetime.Duration == 0 || untilEntitlementExpires < spec.Lifetime.Duration {
+			lifetime = append(lifetime, untilEntitlementExpires)
+		}
+	}
+	info, err := h.Issuer.issueTrustMark(spec, sub, nil, lifetime...)
+	if err != nil {
+		internal.Log(err.Error())
+		errRes := ErrorServerError("could not issue trust mark")
+		return nil, &errRes
+	}
+	return []byte(info.TrustMarkJWT), nil
+}
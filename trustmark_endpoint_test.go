@@ -0,0 +1,308 @@
+package oidfed
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/go-oidfed/lib/oidfedconst"
+	"github.com/go-oidfed/lib/unixtime"
+)
+
+var tmiEntitled = newMockTrustMarkIssuer(
+	"https://tmi-entitled.example.org", []TrustMarkSpec{
+		{
+			TrustMarkType: "https://trustmarks.org/entitled",
+			Lifetime:      unixtime.DurationInSeconds{Duration: 24 * time.Hour},
+		},
+	},
+)
+
+func init() {
+	for _, e := range []TrustMarkEntitlement{
+		{
+			TrustMarkType: "https://trustmarks.org/entitled",
+			Subject:       "https://entitled.example.org",
+		},
+		{
+			TrustMarkType: "https://trustmarks.org/entitled",
+			Subject:       "https://short.example.org",
+			ExpiresAt:     &unixtime.Unixtime{Time: time.Now().Add(time.Hour)},
+		},
+		{
+			TrustMarkType: "https://trustmarks.org/entitled",
+			Subject:       "https://expired.example.org",
+			ExpiresAt:     &unixtime.Unixtime{Time: time.Now().Add(-time.Hour)},
+		},
+	} {
+		if err := tmiEntitled.entitlements.CreateEntitlement(e); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func TestInMemoryTrustMarkEntitlementStore(t *testing.T) {
+	const tmType = "https://trustmarks.org/crud"
+	store := NewInMemoryTrustMarkEntitlementStore()
+	e := TrustMarkEntitlement{
+		TrustMarkType: tmType,
+		Subject:       "https://sub.example.org",
+	}
+	if err := store.UpdateEntitlement(e); err == nil {
+		t.Error("expected error updating non-existing entitlement")
+	}
+	if err := store.CreateEntitlement(e); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateEntitlement(e); err == nil {
+		t.Error("expected error creating duplicate entitlement")
+	}
+	got, err := store.Entitlement(tmType, e.Subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil {
+		t.Fatal("entitlement not found")
+	}
+	e.ExpiresAt = &unixtime.Unixtime{Time: time.Now().Add(-time.Minute)}
+	if err = store.UpdateEntitlement(e); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ = store.Entitlement(tmType, e.Subject); got != nil {
+		t.Error("expired entitlement returned")
+	}
+	all, _ := store.Entitlements(tmType)
+	if len(all) != 0 {
+		t.Errorf("expected no unexpired entitlements, but got %d", len(all))
+	}
+	if err = store.DeleteEntitlement(tmType, e.Subject); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.UpdateEntitlement(e); err == nil {
+		t.Error("expected error updating deleted entitlement")
+	}
+	if err = store.DeleteEntitlement(tmType, e.Subject); err != nil {
+		t.Errorf("deleting non-existing entitlement failed: %v", err)
+	}
+}
+
+func TestTrustMarkHandler(t *testing.T) {
+	handler := NewTrustMarkHandler(&tmiEntitled.TrustMarkIssuer, tmiEntitled.entitlements)
+	tests := []struct {
+		name           string
+		method         string
+		params         url.Values
+		expectedStatus int
+		expectedError  string
+		maxLifetime    time.Duration
+	}{
+		{
+			name:   "entitled",
+			method: http.MethodGet,
+			params: url.Values{
+				"trust_mark_type": {"https://trustmarks.org/entitled"},
+				"sub":             {"https://entitled.example.org"},
+			},
+			expectedStatus: http.StatusOK,
+			maxLifetime:    24 * time.Hour,
+		},
+		{
+			name:   "entitlement limits lifetime",
+			method: http.MethodGet,
+			params: url.Values{
+				"trust_mark_type": {"https://trustmarks.org/entitled"},
+				"sub":             {"https://short.example.org"},
+			},
+			expectedStatus: http.StatusOK,
+			maxLifetime:    time.Hour,
+		},
+		{
+			name:   "entitlement expired",
+			method: http.MethodGet,
+			params: url.Values{
+				"trust_mark_type": {"https://trustmarks.org/entitled"},
+				"sub":             {"https://expired.example.org"},
+			},
+			expectedStatus: http.StatusNotFound,
+			expectedError:  NotFound,
+		},
+		{
+			name:   "not entitled",
+			method: http.MethodGet,
+			params: url.Values{
+				"trust_mark_type": {"https://trustmarks.org/entitled"},
+				"sub":             {"https://other.example.org"},
+			},
+			expectedStatus: http.StatusNotFound,
+			expectedError:  NotFound,
+		},
+		{
+			name:   "unknown trust_mark_type",
+			method: http.MethodGet,
+			params: url.Values{
+				"trust_mark_type": {"https://trustmarks.org/unknown"},
+				"sub":             {"https://entitled.example.org"},
+			},
+			expectedStatus: http.StatusNotFound,
+			expectedError:  NotFound,
+		},
+		{
+			name:           "missing sub",
+			method:         http.MethodGet,
+			params:         url.Values{"trust_mark_type": {"https://trustmarks.org/entitled"}},
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  InvalidRequest,
+		},
+		{
+			name:           "missing trust_mark_type",
+			method:         http.MethodGet,
+			params:         url.Values{"sub": {"https://entitled.example.org"}},
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  InvalidRequest,
+		},
+		{
+			name:   "wrong method",
+			method: http.MethodPost,
+			params: url.Values{
+				"trust_mark_type": {"https://trustmarks.org/entitled"},
+				"sub":             {"https://entitled.example.org"},
+			},
+			expectedStatus: http.StatusMethodNotAllowed,
+			expectedError:  InvalidRequest,
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				req := httptest.NewRequest(test.method, "/trustmark?"+test.params.Encode(), nil)
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+				if rec.Code != test.expectedStatus {
+					t.Fatalf("expected status %d, but got %d: %s", test.expectedStatus, rec.Code, rec.Body.String())
+				}
+				if test.expectedError != "" {
+					var errRes Error
+					if err := json.Unmarshal(rec.Body.Bytes(), &errRes); err != nil {
+						t.Fatal(err)
+					}
+					if errRes.Error != test.expectedError {
+						t.Errorf("expected error '%s', but got '%s'", test.expectedError, errRes.Error)
+					}
+					return
+				}
+				if ct := rec.Header().Get("Content-Type"); ct != oidfedconst.ContentTypeTrustMark {
+					t.Errorf("unexpected content type '%s'", ct)
+				}
+				tm, err := ParseTrustMark(rec.Body.Bytes())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tm.Subject != test.params.Get("sub") {
+					t.Errorf("unexpected subject '%s'", tm.Subject)
+				}
+				if tm.ExpiresAt == nil || unixtime.Until(*tm.ExpiresAt) > test.maxLifetime {
+					t.Errorf("trust mark lifetime exceeds %s", test.maxLifetime)
+				}
+			},
+		)
+	}
+}
+
+func TestEntityConfigurationTrustMarkConfig_refreshFromTrustMarkEndpoint(t *testing.T) {
+	c := &EntityConfigurationTrustMarkConfig{
+		TrustMarkType:   "https://trustmarks.org/entitled",
+		TrustMarkIssuer: tmiEntitled.EntityID,
+	}
+	if err := c.Verify("https://entitled.example.org", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	jwt, err := c.TrustMarkJWT()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm, err := ParseTrustMark([]byte(jwt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tm.Issuer != tmiEntitled.EntityID || tm.Subject != "https://entitled.example.org" {
+		t.Errorf("unexpected trust mark: %+v", tm)
+	}
+}
+
+func TestTrustMarkHandler_RepeatedRequests(t *testing.T) {
+	tmi := newMockTrustMarkIssuer(
+		"https://tmi-repeated.example.org", []TrustMarkSpec{
+			{
+				TrustMarkType: "https://trustmarks.org/repeated",
+				Lifetime:      unixtime.DurationInSeconds{Duration: time.Hour},
+			},
+		},
+	)
+	for _, sub := range []string{"https://repeated.example.org", "https://stale.example.org"} {
+		if err := tmi.entitlements.CreateEntitlement(
+			TrustMarkEntitlement{
+				TrustMarkType: "https://trustmarks.org/repeated",
+				Subject:       sub,
+			},
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+	handler := NewTrustMarkHandler(&tmi.TrustMarkIssuer, tmi.entitlements)
+
+	first, errRes := handler.TrustMark("https://trustmarks.org/repeated", "https://repeated.example.org")
+	if errRes != nil {
+		t.Fatal(errRes.ErrorDescription)
+	}
+	for range 3 {
+		jwt, errRes := handler.TrustMark("https://trustmarks.org/repeated", "https://repeated.example.org")
+		if errRes != nil {
+			t.Fatal(errRes.ErrorDescription)
+		}
+		if string(jwt) != string(first) {
+			t.Error("expected the still valid trust mark to be returned again")
+		}
+	}
+	issued, err := tmi.IssuedTrustMarks.IssuedTrustMarks(
+		"https://trustmarks.org/repeated", "https://repeated.example.org",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issued) != 1 {
+		t.Errorf("expected 1 issued trust mark, but got %d", len(issued))
+	}
+	events, err := tmi.IssuedTrustMarks.AuditLog("", "https://repeated.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Errorf("expected 1 audit event, but got %d", len(events))
+	}
+
+	// a trust mark that is valid for less than half of its lifetime is not
+	// handed out again
+	now := time.Now()
+	if err = tmi.IssuedTrustMarks.StoreIssuedTrustMark(
+		IssuedTrustMark{
+			JTI:           "stale",
+			TrustMarkType: "https://trustmarks.org/repeated",
+			Subject:       "https://stale.example.org",
+			IssuedAt:      unixtime.Unixtime{Time: now.Add(-50 * time.Minute)},
+			ExpiresAt:     &unixtime.Unixtime{Time: now.Add(10 * time.Minute)},
+			TrustMarkJWT:  "stale-jwt",
+		},
+	); err != nil {
+		t.Fatal(err)
+	}
+	jwt, errRes := handler.TrustMark("https://trustmarks.org/repeated", "https://stale.example.org")
+	if errRes != nil {
+		t.Fatal(errRes.ErrorDescription)
+	}
+	if string(jwt) == "stale-jwt" {
+		t.Error("expected a new trust mark instead of the almost expired one")
+	}
+}
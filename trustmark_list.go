@@ -0,0 +1,116 @@
+package oidfed
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/go-oidfed/lib/internal"
+)
+
+// defaultTrustMarkListCacheTime is the time a trust mark list response is
+// cached if the server does not define a lifetime
+const defaultTrustMarkListCacheTime = 10 * time.Minute
+
+// TrustMarkedEntities returns the entity ids of the subjects that hold an
+// active (i.e. neither expired nor revoked) trust mark of the passed type
+// issued by this TrustMarkIssuer; if sub is not empty, the result is
+// filtered to this subject
+func (tmi TrustMarkIssuer) TrustMarkedEntities(trustMarkType, sub string) ([]string, error) {
+	if tmi.IssuedTrustMarks == nil {
+		return nil, errors.New("trust mark issuer does not record issued trust marks")
+	}
+	issued, err := tmi.IssuedTrustMarks.IssuedTrustMarks(trustMarkType, sub)
+	if err != nil {
+		return nil, err
+	}
+	entities := make([]string, 0, len(issued))
+	for _, tm := range issued {
+		if !slices.Contains(entities, tm.Subject) {
+			entities = append(entities, tm.Subject)
+		}
+	}
+	slices.Sort(entities)
+	return entities, nil
+}
+
+// TrustMarkListHandler is a http.Handler for a TrustMarkIssuer's
+// federation_trust_mark_list_endpoint.
+// It lists the entities that hold a trust mark of the requested
+// trust_mark_type, optionally filtered by sub.
+type TrustMarkListHandler struct {
+	Issuer *TrustMarkIssuer
+}
+
+// NewTrustMarkListHandler creates a new TrustMarkListHandler for the passed
+// TrustMarkIssuer
+func NewTrustMarkListHandler(issuer *TrustMarkIssuer) *TrustMarkListHandler {
+	return &TrustMarkListHandler{Issuer: issuer}
+}
+
+// ServeHTTP implements the http.Handler interface
+func (h TrustMarkListHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeErrorResponse(w, http.StatusMethodNotAllowed, ErrorInvalidRequest("only GET is supported"))
+		return
+	}
+	trustMarkType := r.URL.Query().Get("trust_mark_type")
+	if trustMarkType == "" {
+		writeErrorResponse(w, http.StatusBadRequest, ErrorInvalidRequest("trust_mark_type parameter is required"))
+		return
+	}
+	if !slices.Contains(h.Issuer.TrustMarkTypes(), trustMarkType) {
+		writeErrorResponse(w, http.StatusNotFound, ErrorNotFound("unknown trust_mark_type"))
+		return
+	}
+	entities, err := h.Issuer.TrustMarkedEntities(trustMarkType, r.URL.Query().Get("sub"))
+	if err != nil {
+		internal.Log(err.Error())
+		writeErrorResponse(w, http.StatusInternalServerError, ErrorServerError("could not list trust marked entities"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(entities)
+}
+
+// FetchTrustMarkedEntities queries the federation_trust_mark_list_endpoint of
+// the passed trust mark issuer and returns the entity ids of the entities
+// that hold a trust mark of the passed type; if sub is not empty, the result
+// is filtered to this subject. The trust mark issuer is resolved through the
+// passed TrustAnchor to obtain its endpoint.
+func FetchTrustMarkedEntities(trustMarkIssuer, trustMarkType, sub string, ta TrustAnchor) ([]string, error) {
+	taConfig, err := trustAnchorConfiguration(ta)
+	if err != nil {
+		return nil, err
+	}
+	_, metadata, err := resolveTrustMarkIssuer(trustMarkIssuer, taConfig)
+	if err != nil {
+		return nil, err
+	}
+	if metadata == nil || metadata.FederationEntity == nil ||
+		metadata.FederationEntity.FederationTrustMarkListEndpoint == "" {
+		return nil, errors.New("could not obtain trust mark list endpoint of trust mark issuer")
+	}
+	params := url.Values{}
+	params.Set("trust_mark_type", trustMarkType)
+	if sub != "" {
+		params.Set("sub", sub)
+	}
+	body, _, err := httpGetCached(
+		metadata.FederationEntity.FederationTrustMarkListEndpoint, params, defaultTrustMarkListCacheTime,
+	)
+	if err != nil {
+		return nil, err
+	}
+	var entities []string
+	if err = json.Unmarshal(body, &entities); err != nil {
+		return nil, errors.Wrap(err, "unexpected response type")
+	}
+	return entities, nil
+}
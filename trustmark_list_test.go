@@ -0,0 +1,214 @@
+package oidfed
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-oidfed/lib/unixtime"
+)
+
+var tmiList = newMockTrustMarkIssuer(
+	"https://tmi-list.example.org", []TrustMarkSpec{
+		{
+			TrustMarkType: "https://trustmarks.org/listed",
+			Lifetime:      unixtime.DurationInSeconds{Duration: time.Hour},
+		},
+		{
+			TrustMarkType: "https://trustmarks.org/unissued",
+			Lifetime:      unixtime.DurationInSeconds{Duration: time.Hour},
+		},
+	},
+)
+
+func init() {
+	taStatus.RegisterSubordinate(tmiList)
+	for _, sub := range []string{"https://b.example.org", "https://a.example.org"} {
+		if _, err := tmiList.IssueTrustMark("https://trustmarks.org/listed", sub); err != nil {
+			panic(err)
+		}
+	}
+	if _, err := tmiList.IssueTrustMark(
+		"https://trustmarks.org/listed", "https://expired.example.org", -time.Minute,
+	); err != nil {
+		panic(err)
+	}
+	if _, err := tmiList.IssueTrustMark("https://trustmarks.org/listed", "https://revoked.example.org"); err != nil {
+		panic(err)
+	}
+	if err := tmiList.RevokeTrustMark(
+		"https://trustmarks.org/listed", "https://revoked.example.org", "test",
+	); err != nil {
+		panic(err)
+	}
+}
+
+func TestTrustMarkListHandler(t *testing.T) {
+	handler := NewTrustMarkListHandler(&tmiList.TrustMarkIssuer)
+	tests := []struct {
+		name             string
+		method           string
+		params           url.Values
+		expectedStatus   int
+		expectedEntities []string
+		expectedError    string
+	}{
+		{
+			name:           "all subjects",
+			method:         http.MethodGet,
+			params:         url.Values{"trust_mark_type": {"https://trustmarks.org/listed"}},
+			expectedStatus: http.StatusOK,
+			expectedEntities: []string{
+				"https://a.example.org",
+				"https://b.example.org",
+			},
+		},
+		{
+			name:   "filtered by sub",
+			method: http.MethodGet,
+			params: url.Values{
+				"trust_mark_type": {"https://trustmarks.org/listed"},
+				"sub":             {"https://b.example.org"},
+			},
+			expectedStatus:   http.StatusOK,
+			expectedEntities: []string{"https://b.example.org"},
+		},
+		{
+			name:   "expired sub",
+			method: http.MethodGet,
+			params: url.Values{
+				"trust_mark_type": {"https://trustmarks.org/listed"},
+				"sub":             {"https://expired.example.org"},
+			},
+			expectedStatus:   http.StatusOK,
+			expectedEntities: []string{},
+		},
+		{
+			name:   "revoked sub",
+			method: http.MethodGet,
+			params: url.Values{
+				"trust_mark_type": {"https://trustmarks.org/listed"},
+				"sub":             {"https://revoked.example.org"},
+			},
+			expectedStatus:   http.StatusOK,
+			expectedEntities: []string{},
+		},
+		{
+			name:             "nothing issued",
+			method:           http.MethodGet,
+			params:           url.Values{"trust_mark_type": {"https://trustmarks.org/unissued"}},
+			expectedStatus:   http.StatusOK,
+			expectedEntities: []string{},
+		},
+		{
+			name:           "missing trust_mark_type",
+			method:         http.MethodGet,
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  InvalidRequest,
+		},
+		{
+			name:           "unknown trust_mark_type",
+			method:         http.MethodGet,
+			params:         url.Values{"trust_mark_type": {"https://trustmarks.org/unknown"}},
+			expectedStatus: http.StatusNotFound,
+			expectedError:  NotFound,
+		},
+		{
+			name:           "wrong method",
+			method:         http.MethodPost,
+			params:         url.Values{"trust_mark_type": {"https://trustmarks.org/listed"}},
+			expectedStatus: http.StatusMethodNotAllowed,
+			expectedError:  InvalidRequest,
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				req := httptest.NewRequest(test.method, "/trustmarked?"+test.params.Encode(), nil)
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+				if rec.Code != test.expectedStatus {
+					t.Fatalf("expected status %d, but got %d", test.expectedStatus, rec.Code)
+				}
+				if test.expectedError != "" {
+					var errRes Error
+					if err := json.Unmarshal(rec.Body.Bytes(), &errRes); err != nil {
+						t.Fatal(err)
+					}
+					if errRes.Error != test.expectedError {
+						t.Errorf("expected error '%s', but got '%s'", test.expectedError, errRes.Error)
+					}
+					return
+				}
+				var entities []string
+				if err := json.Unmarshal(rec.Body.Bytes(), &entities); err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(entities, test.expectedEntities) {
+					t.Errorf("expected %v, but got %v", test.expectedEntities, entities)
+				}
+			},
+		)
+	}
+}
+
+func TestFetchTrustMarkedEntities(t *testing.T) {
+	ta := TrustAnchor{EntityID: taStatus.EntityID, JWKS: taStatus.data.JWKS}
+	tests := []struct {
+		name             string
+		trustMarkType    string
+		sub              string
+		ta               TrustAnchor
+		expectedEntities []string
+		expectErr        bool
+	}{
+		{
+			name:             "all subjects",
+			trustMarkType:    "https://trustmarks.org/listed",
+			ta:               ta,
+			expectedEntities: []string{"https://a.example.org", "https://b.example.org"},
+		},
+		{
+			name:             "filtered by sub",
+			trustMarkType:    "https://trustmarks.org/listed",
+			sub:              "https://b.example.org",
+			ta:               ta,
+			expectedEntities: []string{"https://b.example.org"},
+		},
+		{
+			name:          "unknown trust mark type",
+			trustMarkType: "https://trustmarks.org/unknown",
+			ta:            ta,
+			expectErr:     true,
+		},
+		{
+			name:          "issuer not in federation of trust anchor",
+			trustMarkType: "https://trustmarks.org/listed",
+			ta:            TrustAnchor{EntityID: taExplicit.EntityID, JWKS: taExplicit.data.JWKS},
+			expectErr:     true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				entities, err := FetchTrustMarkedEntities(tmiList.EntityID, test.trustMarkType, test.sub, test.ta)
+				if err != nil {
+					if !test.expectErr {
+						t.Fatal(err)
+					}
+					return
+				}
+				if test.expectErr {
+					t.Fatalf("expected error, but got %v", entities)
+				}
+				if !reflect.DeepEqual(entities, test.expectedEntities) {
+					t.Errorf("expected %v, but got %v", test.expectedEntities, entities)
+				}
+			},
+		)
+	}
+}
@@ -1,7 +1,9 @@
 package oidfed
 
 import (
+	"math/rand/v2"
 	"net/url"
+	"sync"
 	"time"
 
 	"github.com/lestrrat-go/jwx/v3/jwt"
@@ -28,6 +30,12 @@ type EntityConfigurationTrustMarkConfig struct {
 	sub                  string
 	ownTrustMarkEndpoint string
 	ownTrustMarkIssuer   *TrustMarkIssuer
+	// refreshers is the number of running TrustMarkRefreshers refreshing
+	// this trust mark
+	refreshers int
+	// mutex guards JWT, expiration, lastTried, and refreshers after Verify
+	// was called
+	mutex sync.RWMutex
 }
 
 // Verify verifies that the EntityConfigurationTrustMarkConfig is correct and also extracts trust mark id and issuer
@@ -79,41 +87,82 @@ func (c *EntityConfigurationTrustMarkConfig) Verify(
 }
 
 // TrustMarkJWT returns a trust mark jwt for the linked trust mark,
-// if needed the trust mark is refreshed using the trust mark issuer's trust mark endpoint
+// if needed the trust mark is refreshed using the trust mark issuer's trust mark endpoint.
+// Within the RefreshGracePeriod the trust mark is refreshed in the background,
+// unless a TrustMarkRefresher is running for it.
 func (c *EntityConfigurationTrustMarkConfig) TrustMarkJWT() (string, error) {
 	if !c.Refresh {
 		return c.JWT, nil
 	}
-	if c.JWT != "" && unixtime.Until(c.expiration) > c.MinLifetime.Duration {
-		if unixtime.Until(c.expiration) < c.RefreshGracePeriod.Duration {
-			go c.refresh()
+	c.mutex.RLock()
+	jwt, expiration, managed := c.JWT, c.expiration, c.refreshers > 0
+	c.mutex.RUnlock()
+	if jwt != "" && unixtime.Until(expiration) > c.MinLifetime.Duration {
+		if !managed && unixtime.Until(expiration) < c.RefreshGracePeriod.Duration {
+			go func() {
+				if err := c.refresh(); err != nil {
+					internal.Log(err.Error())
+				}
+			}()
 		}
-		return c.JWT, nil
+		return jwt, nil
 	}
 	err := c.refresh()
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
 	return c.JWT, err
 }
 
-// refresh refreshes the trust mark at the trust mark issuer's trust mark endpoint
+// refresh refreshes the trust mark at the trust mark issuer's trust mark
+// endpoint, but at most once a minute
 func (c *EntityConfigurationTrustMarkConfig) refresh() error {
+	c.mutex.Lock()
 	if time.Since(c.lastTried.Time) < time.Minute {
+		c.mutex.Unlock()
 		// Only try once a minute to obtain a new trust mark
 		return errors.New("only trying to refresh trust mark once a minute")
 	}
 	c.lastTried = unixtime.Now()
+	c.mutex.Unlock()
+	return c.update()
+}
+
+// refreshNow refreshes the trust mark without limiting how often this is
+// tried
+func (c *EntityConfigurationTrustMarkConfig) refreshNow() error {
+	c.mutex.Lock()
+	c.lastTried = unixtime.Now()
+	c.mutex.Unlock()
+	return c.update()
+}
+
+// update obtains a new trust mark and stores it; the trust mark is obtained
+// without holding the lock
+func (c *EntityConfigurationTrustMarkConfig) update() error {
+	jwt, expiration, err := c.obtainTrustMark()
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.JWT = jwt
+	c.expiration = expiration
+	return nil
+}
+
+// obtainTrustMark obtains a new trust mark jwt and returns it together with
+// its expiration
+func (c *EntityConfigurationTrustMarkConfig) obtainTrustMark() (string, unixtime.Unixtime, error) {
 	if c.SelfIssued {
 		tmi, err := c.ownTrustMarkIssuer.IssueTrustMark(c.TrustMarkType, c.sub)
 		if err != nil {
-			return err
+			return "", unixtime.Unixtime{}, err
 		}
-		c.JWT = tmi.TrustMarkJWT
-		exp := tmi.trustmark.ExpiresAt
-		if exp != nil {
-			c.expiration = *exp
-		} else {
-			c.expiration = unixtime.Unixtime{}
+		var expiration unixtime.Unixtime
+		if exp := tmi.trustmark.ExpiresAt; exp != nil {
+			expiration = *exp
 		}
-		return nil
+		return tmi.TrustMarkJWT, expiration, nil
 	}
 
 	var endpoint string
@@ -122,11 +171,11 @@ func (c *EntityConfigurationTrustMarkConfig) refresh() error {
 	} else {
 		tmi, err := GetEntityConfiguration(c.TrustMarkIssuer)
 		if err != nil {
-			return err
+			return "", unixtime.Unixtime{}, err
 		}
 		if tmi.Metadata == nil || tmi.Metadata.FederationEntity == nil || tmi.Metadata.
 			FederationEntity.FederationTrustMarkEndpoint == "" {
-			return errors.New("could not obtain trust mark endpoint of trust mark issuer")
+			return "", unixtime.Unixtime{}, errors.New("could not obtain trust mark endpoint of trust mark issuer")
 		}
 		endpoint = tmi.Metadata.FederationEntity.FederationTrustMarkEndpoint
 	}
@@ -135,20 +184,177 @@ func (c *EntityConfigurationTrustMarkConfig) refresh() error {
 	params.Add("sub", c.sub)
 	res, errRes, err := http.Get(endpoint, params, nil)
 	if err != nil {
-		return err
+		return "", unixtime.Unixtime{}, err
 	}
 	if errRes != nil {
-		return errRes.Err()
+		return "", unixtime.Unixtime{}, errRes.Err()
 	}
 	tm, err := ParseTrustMark(res.Body())
 	if err != nil {
-		return err
+		return "", unixtime.Unixtime{}, err
 	}
-	c.JWT = string(tm.jwtMsg.RawJWT)
+	var expiration unixtime.Unixtime
 	if tm.ExpiresAt != nil {
-		c.expiration = *tm.ExpiresAt
-	} else {
-		c.expiration = unixtime.Unixtime{}
+		expiration = *tm.ExpiresAt
 	}
-	return nil
+	return string(tm.jwtMsg.RawJWT), expiration, nil
+}
+
+// setRefresherRunning records that a TrustMarkRefresher started or stopped
+// refreshing the trust mark
+func (c *EntityConfigurationTrustMarkConfig) setRefresherRunning(running bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if running {
+		c.refreshers++
+	} else if c.refreshers > 0 {
+		c.refreshers--
+	}
+}
+
+// nextRefresh returns the time until the trust mark should be refreshed and
+// false if it does not need to be refreshed at all
+func (c *EntityConfigurationTrustMarkConfig) nextRefresh() (time.Duration, bool) {
+	if !c.Refresh {
+		return 0, false
+	}
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.JWT == "" {
+		return 0, true
+	}
+	if c.expiration.IsZero() {
+		return 0, false
+	}
+	remaining := unixtime.Until(c.expiration)
+	// refresh within the grace period, but not more often than every half
+	// lifetime, so short-lived trust marks do not cause a refresh loop
+	return max(remaining-c.RefreshGracePeriod.Duration, remaining/2, 0), true
+}
+
+// Default backoff durations of a TrustMarkRefresher
+const (
+	DefaultTrustMarkRefreshMinBackoff = time.Minute
+	DefaultTrustMarkRefreshMaxBackoff = time.Hour
+)
+
+// TrustMarkRefreshFailureHandler is called when a TrustMarkRefresher fails
+// to refresh a trust mark
+type TrustMarkRefreshFailureHandler func(trustMarkType, trustMarkIssuer string, err error)
+
+// TrustMarkRefresher refreshes trust marks in the background ahead of their
+// expiration. Failed refreshes are retried with a jittered exponential
+// backoff between MinBackoff and MaxBackoff.
+type TrustMarkRefresher struct {
+	TrustMarks []*EntityConfigurationTrustMarkConfig
+	// OnFailure is optionally called when refreshing a trust mark fails
+	OnFailure  TrustMarkRefreshFailureHandler
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	mutex sync.Mutex
+	stop  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// NewTrustMarkRefresher creates a new TrustMarkRefresher for the passed
+// trust mark configs with the default backoff durations
+func NewTrustMarkRefresher(
+	trustMarks []*EntityConfigurationTrustMarkConfig, onFailure TrustMarkRefreshFailureHandler,
+) *TrustMarkRefresher {
+	return &TrustMarkRefresher{
+		TrustMarks: trustMarks,
+		OnFailure:  onFailure,
+		MinBackoff: DefaultTrustMarkRefreshMinBackoff,
+		MaxBackoff: DefaultTrustMarkRefreshMaxBackoff,
+	}
+}
+
+// Start starts refreshing the trust marks in the background; starting an
+// already started TrustMarkRefresher has no effect
+func (r *TrustMarkRefresher) Start() {
+	r.StartWithFailureHandler(r.OnFailure)
+}
+
+// StartWithFailureHandler sets the OnFailure handler and starts the
+// TrustMarkRefresher; if it is already started, this has no effect
+func (r *TrustMarkRefresher) StartWithFailureHandler(onFailure TrustMarkRefreshFailureHandler) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.stop != nil {
+		return
+	}
+	r.OnFailure = onFailure
+	r.stop = make(chan struct{})
+	for _, c := range r.TrustMarks {
+		r.wg.Add(1)
+		go r.run(c, r.stop)
+	}
+}
+
+// Stop stops the TrustMarkRefresher and waits until all running refreshes
+// are finished
+func (r *TrustMarkRefresher) Stop() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.stop == nil {
+		return
+	}
+	close(r.stop)
+	r.wg.Wait()
+	r.stop = nil
+}
+
+func (r *TrustMarkRefresher) run(c *EntityConfigurationTrustMarkConfig, stop <-chan struct{}) {
+	defer r.wg.Done()
+	c.setRefresherRunning(true)
+	defer c.setRefresherRunning(false)
+	backoff := r.MinBackoff
+	// minWait is the minimum time between two refreshes; it prevents a
+	// refresh loop if a freshly obtained trust mark is already (about to be)
+	// expired
+	var minWait time.Duration
+	for {
+		wait, ok := c.nextRefresh()
+		if !ok {
+			return
+		}
+		if !sleep(max(wait, minWait), stop) {
+			return
+		}
+		err := c.refreshNow()
+		if err == nil {
+			backoff = r.MinBackoff
+			minWait = r.MinBackoff
+			continue
+		}
+		if r.OnFailure != nil {
+			r.OnFailure(c.TrustMarkType, c.TrustMarkIssuer, err)
+		}
+		if !sleep(jitter(backoff), stop) {
+			return
+		}
+		backoff = min(2*backoff, r.MaxBackoff)
+	}
+}
+
+// sleep waits for the passed duration and returns false if stop was closed
+// in the meantime
+func sleep(d time.Duration, stop <-chan struct{}) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-stop:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// jitter returns a random duration between d/2 and d
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	return d/2 + rand.N(d/2)
 }
@@ -0,0 +1,240 @@
+package oidfed
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v3/jwa"
+
+	"github.com/go-oidfed/lib/unixtime"
+)
+
+func newRefresherTestEntity(t *testing.T, configs ...*EntityConfigurationTrustMarkConfig) *FederationEntity {
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entityID := "https://entitled.example.org"
+	for _, c := range configs {
+		if err = c.Verify(entityID, "", NewTrustMarkSigner(sk, jwa.ES256())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entity, err := NewFederationEntity(entityID, nil, nil, NewEntityStatementSigner(sk, jwa.ES256()), 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entity.TrustMarks = configs
+	return entity
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTrustMarkRefresher(t *testing.T) {
+	fromIssuer := &EntityConfigurationTrustMarkConfig{
+		TrustMarkType:   "https://trustmarks.org/entitled",
+		TrustMarkIssuer: tmiEntitled.EntityID,
+	}
+	selfIssued := &EntityConfigurationTrustMarkConfig{
+		TrustMarkType: "https://trustmarks.org/self-issued",
+		SelfIssued:    true,
+		SelfIssuanceSpec: TrustMarkSpec{
+			Lifetime: unixtime.DurationInSeconds{Duration: time.Hour},
+		},
+	}
+	failing := &EntityConfigurationTrustMarkConfig{
+		TrustMarkType:   "https://trustmarks.org/entitled",
+		TrustMarkIssuer: "https://unknown-tmi.example.org",
+	}
+	entity := newRefresherTestEntity(t, fromIssuer, selfIssued, failing)
+
+	var failures atomic.Int32
+	refresher := entity.TrustMarkRefresher()
+	refresher.MinBackoff = 10 * time.Millisecond
+	refresher.MaxBackoff = 20 * time.Millisecond
+	entity.StartTrustMarkRefresher(
+		func(trustMarkType, trustMarkIssuer string, err error) {
+			if trustMarkIssuer != failing.TrustMarkIssuer {
+				t.Errorf("unexpected failure for '%s' from '%s': %v", trustMarkType, trustMarkIssuer, err)
+			}
+			failures.Add(1)
+		},
+	)
+	// starting twice must not start additional refreshes
+	entity.StartTrustMarkRefresher(nil)
+
+	hasJWT := func(c *EntityConfigurationTrustMarkConfig) func() bool {
+		return func() bool {
+			c.mutex.RLock()
+			defer c.mutex.RUnlock()
+			return c.JWT != ""
+		}
+	}
+	waitFor(t, hasJWT(fromIssuer))
+	waitFor(t, hasJWT(selfIssued))
+	waitFor(t, func() bool { return failures.Load() >= 3 })
+	entity.StopTrustMarkRefresher()
+
+	n := failures.Load()
+	time.Sleep(50 * time.Millisecond)
+	if failures.Load() != n {
+		t.Error("trust marks are still refreshed after the refresher was stopped")
+	}
+
+	tms := entity.EntityConfigurationPayload().TrustMarks
+	if len(tms) != 2 {
+		t.Fatalf("expected 2 trust marks in entity configuration, but got %d", len(tms))
+	}
+	for _, tm := range tms {
+		mark, err := tm.TrustMark()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mark.Subject != entity.EntityID {
+			t.Errorf("unexpected trust mark subject '%s'", mark.Subject)
+		}
+	}
+}
+
+func TestEntityConfigurationTrustMarkConfig_ConcurrentRefresh(t *testing.T) {
+	c := &EntityConfigurationTrustMarkConfig{
+		TrustMarkType: "https://trustmarks.org/self-issued",
+		SelfIssued:    true,
+		SelfIssuanceSpec: TrustMarkSpec{
+			Lifetime: unixtime.DurationInSeconds{Duration: time.Hour},
+		},
+		// always within the grace period, so every call triggers a refresh
+		RefreshGracePeriod: unixtime.DurationInSeconds{Duration: 2 * time.Hour},
+	}
+	entity := newRefresherTestEntity(t, c)
+	refresher := entity.TrustMarkRefresher()
+	refresher.MinBackoff = time.Millisecond
+	refresher.MaxBackoff = time.Millisecond
+	entity.StartTrustMarkRefresher(nil)
+	defer entity.StopTrustMarkRefresher()
+	waitFor(
+		t, func() bool {
+			c.mutex.RLock()
+			defer c.mutex.RUnlock()
+			return c.JWT != ""
+		},
+	)
+
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 10 {
+				if _, err := c.TrustMarkJWT(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestTrustMarkRefresher_MinBackoffAfterRefresh(t *testing.T) {
+	var issued atomic.Int32
+	c := &EntityConfigurationTrustMarkConfig{
+		TrustMarkType: "https://trustmarks.org/self-issued",
+		SelfIssued:    true,
+		SelfIssuanceSpec: TrustMarkSpec{
+			// the trust mark is already expired when it is obtained
+			Lifetime: unixtime.DurationInSeconds{Duration: time.Millisecond},
+			ClaimsProvider: TrustMarkClaimsProviderFunc(
+				func(_, _ string) (map[string]any, error) {
+					issued.Add(1)
+					return nil, nil
+				},
+			),
+		},
+	}
+	entity := newRefresherTestEntity(t, c)
+	refresher := entity.TrustMarkRefresher()
+	refresher.MinBackoff = 50 * time.Millisecond
+	refresher.MaxBackoff = 50 * time.Millisecond
+	entity.StartTrustMarkRefresher(nil)
+	time.Sleep(200 * time.Millisecond)
+	entity.StopTrustMarkRefresher()
+	if n := issued.Load(); n == 0 || n > 6 {
+		t.Errorf("expected expired trust mark to be refreshed at most every MinBackoff, but it was refreshed %d times", n)
+	}
+}
+
+func TestEntityConfigurationTrustMarkConfig_NoLazyRefreshWithRefresher(t *testing.T) {
+	var issued atomic.Int32
+	c := &EntityConfigurationTrustMarkConfig{
+		TrustMarkType: "https://trustmarks.org/self-issued",
+		SelfIssued:    true,
+		SelfIssuanceSpec: TrustMarkSpec{
+			Lifetime: unixtime.DurationInSeconds{Duration: time.Hour},
+			ClaimsProvider: TrustMarkClaimsProviderFunc(
+				func(_, _ string) (map[string]any, error) {
+					issued.Add(1)
+					return nil, nil
+				},
+			),
+		},
+		// always within the grace period
+		RefreshGracePeriod: unixtime.DurationInSeconds{Duration: 2 * time.Hour},
+	}
+	entity := newRefresherTestEntity(t, c)
+	entity.StartTrustMarkRefresher(nil)
+	waitFor(t, func() bool { return issued.Load() > 0 })
+
+	lazyRefresh := func() {
+		t.Helper()
+		c.mutex.Lock()
+		c.lastTried = unixtime.Unixtime{}
+		c.mutex.Unlock()
+		if _, err := c.TrustMarkJWT(); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	lazyRefresh()
+	if n := issued.Load(); n != 1 {
+		t.Errorf("expected no lazy refresh while the refresher is running, but trust mark was issued %d times", n)
+	}
+	entity.StopTrustMarkRefresher()
+	lazyRefresh()
+	if n := issued.Load(); n != 2 {
+		t.Errorf("expected lazy refresh after the refresher was stopped, but trust mark was issued %d times", n)
+	}
+}
+
+func TestFederationEntity_TrustMarkRefresher_Concurrent(t *testing.T) {
+	entity := newRefresherTestEntity(t)
+	refreshers := make([]*TrustMarkRefresher, 20)
+	var wg sync.WaitGroup
+	for i := range refreshers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			refreshers[i] = entity.TrustMarkRefresher()
+		}()
+	}
+	wg.Wait()
+	for _, r := range refreshers {
+		if r == nil || r != refreshers[0] {
+			t.Fatal("expected all calls to return the same TrustMarkRefresher")
+		}
+	}
+}
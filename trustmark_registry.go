@@ -0,0 +1,462 @@
+package oidfed
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/go-oidfed/lib/unixtime"
+)
+
+// IssuedTrustMark is a record of a trust mark that was issued by a
+// TrustMarkIssuer
+type IssuedTrustMark struct {
+	JTI              string             `json:"jti" msgpack:"jti"`
+	TrustMarkType    string             `json:"trust_mark_type" msgpack:"trust_mark_type"`
+	Subject          string             `json:"sub" msgpack:"sub"`
+	IssuedAt         unixtime.Unixtime  `json:"iat" msgpack:"iat"`
+	ExpiresAt        *unixtime.Unixtime `json:"exp,omitempty" msgpack:"exp,omitempty"`
+	Revoked          bool               `json:"revoked,omitempty" msgpack:"revoked,omitempty"`
+	RevokedAt        *unixtime.Unixtime `json:"revoked_at,omitempty" msgpack:"revoked_at,omitempty"`
+	RevocationReason string             `json:"revocation_reason,omitempty" msgpack:"revocation_reason,omitempty"`
+	// TrustMarkJWT is the issued trust mark jwt; it is used to hand out the
+	// same trust mark again instead of issuing a new one
+	TrustMarkJWT string `json:"trust_mark,omitempty" msgpack:"trust_mark,omitempty"`
+}
+
+// Expired checks if the IssuedTrustMark is expired
+func (tm IssuedTrustMark) Expired() bool {
+	return tm.ExpiresAt != nil && !tm.ExpiresAt.IsZero() && tm.ExpiresAt.Before(time.Now())
+}
+
+// Active checks if the IssuedTrustMark is neither expired nor revoked
+func (tm IssuedTrustMark) Active() bool {
+	return !tm.Revoked && !tm.Expired()
+}
+
+// Events recorded in the audit log of an IssuedTrustMarkStore
+const (
+	// TrustMarkEventIssued is recorded when a trust mark is issued to a
+	// subject that does not hold an active trust mark of this type
+	TrustMarkEventIssued = "issued"
+	// TrustMarkEventRefreshed is recorded when a trust mark is issued to a
+	// subject that already holds an active trust mark of this type
+	TrustMarkEventRefreshed = "refreshed"
+	// TrustMarkEventRevoked is recorded when a trust mark is revoked
+	TrustMarkEventRevoked = "revoked"
+)
+
+// TrustMarkAuditEvent is an entry in the audit log of an
+// IssuedTrustMarkStore
+type TrustMarkAuditEvent struct {
+	Event         string             `json:"event"`
+	Time          unixtime.Unixtime  `json:"time"`
+	JTI           string             `json:"jti"`
+	TrustMarkType string             `json:"trust_mark_type"`
+	Subject       string             `json:"sub"`
+	IssuedAt      *unixtime.Unixtime `json:"iat,omitempty"`
+	ExpiresAt     *unixtime.Unixtime `json:"exp,omitempty"`
+	Reason        string             `json:"reason,omitempty"`
+	TrustMarkJWT  string             `json:"trust_mark,omitempty"`
+}
+
+// IssuedTrustMarkStore is a registry of the trust marks issued by a
+// TrustMarkIssuer; it keeps an append-only audit log of issuance, refresh,
+// and revocation events
+type IssuedTrustMarkStore interface {
+	// StoreIssuedTrustMark records an issued trust mark
+	StoreIssuedTrustMark(tm IssuedTrustMark) error
+	// IssuedTrustMarks returns the active IssuedTrustMarks of the passed
+	// trust mark type; if sub is not empty, only the trust marks of this
+	// subject are returned
+	IssuedTrustMarks(trustMarkType, sub string) ([]IssuedTrustMark, error)
+	// IssuedTrustMark returns the IssuedTrustMark with the passed jti
+	// regardless of its state; if there is no such trust mark, nil is
+	// returned; expired trust marks might have been pruned from the store
+	IssuedTrustMark(jti string) (*IssuedTrustMark, error)
+	// RevokeTrustMarks revokes all active trust marks of the passed trust
+	// mark type of the passed subject and returns them
+	RevokeTrustMarks(trustMarkType, sub, reason string) ([]IssuedTrustMark, error)
+	// AuditLog returns the recorded events in chronological order; if
+	// trustMarkType or sub are not empty, the events are filtered
+	// accordingly
+	AuditLog(trustMarkType, sub string) ([]TrustMarkAuditEvent, error)
+}
+
+// issuedJWT is an issued jwt that might be handed out again
+type issuedJWT struct {
+	jwt       string
+	issuedAt  unixtime.Unixtime
+	expiresAt *unixtime.Unixtime
+}
+
+// reusableJWT returns the most recently issued of the passed jwts that can be
+// handed out again instead of issuing a new one; only jwts that are valid for
+// at least half of their lifetime and at least minRemaining and that do not
+// expire after notAfter are considered; if there is no such jwt, nil is
+// returned
+func reusableJWT(issued []issuedJWT, notAfter *unixtime.Unixtime, minRemaining time.Duration) []byte {
+	now := time.Now()
+	var reusable *issuedJWT
+	for i, j := range issued {
+		if j.jwt == "" {
+			continue
+		}
+		if j.expiresAt != nil && !j.expiresAt.IsZero() {
+			if notAfter != nil && !notAfter.IsZero() && j.expiresAt.After(notAfter.Time) {
+				continue
+			}
+			remaining := j.expiresAt.Sub(now)
+			if remaining < minRemaining || 2*remaining < j.expiresAt.Sub(j.issuedAt.Time) {
+				continue
+			}
+		} else if notAfter != nil && !notAfter.IsZero() {
+			continue
+		}
+		if reusable == nil || j.issuedAt.After(reusable.issuedAt.Time) {
+			reusable = &issued[i]
+		}
+	}
+	if reusable == nil {
+		return nil
+	}
+	return []byte(reusable.jwt)
+}
+
+// reusableIssuedTrustMark returns the jwt of an active IssuedTrustMark of the
+// passed type and subject from the passed store, so it can be handed out
+// again instead of issuing a new one (see reusableJWT); if there is no such
+// trust mark, nil is returned
+func reusableIssuedTrustMark(
+	store IssuedTrustMarkStore, trustMarkType, sub string, notAfter *unixtime.Unixtime, minRemaining time.Duration,
+) ([]byte, error) {
+	issued, err := store.IssuedTrustMarks(trustMarkType, sub)
+	if err != nil {
+		return nil, err
+	}
+	jwts := make([]issuedJWT, len(issued))
+	for i, tm := range issued {
+		jwts[i] = issuedJWT{
+			jwt:       tm.TrustMarkJWT,
+			issuedAt:  tm.IssuedAt,
+			expiresAt: tm.ExpiresAt,
+		}
+	}
+	return reusableJWT(jwts, notAfter, minRemaining), nil
+}
+
+// DefaultIssuedTrustMarkAuditLogSize is the default number of audit log
+// events an InMemoryIssuedTrustMarkStore keeps
+const DefaultIssuedTrustMarkAuditLogSize = 1000
+
+// DefaultIssuedTrustMarkRetention is the default time an
+// InMemoryIssuedTrustMarkStore keeps trust marks without an expiration
+const DefaultIssuedTrustMarkRetention = 365 * 24 * time.Hour
+
+// InMemoryIssuedTrustMarkStore is an IssuedTrustMarkStore that keeps the
+// IssuedTrustMarks and the audit log in memory. Expired trust marks are
+// pruned from the store; the audit log only keeps the latest events.
+type InMemoryIssuedTrustMarkStore struct {
+	// AuditLogSize is the maximum number of audit log events that are kept;
+	// older events are dropped
+	AuditLogSize int
+	// Retention is the time after their issuance after which trust marks
+	// without an expiration are pruned from the store; if 0, they are kept
+	// forever
+	Retention time.Duration
+
+	mutex      sync.RWMutex
+	trustMarks map[string]*IssuedTrustMark
+	log        []TrustMarkAuditEvent
+	// persist is called with new events before they are applied
+	persist func(events []TrustMarkAuditEvent) error
+}
+
+// NewInMemoryIssuedTrustMarkStore creates a new InMemoryIssuedTrustMarkStore
+// with the DefaultIssuedTrustMarkAuditLogSize and the
+// DefaultIssuedTrustMarkRetention
+func NewInMemoryIssuedTrustMarkStore() *InMemoryIssuedTrustMarkStore {
+	return &InMemoryIssuedTrustMarkStore{
+		AuditLogSize: DefaultIssuedTrustMarkAuditLogSize,
+		Retention:    DefaultIssuedTrustMarkRetention,
+		trustMarks:   make(map[string]*IssuedTrustMark),
+	}
+}
+
+// apply applies an event to the state of the store; the caller must hold
+// the lock
+func (s *InMemoryIssuedTrustMarkStore) apply(e TrustMarkAuditEvent) {
+	if s.AuditLogSize > 0 {
+		s.log = append(s.log, e)
+		if len(s.log) > s.AuditLogSize {
+			s.log = slices.Delete(s.log, 0, len(s.log)-s.AuditLogSize)
+		}
+	}
+	switch e.Event {
+	case TrustMarkEventIssued, TrustMarkEventRefreshed:
+		tm := &IssuedTrustMark{
+			JTI:           e.JTI,
+			TrustMarkType: e.TrustMarkType,
+			Subject:       e.Subject,
+			ExpiresAt:     e.ExpiresAt,
+			TrustMarkJWT:  e.TrustMarkJWT,
+		}
+		if e.IssuedAt != nil {
+			tm.IssuedAt = *e.IssuedAt
+		}
+		s.trustMarks[e.JTI] = tm
+	case TrustMarkEventRevoked:
+		if tm, ok := s.trustMarks[e.JTI]; ok {
+			revokedAt := e.Time
+			tm.Revoked = true
+			tm.RevokedAt = &revokedAt
+			tm.RevocationReason = e.Reason
+		}
+	}
+}
+
+// record persists and applies events; the caller must hold the lock
+func (s *InMemoryIssuedTrustMarkStore) record(events ...TrustMarkAuditEvent) error {
+	if s.persist != nil {
+		if err := s.persist(events); err != nil {
+			return err
+		}
+	}
+	for _, e := range events {
+		s.apply(e)
+	}
+	return nil
+}
+
+// prune removes expired trust marks and trust marks without an expiration
+// that are older than the Retention from the store; the audit log is not
+// changed; the caller must hold the lock
+func (s *InMemoryIssuedTrustMarkStore) prune() {
+	now := time.Now()
+	for jti, tm := range s.trustMarks {
+		if tm.Expired() {
+			delete(s.trustMarks, jti)
+			continue
+		}
+		if s.Retention > 0 && (tm.ExpiresAt == nil || tm.ExpiresAt.IsZero()) &&
+			tm.IssuedAt.Add(s.Retention).Before(now) {
+			delete(s.trustMarks, jti)
+		}
+	}
+}
+
+// activeTrustMarks returns the active trust marks of the passed type and
+// subject; the caller must hold the lock
+func (s *InMemoryIssuedTrustMarkStore) activeTrustMarks(trustMarkType, sub string) (active []IssuedTrustMark) {
+	for _, tm := range s.trustMarks {
+		if tm.TrustMarkType == trustMarkType && (sub == "" || tm.Subject == sub) && tm.Active() {
+			active = append(active, *tm)
+		}
+	}
+	return
+}
+
+// StoreIssuedTrustMark implements the IssuedTrustMarkStore interface
+func (s *InMemoryIssuedTrustMarkStore) StoreIssuedTrustMark(tm IssuedTrustMark) error {
+	if tm.JTI == "" {
+		return errors.New("issued trust mark has no jti")
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.prune()
+	if _, ok := s.trustMarks[tm.JTI]; ok {
+		return errors.Errorf("trust mark with jti '%s' already recorded", tm.JTI)
+	}
+	event := TrustMarkEventIssued
+	if len(s.activeTrustMarks(tm.TrustMarkType, tm.Subject)) > 0 {
+		event = TrustMarkEventRefreshed
+	}
+	iat := tm.IssuedAt
+	return s.record(
+		TrustMarkAuditEvent{
+			Event:         event,
+			Time:          unixtime.Now(),
+			JTI:           tm.JTI,
+			TrustMarkType: tm.TrustMarkType,
+			Subject:       tm.Subject,
+			IssuedAt:      &iat,
+			ExpiresAt:     tm.ExpiresAt,
+			TrustMarkJWT:  tm.TrustMarkJWT,
+		},
+	)
+}
+
+// IssuedTrustMarks implements the IssuedTrustMarkStore interface
+func (s *InMemoryIssuedTrustMarkStore) IssuedTrustMarks(trustMarkType, sub string) ([]IssuedTrustMark, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.activeTrustMarks(trustMarkType, sub), nil
+}
+
+// IssuedTrustMark implements the IssuedTrustMarkStore interface
+func (s *InMemoryIssuedTrustMarkStore) IssuedTrustMark(jti string) (*IssuedTrustMark, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	tm, ok := s.trustMarks[jti]
+	if !ok {
+		return nil, nil
+	}
+	c := *tm
+	return &c, nil
+}
+
+// RevokeTrustMarks implements the IssuedTrustMarkStore interface
+func (s *InMemoryIssuedTrustMarkStore) RevokeTrustMarks(trustMarkType, sub, reason string) (
+	[]IssuedTrustMark, error,
+) {
+	if sub == "" {
+		return nil, errors.New("sub must be given to revoke trust marks")
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	active := s.activeTrustMarks(trustMarkType, sub)
+	if len(active) == 0 {
+		return nil, nil
+	}
+	now := unixtime.Now()
+	events := make([]TrustMarkAuditEvent, len(active))
+	for i, tm := range active {
+		events[i] = TrustMarkAuditEvent{
+			Event:         TrustMarkEventRevoked,
+			Time:          now,
+			JTI:           tm.JTI,
+			TrustMarkType: tm.TrustMarkType,
+			Subject:       tm.Subject,
+			Reason:        reason,
+		}
+	}
+	if err := s.record(events...); err != nil {
+		return nil, err
+	}
+	revoked := make([]IssuedTrustMark, len(active))
+	for i, tm := range active {
+		revoked[i] = *s.trustMarks[tm.JTI]
+	}
+	return revoked, nil
+}
+
+// AuditLog implements the IssuedTrustMarkStore interface; only the latest
+// AuditLogSize events are returned
+func (s *InMemoryIssuedTrustMarkStore) AuditLog(trustMarkType, sub string) ([]TrustMarkAuditEvent, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var events []TrustMarkAuditEvent
+	for _, e := range s.log {
+		if (trustMarkType == "" || e.TrustMarkType == trustMarkType) && (sub == "" || e.Subject == sub) {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+// FileIssuedTrustMarkStore is an IssuedTrustMarkStore that persists its
+// audit log as a file with one json encoded TrustMarkAuditEvent per line;
+// the file is only appended to and the IssuedTrustMarks are restored from
+// it when the store is created. The audit log is only kept in the file and
+// not in memory.
+type FileIssuedTrustMarkStore struct {
+	*InMemoryIssuedTrustMarkStore
+	path string
+}
+
+// NewFileIssuedTrustMarkStore creates a new FileIssuedTrustMarkStore that
+// uses the audit log file at the passed path; if the file exists, the
+// recorded events are loaded from it. Trust marks without an expiration are
+// kept for the DefaultIssuedTrustMarkRetention.
+func NewFileIssuedTrustMarkStore(path string) (*FileIssuedTrustMarkStore, error) {
+	s := &FileIssuedTrustMarkStore{
+		InMemoryIssuedTrustMarkStore: NewInMemoryIssuedTrustMarkStore(),
+		path:                         path,
+	}
+	s.AuditLogSize = 0
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	s.persist = s.append
+	return s, nil
+}
+
+// readLog calls the passed function for each event in the audit log file
+func (s *FileIssuedTrustMarkStore) readLog(callback func(e TrustMarkAuditEvent)) error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrap(err, "could not open trust mark audit log")
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e TrustMarkAuditEvent
+		if err = json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return errors.Wrapf(err, "could not parse trust mark audit log line %d", line)
+		}
+		callback(e)
+	}
+	return errors.Wrap(scanner.Err(), "could not read trust mark audit log")
+}
+
+func (s *FileIssuedTrustMarkStore) load() error {
+	if err := s.readLog(s.apply); err != nil {
+		return err
+	}
+	s.prune()
+	return nil
+}
+
+// AuditLog implements the IssuedTrustMarkStore interface; the events are
+// read from the audit log file
+func (s *FileIssuedTrustMarkStore) AuditLog(trustMarkType, sub string) ([]TrustMarkAuditEvent, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var events []TrustMarkAuditEvent
+	err := s.readLog(
+		func(e TrustMarkAuditEvent) {
+			if (trustMarkType == "" || e.TrustMarkType == trustMarkType) && (sub == "" || e.Subject == sub) {
+				events = append(events, e)
+			}
+		},
+	)
+	return events, err
+}
+
+func (s *FileIssuedTrustMarkStore) append(events []TrustMarkAuditEvent) error {
+	var data []byte
+	for _, e := range events {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		data = append(append(data, line...), '\n')
+	}
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrap(err, "could not open trust mark audit log")
+	}
+	if _, err = f.Write(data); err != nil {
+		_ = f.Close()
+		return errors.Wrap(err, "could not write trust mark audit log")
+	}
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return errors.Wrap(err, "could not write trust mark audit log")
+	}
+	return errors.Wrap(f.Close(), "could not write trust mark audit log")
+}
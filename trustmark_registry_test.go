@@ -0,0 +1,185 @@
+package oidfed
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-oidfed/lib/unixtime"
+)
+
+func issuedTrustMark(jti, sub string, lifetime time.Duration) IssuedTrustMark {
+	now := time.Now()
+	return IssuedTrustMark{
+		JTI:           jti,
+		TrustMarkType: "https://trustmarks.org/registry",
+		Subject:       sub,
+		IssuedAt:      unixtime.Unixtime{Time: now},
+		ExpiresAt:     &unixtime.Unixtime{Time: now.Add(lifetime)},
+	}
+}
+
+func fillIssuedTrustMarkStore(t *testing.T, store IssuedTrustMarkStore) {
+	for _, tm := range []IssuedTrustMark{
+		issuedTrustMark("1", "https://a.example.org", time.Hour),
+		issuedTrustMark("2", "https://a.example.org", time.Hour),
+		issuedTrustMark("3", "https://b.example.org", time.Hour),
+		issuedTrustMark("4", "https://expired.example.org", -time.Hour),
+	} {
+		if err := store.StoreIssuedTrustMark(tm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.StoreIssuedTrustMark(issuedTrustMark("1", "https://c.example.org", time.Hour)); err == nil {
+		t.Error("expected error for duplicate jti")
+	}
+	revoked, err := store.RevokeTrustMarks("https://trustmarks.org/registry", "https://a.example.org", "misconduct")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revoked) != 2 {
+		t.Fatalf("expected 2 revoked trust marks, but got %d", len(revoked))
+	}
+}
+
+func checkIssuedTrustMarkStore(t *testing.T, store IssuedTrustMarkStore) {
+	active, err := store.IssuedTrustMarks("https://trustmarks.org/registry", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(active) != 1 || active[0].JTI != "3" {
+		t.Errorf("unexpected active trust marks: %+v", active)
+	}
+	tm, err := store.IssuedTrustMark("2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tm == nil || !tm.Revoked || tm.RevokedAt == nil || tm.RevocationReason != "misconduct" {
+		t.Errorf("trust mark not revoked: %+v", tm)
+	}
+	if tm, err = store.IssuedTrustMark("unknown"); err != nil || tm != nil {
+		t.Errorf("expected no trust mark for unknown jti, but got %+v, %v", tm, err)
+	}
+	if tm, err = store.IssuedTrustMark("4"); err != nil || tm != nil {
+		t.Errorf("expected expired trust mark to be pruned, but got %+v, %v", tm, err)
+	}
+
+	events, err := store.AuditLog("", "https://a.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedEvents := []string{
+		TrustMarkEventIssued, TrustMarkEventRefreshed, TrustMarkEventRevoked, TrustMarkEventRevoked,
+	}
+	if len(events) != len(expectedEvents) {
+		t.Fatalf("expected %d events, but got %d: %+v", len(expectedEvents), len(events), events)
+	}
+	for i, e := range events {
+		if e.Event != expectedEvents[i] {
+			t.Errorf("expected event %d to be '%s', but got '%s'", i, expectedEvents[i], e.Event)
+		}
+	}
+	if events[3].Reason != "misconduct" {
+		t.Errorf("revocation reason not logged: %+v", events[3])
+	}
+	all, err := store.AuditLog("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 6 {
+		t.Errorf("expected 6 events, but got %d", len(all))
+	}
+}
+
+func TestInMemoryIssuedTrustMarkStore(t *testing.T) {
+	store := NewInMemoryIssuedTrustMarkStore()
+	fillIssuedTrustMarkStore(t, store)
+	checkIssuedTrustMarkStore(t, store)
+	revoked, err := store.RevokeTrustMarks("https://trustmarks.org/registry", "https://a.example.org", "again")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revoked) != 0 {
+		t.Error("revoked trust marks must not be revoked again")
+	}
+}
+
+func TestFileIssuedTrustMarkStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trustmarks.log")
+	store, err := NewFileIssuedTrustMarkStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillIssuedTrustMarkStore(t, store)
+	checkIssuedTrustMarkStore(t, store)
+	if len(store.log) != 0 {
+		t.Errorf("expected the audit log not to be kept in memory, but got %d events", len(store.log))
+	}
+
+	reloaded, err := NewFileIssuedTrustMarkStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIssuedTrustMarkStore(t, reloaded)
+	if err = reloaded.StoreIssuedTrustMark(issuedTrustMark("5", "https://b.example.org", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	events, err := reloaded.AuditLog("", "https://b.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[1].Event != TrustMarkEventRefreshed {
+		t.Errorf("unexpected events after reload: %+v", events)
+	}
+}
+
+func TestInMemoryIssuedTrustMarkStore_AuditLogSize(t *testing.T) {
+	store := NewInMemoryIssuedTrustMarkStore()
+	store.AuditLogSize = 2
+	for _, jti := range []string{"1", "2", "3"} {
+		if err := store.StoreIssuedTrustMark(issuedTrustMark(jti, "https://a.example.org", time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	events, err := store.AuditLog("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].JTI != "2" || events[1].JTI != "3" {
+		t.Errorf("expected only the latest 2 events, but got %+v", events)
+	}
+	if tm, err := store.IssuedTrustMark("1"); err != nil || tm == nil {
+		t.Errorf("dropping audit log events must not drop trust marks, but got %+v, %v", tm, err)
+	}
+}
+
+func TestInMemoryIssuedTrustMarkStore_Retention(t *testing.T) {
+	store := NewInMemoryIssuedTrustMarkStore()
+	store.Retention = time.Hour
+	withoutExp := func(jti string, issuedAt time.Time) IssuedTrustMark {
+		return IssuedTrustMark{
+			JTI:           jti,
+			TrustMarkType: "https://trustmarks.org/registry",
+			Subject:       "https://a.example.org",
+			IssuedAt:      unixtime.Unixtime{Time: issuedAt},
+		}
+	}
+	for _, tm := range []IssuedTrustMark{
+		withoutExp("old", time.Now().Add(-2*time.Hour)),
+		withoutExp("new", time.Now()),
+	} {
+		if err := store.StoreIssuedTrustMark(tm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// pruning happens when trust marks are stored
+	if err := store.StoreIssuedTrustMark(issuedTrustMark("other", "https://b.example.org", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if tm, err := store.IssuedTrustMark("old"); err != nil || tm != nil {
+		t.Errorf("expected trust mark without expiration to be pruned after retention, but got %+v, %v", tm, err)
+	}
+	if tm, err := store.IssuedTrustMark("new"); err != nil || tm == nil {
+		t.Errorf("expected trust mark without expiration to be kept within retention, but got %+v, %v", tm, err)
+	}
+}
@@ -0,0 +1,249 @@
+package oidfed
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/go-oidfed/lib/cache"
+	"github.com/go-oidfed/lib/internal"
+	"github.com/go-oidfed/lib/internal/http"
+	"github.com/go-oidfed/lib/internal/jwx"
+	"github.com/go-oidfed/lib/oidfedconst"
+	"github.com/go-oidfed/lib/unixtime"
+)
+
+// Trust mark statuses as returned by the trust mark status endpoint
+const (
+	TrustMarkStatusActive  = "active"
+	TrustMarkStatusExpired = "expired"
+	TrustMarkStatusRevoked = "revoked"
+	TrustMarkStatusInvalid = "invalid"
+)
+
+// TrustMarkStatusResponse is the payload of a trust mark status response
+type TrustMarkStatusResponse struct {
+	Issuer    string            `json:"iss"`
+	IssuedAt  unixtime.Unixtime `json:"iat"`
+	TrustMark string            `json:"trust_mark"`
+	Status    string            `json:"status"`
+}
+
+// RevokeTrustMark revokes the active trust marks of the passed type issued
+// to the passed subject; the reason is recorded in the audit log
+func (tmi TrustMarkIssuer) RevokeTrustMark(trustMarkType, sub, reason string) error {
+	if _, ok := tmi.trustMarks[trustMarkType]; !ok {
+		return errors.Errorf("unknown trustmark '%s'", trustMarkType)
+	}
+	if tmi.IssuedTrustMarks == nil {
+		return errors.New("trust mark issuer does not record issued trust marks")
+	}
+	revoked, err := tmi.IssuedTrustMarks.RevokeTrustMarks(trustMarkType, sub, reason)
+	if err != nil {
+		return err
+	}
+	if len(revoked) == 0 {
+		return errors.Errorf("'%s' does not hold an active trustmark '%s'", sub, trustMarkType)
+	}
+	return nil
+}
+
+// TrustMarkStatus returns the status of the passed trust mark jwt; it is
+// TrustMarkStatusInvalid if the trust mark was not issued by this
+// TrustMarkIssuer
+func (tmi TrustMarkIssuer) TrustMarkStatus(trustMarkJWT []byte) (string, error) {
+	tm, err := ParseTrustMark(trustMarkJWT)
+	if err != nil || tm.Issuer != tmi.EntityID || tm.JTI == "" {
+		return TrustMarkStatusInvalid, nil
+	}
+	if _, err = tm.jwtMsg.VerifyWithSet(tmi.TrustMarkSigner.JWKS()); err != nil {
+		return TrustMarkStatusInvalid, nil
+	}
+	if tmi.IssuedTrustMarks == nil {
+		return "", errors.New("trust mark issuer does not record issued trust marks")
+	}
+	issued, err := tmi.IssuedTrustMarks.IssuedTrustMark(tm.JTI)
+	if err != nil {
+		return "", err
+	}
+	if issued == nil && tm.ExpiresAt != nil && !tm.ExpiresAt.IsZero() && tm.ExpiresAt.Before(time.Now()) {
+		// expired trust marks are pruned from the IssuedTrustMarkStore
+		return TrustMarkStatusExpired, nil
+	}
+	if issued == nil || issued.TrustMarkType != tm.TrustMarkType || issued.Subject != tm.Subject {
+		return TrustMarkStatusInvalid, nil
+	}
+	if issued.Revoked {
+		return TrustMarkStatusRevoked, nil
+	}
+	if err = unixtime.VerifyTime(nil, tm.ExpiresAt); err != nil {
+		return TrustMarkStatusExpired, nil
+	}
+	return TrustMarkStatusActive, nil
+}
+
+// TrustMarkStatusResponseJWT returns the signed trust mark status response
+// for the passed trust mark jwt
+func (tmi TrustMarkIssuer) TrustMarkStatusResponseJWT(trustMarkJWT []byte) ([]byte, error) {
+	status, err := tmi.TrustMarkStatus(trustMarkJWT)
+	if err != nil {
+		return nil, err
+	}
+	return tmi.TrustMarkSigner.Typed(oidfedconst.JWTTypeTrustMarkStatusResponse).JWT(
+		TrustMarkStatusResponse{
+			Issuer:    tmi.EntityID,
+			IssuedAt:  unixtime.Now(),
+			TrustMark: string(trustMarkJWT),
+			Status:    status,
+		},
+	)
+}
+
+// FetchStatus queries the federation_trust_mark_status_endpoint of the
+// TrustMark's issuer and returns the status of the TrustMark; the trust mark
+// issuer is resolved with the passed trust anchor to obtain the endpoint and
+// the keys to verify the status response
+func (tm *TrustMark) FetchStatus(ta *EntityStatementPayload) (string, error) {
+	if tm.jwtMsg == nil {
+		return "", errors.New("trust mark jwt not available")
+	}
+	keys, metadata, err := resolveTrustMarkIssuer(tm.Issuer, ta)
+	if err != nil {
+		return "", err
+	}
+	if metadata == nil || metadata.FederationEntity == nil ||
+		metadata.FederationEntity.FederationTrustMarkStatusEndpoint == "" {
+		return "", errors.New("could not obtain trust mark status endpoint of trust mark issuer")
+	}
+	trustMarkJWT := string(tm.jwtMsg.RawJWT)
+	res, err := http.Do().R().SetFormData(map[string]string{"trust_mark": trustMarkJWT}).
+		Post(metadata.FederationEntity.FederationTrustMarkStatusEndpoint)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if res.IsError() {
+		return "", errors.Errorf("trust mark status endpoint returned status %d", res.StatusCode())
+	}
+	m, err := jwx.Parse(res.Body())
+	if err != nil {
+		return "", err
+	}
+	if !m.VerifyType(oidfedconst.JWTTypeTrustMarkStatusResponse) {
+		return "", errors.Errorf(
+			"trust mark status response does not have '%s' JWT type", oidfedconst.JWTTypeTrustMarkStatusResponse,
+		)
+	}
+	if _, err = m.VerifyWithSet(keys); err != nil {
+		return "", errors.Wrap(err, "verify trust mark status response")
+	}
+	var statusRes TrustMarkStatusResponse
+	if err = json.Unmarshal(m.Payload(), &statusRes); err != nil {
+		return "", errors.WithStack(err)
+	}
+	if statusRes.Issuer != tm.Issuer || statusRes.TrustMark != trustMarkJWT {
+		return "", errors.New("trust mark status response is not about this trust mark")
+	}
+	return statusRes.Status, nil
+}
+
+// TrustMarkStatusCacheLifetime is the time a trust mark status obtained by
+// the TrustMarkStatusRevocationChecker is cached
+var TrustMarkStatusCacheLifetime = time.Minute
+
+// jwtCacheSubKey returns a cache sub key for the passed jwt
+func jwtCacheSubKey(jwt []byte) string {
+	h := sha256.Sum256(jwt)
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
+// cachedJWTStatus returns the status cached for the passed jwt in the
+// passed cache subsystem; if there is none, it is obtained with the passed
+// function and cached for the passed lifetime
+func cachedJWTStatus(
+	subsystem string, jwt []byte, lifetime time.Duration, fetch func() (string, error),
+) (string, error) {
+	key := cache.Key(subsystem, jwtCacheSubKey(jwt))
+	var status string
+	set, err := cache.Get(key, &status)
+	if err != nil {
+		internal.Log(err)
+	} else if set {
+		return status, nil
+	}
+	if status, err = fetch(); err != nil {
+		return "", err
+	}
+	if err = cache.Set(key, status, lifetime); err != nil {
+		internal.Log(err)
+	}
+	return status, nil
+}
+
+// TrustMarkStatusRevocationChecker is a TrustMarkRevocationChecker that
+// queries the trust mark status endpoint of the trust mark issuer; it can be
+// set as the DefaultTrustMarkRevocationChecker. Obtained statuses are cached
+// for the TrustMarkStatusCacheLifetime.
+type TrustMarkStatusRevocationChecker struct {
+	// TrustAnchors are used to resolve the trust mark issuer if the trust
+	// mark is not verified within the federation of a trust anchor; the
+	// first TrustAnchor the trust mark issuer can be resolved with is used
+	TrustAnchors TrustAnchors
+}
+
+// Revoked implements the TrustMarkRevocationChecker interface
+func (c TrustMarkStatusRevocationChecker) Revoked(tm *TrustMark) (bool, error) {
+	return trustMarkStatusRevoked(
+		tm, func() (string, error) {
+			if len(c.TrustAnchors) == 0 {
+				return "", errors.New("no trust anchors configured to resolve the trust mark issuer")
+			}
+			var status string
+			var err error
+			for _, anchor := range c.TrustAnchors {
+				var ta *EntityStatementPayload
+				ta, err = trustAnchorConfiguration(anchor)
+				if err != nil {
+					continue
+				}
+				status, err = tm.FetchStatus(ta)
+				if err == nil {
+					break
+				}
+			}
+			return status, err
+		},
+	)
+}
+
+// RevokedInFederation implements the TrustMarkFederationRevocationChecker
+// interface; the trust mark issuer is resolved with the passed trust anchor
+func (TrustMarkStatusRevocationChecker) RevokedInFederation(tm *TrustMark, ta *EntityStatementPayload) (bool, error) {
+	return trustMarkStatusRevoked(
+		tm, func() (string, error) {
+			return tm.FetchStatus(ta)
+		},
+	)
+}
+
+// trustMarkStatusRevoked obtains the (cached) status of the passed TrustMark
+// with the passed function and checks if it is revoked
+func trustMarkStatusRevoked(tm *TrustMark, fetch func() (string, error)) (bool, error) {
+	if tm.jwtMsg == nil {
+		return false, errors.New("trust mark jwt not available")
+	}
+	status, err := cachedJWTStatus(cache.KeyTrustMarkStatus, tm.jwtMsg.RawJWT, TrustMarkStatusCacheLifetime, fetch)
+	if err != nil {
+		return false, err
+	}
+	switch status {
+	case TrustMarkStatusRevoked:
+		return true, nil
+	case TrustMarkStatusActive, TrustMarkStatusExpired:
+		return false, nil
+	default:
+		return false, errors.Errorf("trust mark status is '%s'", status)
+	}
+}
@@ -0,0 +1,45 @@
+package oidfed
+
+import (
+	"net/http"
+
+	"github.com/go-oidfed/lib/internal"
+	"github.com/go-oidfed/lib/oidfedconst"
+)
+
+// TrustMarkStatusHandler is a http.Handler for a TrustMarkIssuer's
+// federation_trust_mark_status_endpoint.
+// It returns a signed trust mark status response for the trust mark passed
+// in the trust_mark form parameter.
+type TrustMarkStatusHandler struct {
+	Issuer *TrustMarkIssuer
+}
+
+// NewTrustMarkStatusHandler creates a new TrustMarkStatusHandler for the
+// passed TrustMarkIssuer
+func NewTrustMarkStatusHandler(issuer *TrustMarkIssuer) *TrustMarkStatusHandler {
+	return &TrustMarkStatusHandler{Issuer: issuer}
+}
+
+// ServeHTTP implements the http.Handler interface
+func (h TrustMarkStatusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeErrorResponse(w, http.StatusMethodNotAllowed, ErrorInvalidRequest("only POST is supported"))
+		return
+	}
+	trustMark := r.PostFormValue("trust_mark")
+	if trustMark == "" {
+		writeErrorResponse(w, http.StatusBadRequest, ErrorInvalidRequest("trust_mark parameter is required"))
+		return
+	}
+	res, err := h.Issuer.TrustMarkStatusResponseJWT([]byte(trustMark))
+	if err != nil {
+		internal.Log(err.Error())
+		writeErrorResponse(w, http.StatusInternalServerError, ErrorServerError("could not determine trust mark status"))
+		return
+	}
+	w.Header().Set("Content-Type", oidfedconst.ContentTypeTrustMarkStatusResponse)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(res)
+}
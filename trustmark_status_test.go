@@ -0,0 +1,296 @@
+package oidfed
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-oidfed/lib/internal/jwx"
+	"github.com/go-oidfed/lib/oidfedconst"
+	"github.com/go-oidfed/lib/unixtime"
+)
+
+const tmTypeStatus = "https://trustmarks.org/status"
+
+var tmiStatus = newMockTrustMarkIssuer(
+	"https://tmi-status.example.org", []TrustMarkSpec{
+		{
+			TrustMarkType: tmTypeStatus,
+			Lifetime:      unixtime.DurationInSeconds{Duration: time.Hour},
+		},
+	},
+)
+
+var taStatus = newMockAuthority("https://ta-status.example.org", EntityStatementPayload{})
+
+func init() {
+	taStatus.RegisterSubordinate(tmiStatus)
+}
+
+func TestTrustMarkStatusHandler(t *testing.T) {
+	issue := func(tmi *mockTMI, sub string, lifetime ...time.Duration) string {
+		info, err := tmi.IssueTrustMark(tmTypeStatus, sub, lifetime...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.TrustMarkJWT
+	}
+	active := issue(tmiStatus, "https://active.example.org")
+	expired := issue(tmiStatus, "https://expired.example.org", -time.Minute)
+	revoked := issue(tmiStatus, "https://revoked.example.org")
+	if err := tmiStatus.RevokeTrustMark(tmTypeStatus, "https://revoked.example.org", "test"); err != nil {
+		t.Fatal(err)
+	}
+	foreign := issue(
+		newMockTrustMarkIssuer(
+			"https://tmi-status-other.example.org", []TrustMarkSpec{{TrustMarkType: tmTypeStatus}},
+		), "https://foreign.example.org",
+	)
+
+	handler := NewTrustMarkStatusHandler(&tmiStatus.TrustMarkIssuer)
+	tests := []struct {
+		name           string
+		method         string
+		trustMark      string
+		expectedStatus int
+		expected       string
+	}{
+		{
+			name:           "active",
+			method:         http.MethodPost,
+			trustMark:      active,
+			expectedStatus: http.StatusOK,
+			expected:       TrustMarkStatusActive,
+		},
+		{
+			name:           "expired",
+			method:         http.MethodPost,
+			trustMark:      expired,
+			expectedStatus: http.StatusOK,
+			expected:       TrustMarkStatusExpired,
+		},
+		{
+			name:           "revoked",
+			method:         http.MethodPost,
+			trustMark:      revoked,
+			expectedStatus: http.StatusOK,
+			expected:       TrustMarkStatusRevoked,
+		},
+		{
+			name:           "not issued by this issuer",
+			method:         http.MethodPost,
+			trustMark:      foreign,
+			expectedStatus: http.StatusOK,
+			expected:       TrustMarkStatusInvalid,
+		},
+		{
+			name:           "malformed",
+			method:         http.MethodPost,
+			trustMark:      "not-a-jwt",
+			expectedStatus: http.StatusOK,
+			expected:       TrustMarkStatusInvalid,
+		},
+		{
+			name:           "missing trust mark",
+			method:         http.MethodPost,
+			expectedStatus: http.StatusBadRequest,
+			expected:       InvalidRequest,
+		},
+		{
+			name:           "wrong method",
+			method:         http.MethodGet,
+			trustMark:      active,
+			expectedStatus: http.StatusMethodNotAllowed,
+			expected:       InvalidRequest,
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				body := url.Values{}
+				if test.trustMark != "" {
+					body.Set("trust_mark", test.trustMark)
+				}
+				req := httptest.NewRequest(test.method, "/status", strings.NewReader(body.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+				if rec.Code != test.expectedStatus {
+					t.Fatalf("expected status %d, but got %d", test.expectedStatus, rec.Code)
+				}
+				if rec.Code != http.StatusOK {
+					var errRes Error
+					if err := json.Unmarshal(rec.Body.Bytes(), &errRes); err != nil {
+						t.Fatal(err)
+					}
+					if errRes.Error != test.expected {
+						t.Errorf("expected error '%s', but got '%s'", test.expected, errRes.Error)
+					}
+					return
+				}
+				if ct := rec.Header().Get("Content-Type"); ct != oidfedconst.ContentTypeTrustMarkStatusResponse {
+					t.Errorf("unexpected content type '%s'", ct)
+				}
+				m, err := jwx.Parse(rec.Body.Bytes())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err = m.VerifyWithSet(tmiStatus.jwks); err != nil {
+					t.Fatal(err)
+				}
+				var res TrustMarkStatusResponse
+				if err = json.Unmarshal(m.Payload(), &res); err != nil {
+					t.Fatal(err)
+				}
+				if res.Status != test.expected {
+					t.Errorf("expected status '%s', but got '%s'", test.expected, res.Status)
+				}
+				if res.Issuer != tmiStatus.EntityID || res.TrustMark != test.trustMark {
+					t.Errorf("unexpected status response: %+v", res)
+				}
+			},
+		)
+	}
+}
+
+// statusTestTrustMarks issues a valid and a revoked trust mark by tmiStatus
+// for subjects with the passed prefix
+func statusTestTrustMarks(t *testing.T, prefix string) TrustMarkInfos {
+	info := func(sub string) TrustMarkInfo {
+		i, err := tmiStatus.IssueTrustMark(tmTypeStatus, sub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return TrustMarkInfo{
+			TrustMarkType: i.TrustMarkType,
+			TrustMarkJWT:  i.TrustMarkJWT,
+		}
+	}
+	revokedSub := prefix + "-to-revoke.example.org"
+	infos := TrustMarkInfos{info(prefix + "-valid.example.org"), info(revokedSub)}
+	if err := tmiStatus.RevokeTrustMark(tmTypeStatus, revokedSub, "test"); err != nil {
+		t.Fatal(err)
+	}
+	return infos
+}
+
+func TestTrustMarkStatusRevocationChecker(t *testing.T) {
+	if err := tmiStatus.RevokeTrustMark(tmTypeStatus, "https://unknown.example.org", "test"); err == nil {
+		t.Error("expected error when revoking a trust mark that was not issued")
+	}
+
+	defer func() { DefaultTrustMarkRevocationChecker = nil }()
+	tests := []struct {
+		name           string
+		anchors        TrustAnchors
+		expectedCauses []TrustMarkFailureCause
+	}{
+		{
+			name: "resolved with trust anchor",
+			anchors: TrustAnchors{
+				{
+					EntityID: taStatus.EntityID,
+					JWKS:     taStatus.data.JWKS,
+				},
+			},
+			expectedCauses: []TrustMarkFailureCause{"", TrustMarkFailureRevoked},
+		},
+		{
+			name: "first trust anchor cannot resolve issuer",
+			anchors: TrustAnchors{
+				{
+					EntityID: taWithTmo.EntityID,
+					JWKS:     taWithTmo.data.JWKS,
+				},
+				{
+					EntityID: taStatus.EntityID,
+					JWKS:     taStatus.data.JWKS,
+				},
+			},
+			expectedCauses: []TrustMarkFailureCause{"", TrustMarkFailureRevoked},
+		},
+		{
+			name: "issuer not resolvable",
+			anchors: TrustAnchors{
+				{
+					EntityID: taWithTmo.EntityID,
+					JWKS:     taWithTmo.data.JWKS,
+				},
+			},
+			expectedCauses: []TrustMarkFailureCause{TrustMarkFailureStatusUnknown, TrustMarkFailureStatusUnknown},
+		},
+		{
+			name: "wrong trust anchor keys",
+			anchors: TrustAnchors{
+				{
+					EntityID: taStatus.EntityID,
+					JWKS:     taWithTmo.data.JWKS,
+				},
+			},
+			expectedCauses: []TrustMarkFailureCause{TrustMarkFailureStatusUnknown, TrustMarkFailureStatusUnknown},
+		},
+		{
+			name:           "no trust anchors",
+			expectedCauses: []TrustMarkFailureCause{TrustMarkFailureStatusUnknown, TrustMarkFailureStatusUnknown},
+		},
+	}
+	for i, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				// fresh trust marks, so that no cached status is used
+				infos := statusTestTrustMarks(t, fmt.Sprintf("https://checker-%d", i))
+				DefaultTrustMarkRevocationChecker = TrustMarkStatusRevocationChecker{TrustAnchors: test.anchors}
+				report := infos.VerifyExternalReport(tmiStatus.jwks)
+				for i, cause := range test.expectedCauses {
+					if report[i].Cause != cause {
+						t.Errorf(
+							"expected cause '%s' for trust mark %d, but got '%s': %v", cause, i, report[i].Cause,
+							report[i].Err,
+						)
+					}
+				}
+			},
+		)
+	}
+}
+
+func TestTrustMarkStatusRevocationChecker_Federation(t *testing.T) {
+	defer func() { DefaultTrustMarkRevocationChecker = nil }()
+	// no trust anchors are configured, the trust anchor passed to the
+	// verification is used
+	DefaultTrustMarkRevocationChecker = TrustMarkStatusRevocationChecker{}
+	infos := statusTestTrustMarks(t, "https://federation")
+	report := infos.VerifyFederationReport(taStatus.EntityStatementPayload())
+	expectedCauses := []TrustMarkFailureCause{"", TrustMarkFailureRevoked}
+	for i, cause := range expectedCauses {
+		if report[i].Cause != cause {
+			t.Errorf("expected cause '%s' for trust mark %d, but got '%s': %v", cause, i, report[i].Cause, report[i].Err)
+		}
+	}
+}
+
+func TestTrustMarkStatusRevocationChecker_Cached(t *testing.T) {
+	defer func() { DefaultTrustMarkRevocationChecker = nil }()
+	DefaultTrustMarkRevocationChecker = TrustMarkStatusRevocationChecker{}
+	sub := "https://cached.example.org"
+	info, err := tmiStatus.IssueTrustMark(tmTypeStatus, sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos := TrustMarkInfos{{TrustMarkType: info.TrustMarkType, TrustMarkJWT: info.TrustMarkJWT}}
+	ta := taStatus.EntityStatementPayload()
+	if report := infos.VerifyFederationReport(ta); !report[0].Valid() {
+		t.Fatalf("expected trust mark to be valid: %v", report[0].Err)
+	}
+	if err = tmiStatus.RevokeTrustMark(tmTypeStatus, sub, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if report := infos.VerifyFederationReport(ta); !report[0].Valid() {
+		t.Errorf("expected the cached status to be used, but got: %v", report[0].Err)
+	}
+}
@@ -0,0 +1,256 @@
+package oidfed
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/go-oidfed/lib/jwks"
+	"github.com/go-oidfed/lib/unixtime"
+)
+
+// TrustMarkFailureCause describes why the verification of a trust mark failed
+type TrustMarkFailureCause string
+
+// Causes for a failed trust mark verification
+const (
+	// TrustMarkFailureMalformed is used if the trust mark jwt could not be
+	// parsed
+	TrustMarkFailureMalformed TrustMarkFailureCause = "malformed"
+	// TrustMarkFailureTypeMismatch is used if the trust_mark_type of the
+	// TrustMarkInfo does not match the one in the trust mark jwt
+	TrustMarkFailureTypeMismatch TrustMarkFailureCause = "type_mismatch"
+	// TrustMarkFailureExpired is used if the trust mark is expired
+	TrustMarkFailureExpired TrustMarkFailureCause = "expired"
+	// TrustMarkFailureNotYetValid is used if the trust mark was issued in
+	// the future
+	TrustMarkFailureNotYetValid TrustMarkFailureCause = "not_yet_valid"
+	// TrustMarkFailureIssuerNotAllowed is used if the trust mark issuer is
+	// not listed in the trust anchor's trust_mark_issuers
+	TrustMarkFailureIssuerNotAllowed TrustMarkFailureCause = "issuer_not_allowed"
+	// TrustMarkFailureIssuerUnresolvable is used if the keys of the trust
+	// mark issuer could not be obtained
+	TrustMarkFailureIssuerUnresolvable TrustMarkFailureCause = "issuer_unresolvable"
+	// TrustMarkFailureInvalidSignature is used if the trust mark signature
+	// could not be verified with the trust mark issuer's keys
+	TrustMarkFailureInvalidSignature TrustMarkFailureCause = "invalid_signature"
+	// TrustMarkFailureMissingDelegation is used if the trust mark type has
+	// a trust mark owner, but the trust mark does not contain a delegation
+	TrustMarkFailureMissingDelegation TrustMarkFailureCause = "missing_delegation"
+	// TrustMarkFailureInvalidDelegation is used if the delegation contained
+	// in the trust mark is not valid
+	TrustMarkFailureInvalidDelegation TrustMarkFailureCause = "invalid_delegation"
+	// TrustMarkFailureRevoked is used if the trust mark was revoked
+	TrustMarkFailureRevoked TrustMarkFailureCause = "revoked"
+	// TrustMarkFailureDelegationRevoked is used if the trust mark owner
+	// revoked the delegation contained in the trust mark
+	TrustMarkFailureDelegationRevoked TrustMarkFailureCause = "delegation_revoked"
+	// TrustMarkFailureStatusUnknown is used if it could not be checked if
+	// the trust mark or its delegation was revoked
+	TrustMarkFailureStatusUnknown TrustMarkFailureCause = "status_unknown"
+	// TrustMarkFailureTrustAnchorUnavailable is used if the entity
+	// configuration of the trust anchor could not be obtained or verified
+	TrustMarkFailureTrustAnchorUnavailable TrustMarkFailureCause = "trust_anchor_unavailable"
+	// TrustMarkFailureOther is used for errors without a known cause
+	TrustMarkFailureOther TrustMarkFailureCause = "other"
+)
+
+// TrustMarkVerificationError is the error returned if the verification of a
+// trust mark fails; it holds the cause of the failure
+type TrustMarkVerificationError struct {
+	Cause TrustMarkFailureCause
+	Err   error
+}
+
+// Error implements the error interface
+func (e *TrustMarkVerificationError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *TrustMarkVerificationError) Unwrap() error {
+	return e.Err
+}
+
+func trustMarkVerificationError(cause TrustMarkFailureCause, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &TrustMarkVerificationError{
+		Cause: cause,
+		Err:   err,
+	}
+}
+
+// TrustMarkFailureCauseOf returns the TrustMarkFailureCause of an error
+// returned from a trust mark verification; if err is nil an empty
+// TrustMarkFailureCause is returned
+func TrustMarkFailureCauseOf(err error) TrustMarkFailureCause {
+	if err == nil {
+		return ""
+	}
+	var verr *TrustMarkVerificationError
+	if errors.As(err, &verr) {
+		return verr.Cause
+	}
+	return TrustMarkFailureOther
+}
+
+// verifyTrustMarkTime checks iat and exp of a trust mark
+func verifyTrustMarkTime(iat unixtime.Unixtime, exp *unixtime.Unixtime) error {
+	err := unixtime.VerifyTime(&iat, exp)
+	if err == nil {
+		return nil
+	}
+	if exp != nil && !exp.IsZero() && exp.Before(time.Now()) {
+		return trustMarkVerificationError(TrustMarkFailureExpired, err)
+	}
+	return trustMarkVerificationError(TrustMarkFailureNotYetValid, err)
+}
+
+// TrustMarkRevocationChecker checks if a TrustMark was revoked
+type TrustMarkRevocationChecker interface {
+	Revoked(tm *TrustMark) (bool, error)
+}
+
+// TrustMarkRevocationCheckerFunc is a function implementing the
+// TrustMarkRevocationChecker interface
+type TrustMarkRevocationCheckerFunc func(tm *TrustMark) (bool, error)
+
+// Revoked implements the TrustMarkRevocationChecker interface
+func (f TrustMarkRevocationCheckerFunc) Revoked(tm *TrustMark) (bool, error) {
+	return f(tm)
+}
+
+// TrustMarkFederationRevocationChecker is a TrustMarkRevocationChecker that
+// can also check the revocation of a TrustMark within the federation of a
+// trust anchor; TrustMark.VerifyFederation uses RevokedInFederation with its
+// trust anchor if the DefaultTrustMarkRevocationChecker implements this
+// interface
+type TrustMarkFederationRevocationChecker interface {
+	TrustMarkRevocationChecker
+	RevokedInFederation(tm *TrustMark, ta *EntityStatementPayload) (bool, error)
+}
+
+// DefaultTrustMarkRevocationChecker is used during trust mark verification
+// to check if an otherwise valid TrustMark was revoked; if nil, revocation
+// is not checked
+var DefaultTrustMarkRevocationChecker TrustMarkRevocationChecker
+
+// checkTrustMarkRevocation checks the revocation of the passed TrustMark
+// with the DefaultTrustMarkRevocationChecker; ta is the trust anchor the
+// TrustMark is verified with and might be nil
+func checkTrustMarkRevocation(tm *TrustMark, ta *EntityStatementPayload) error {
+	if DefaultTrustMarkRevocationChecker == nil {
+		return nil
+	}
+	var revoked bool
+	var err error
+	if checker, ok := DefaultTrustMarkRevocationChecker.(TrustMarkFederationRevocationChecker); ok && ta != nil {
+		revoked, err = checker.RevokedInFederation(tm, ta)
+	} else {
+		revoked, err = DefaultTrustMarkRevocationChecker.Revoked(tm)
+	}
+	if err != nil {
+		return trustMarkVerificationError(
+			TrustMarkFailureStatusUnknown, errors.Wrap(err, "verify trustmark: checking revocation"),
+		)
+	}
+	if revoked {
+		return trustMarkVerificationError(TrustMarkFailureRevoked, errors.New("verify trustmark: trust mark was revoked"))
+	}
+	return nil
+}
+
+// TrustMarkVerificationResult holds the outcome of the verification of a
+// single TrustMarkInfo
+type TrustMarkVerificationResult struct {
+	TrustMarkInfo TrustMarkInfo
+	// Cause is empty if the trust mark is valid
+	Cause TrustMarkFailureCause
+	// Err is nil if the trust mark is valid
+	Err error
+}
+
+// Valid returns true if the trust mark was successfully verified
+func (r TrustMarkVerificationResult) Valid() bool {
+	return r.Err == nil
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (r TrustMarkVerificationResult) MarshalJSON() ([]byte, error) {
+	res := struct {
+		TrustMarkType string                `json:"trust_mark_type"`
+		TrustMark     string                `json:"trust_mark"`
+		Valid         bool                  `json:"valid"`
+		Cause         TrustMarkFailureCause `json:"cause,omitempty"`
+		Reason        string                `json:"reason,omitempty"`
+	}{
+		TrustMarkType: r.TrustMarkInfo.TrustMarkType,
+		TrustMark:     r.TrustMarkInfo.TrustMarkJWT,
+		Valid:         r.Valid(),
+		Cause:         r.Cause,
+	}
+	if r.Err != nil {
+		res.Reason = r.Err.Error()
+	}
+	return json.Marshal(res)
+}
+
+func newTrustMarkVerificationResult(info TrustMarkInfo, err error) TrustMarkVerificationResult {
+	return TrustMarkVerificationResult{
+		TrustMarkInfo: info,
+		Cause:         TrustMarkFailureCauseOf(err),
+		Err:           err,
+	}
+}
+
+// TrustMarkVerificationReport holds a TrustMarkVerificationResult for each
+// verified TrustMarkInfo
+type TrustMarkVerificationReport []TrustMarkVerificationResult
+
+// Verified returns the TrustMarkInfos that were successfully verified
+func (r TrustMarkVerificationReport) Verified() (verified TrustMarkInfos) {
+	for _, res := range r {
+		if res.Valid() {
+			verified = append(verified, res.TrustMarkInfo)
+		}
+	}
+	return
+}
+
+// Failed returns the TrustMarkVerificationResults of the trust marks that
+// could not be verified
+func (r TrustMarkVerificationReport) Failed() (failed TrustMarkVerificationReport) {
+	for _, res := range r {
+		if !res.Valid() {
+			failed = append(failed, res)
+		}
+	}
+	return
+}
+
+// VerifyFederationReport verifies all TrustMarkInfos by using the passed
+// trust anchor and returns the outcome for each of them
+func (tms TrustMarkInfos) VerifyFederationReport(ta *EntityStatementPayload) TrustMarkVerificationReport {
+	report := make(TrustMarkVerificationReport, len(tms))
+	for i, tm := range tms {
+		report[i] = newTrustMarkVerificationResult(tm, tm.VerifyFederation(ta))
+	}
+	return report
+}
+
+// VerifyExternalReport verifies all TrustMarkInfos by using the passed trust
+// mark issuer jwks and optionally the passed trust mark owner jwks and
+// returns the outcome for each of them
+func (tms TrustMarkInfos) VerifyExternalReport(
+	jwks jwks.JWKS,
+	tmo ...TrustMarkOwnerSpec,
+) TrustMarkVerificationReport {
+	report := make(TrustMarkVerificationReport, len(tms))
+	for i, tm := range tms {
+		report[i] = newTrustMarkVerificationResult(tm, tm.VerifyExternal(jwks, tmo...))
+	}
+	return report
+}
@@ -0,0 +1,176 @@
+package oidfed
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/go-oidfed/lib/jwks"
+)
+
+func TestTrustMarkInfos_VerifyFederationReport(t *testing.T) {
+	issue := func(tmi *mockTMI, trustMarkType, sub string, lifetime ...time.Duration) TrustMarkInfo {
+		info, err := tmi.IssueTrustMark(trustMarkType, sub, lifetime...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *info
+	}
+	mismatch := issue(tmi1, "https://trustmarks.org/tm1", "https://sub.example.org")
+	mismatch.TrustMarkType = "https://trustmarks.org/tm2"
+
+	DefaultTrustMarkRevocationChecker = TrustMarkRevocationCheckerFunc(
+		func(tm *TrustMark) (bool, error) {
+			return tm.Subject == "https://revoked.example.org", nil
+		},
+	)
+	defer func() { DefaultTrustMarkRevocationChecker = nil }()
+
+	tests := []struct {
+		name          string
+		info          TrustMarkInfo
+		expectedCause TrustMarkFailureCause
+	}{
+		{
+			name: "valid",
+			info: issue(tmi1, "https://trustmarks.org/tm1", "https://sub.example.org"),
+		},
+		{
+			name:          "expired",
+			info:          issue(tmi1, "https://trustmarks.org/tm1", "https://sub.example.org", -time.Minute),
+			expectedCause: TrustMarkFailureExpired,
+		},
+		{
+			name:          "issuer not allowed",
+			info:          issue(tmi1, "https://trustmarks.org/tm4", "https://sub.example.org"),
+			expectedCause: TrustMarkFailureIssuerNotAllowed,
+		},
+		{
+			name:          "missing delegation",
+			info:          issue(tmi1, "https://trustmarks.org/tm-delegated", "https://sub.example.org"),
+			expectedCause: TrustMarkFailureMissingDelegation,
+		},
+		{
+			name: "valid delegation",
+			info: issue(tmi1, "https://trustmarks.org/test", "https://sub.example.org"),
+		},
+		{
+			name:          "type mismatch",
+			info:          mismatch,
+			expectedCause: TrustMarkFailureTypeMismatch,
+		},
+		{
+			name: "malformed",
+			info: TrustMarkInfo{
+				TrustMarkType: "https://trustmarks.org/tm1",
+				TrustMarkJWT:  "not-a-jwt",
+			},
+			expectedCause: TrustMarkFailureMalformed,
+		},
+		{
+			name:          "revoked",
+			info:          issue(tmi1, "https://trustmarks.org/tm1", "https://revoked.example.org"),
+			expectedCause: TrustMarkFailureRevoked,
+		},
+	}
+	var infos TrustMarkInfos
+	for _, test := range tests {
+		infos = append(infos, test.info)
+	}
+	report := infos.VerifyFederationReport(taWithTmo.EntityStatementPayload())
+	if len(report) != len(tests) {
+		t.Fatalf("expected %d results, but got %d", len(tests), len(report))
+	}
+	for i, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				res := report[i]
+				if res.Cause != test.expectedCause {
+					t.Errorf("expected cause '%s', but got '%s': %v", test.expectedCause, res.Cause, res.Err)
+				}
+				if res.Valid() != (test.expectedCause == "") {
+					t.Errorf("unexpected validity %v: %v", res.Valid(), res.Err)
+				}
+			},
+		)
+	}
+	if verified := report.Verified(); len(verified) != 2 {
+		t.Errorf("expected 2 verified trust marks, but got %d", len(verified))
+	}
+	if failed := report.Failed(); len(failed) != len(tests)-2 {
+		t.Errorf("expected %d failed trust marks, but got %d", len(tests)-2, len(failed))
+	}
+}
+
+func TestTrustMarkInfos_VerifyExternalReport(t *testing.T) {
+	info, err := tmi1.IssueTrustMark("https://trustmarks.org/test", "https://sub.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmoSpec := taWithTmo.EntityStatementPayload().TrustMarkOwners["https://trustmarks.org/test"]
+	tests := []struct {
+		name          string
+		jwks          jwks.JWKS
+		tmo           []TrustMarkOwnerSpec
+		expectedCause TrustMarkFailureCause
+	}{
+		{
+			name: "valid",
+			jwks: tmi1.jwks,
+			tmo:  []TrustMarkOwnerSpec{tmoSpec},
+		},
+		{
+			name:          "invalid signature",
+			jwks:          tmi2.jwks,
+			expectedCause: TrustMarkFailureInvalidSignature,
+		},
+		{
+			name: "delegation from other owner",
+			jwks: tmi1.jwks,
+			tmo: []TrustMarkOwnerSpec{
+				{
+					ID:   "https://other.owner.org",
+					JWKS: tmoSpec.JWKS,
+				},
+			},
+			expectedCause: TrustMarkFailureInvalidDelegation,
+		},
+		{
+			name: "delegation with wrong owner keys",
+			jwks: tmi1.jwks,
+			tmo: []TrustMarkOwnerSpec{
+				{
+					ID:   tmoSpec.ID,
+					JWKS: tmi2.jwks,
+				},
+			},
+			expectedCause: TrustMarkFailureInvalidDelegation,
+		},
+	}
+	for _, test := range tests {
+		t.Run(
+			test.name, func(t *testing.T) {
+				report := TrustMarkInfos{*info}.VerifyExternalReport(test.jwks, test.tmo...)
+				if len(report) != 1 {
+					t.Fatalf("expected 1 result, but got %d", len(report))
+				}
+				if report[0].Cause != test.expectedCause {
+					t.Errorf(
+						"expected cause '%s', but got '%s': %v", test.expectedCause, report[0].Cause, report[0].Err,
+					)
+				}
+				data, err := json.Marshal(report[0])
+				if err != nil {
+					t.Fatal(err)
+				}
+				var res map[string]any
+				if err = json.Unmarshal(data, &res); err != nil {
+					t.Fatal(err)
+				}
+				if res["valid"] != (test.expectedCause == "") {
+					t.Errorf("unexpected json: %s", data)
+				}
+			},
+		)
+	}
+}
@@ -37,6 +37,16 @@ var ResolverCacheGracePeriod = time.Hour
 // lifetimes.
 var ResolverCacheLifetimeElapsedGraceFactor = 0.5
 
+// ResolverCacheReverifySignatures enables the re-verification of cached
+// trust trees and TrustChains when they are loaded from the cache.
+// If enabled, the payloads of cached entity statements are re-parsed from
+// the signed JWTs, the signatures are verified again against the
+// TrustAnchors, and cached resolved metadata is not used.
+// Entries that cannot be verified are treated as cache misses.
+// This protects against a shared cache that can be written by others; see
+// also cache.NewIntegrityProtectedCache.
+var ResolverCacheReverifySignatures = false
+
 // ResolveResponse is a type describing the response of a resolve request
 type ResolveResponse struct {
 	Issuer                 string            `json:"iss"`
@@ -263,6 +273,15 @@ func (r TrustResolver) cacheGetTrustChains() (
 	set, err = cache.Get(
 		cache.Key(cache.KeyTrustTreeChains, string(hash)), &chains,
 	)
+	if err != nil || !set || !ResolverCacheReverifySignatures {
+		return
+	}
+	for _, chain := range chains {
+		if !chain.verifySignatures(r.TrustAnchors) {
+			internal.Log("Signature verification of cached trust chain failed")
+			return nil, false, nil
+		}
+	}
 	return
 }
 
@@ -287,8 +306,17 @@ func (r *TrustResolver) cacheGetTrustTree() (
 	set, err = cache.Get(
 		cache.Key(cache.KeyTrustTree, string(hash)), &r.trustTree,
 	)
+	if err != nil || !set || !ResolverCacheReverifySignatures {
+		return
+	}
+	if !r.trustTree.verifySignatures(r.TrustAnchors) {
+		internal.Log("Signature verification of cached trust tree failed")
+		r.trustTree = trustTree{}
+		return false, nil
+	}
 	return
 }
+
 func (r TrustResolver) cacheSetTrustTree() error {
 	hash, err := r.hash()
 	if err != nil {
@@ -501,9 +529,12 @@ func (t trustTree) chains() (chains []TrustChain) {
 	return
 }
 
-func entityStmtCacheSet(subID, issID string, stmt *EntityStatement) {
+func entityStmtCacheSet(subID, issID string, stmt *EntityStatement, lifetime time.Duration) {
+	if lifetime <= 0 {
+		return
+	}
 	if err := cache.Set(
-		cache.EntityStmtCacheKey(subID, issID), stmt, time.Until(stmt.ExpiresAt.Time),
+		cache.EntityStmtCacheKey(subID, issID), stmt, lifetime,
 	); err != nil {
 		internal.Log(err)
 	}
@@ -521,18 +552,22 @@ func entityStmtCacheGet(subID, issID string) *EntityStatement {
 	return &stmt
 }
 
+// entityStatementObtainer obtains an EntityStatement together with the
+// caching information of the http response it was obtained from
+type entityStatementObtainer func() (*EntityStatement, http.CacheControl, error)
+
 // GetEntityConfiguration obtains the entity configuration for the passed entity id and returns it as an
 // EntityStatement
 func GetEntityConfiguration(entityID string) (*EntityStatement, error) {
 	return getEntityStatementOrConfiguration(
-		entityID, entityID, func() (*EntityStatement, error) {
+		entityID, entityID, func() (*EntityStatement, http.CacheControl, error) {
 			return httpGetEntityConfiguration(entityID)
 		},
 	)
 }
 
 func getEntityStatementOrConfiguration(
-	subID, issID string, obtainerFnc func() (*EntityStatement, error),
+	subID, issID string, obtainerFnc entityStatementObtainer,
 ) (*EntityStatement, error) {
 
 	if stmt := entityStmtCacheGet(subID, issID); stmt != nil {
@@ -557,52 +592,47 @@ func getEntityStatementOrConfiguration(
 }
 
 func obtainAndSetEntityStatementOrConfiguration(
-	subID, issID string, obtainerFnc func() (*EntityStatement, error),
+	subID, issID string, obtainerFnc entityStatementObtainer,
 ) (*EntityStatement, error) {
-	stmt, err := obtainerFnc()
+	stmt, cc, err := obtainerFnc()
 	if err != nil {
 		internal.Log(err)
 		return nil, err
 	}
 	internal.Log("Obtained entity statement from http")
-	entityStmtCacheSet(subID, issID, stmt)
+	entityStmtCacheSet(subID, issID, stmt, cacheLifetime(cc, unixtime.Until(stmt.ExpiresAt)))
 	return stmt, nil
 }
 
 func httpGetEntityConfiguration(
 	entityID string,
-) (*EntityStatement, error) {
+) (*EntityStatement, http.CacheControl, error) {
 	uri := strings.TrimSuffix(entityID, "/") + oidfedconst.FederationSuffix
 	internal.Logf("Obtaining entity configuration from %+q", uri)
-	res, errRes, err := http.Get(uri, nil, nil)
+	body, cc, err := httpGetCached(uri, nil, 0)
 	if err != nil {
-		return nil, err
-	}
-	if errRes != nil {
-		return nil, errRes.Err()
+		return nil, cc, err
 	}
-	return ParseEntityStatement(res.Body())
+	stmt, err := ParseEntityStatement(body)
+	return stmt, cc, err
 }
 
 // FetchEntityStatement fetches an EntityStatement from a fetch endpoint
 func FetchEntityStatement(fetchEndpoint, subID, issID string) (*EntityStatement, error) {
 	return getEntityStatementOrConfiguration(
-		subID, issID, func() (*EntityStatement, error) {
+		subID, issID, func() (*EntityStatement, http.CacheControl, error) {
 			return httpFetchEntityStatement(fetchEndpoint, subID)
 		},
 	)
 }
 
-func httpFetchEntityStatement(fetchEndpoint, subID string) (*EntityStatement, error) {
-	uri := fetchEndpoint
+func httpFetchEntityStatement(fetchEndpoint, subID string) (*EntityStatement, http.CacheControl, error) {
 	params := url.Values{}
 	params.Add("sub", subID)
-	res, errRes, err := http.Get(uri, params, nil)
+	body, cc, err := httpGetCached(fetchEndpoint, params, 0)
 	if err != nil {
-		return nil, err
-	}
-	if errRes != nil {
-		return nil, errRes.Err()
+		return nil, cc, err
 	}
-	return ParseEntityStatement(res.Body())
+	stmt, err := ParseEntityStatement(body)
+	return stmt, cc, err
 }
@@ -400,3 +400,23 @@ func TestTrustResolver_ResolveWithType(t *testing.T) {
 		)
 	}
 }
+
+func TestTrustResolver_ResolveWithReverifiedCache(t *testing.T) {
+	ResolverCacheReverifySignatures = true
+	defer func() { ResolverCacheReverifySignatures = false }()
+	for i := 0; i < 2; i++ {
+		resolver := TrustResolver{
+			TrustAnchors: TrustAnchors{
+				TrustAnchor{
+					EntityID: ta1.EntityID,
+					JWKS:     ta1.data.JWKS,
+				},
+			},
+			StartingEntity: rp1.EntityID,
+		}
+		chains := resolver.ResolveToValidChains()
+		if !compareTrustChains(chains, ta1Chains) {
+			t.Errorf("run %d: resolved chains do not match expected chains", i)
+		}
+	}
+}